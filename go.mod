@@ -6,6 +6,5 @@ require (
 	github.com/google/gopacket v1.1.19
 	github.com/moriyoshi/routewrapper v0.0.0-20180228100351-e52d8d14cf39
 	golang.org/x/net v0.27.0
+	golang.org/x/sys v0.22.0
 )
-
-require golang.org/x/sys v0.22.0 // indirect
@@ -0,0 +1,64 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"log"
+	"time"
+)
+
+// dropGrowthSamples is the number of consecutive samples the kernel drops must grow in before the buffer is doubled
+const dropGrowthSamples = 2
+
+// dropGrowth decides, from the samples of a kernel drop counter, when to grow the kernel buffer
+type dropGrowth struct {
+	last    int
+	growing int // consecutive samples the drops grew in
+}
+
+// sample takes the drop counter sampled while the buffer holds size bytes, and returns the size to grow it to, doubled
+// and clamped to ceiling, once the drops have grown in dropGrowthSamples consecutive samples, or 0 to keep it
+func (g *dropGrowth) sample(drops, size, ceiling int) int {
+	if drops > g.last {
+		g.growing++
+	} else {
+		g.growing = 0
+	}
+	g.last = drops
+
+	if g.growing < dropGrowthSamples || size >= ceiling {
+		return 0
+	}
+	g.growing = 0
+	return min(size*2, ceiling)
+}
+
+// watchDrops samples the kernel drop counters of the session every dropSampleInterval and doubles the kernel buffer,
+// up to maxBufferSize, as dropGrowth decides. The buffer never shrinks again
+func (ps *pcapSession) watchDrops() {
+	defer ps.wg.Done()
+
+	ticker := time.NewTicker(ps.config.dropSampleInterval)
+	defer ticker.Stop()
+
+	growth := dropGrowth{last: ps.stats().PcapDropped}
+	for {
+		select {
+		case <-ps.stopChan:
+			return
+		case <-ticker.C:
+		}
+
+		size := growth.sample(ps.stats().PcapDropped, int(ps.bufferSize.Load()), ps.config.maxBufferSize)
+		if size == 0 {
+			continue
+		}
+		if err := ps.reopenHandles(size, "kernel drops"); err != nil {
+			log.Printf("Warning: no more buffer growth on %s: %v", ps.params.key, err)
+			return
+		}
+		// the frames dropped while reopening do not count as growth
+		growth.last = ps.stats().PcapDropped
+	}
+}
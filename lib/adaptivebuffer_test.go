@@ -0,0 +1,60 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import "testing"
+
+func TestDropGrowth(t *testing.T) {
+	const ceiling = 5 << 20
+	type step struct {
+		drops, size, want int
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"no drops", []step{
+			{0, 2 << 20, 0},
+			{0, 2 << 20, 0},
+			{0, 2 << 20, 0},
+		}},
+		{"doubles after two growing samples", []step{
+			{10, 2 << 20, 0},
+			{20, 2 << 20, 4 << 20},
+		}},
+		{"steady drops reset the streak", []step{
+			{10, 2 << 20, 0},
+			{10, 2 << 20, 0},
+			{20, 2 << 20, 0},
+			{30, 2 << 20, 4 << 20},
+		}},
+		{"a new streak after growing", []step{
+			{10, 1 << 20, 0},
+			{20, 1 << 20, 2 << 20},
+			{30, 2 << 20, 0},
+			{40, 2 << 20, 4 << 20},
+		}},
+		{"clamped at the ceiling", []step{
+			{10, 4 << 20, 0},
+			{20, 4 << 20, ceiling},
+			{30, ceiling, 0},
+			{40, ceiling, 0},
+			{50, ceiling, 0},
+		}},
+		{"above the ceiling", []step{
+			{10, 8 << 20, 0},
+			{20, 8 << 20, 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var g dropGrowth
+			for i, s := range tt.steps {
+				if got := g.sample(s.drops, s.size, ceiling); got != s.want {
+					t.Fatalf("sample %d (%d drops, %d bytes): grow to %d, want %d", i, s.drops, s.size, got, s.want)
+				}
+			}
+		})
+	}
+}
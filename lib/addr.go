@@ -0,0 +1,53 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+	"net"
+)
+
+// normalizeIP returns the 4-byte form of IPv4 addresses, including IPv4-mapped IPv6 ones, so that the 16-byte result
+// of net.ParseIP and the 4-byte result of To4 behave the same. IPv6 addresses, and nil, are returned as is.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// checkDestination normalizes a destination address and rejects the ones no packet can be sent to
+func checkDestination(ip net.IP) (net.IP, error) {
+	ip = normalizeIP(ip)
+	if ip == nil || ip.IsUnspecified() {
+		return nil, fmt.Errorf("destination %v: %w", ip, ErrUnspecifiedAddress)
+	}
+	return ip, nil
+}
+
+// checkLocal normalizes a local address to dial from or listen on and rejects the ones a host cannot own.
+// nil and unspecified addresses are only accepted if allowUnspecified is set, and are then returned as nil
+func checkLocal(ip net.IP, allowUnspecified bool) (net.IP, error) {
+	ip = normalizeIP(ip)
+	switch {
+	case ip == nil || ip.IsUnspecified():
+		if allowUnspecified {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("local address %v: %w", ip, ErrUnspecifiedAddress)
+	case ip.IsMulticast() || ip.Equal(net.IPv4bcast):
+		return nil, fmt.Errorf("local address %v: %w", ip, ErrMulticastAddress)
+	}
+	return ip, nil
+}
+
+// hostIface returns the non-loopback interface owning ip, nil if ip is not an address of the host or is on loopback,
+// where packets written with pcap do reach the host's stack and captures
+func hostIface(ip net.IP) *net.Interface {
+	iface, err := findInterfaceByIP(ip)
+	if err != nil || iface.Flags&net.FlagLoopback != 0 {
+		return nil
+	}
+	return iface
+}
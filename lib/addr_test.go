@@ -0,0 +1,151 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// addrForms are the representations callers give IPv4 addresses in
+var addrForms = []struct {
+	name string
+	form func(ip net.IP) net.IP
+}{
+	{"4-byte", func(ip net.IP) net.IP { return ip.To4() }},
+	{"16-byte", func(ip net.IP) net.IP { return ip.To16() }},
+	{"mapped", func(ip net.IP) net.IP { return net.ParseIP("::ffff:" + ip.String()) }},
+}
+
+// loopbackIPv4 returns the loopback interface of the host and its IPv4 address, skipping the test if there is none
+func loopbackIPv4(tb testing.TB) (*net.Interface, net.IP) {
+	tb.Helper()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		tb.Skipf("no interfaces: %v", err)
+	}
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		addrs, _ := ifaces[i].Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				return &ifaces[i], ipNet.IP.To4()
+			}
+		}
+	}
+	tb.Skip("no loopback interface with an IPv4 address")
+	return nil, nil
+}
+
+// TestAddressFormMatrix dials, listens and replies with every representation of the same IPv4 address, through
+// DialIP and ListenIP on the loopback interface, and checks that the demux matches them all and that addresses come
+// back out in their 4-byte form
+func TestAddressFormMatrix(t *testing.T) {
+	lo, ip := loopbackIPv4(t)
+	transport := NewMemoryTransport()
+	client := NewRawSocketCore(60, 1, WithHandleFactory(transport.A()), WithKeepIdleSessions())
+	defer client.Close()
+	server := NewRawSocketCore(60, 1, WithHandleFactory(transport.B()), WithKeepIdleSessions())
+	defer server.Close()
+
+	for _, listenForm := range addrForms {
+		listener, err := server.ListenIP(listenForm.form(ip), layers.IPProtocolUDP)
+		if err != nil {
+			t.Fatalf("listen on the %s form: %v", listenForm.name, err)
+		}
+		if got := listener.LocalIP(); len(got) != net.IPv4len || !got.Equal(ip) {
+			t.Errorf("listener on the %s form has local IP %v of %d bytes", listenForm.name, got, len(got))
+		}
+
+		for _, dialForm := range addrForms {
+			name := fmt.Sprintf("listen %s, dial %s", listenForm.name, dialForm.name)
+			conn, err := client.DialIP(layers.IPProtocolUDP, dialForm.form(ip), dialForm.form(ip))
+			if err != nil {
+				t.Fatalf("%s: dial: %v", name, err)
+			}
+			if l, r := conn.LocalIP(), conn.RemoteIP(); len(l) != net.IPv4len || len(r) != net.IPv4len {
+				t.Errorf("%s: conn addresses %v->%v are not in their 4-byte form", name, l, r)
+			}
+
+			if _, err := conn.Write([]byte(name)); err != nil {
+				t.Fatalf("%s: write: %v", name, err)
+			}
+			buf := make([]byte, 256)
+			listener.SetReadDeadline(time.Now().Add(time.Second))
+			n, from, err := listener.ReadFrom(buf)
+			if err != nil || string(buf[:n]) != name {
+				t.Fatalf("%s: listener read %q, %v", name, buf[:n], err)
+			}
+			if src := from.(*net.IPAddr).IP; len(src) != net.IPv4len || !src.Equal(ip) {
+				t.Errorf("%s: packet from %v of %d bytes, want %v in its 4-byte form", name, src, len(src), ip)
+			}
+
+			// replies to any form of the address reach the dialed conn
+			for _, replyForm := range addrForms {
+				reply := name + ", reply " + replyForm.name
+				if _, err := listener.WriteTo([]byte(reply), &net.IPAddr{IP: replyForm.form(ip)}); err != nil {
+					t.Fatalf("%s: reply: %v", reply, err)
+				}
+				if got := readTimeout(t, conn, time.Second); string(got) != reply {
+					t.Fatalf("%s: conn read %q", reply, got)
+				}
+			}
+
+			conn.Close()
+			ps, _ := client.sessions.get(lo.Name)
+			deadline := time.Now().Add(time.Second)
+			for ps.conns.len() != 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		// listening again on any other form of the address is a duplicate
+		for _, other := range addrForms {
+			if _, err := server.ListenIP(other.form(ip), layers.IPProtocolUDP); !errors.Is(err, ErrAlreadyListening) {
+				t.Errorf("listen on the %s form while listening on the %s one: %v, want ErrAlreadyListening", other.name, listenForm.name, err)
+			}
+		}
+		listener.Close()
+		ps, _ := server.sessions.get(lo.Name)
+		deadline := time.Now().Add(time.Second)
+		for ps.conns.len() != 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestAddressFormsRejected(t *testing.T) {
+	core := NewRawSocketCore(60, 1, WithHandleFactory(NewMemoryTransport().A()))
+	defer core.Close()
+
+	unspecified := []net.IP{nil, net.IPv4zero.To4(), net.IPv4zero, net.ParseIP("::ffff:0.0.0.0"), net.IPv6unspecified}
+	for _, ip := range unspecified {
+		if _, err := core.DialIP(layers.IPProtocolUDP, nil, ip); !errors.Is(err, ErrUnspecifiedAddress) {
+			t.Errorf("dial to %#v: %v, want ErrUnspecifiedAddress", ip, err)
+		}
+		if _, err := core.ListenIP(ip, layers.IPProtocolUDP); !errors.Is(err, ErrUnspecifiedAddress) {
+			t.Errorf("listen on %#v: %v, want ErrUnspecifiedAddress", ip, err)
+		}
+	}
+	for _, ip := range []net.IP{net.IPv4(224, 0, 0, 251), net.IPv4(224, 0, 0, 251).To4(), net.ParseIP("::ffff:239.1.2.3"), net.IPv4bcast} {
+		if _, err := core.ListenIP(ip, layers.IPProtocolUDP); !errors.Is(err, ErrMulticastAddress) {
+			t.Errorf("listen on %v: %v, want ErrMulticastAddress", ip, err)
+		}
+		if _, err := core.DialIP(layers.IPProtocolUDP, ip, net.IPv4(192, 0, 2, 1)); !errors.Is(err, ErrMulticastAddress) {
+			t.Errorf("dial from %v: %v, want ErrMulticastAddress", ip, err)
+		}
+	}
+	// a mapped IPv4 source and an IPv6 destination are different families, whatever the length of the source
+	if _, err := core.DialIP(layers.IPProtocolUDP, net.ParseIP("::ffff:192.0.2.1"), net.ParseIP("2001:db8::1")); !errors.Is(err, ErrAddressFamilyMismatch) {
+		t.Errorf("dial from a mapped IPv4 address to IPv6: %v, want ErrAddressFamilyMismatch", err)
+	}
+}
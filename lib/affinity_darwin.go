@@ -0,0 +1,10 @@
+//go:build darwin
+// +build darwin
+
+package lib
+
+// setThreadAffinity does nothing: macOS has no API to pin a thread to a CPU, its affinity tags are mere hints
+// and ignored on Apple silicon
+func setThreadAffinity(cpu int) error {
+	return nil
+}
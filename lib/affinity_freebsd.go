@@ -0,0 +1,31 @@
+//go:build freebsd
+// +build freebsd
+
+package lib
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	cpuLevelWhich = 3  // CPU_LEVEL_WHICH: the mask of the object itself
+	cpuWhichTID   = 1  // CPU_WHICH_TID: the object is a thread, -1 being the current one
+	cpuSetSize    = 32 // sizeof(cpuset_t) for CPU_SETSIZE 256
+)
+
+// setThreadAffinity restricts the current OS thread to the given CPU
+func setThreadAffinity(cpu int) error {
+	if cpu >= cpuSetSize*8 {
+		return syscall.EINVAL
+	}
+	var mask [cpuSetSize]byte
+	mask[cpu/8] = 1 << (cpu % 8)
+	id := int64(-1)
+	_, _, errno := syscall.Syscall6(syscall.SYS_CPUSET_SETAFFINITY, cpuLevelWhich, cpuWhichTID, uintptr(id),
+		uintptr(len(mask)), uintptr(unsafe.Pointer(&mask[0])), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+package lib
+
+import (
+	"syscall"
+)
+
+var (
+	kernel32                  = syscall.NewLazyDLL("kernel32.dll")
+	procGetCurrentThread      = kernel32.NewProc("GetCurrentThread")
+	procSetThreadAffinityMask = kernel32.NewProc("SetThreadAffinityMask")
+)
+
+// setThreadAffinity restricts the current OS thread to the given CPU of its processor group
+func setThreadAffinity(cpu int) error {
+	if cpu >= 64 {
+		return syscall.EINVAL // beyond the 64 CPUs of a processor group
+	}
+	thread, _, _ := procGetCurrentThread.Call() // a pseudo handle, which needs no closing
+	if ret, _, err := procSetThreadAffinityMask.Call(thread, uintptr(1)<<uint(cpu)); ret == 0 {
+		return err
+	}
+	return nil
+}
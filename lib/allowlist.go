@@ -0,0 +1,72 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// sourceAllowlist is the set of sources a conn accepts packets from. It is never modified once built, so that the
+// dispatch path reads it without locking while SetSourceAllowlist swaps in a new one
+type sourceAllowlist struct {
+	addrs    map[netip.Addr]struct{}
+	prefixes []netip.Prefix
+}
+
+func (l *sourceAllowlist) allows(src netip.Addr) bool {
+	if _, ok := l.addrs[src]; ok {
+		return true
+	}
+	for _, prefix := range l.prefixes {
+		if prefix.Contains(src) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSourceAllowlist makes the conn drop the inbound packets whose source is not one of ips, before they take room in
+// its queue, counting them in the SourceFiltered stat. It replaces the allowlist set before, and is safe to call while
+// packets are being received. An empty list accepts every source again.
+func (conn *RawIPConn) SetSourceAllowlist(ips []net.IP) error {
+	if len(ips) == 0 {
+		conn.allowlist.Store(nil)
+		return nil
+	}
+	list := &sourceAllowlist{addrs: make(map[netip.Addr]struct{}, len(ips))}
+	for _, ip := range ips {
+		addr := toAddr(ip)
+		if !addr.IsValid() {
+			return fmt.Errorf("source allowlist: invalid address %v", ip)
+		}
+		list.addrs[addr] = struct{}{}
+	}
+	conn.allowlist.Store(list)
+	return nil
+}
+
+// SetSourceAllowlistNets is SetSourceAllowlist for prefixes: the conn only accepts packets from sources within nets
+func (conn *RawIPConn) SetSourceAllowlistNets(nets []*net.IPNet) error {
+	if len(nets) == 0 {
+		conn.allowlist.Store(nil)
+		return nil
+	}
+	list := &sourceAllowlist{}
+	for _, ipNet := range nets {
+		addr := toAddr(ipNet.IP)
+		ones, _ := ipNet.Mask.Size()
+		if !addr.IsValid() {
+			return fmt.Errorf("source allowlist: invalid prefix %v", ipNet)
+		}
+		prefix, err := addr.Prefix(ones)
+		if err != nil {
+			return fmt.Errorf("source allowlist: invalid prefix %v: %w", ipNet, err)
+		}
+		list.prefixes = append(list.prefixes, prefix)
+	}
+	conn.allowlist.Store(list)
+	return nil
+}
@@ -9,67 +9,131 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
-// getRemoteMAC sends an ARP request to get the MAC address for a given IP and interface
-func getRemoteMAC(iface *net.Interface, ip net.IP, arpRequestTimeout time.Duration) (net.HardwareAddr, error) {
-	// Open up a pcap handle for packet reads/writes.
-	handle, err := pcap.OpenLive(getPcapDeviceName(iface), 65536, true, pcap.BlockForever)
+// arpWaiters holds the channels of the dials waiting for the ARP reply of an IP. The dispatch workers of the session
+// hand them the replies they capture
+type arpWaiters struct {
+	mu      sync.Mutex
+	waiters map[netip.Addr][]chan net.HardwareAddr
+}
+
+func newARPWaiters() *arpWaiters {
+	return &arpWaiters{waiters: make(map[netip.Addr][]chan net.HardwareAddr)}
+}
+
+// wait returns a channel receiving the next MAC address ARP replies give for ip
+func (w *arpWaiters) wait(ip netip.Addr) chan net.HardwareAddr {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	reply := make(chan net.HardwareAddr, 1)
+	w.waiters[ip] = append(w.waiters[ip], reply)
+	return reply
+}
+
+// cancel stops the delivery to a channel returned by wait
+func (w *arpWaiters) cancel(ip netip.Addr, reply chan net.HardwareAddr) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	waiters := w.waiters[ip]
+	for i, ch := range waiters {
+		if ch == reply {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(w.waiters, ip)
+	} else {
+		w.waiters[ip] = waiters
+	}
+}
+
+// deliver hands mac to every dial waiting for the ARP reply of ip
+func (w *arpWaiters) deliver(ip netip.Addr, mac net.HardwareAddr) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, reply := range w.waiters[ip] {
+		select {
+		case reply <- mac:
+		default: // already has a reply
+		}
+	}
+	delete(w.waiters, ip)
+}
+
+// requestARP sends an ARP request for ip on the session and waits for the reply, captured by the session itself
+func (ps *pcapSession) requestARP(ip net.IP) (net.HardwareAddr, error) {
+	frame, err := arpRequestFrame(ps.params.iface, ip)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open pcap handle: %w", err)
+		return nil, fmt.Errorf("failed to send ARP request: %w", err)
 	}
-	defer handle.Close()
 
-	// Set up a channel to receive ARP replies
-	arpReplies := make(chan net.HardwareAddr, 1)
+	wait, ok := ps.arpLimit.reserve(time.Now())
+	if !ok {
+		return nil, fmt.Errorf("ARP request for %v: %w", ip, ErrARPRateLimited)
+	}
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ps.stopChan:
+			return nil, ErrClosed
+		}
+	}
 
-	// Start a goroutine to read ARP replies
-	go func() {
-		readARP(handle, iface, ip, arpReplies)
-	}()
+	// wait before sending, so that a fast reply is not missed
+	addr := toAddr(ip)
+	reply := ps.arp.wait(addr)
+	defer ps.arp.cancel(addr, reply)
 
-	// Send ARP request
-	if err := writeARP(handle, iface, ip); err != nil {
+	// written rather than queued: handleOutgoingPackets resolves the next hop of packets sent without one itself
+	if err := ps.writeFrame(frame); err != nil {
+		ps.writeErrors.Add(1)
 		return nil, fmt.Errorf("failed to send ARP request: %w", err)
 	}
 
 	// Wait for ARP reply or timeout
 	select {
-	case mac := <-arpReplies:
+	case mac := <-reply:
 		return mac, nil
-	case <-time.After(arpRequestTimeout):
-		return nil, fmt.Errorf("timeout waiting for ARP reply")
+	case <-time.After(ps.config.arpRequestTimeout):
+		return nil, fmt.Errorf("no ARP reply from %v after %v: %w", ip, ps.config.arpRequestTimeout, ErrARPTimeout)
+	case <-ps.stopChan:
+		return nil, ErrClosed
 	}
 }
 
-// readARP watches a handle for incoming ARP responses and sends the MAC address to the provided channel.
-func readARP(handle *pcap.Handle, iface *net.Interface, targetIP net.IP, arpReplies chan<- net.HardwareAddr) {
-	src := gopacket.NewPacketSource(handle, layers.LayerTypeEthernet)
-	in := src.Packets()
-
-	for packet := range in {
-		arpLayer := packet.Layer(layers.LayerTypeARP)
-		if arpLayer == nil {
-			continue
-		}
-		arp := arpLayer.(*layers.ARP)
-		if arp.Operation != layers.ARPReply || bytes.Equal([]byte(iface.HardwareAddr), arp.SourceHwAddress) {
-			continue
-		}
-		if net.IP(arp.SourceProtAddress).Equal(targetIP) {
-			arpReplies <- net.HardwareAddr(arp.SourceHwAddress)
-			return
+// handleARP hands the ARP replies captured on the session to the dials waiting for them, and reports replies
+// contradicting the ARP cache as ARPConflict events
+func (ps *pcapSession) handleARP(arp *layers.ARP) {
+	if arp.Operation != layers.ARPReply || bytes.Equal([]byte(ps.params.iface.HardwareAddr), arp.SourceHwAddress) {
+		return
+	}
+	addr, ok := netip.AddrFromSlice(arp.SourceProtAddress)
+	if !ok {
+		return
+	}
+	if ps.params.events != nil && ps.params.arpCache != nil {
+		ip := net.IP(addr.Unmap().AsSlice())
+		if known, found := ps.params.arpCache.Lookup(ip.String()); found && !bytes.Equal(known, arp.SourceHwAddress) {
+			ps.params.events.emit(&ARPConflict{eventTime{time.Now()}, ps.params.key, ip, known,
+				append(net.HardwareAddr(nil), arp.SourceHwAddress...)})
 		}
 	}
+	ps.arp.deliver(addr.Unmap(), append(net.HardwareAddr(nil), arp.SourceHwAddress...))
 }
 
-// writeARP writes an ARP request for the target IP to the pcap handle.
-func writeARP(handle *pcap.Handle, iface *net.Interface, targetIP net.IP) error {
+// arpRequestFrame returns the Ethernet frame of an ARP request for the target IP sent from iface.
+func arpRequestFrame(iface *net.Interface, targetIP net.IP) ([]byte, error) {
 	// Get the interface IP address
 	log.Printf("iface name is: %s     target IP: %s", iface.Name, targetIP)
 	var ifaceIP net.IP
@@ -88,7 +152,7 @@ func writeARP(handle *pcap.Handle, iface *net.Interface, targetIP net.IP) error
 	}
 
 	if ifaceIP == nil {
-		return errors.New("interface has no IPv4 address which is in the same subnet as that of target IP")
+		return nil, errors.New("interface has no IPv4 address which is in the same subnet as that of target IP")
 	}
 
 	// Construct the ARP packet
@@ -116,50 +180,12 @@ func writeARP(handle *pcap.Handle, iface *net.Interface, targetIP net.IP) error
 		ComputeChecksums: true,
 	}
 
-	// Serialize and send the ARP packet
+	// Serialize the ARP packet
 	if err := gopacket.SerializeLayers(buf, opts, &eth, &arp); err != nil {
-		return err
-	}
-
-	log.Println("ARP request sent successfully")
-	return handle.WritePacketData(buf.Bytes())
-}
-
-// getPcapDeviceName gets the appropriate pcap device name for the interface
-func getPcapDeviceName(iface *net.Interface) string {
-	devices, err := pcap.FindAllDevs()
-	if err != nil {
-		log.Fatalf("failed to list devices: %v", err)
+		return nil, err
 	}
 
-	// Get the IP addresses of the interface
-	var ifaceIPs []net.IP
-	if addrs, err := iface.Addrs(); err == nil {
-		for _, addr := range addrs {
-			if ipnet, ok := addr.(*net.IPNet); ok {
-				if ip4 := ipnet.IP.To4(); ip4 != nil {
-					ifaceIPs = append(ifaceIPs, ip4)
-				}
-			}
-		}
-	}
-	log.Printf("interface %s's ip list: %+v", iface.Name, ifaceIPs)
-
-	for _, device := range devices {
-		for _, address := range device.Addresses {
-			ip := address.IP.To4()
-			if ip != nil {
-				log.Printf("Pcap device %s ip: %s\n", device.Name, ip)
-				for _, ifaceIP := range ifaceIPs {
-					if ifaceIP.String() == ip.String() {
-						return device.Name
-					}
-				}
-			}
-		}
-	}
-	log.Fatalf("No matching device found for interface: %v", iface.Name)
-	return ""
+	return buf.Bytes(), nil
 }
 
 // listInterfaces prints the available network interfaces
@@ -4,9 +4,11 @@
 package lib
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,24 +17,120 @@ type ARPEntry struct {
 	Expiry     time.Time
 }
 
+// String returns the entry on one line, e.g. "aa:bb:cc:dd:ee:ff until 15:04:05"
+func (e ARPEntry) String() string {
+	return fmt.Sprintf("%v until %s", e.MacAddress, e.Expiry.Format("15:04:05"))
+}
+
+// defaultARPCacheSize is the number of entries the ARP cache holds unless configured otherwise with WithARPCacheSize
+const defaultARPCacheSize = 65536
+
 type ARPCache struct {
 	mu           sync.RWMutex
-	entries      map[string]ARPEntry
+	entries      map[string]*arpNode
+	lru          arpNode // sentinel of the entries by use: lru.next is the most recently used, lru.prev the least
+	maxEntries   int     // the least recently used entry is evicted to add one beyond it
+	evictions    uint64
 	timeout      time.Duration
 	timeoutTimer *time.Timer
 	stopChan     chan struct{}
 	isClosed     bool
 	wg           sync.WaitGroup
+	latency      map[string]*arpLatency // ARP resolution latency per interface name
+}
+
+// arpNode is an entry of the ARP cache, linked into its LRU list
+type arpNode struct {
+	ip         string
+	entry      ARPEntry
+	prev, next *arpNode
+}
+
+// unlink removes the node from the LRU list
+func (n *arpNode) unlink() {
+	n.prev.next = n.next
+	n.next.prev = n.prev
+}
+
+// pushFront inserts n into the LRU list as its most recently used entry. The caller must hold cache.mu for writing
+func (cache *ARPCache) pushFront(n *arpNode) {
+	n.prev, n.next = &cache.lru, cache.lru.next
+	cache.lru.next.prev = n
+	cache.lru.next = n
+}
+
+// ARPLatencyHistogram counts ARP resolutions, i.e. ARP requests that went on the wire, by how long they took.
+// The counters are monotonic: they are never reset, so rates are obtained by differencing two snapshots.
+type ARPLatencyHistogram struct {
+	Under1ms     uint64
+	Under10ms    uint64
+	Under100ms   uint64
+	Under1s      uint64
+	UnderTimeout uint64 // 1s or more, but answered before the ARP request timeout
+	Timeout      uint64 // no reply within the ARP request timeout
+
+	LastResolveDuration time.Duration // duration of the latest answered resolution, 0 before the first one
+}
+
+// CacheStats is a snapshot of the ARP cache statistics
+type CacheStats struct {
+	Entries    int
+	MaxEntries int                            // see WithARPCacheSize
+	Evictions  uint64                         // entries evicted to make room for others, expired entries aside
+	Resolution map[string]ARPLatencyHistogram // keyed by interface name
+}
+
+type arpLatency struct {
+	under1ms, under10ms, under100ms, under1s, underTimeout, timeout atomic.Uint64
+
+	last atomic.Int64 // nanoseconds
+}
+
+// observe records one resolution which took d, or timed out
+func (l *arpLatency) observe(d time.Duration, timedOut bool) {
+	if !timedOut {
+		l.last.Store(int64(d))
+	}
+	switch {
+	case timedOut:
+		l.timeout.Add(1)
+	case d < time.Millisecond:
+		l.under1ms.Add(1)
+	case d < 10*time.Millisecond:
+		l.under10ms.Add(1)
+	case d < 100*time.Millisecond:
+		l.under100ms.Add(1)
+	case d < time.Second:
+		l.under1s.Add(1)
+	default:
+		l.underTimeout.Add(1)
+	}
+}
+
+func (l *arpLatency) snapshot() ARPLatencyHistogram {
+	return ARPLatencyHistogram{
+		Under1ms:     l.under1ms.Load(),
+		Under10ms:    l.under10ms.Load(),
+		Under100ms:   l.under100ms.Load(),
+		Under1s:      l.under1s.Load(),
+		UnderTimeout: l.underTimeout.Load(),
+		Timeout:      l.timeout.Load(),
+
+		LastResolveDuration: time.Duration(l.last.Load()),
+	}
 }
 
 func NewARPCache(timeout time.Duration) *ARPCache {
 	cache := &ARPCache{
-		entries:      make(map[string]ARPEntry),
+		entries:      make(map[string]*arpNode),
+		maxEntries:   defaultARPCacheSize,
 		timeout:      timeout,
 		timeoutTimer: time.NewTimer(timeout), // Initialize the timer
 		stopChan:     make(chan struct{}),    // Initialize the stop channel
 		wg:           sync.WaitGroup{},
+		latency:      make(map[string]*arpLatency),
 	}
+	cache.lru.prev, cache.lru.next = &cache.lru, &cache.lru
 
 	cache.wg.Add(1)
 	go cache.cleanup() // Start background cleanup process
@@ -40,23 +138,93 @@ func NewARPCache(timeout time.Duration) *ARPCache {
 	return cache
 }
 
+// Add adds or refreshes the entry of ip. A full cache evicts its least recently used entry to make room
 func (cache *ARPCache) Add(ip string, mac net.HardwareAddr) {
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
-	cache.entries[ip] = ARPEntry{
+	entry := ARPEntry{
 		MacAddress: mac,
 		Expiry:     time.Now().Add(cache.timeout),
 	}
+	if n, found := cache.entries[ip]; found {
+		n.entry = entry
+		n.unlink()
+		cache.pushFront(n)
+		return
+	}
+
+	for len(cache.entries) >= cache.maxEntries && len(cache.entries) > 0 {
+		cache.evictOldest()
+	}
+	n := &arpNode{ip: ip, entry: entry}
+	cache.entries[ip] = n
+	cache.pushFront(n)
 }
 
+// Lookup returns the MAC address of ip unless it is unknown or expired, and marks the entry as the most recently used
 func (cache *ARPCache) Lookup(ip string) (net.HardwareAddr, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	n, found := cache.entries[ip]
+	if !found || time.Now().After(n.entry.Expiry) {
+		return nil, false
+	}
+	n.unlink()
+	cache.pushFront(n)
+	return n.entry.MacAddress, true
+}
+
+// setMaxEntries bounds the number of entries of the cache, evicting the least recently used ones beyond n
+func (cache *ARPCache) setMaxEntries(n int) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.maxEntries = n
+	for len(cache.entries) > n {
+		cache.evictOldest()
+	}
+}
+
+// evictOldest removes the least recently used entry of a cache which is not empty. The caller must hold cache.mu for writing
+func (cache *ARPCache) evictOldest() {
+	oldest := cache.lru.prev
+	oldest.unlink()
+	delete(cache.entries, oldest.ip)
+	cache.evictions++
+}
+
+// observeResolution records the duration of an ARP resolution on the given interface
+func (cache *ARPCache) observeResolution(ifaceName string, d time.Duration, timedOut bool) {
+	cache.mu.RLock()
+	latency, exists := cache.latency[ifaceName]
+	cache.mu.RUnlock()
+
+	if !exists {
+		cache.mu.Lock()
+		if latency, exists = cache.latency[ifaceName]; !exists {
+			latency = &arpLatency{}
+			cache.latency[ifaceName] = latency
+		}
+		cache.mu.Unlock()
+	}
+
+	latency.observe(d, timedOut)
+}
+
+// Stats returns a snapshot of the ARP cache statistics
+func (cache *ARPCache) Stats() CacheStats {
 	cache.mu.RLock()
 	defer cache.mu.RUnlock()
-	entry, found := cache.entries[ip]
-	if !found || time.Now().After(entry.Expiry) {
-		return nil, false
+
+	stats := CacheStats{
+		Entries:    len(cache.entries),
+		MaxEntries: cache.maxEntries,
+		Evictions:  cache.evictions,
+		Resolution: make(map[string]ARPLatencyHistogram, len(cache.latency)),
 	}
-	return entry.MacAddress, true
+	for ifaceName, latency := range cache.latency {
+		stats.Resolution[ifaceName] = latency.snapshot()
+	}
+	return stats
 }
 
 func (cache *ARPCache) cleanup() {
@@ -67,8 +235,9 @@ func (cache *ARPCache) cleanup() {
 		case <-cache.timeoutTimer.C:
 			cache.mu.Lock()
 			now := time.Now()
-			for ip, entry := range cache.entries {
-				if now.After(entry.Expiry) {
+			for ip, n := range cache.entries {
+				if now.After(n.entry.Expiry) {
+					n.unlink()
 					delete(cache.entries, ip)
 				}
 			}
@@ -82,6 +251,18 @@ func (cache *ARPCache) cleanup() {
 	}
 }
 
+// entriesSnapshot returns a copy of the entries of the cache, keyed by IP
+func (cache *ARPCache) entriesSnapshot() map[string]ARPEntry {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+
+	entries := make(map[string]ARPEntry, len(cache.entries))
+	for ip, n := range cache.entries {
+		entries[ip] = n.entry
+	}
+	return entries
+}
+
 func (cache *ARPCache) Close() {
 	if cache.isClosed {
 		return
@@ -0,0 +1,104 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultARPRateLimit   = 50              // ARP requests per second per interface unless configured otherwise
+	defaultARPNegativeTTL = 3 * time.Second // how long a failed resolution is remembered unless configured otherwise
+	arpRateLimitWait      = time.Second     // longest a resolution waits for the rate limit before failing
+	arpFailuresPruneLen   = 4096            // number of remembered failures above which the expired ones are pruned
+)
+
+// arpLimiter keeps a pcapSession from flooding its link with ARP requests: a token bucket bounds the rate of the
+// requests it sends, and the addresses which did not answer recently are not asked again until their failure expires
+type arpLimiter struct {
+	rate   float64       // requests per second, also the burst. 0 disables the limit
+	negTTL time.Duration // 0 disables the negative cache
+
+	mu       sync.Mutex
+	tokens   float64
+	last     time.Time
+	failures map[netip.Addr]time.Time // expiry of the remembered failures
+
+	rateLimited  atomic.Uint64 // resolutions failed with ErrARPRateLimited
+	negativeHits atomic.Uint64 // resolutions failed right away for a remembered failure
+}
+
+func newARPLimiter(rate int, negTTL time.Duration) *arpLimiter {
+	return &arpLimiter{
+		rate:     float64(rate),
+		negTTL:   negTTL,
+		tokens:   float64(rate),
+		last:     time.Now(),
+		failures: make(map[netip.Addr]time.Time),
+	}
+}
+
+// reserve takes the token of an ARP request and returns how long to wait before sending it. It fails if that is
+// longer than arpRateLimitWait, taking nothing
+func (l *arpLimiter) reserve(now time.Time) (time.Duration, bool) {
+	if l.rate == 0 {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	var wait time.Duration
+	if l.tokens < 1 {
+		wait = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	}
+	if wait > arpRateLimitWait {
+		l.rateLimited.Add(1)
+		return 0, false
+	}
+	l.tokens--
+	return wait, true
+}
+
+// failed remembers that the resolution of ip timed out
+func (l *arpLimiter) failed(ip netip.Addr, now time.Time) {
+	if l.negTTL == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.failures) >= arpFailuresPruneLen {
+		for addr, expiry := range l.failures {
+			if now.After(expiry) {
+				delete(l.failures, addr)
+			}
+		}
+	}
+	l.failures[ip] = now.Add(l.negTTL)
+}
+
+// recentlyFailed tells if the resolution of ip timed out less than the negative TTL ago
+func (l *arpLimiter) recentlyFailed(ip netip.Addr, now time.Time) bool {
+	if l.negTTL == 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expiry, found := l.failures[ip]
+	if !found {
+		return false
+	}
+	if now.After(expiry) {
+		delete(l.failures, ip)
+		return false
+	}
+	l.negativeHits.Add(1)
+	return true
+}
@@ -0,0 +1,301 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxBlockFilterEntries is the number of blocked prefixes beyond which they are no longer compiled into the BPF
+// filters of the sessions, which would grow too long, and are only dropped by the dispatch path
+const maxBlockFilterEntries = 64
+
+// BlockedSource describes a source blocked by RawSocketCore.Block
+type BlockedSource struct {
+	Net     *net.IPNet
+	Expires time.Time // zero if the block never expires
+	Dropped uint64    // packets of the source dropped by the dispatch path. Those dropped by BPF are not counted
+	// InFilter tells that the block is part of the BPF filters of the sessions, which drop the packets of the
+	// source uncounted: Dropped then only counts those of the capture handles refusing the filter
+	InFilter bool
+}
+
+// blockEntry is a blocked prefix
+type blockEntry struct {
+	prefix  netip.Prefix
+	expires time.Time
+	timer   *time.Timer // unblocks the prefix once it expires, nil if it never does
+	dropped atomic.Uint64
+}
+
+// blocklist is the set of sources the sessions of a core drop. The dispatch path reads the current snapshot
+// without locking, changes swap in a new one
+type blocklist struct {
+	mu       sync.Mutex
+	entries  map[netip.Prefix]*blockEntry
+	current  atomic.Pointer[[]*blockEntry]
+	onChange func() // applies the new BPF filter to the sessions, called without mu held
+}
+
+func newBlocklist(onChange func()) *blocklist {
+	return &blocklist{entries: make(map[netip.Prefix]*blockEntry), onChange: onChange}
+}
+
+// drops tells whether packets from src are blocked, counting them against their entry if so
+func (b *blocklist) drops(src net.IP) bool {
+	list := b.current.Load()
+	if list == nil || len(*list) == 0 {
+		return false
+	}
+	addr := toAddr(src)
+	for _, entry := range *list {
+		if entry.prefix.Contains(addr) {
+			entry.dropped.Add(1)
+			return true
+		}
+	}
+	return false
+}
+
+func (b *blocklist) block(prefix netip.Prefix, ttl time.Duration) {
+	b.mu.Lock()
+	entry, exists := b.entries[prefix]
+	if !exists {
+		entry = &blockEntry{prefix: prefix}
+		b.entries[prefix] = entry
+	}
+	if entry.timer != nil {
+		entry.timer.Stop()
+		entry.timer = nil
+	}
+	entry.expires = time.Time{}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+		entry.timer = time.AfterFunc(ttl, func() { b.expire(entry) })
+	}
+	b.publish()
+	b.mu.Unlock()
+
+	if !exists {
+		b.onChange()
+	}
+}
+
+func (b *blocklist) unblock(prefix netip.Prefix) bool {
+	b.mu.Lock()
+	entry, exists := b.entries[prefix]
+	if exists {
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+		delete(b.entries, prefix)
+		b.publish()
+	}
+	b.mu.Unlock()
+
+	if exists {
+		b.onChange()
+	}
+	return exists
+}
+
+// expire removes entry once its block expired, unless it was blocked again since
+func (b *blocklist) expire(entry *blockEntry) {
+	b.mu.Lock()
+	current, exists := b.entries[entry.prefix]
+	removed := exists && current == entry && !entry.expires.IsZero() && !time.Now().Before(entry.expires)
+	if removed {
+		delete(b.entries, entry.prefix)
+		b.publish()
+	}
+	b.mu.Unlock()
+
+	if removed {
+		b.onChange()
+	}
+}
+
+// publish swaps in the snapshot of the entries. The caller must hold mu
+func (b *blocklist) publish() {
+	list := make([]*blockEntry, 0, len(b.entries))
+	for _, entry := range b.entries {
+		list = append(list, entry)
+	}
+	// most specific prefixes first, so that a source is counted against the narrowest block covering it
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].prefix.Bits() != list[j].prefix.Bits() {
+			return list[i].prefix.Bits() > list[j].prefix.Bits()
+		}
+		return list[i].prefix.Addr().Less(list[j].prefix.Addr())
+	})
+	b.current.Store(&list)
+}
+
+func (b *blocklist) snapshot() []BlockedSource {
+	list := b.current.Load()
+	if list == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// filter compiles the IPv4 entries into BPF unless there are too many entries
+	compiled := len(*list) <= maxBlockFilterEntries
+	blocked := make([]BlockedSource, 0, len(*list))
+	for _, entry := range *list {
+		blocked = append(blocked, BlockedSource{
+			Net:      prefixToIPNet(entry.prefix),
+			Expires:  entry.expires,
+			Dropped:  entry.dropped.Load(),
+			InFilter: compiled && entry.prefix.Addr().Is4(),
+		})
+	}
+	return blocked
+}
+
+// filter returns the BPF expression dropping the blocked IPv4 sources, "" if there are none or too many of them
+func (b *blocklist) filter() string {
+	list := b.current.Load()
+	if list == nil || len(*list) == 0 || len(*list) > maxBlockFilterEntries {
+		return ""
+	}
+	var terms []string
+	for _, entry := range *list {
+		if entry.prefix.Addr().Is4() {
+			terms = append(terms, "src net "+entry.prefix.String())
+		}
+	}
+	if len(terms) == 0 {
+		return ""
+	}
+	return "not (" + strings.Join(terms, " or ") + ")"
+}
+
+// prefixToIPNet converts prefix to a *net.IPNet
+func prefixToIPNet(prefix netip.Prefix) *net.IPNet {
+	bits := prefix.Addr().BitLen()
+	return &net.IPNet{IP: net.IP(prefix.Addr().AsSlice()), Mask: net.CIDRMask(prefix.Bits(), bits)}
+}
+
+// setBlockFilter applies block, the BPF expression of the blocklist, to the capture handles of the session along with
+// their partition filters. A handle refusing it keeps its partition filter only: the dispatch path drops the blocked
+// sources anyway
+func (ps *pcapSession) setBlockFilter(block string) {
+	ps.handleMu.RLock()
+	defer ps.handleMu.RUnlock()
+	if ps.isClosed.Load() {
+		return
+	}
+	ps.applyBlockFilter(ps.captureHandles, block)
+}
+
+// applyBlockFilter sets the partition filters of handles, the capture handles of the session, combined with block
+func (ps *pcapSession) applyBlockFilter(handles []PacketIO, block string) {
+	n := len(handles)
+	for i, handle := range handles {
+		partition := ""
+		if n > 1 {
+			partition = capturePartitionFilter(i, n)
+		}
+		expr := partition
+		switch {
+		case block != "" && partition != "":
+			expr = fmt.Sprintf("(%s) and (%s)", partition, block)
+		case block != "":
+			expr = block
+		}
+		if err := handle.SetBPFFilter(expr); err != nil {
+			log.Printf("Warning: cannot set the block filter of capture #%d on %s, dropping in user space instead: %v", i, ps.params.key, err)
+			handle.SetBPFFilter(partition)
+		}
+	}
+}
+
+// refreshBlockFilters applies the blocklist to the BPF filters of all sessions. Holding createMu keeps a session
+// created meanwhile from missing the change
+func (core *RawSocketCore) refreshBlockFilters() {
+	core.sessions.createMu.Lock()
+	defer core.sessions.createMu.Unlock()
+
+	block := core.blocklist.filter()
+	for _, ps := range core.sessions.all() {
+		ps.setBlockFilter(block)
+	}
+}
+
+// Block makes every session of the core drop the packets from the sources within ipNet, as early as possible: in the
+// BPF filters of the sessions when it can be expressed there, by the dispatch path otherwise. It applies to the
+// sessions opened later as well. A ttl over 0 unblocks the sources once it has passed. Blocking the same prefix again
+// replaces its ttl. This is meant as incident tooling, not a firewall.
+func (core *RawSocketCore) Block(ipNet *net.IPNet, ttl time.Duration) error {
+	prefix, err := ipNetToPrefix(ipNet)
+	if err != nil {
+		return err
+	}
+	core.blocklist.block(prefix, ttl)
+	return nil
+}
+
+// BlockIP is Block for a single source
+func (core *RawSocketCore) BlockIP(ip net.IP, ttl time.Duration) error {
+	addr := toAddr(ip)
+	if !addr.IsValid() {
+		return fmt.Errorf("block: invalid address %v", ip)
+	}
+	core.blocklist.block(netip.PrefixFrom(addr, addr.BitLen()), ttl)
+	return nil
+}
+
+// Unblock removes the block of ipNet set by Block, and tells whether there was one
+func (core *RawSocketCore) Unblock(ipNet *net.IPNet) bool {
+	prefix, err := ipNetToPrefix(ipNet)
+	if err != nil {
+		return false
+	}
+	return core.blocklist.unblock(prefix)
+}
+
+// UnblockIP removes the block of ip set by BlockIP, and tells whether there was one
+func (core *RawSocketCore) UnblockIP(ip net.IP) bool {
+	addr := toAddr(ip)
+	if !addr.IsValid() {
+		return false
+	}
+	return core.blocklist.unblock(netip.PrefixFrom(addr, addr.BitLen()))
+}
+
+// Blocked returns the blocked sources with the packets dropped for each of them, most specific first. The counts
+// exclude the packets dropped by the BPF filters, which never reach the dispatch path: a source whose InFilter is set
+// may show few drops or none while it is flooding the interface. Drops in BPF are not reported at all, not even in
+// aggregate, since pcap does not count the packets its filter rejects.
+func (core *RawSocketCore) Blocked() []BlockedSource {
+	return core.blocklist.snapshot()
+}
+
+// ipNetToPrefix converts ipNet to its masked netip.Prefix, unmapping IPv4 addresses
+func ipNetToPrefix(ipNet *net.IPNet) (netip.Prefix, error) {
+	if ipNet == nil {
+		return netip.Prefix{}, fmt.Errorf("block: nil prefix")
+	}
+	addr := toAddr(ipNet.IP)
+	ones, bits := ipNet.Mask.Size()
+	if !addr.IsValid() || bits == 0 {
+		return netip.Prefix{}, fmt.Errorf("block: invalid prefix %v", ipNet)
+	}
+	if addr.Is4() && bits == 8*net.IPv6len {
+		ones -= 96 // a 16 bytes mask of an IPv4 prefix
+	}
+	prefix, err := addr.Prefix(ones)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("block: invalid prefix %v: %w", ipNet, err)
+	}
+	return prefix, nil
+}
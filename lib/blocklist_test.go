@@ -0,0 +1,79 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// TestBlockCountsDispatchDrops blocks the client on the server, whose MemoryTransport handles apply no BPF filter, and
+// checks that the dispatch path drops and counts its packets until it is unblocked
+func TestBlockCountsDispatchDrops(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIP, layers.IPProtocolUDP)
+	conn := p.dial(t, layers.IPProtocolUDP)
+
+	if err := p.server.BlockIP(testClientIP, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Write([]byte("blocked")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		blocked := p.server.Blocked()
+		if len(blocked) != 1 {
+			t.Fatalf("Blocked returned %v, want the client only", blocked)
+		}
+		if blocked[0].Dropped == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d packets counted as dropped, want 3", blocked[0].Dropped)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if !p.server.UnblockIP(testClientIP) {
+		t.Fatal("client not unblocked")
+	}
+	if _, err := conn.Write([]byte("unblocked")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTimeout(t, listener, time.Second); !bytes.Equal(got, []byte("unblocked")) {
+		t.Errorf("read %q, want the packet sent once unblocked only", got)
+	}
+}
+
+// TestBlockedInFilter checks which blocks Blocked reports as part of the BPF filters, whose drops it does not count
+func TestBlockedInFilter(t *testing.T) {
+	core := NewRawSocketCore(60, 1)
+	defer core.Close()
+
+	core.BlockIP(net.ParseIP("192.0.2.1"), 0)
+	core.BlockIP(net.ParseIP("2001:db8::1"), 0)
+	for _, source := range core.Blocked() {
+		if want := source.Net.IP.To4() != nil; source.InFilter != want {
+			t.Errorf("%v reported InFilter %v, want %v", source.Net, source.InFilter, want)
+		}
+	}
+
+	// beyond maxBlockFilterEntries, the dispatch path drops them all
+	for i := 0; i < maxBlockFilterEntries; i++ {
+		core.BlockIP(net.ParseIP(fmt.Sprintf("198.51.100.%d", i)), 0)
+	}
+	for _, source := range core.Blocked() {
+		if source.InFilter {
+			t.Errorf("%v reported InFilter with %d blocks", source.Net, maxBlockFilterEntries+2)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// IPv4Config describes the IPv4 header built by BuildIPv4Header
+type IPv4Config struct {
+	Src, Dst     net.IP
+	Protocol     layers.IPProtocol
+	TTL          uint8 // 0 means 64
+	TOS          uint8
+	ID           uint16
+	DontFragment bool
+	PayloadLen   int // bytes following the header, for the total length field
+}
+
+// layer returns the IPv4 layer described by cfg. Writes build their header through it as well
+func (cfg IPv4Config) layer() *layers.IPv4 {
+	ttl := cfg.TTL
+	if ttl == 0 {
+		ttl = 64
+	}
+	ipLayer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TOS:      cfg.TOS,
+		Id:       cfg.ID,
+		TTL:      ttl,
+		Protocol: cfg.Protocol,
+		SrcIP:    cfg.Src,
+		DstIP:    cfg.Dst,
+	}
+	if cfg.DontFragment {
+		ipLayer.Flags = layers.IPv4DontFragment
+	}
+	return ipLayer
+}
+
+// BuildIPv4Header returns the 20 bytes IPv4 header described by cfg, checksum included
+func BuildIPv4Header(cfg IPv4Config) ([]byte, error) {
+	if cfg.Src.To4() == nil || cfg.Dst.To4() == nil {
+		return nil, fmt.Errorf("ipv4 header %v->%v: %w", cfg.Src, cfg.Dst, ErrAddressFamilyMismatch)
+	}
+	if cfg.PayloadLen < 0 || cfg.PayloadLen > 0xffff-ipv4HeaderLen {
+		return nil, fmt.Errorf("ipv4 header: payload length %d out of range", cfg.PayloadLen)
+	}
+
+	ipLayer := cfg.layer()
+	ipLayer.Length = uint16(ipv4HeaderLen + cfg.PayloadLen)
+	buffer := gopacket.NewSerializeBuffer()
+	// no FixLengths: the payload is not part of the buffer, the total length is the one set above
+	if err := ipLayer.SerializeTo(buffer, gopacket.SerializeOptions{ComputeChecksums: true}); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// ipv6HeaderLen is the length of the fixed IPv6 header
+const ipv6HeaderLen = 40
+
+// maxFlowLabel is the largest IPv6 flow label, which is 20 bits long
+const maxFlowLabel = 1<<20 - 1
+
+// IPv6Config describes the IPv6 header built by BuildIPv6Header
+type IPv6Config struct {
+	Src, Dst     net.IP
+	NextHeader   layers.IPProtocol
+	HopLimit     uint8 // 0 means 64
+	TrafficClass uint8
+	FlowLabel    uint32                // 20 bits. AutoFlowLabel derives a stable one from the flow
+	PayloadLen   int                   // bytes following the header and its extension headers, for the payload length field
+	Extensions   []IPv6ExtensionHeader // placed in order between the header and the payload
+	LinkMTU      int                   // MTU of the link the packet goes out on, required by jumbograms only
+}
+
+// BuildIPv6Header returns the 40 bytes IPv6 header described by cfg, followed by its extension headers, the way IPv6
+// conns build the header of their writes. It is meant for callers injecting complete frames themselves, e.g. to probe
+// the flow label hashing of load balancers.
+// A payload too long for the 16 bits payload length makes a jumbogram (RFC 2675): its length goes into a Jumbo
+// Payload option of the Hop-by-Hop header, added if there is none. The whole packet must then fit into cfg.LinkMTU.
+func BuildIPv6Header(cfg IPv6Config) ([]byte, error) {
+	if cfg.Src.To4() != nil || cfg.Dst.To4() != nil || len(cfg.Src) != net.IPv6len || len(cfg.Dst) != net.IPv6len {
+		return nil, fmt.Errorf("ipv6 header %v->%v: %w", cfg.Src, cfg.Dst, ErrAddressFamilyMismatch)
+	}
+	if cfg.FlowLabel > maxFlowLabel {
+		return nil, fmt.Errorf("ipv6 header: flow label %#x does not fit in 20 bits", cfg.FlowLabel)
+	}
+	if cfg.PayloadLen < 0 {
+		return nil, fmt.Errorf("ipv6 header: payload length %d out of range", cfg.PayloadLen)
+	}
+	chain, next, err := marshalIPv6Extensions(cfg.Extensions, cfg.NextHeader)
+	if err != nil {
+		return nil, err
+	}
+	length := uint16(len(chain) + cfg.PayloadLen)
+	if len(chain)+cfg.PayloadLen > 0xffff {
+		if chain, next, err = jumboExtensions(cfg); err != nil {
+			return nil, err
+		}
+		length = 0 // the Jumbo Payload option carries it
+	}
+
+	hopLimit := cfg.HopLimit
+	if hopLimit == 0 {
+		hopLimit = 64
+	}
+	ipLayer := &layers.IPv6{
+		Version:      6,
+		TrafficClass: cfg.TrafficClass,
+		FlowLabel:    cfg.FlowLabel,
+		Length:       length,
+		NextHeader:   next,
+		HopLimit:     hopLimit,
+		SrcIP:        cfg.Src,
+		DstIP:        cfg.Dst,
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	if err := ipLayer.SerializeTo(buffer, gopacket.SerializeOptions{}); err != nil {
+		return nil, err
+	}
+	return append(buffer.Bytes(), chain...), nil
+}
+
+// AutoFlowLabel returns the flow label RFC 6437 recommends for a flow: a hash of its addresses, protocol and ports,
+// stable for the flow and never 0. Ports are 0 for protocols without them.
+func AutoFlowLabel(src, dst net.IP, protocol layers.IPProtocol, srcPort, dstPort uint16) uint32 {
+	// FNV-1a over the 5-tuple, folded to 20 bits
+	hash := uint32(2166136261)
+	mix := func(b []byte) {
+		for _, c := range b {
+			hash ^= uint32(c)
+			hash *= 16777619
+		}
+	}
+	mix(src.To16())
+	mix(dst.To16())
+	mix([]byte{byte(protocol), byte(srcPort >> 8), byte(srcPort), byte(dstPort >> 8), byte(dstPort)})
+
+	label := (hash ^ hash>>20) & maxFlowLabel
+	if label == 0 {
+		label = 1 // 0 means the packet is not labelled
+	}
+	return label
+}
+
+// BuildUDPPacket returns the UDP datagram from src to dst carrying payload, checksum over the IPv4 pseudo-header included.
+// The result is meant to be written to a RawIPConn dialed with layers.IPProtocolUDP between the same addresses.
+func BuildUDPPacket(src, dst *net.UDPAddr, payload []byte) ([]byte, error) {
+	if src.IP.To4() == nil || dst.IP.To4() == nil {
+		return nil, fmt.Errorf("udp packet %v->%v: %w", src, dst, ErrAddressFamilyMismatch)
+	}
+
+	udp := &layers.UDP{SrcPort: layers.UDPPort(src.Port), DstPort: layers.UDPPort(dst.Port)}
+	if err := udp.SetNetworkLayerForChecksum(&layers.IPv4{SrcIP: src.IP.To4(), DstIP: dst.IP.To4(), Protocol: layers.IPProtocolUDP}); err != nil {
+		return nil, err
+	}
+	return serializeLayers(udp, gopacket.Payload(payload))
+}
+
+// BuildICMPEcho returns the ICMPv4 echo request with the given identifier and sequence number carrying payload,
+// checksum included. The result is meant to be written to a RawIPConn dialed with layers.IPProtocolICMPv4.
+func BuildICMPEcho(id, seq uint16, payload []byte) []byte {
+	icmp := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0),
+		Id:       id,
+		Seq:      seq,
+	}
+	// serializing an ICMP header into a growing buffer cannot fail
+	b, _ := serializeLayers(icmp, gopacket.Payload(payload))
+	return b
+}
+
+// serializeLayers serializes layers with their lengths and checksums computed, the way the library builds every packet
+func serializeLayers(l ...gopacket.SerializableLayer) ([]byte, error) {
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, l...); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// IPIDStrategy tells how a conn fills in the IP ID of the packets it writes
+type IPIDStrategy int
+
+const (
+	IPIDZero      IPIDStrategy = iota // always 0, which RFC 6864 allows for packets with DF set like the ones of the library
+	IPIDIncrement                     // a counter per conn
+	IPIDRandom                        // a random ID per packet
+)
+
+func (s IPIDStrategy) valid() bool {
+	return s >= IPIDZero && s <= IPIDRandom
+}
@@ -0,0 +1,174 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// captureNothingFilter keeps a new capture handle quiet until it replaces the handle capturing the same traffic
+const captureNothingFilter = "ip and not ip"
+
+// openCaptureHandles returns the handles the capture loops of a session read from: the session's own handle
+// plus n-1 extra handles opened on the same device.
+//
+// Every pcap handle on a device receives its own copy of all the traffic (separate Npcap kernel buffers on Windows,
+// separate /dev/bpf devices on macOS and FreeBSD), so running n loops naively would deliver every packet n times.
+// To avoid duplicate delivery each handle gets a BPF filter selecting its share of the IPv4 flows by the sum of
+// source and destination address, which keeps both directions of a conn on the same handle. Non-IPv4 frames
+// (ARP and the like) are only captured by the first handle.
+//
+// The kernel still copies and filters every frame once per handle, so this only helps when the user-space capture
+// loop is the bottleneck. If the platform refuses extra handles or the filter cannot be compiled (libpcap too old
+// for the modulo operator), it degrades to the single session handle with a logged warning.
+func openCaptureHandles(device string, first *pcap.Handle, config *pcapSessionConfig) []*pcap.Handle {
+	n := config.captureWorkers
+	if n <= 1 {
+		return []*pcap.Handle{first}
+	}
+
+	handles := []*pcap.Handle{first}
+	degrade := func(err error) []*pcap.Handle {
+		log.Printf("Warning: cannot run %d capture workers on %s, using 1 instead: %v", n, device, err)
+		for _, handle := range handles[1:] {
+			handle.Close()
+		}
+		first.SetBPFFilter("") // remove the partition filter again
+		return []*pcap.Handle{first}
+	}
+
+	for i := 1; i < n; i++ {
+		handle, err := openHandle(device, config)
+		if err != nil {
+			return degrade(err)
+		}
+		handles = append(handles, handle)
+	}
+
+	for i, handle := range handles {
+		if err := handle.SetBPFFilter(capturePartitionFilter(i, n)); err != nil {
+			return degrade(err)
+		}
+	}
+
+	return handles
+}
+
+// openHandle opens a pcap handle on device with the capture settings of the session
+func openHandle(device string, config *pcapSessionConfig) (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(device)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+
+	if err := inactive.SetSnapLen(config.snaplen); err != nil {
+		return nil, fmt.Errorf("snaplen: %w", err)
+	}
+	if err := inactive.SetPromisc(config.promiscuous); err != nil {
+		return nil, fmt.Errorf("promiscuous mode: %w", err)
+	}
+	if err := inactive.SetTimeout(pcap.BlockForever); err != nil {
+		return nil, fmt.Errorf("timeout: %w", err)
+	}
+	if config.bufferSize > 0 {
+		if err := inactive.SetBufferSize(config.bufferSize); err != nil {
+			return nil, fmt.Errorf("buffer size: %w", err)
+		}
+	}
+	if config.immediateMode {
+		if err := inactive.SetImmediateMode(true); err != nil {
+			return nil, fmt.Errorf("immediate mode: %w", err)
+		}
+	}
+	if config.timestampSource != "" {
+		source, err := pcap.TimestampSourceFromString(config.timestampSource)
+		if err != nil {
+			return nil, fmt.Errorf("timestamp source: %w", err)
+		}
+		if err := inactive.SetTimestampSource(source); err != nil {
+			return nil, fmt.Errorf("timestamp source: %w", err)
+		}
+	}
+
+	return inactive.Activate()
+}
+
+// reopenHandles replaces the capture handles of the session with new ones opened with a kernel buffer of bufferSize,
+// for the settings pcap fixes when a handle is activated. The conns, the dispatch workers and the queued packets are
+// kept. The new handles are opened first, capturing nothing, so that only the frames arriving between closing the old
+// handles and filtering the new ones are lost: a gap reported by a CaptureRestarted event. If they cannot be opened,
+// the old handles are kept. reason ends up in the event
+func (ps *pcapSession) reopenHandles(bufferSize int, reason string) error {
+	config := *ps.config
+	config.bufferSize = bufferSize
+	first, err := openHandle(ps.device, &config)
+	if err != nil {
+		ps.params.events.emit(&CaptureRestarted{eventTime{time.Now()}, ps.params.key, reason, int(ps.bufferSize.Load()), 0, err})
+		return fmt.Errorf("cannot reopen the capture on %s: %w", ps.params.key, err)
+	}
+	var handles []PacketIO
+	for _, handle := range openCaptureHandles(ps.device, first, &config) {
+		handle.SetBPFFilter(captureNothingFilter)
+		handles = append(handles, handle)
+	}
+	block := ""
+	if ps.params.blocklist != nil {
+		block = ps.params.blocklist.filter()
+	}
+
+	ps.handleMu.Lock()
+	if ps.isClosed.Load() {
+		ps.handleMu.Unlock()
+		for _, handle := range handles {
+			handle.Close()
+		}
+		return nil
+	}
+	start := time.Now()
+	for _, io := range ps.captureHandles {
+		if handle, ok := io.(*pcap.Handle); ok {
+			if stats, err := handle.Stats(); err == nil {
+				ps.retiredPcap.PacketsReceived += stats.PacketsReceived
+				ps.retiredPcap.PacketsDropped += stats.PacketsDropped
+				ps.retiredPcap.PacketsIfDropped += stats.PacketsIfDropped
+			}
+		}
+	}
+	close(ps.captureRetired)
+	for _, handle := range ps.captureHandles {
+		handle.Close()
+	}
+	ps.applyBlockFilter(handles, block)
+	gap := time.Since(start)
+
+	ps.captureHandles = handles
+	ps.params.handle = handles[0]
+	ps.captureRetired = make(chan struct{})
+	retired := ps.captureRetired
+	ps.captureCount.Store(int32(len(handles)))
+	ps.bufferSize.Store(int64(bufferSize))
+	ps.captureRestarts.Add(1)
+	ps.handleMu.Unlock()
+
+	for i, handle := range handles {
+		go ps.handleIncomingPackets(handle, i, retired)
+	}
+	log.Printf("Pcap Session %s reopened its capture with a %d byte buffer (%s), no capture for %v", ps.params.key, bufferSize, reason, gap)
+	ps.params.events.emit(&CaptureRestarted{eventTime{time.Now()}, ps.params.key, reason, bufferSize, gap, nil})
+	return nil
+}
+
+// capturePartitionFilter returns the BPF filter selecting the share of traffic of capture handle i out of n
+func capturePartitionFilter(i, n int) string {
+	partition := fmt.Sprintf("(ip[12:4] + ip[16:4]) %% %d = %d", n, i)
+	if i == 0 {
+		return fmt.Sprintf("not ip or (%s)", partition)
+	}
+	return fmt.Sprintf("ip and (%s)", partition)
+}
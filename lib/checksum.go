@@ -0,0 +1,80 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Internet checksum (RFC 1071) helpers for crafting packets by hand. A checksum is computed by summing the
+// pseudo-header, if the protocol has one, then finishing the sum over the data:
+//
+//	sum := PseudoHeaderChecksumIPv4(src, dst, layers.IPProtocolUDP, len(udp))
+//	binary.BigEndian.PutUint16(udp[6:8], FinishChecksum(sum, udp)) // with the checksum field zeroed first
+
+// Checksum returns the internet checksum of data
+func Checksum(data []byte) uint16 {
+	return FinishChecksum(0, data)
+}
+
+// PseudoHeaderChecksumIPv4 returns the partial sum of the IPv4 pseudo-header of a TCP, UDP or similar segment
+// of length bytes, to be finished by FinishChecksum
+func PseudoHeaderChecksumIPv4(src, dst net.IP, proto layers.IPProtocol, length int) uint32 {
+	var pseudo [12]byte
+	copy(pseudo[0:4], src.To4())
+	copy(pseudo[4:8], dst.To4())
+	pseudo[9] = byte(proto)
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(length))
+	return checksumAdd(0, pseudo[:])
+}
+
+// PseudoHeaderChecksumIPv6 returns the partial sum of the IPv6 pseudo-header (RFC 8200 8.1) of a TCP, UDP or ICMPv6
+// message of length bytes, to be finished by FinishChecksum
+func PseudoHeaderChecksumIPv6(src, dst net.IP, proto layers.IPProtocol, length int) uint32 {
+	var pseudo [40]byte
+	copy(pseudo[0:16], src.To16())
+	copy(pseudo[16:32], dst.To16())
+	binary.BigEndian.PutUint32(pseudo[32:36], uint32(length))
+	pseudo[39] = byte(proto)
+	return checksumAdd(0, pseudo[:])
+}
+
+// FinishChecksum adds data to the partial sum, typically the one of a pseudo-header, and returns the checksum
+func FinishChecksum(partial uint32, data []byte) uint16 {
+	return ^foldChecksum(checksumAdd(partial, data))
+}
+
+// UpdateChecksum returns the checksum of a message whose 16-bit field changed from oldField to newField, given its checksum
+// before the change, without summing the whole message again (RFC 1624 eqn. 3)
+func UpdateChecksum(checksum, oldField, newField uint16) uint16 {
+	sum := uint32(^checksum) + uint32(^oldField) + uint32(newField)
+	return ^foldChecksum(sum)
+}
+
+// checksumAdd adds data to the partial sum as a sequence of big endian 16-bit words, padding an odd last byte with zero.
+// The sum is folded often enough never to overflow
+func checksumAdd(sum uint32, data []byte) uint32 {
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		if sum >= 1<<31 {
+			sum = uint32(foldChecksum(sum))
+		}
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	return sum
+}
+
+// foldChecksum folds the carries of sum into its low 16 bits
+func foldChecksum(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
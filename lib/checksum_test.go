@@ -0,0 +1,122 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestChecksumRFC1071(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want uint16
+	}{
+		// RFC 1071 section 3: the words sum to 0xddf2
+		{"rfc 1071 example", []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, ^uint16(0xddf2)},
+		{"odd length pads with zero", []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6}, ^uint16(0xdcfb)}, // 0x0001+0xf203+0xf4f5+0xf600 folded
+		{"empty", nil, 0xffff},
+		{"carries fold back", []byte{0xff, 0xff, 0x00, 0x01}, 0xfffe},
+		// the usual IPv4 header checksum example, UDP from 192.168.0.1 to 192.168.0.199
+		{"ipv4 header", []byte{0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11, 0x00, 0x00, 0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7}, 0xb861},
+	}
+	for _, tt := range tests {
+		if got := Checksum(tt.data); got != tt.want {
+			t.Errorf("%s: Checksum = %#04x, want %#04x", tt.name, got, tt.want)
+		}
+	}
+
+	// a message carrying its checksum sums to zero
+	header := []byte{0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11, 0xb8, 0x61, 0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7}
+	if got := Checksum(header); got != 0 {
+		t.Errorf("Checksum of a header with its checksum = %#04x, want 0", got)
+	}
+}
+
+func TestChecksumLargeInput(t *testing.T) {
+	// enough 0xffff words to overflow an unfolded 32 bits sum
+	data := make([]byte, 1<<17*2+2)
+	for i := range data {
+		data[i] = 0xff
+	}
+	if got := Checksum(data); got != 0 {
+		t.Errorf("Checksum of %d bytes of 0xff = %#04x, want 0", len(data), got)
+	}
+}
+
+func TestPseudoHeaderChecksumMatchesGopacket(t *testing.T) {
+	src, dst := net.IPv4(192, 0, 2, 1), net.IPv4(198, 51, 100, 2)
+	b, err := BuildUDPPacket(&net.UDPAddr{IP: src, Port: 5353}, &net.UDPAddr{IP: dst, Port: 53}, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := binary.BigEndian.Uint16(b[6:8])
+	binary.BigEndian.PutUint16(b[6:8], 0)
+	if got := FinishChecksum(PseudoHeaderChecksumIPv4(src, dst, layers.IPProtocolUDP, len(b)), b); got != want {
+		t.Errorf("udp checksum = %#04x, gopacket computed %#04x", got, want)
+	}
+
+	src6, dst6 := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	ip6 := &layers.IPv6{SrcIP: src6, DstIP: dst6, NextHeader: layers.IPProtocolUDP}
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip6)
+	if b, err = serializeLayers(udp, gopacket.Payload("payload")); err != nil {
+		t.Fatal(err)
+	}
+	want = binary.BigEndian.Uint16(b[6:8])
+	binary.BigEndian.PutUint16(b[6:8], 0)
+	if got := FinishChecksum(PseudoHeaderChecksumIPv6(src6, dst6, layers.IPProtocolUDP, len(b)), b); got != want {
+		t.Errorf("udp over ipv6 checksum = %#04x, gopacket computed %#04x", got, want)
+	}
+}
+
+func TestUpdateChecksumRFC1624(t *testing.T) {
+	// RFC 1624 section 4: eqn. 3 gives 0x0000 where the eqn. 2 of RFC 1141 gives 0xffff
+	if got := UpdateChecksum(0xdd2f, 0x5555, 0x3285); got != 0x0000 {
+		t.Errorf("UpdateChecksum(0xdd2f, 0x5555, 0x3285) = %#04x, want 0x0000", got)
+	}
+
+	// decrementing the TTL of an IPv4 header, the update routers do
+	header := []byte{0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11, 0x00, 0x00, 0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7}
+	old := Checksum(header)
+	oldWord := binary.BigEndian.Uint16(header[8:10])
+	header[8]--
+	if got, want := UpdateChecksum(old, oldWord, binary.BigEndian.Uint16(header[8:10])), Checksum(header); got != want {
+		t.Errorf("checksum after the TTL decrement = %#04x, want %#04x", got, want)
+	}
+}
+
+// sameChecksum tells if a and b are the same one's complement number, 0x0000 and 0xffff being both zero
+func sameChecksum(a, b uint16) bool {
+	return a == b || (a == 0 || a == 0xffff) && (b == 0 || b == 0xffff)
+}
+
+// FuzzUpdateChecksum checks that the incremental update of the checksum of data, after changing the 16-bit word at
+// index to newField, matches its full recomputation
+func FuzzUpdateChecksum(f *testing.F) {
+	f.Add([]byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, uint16(1), uint16(0x1234))
+	f.Add([]byte{0x55, 0x55, 0x00, 0x00}, uint16(0), uint16(0x3285))
+	f.Add([]byte{0x00, 0x00, 0x00, 0x00}, uint16(0), uint16(0xffff))
+	f.Add([]byte{0xff, 0xff}, uint16(0), uint16(0x0000))
+	f.Fuzz(func(t *testing.T, data []byte, index, newField uint16) {
+		if len(data) < 2 {
+			return
+		}
+		offset := int(index) % (len(data) / 2) * 2
+		old := Checksum(data)
+		oldField := binary.BigEndian.Uint16(data[offset:])
+
+		changed := append([]byte(nil), data...)
+		binary.BigEndian.PutUint16(changed[offset:], newField)
+		got, want := UpdateChecksum(old, oldField, newField), Checksum(changed)
+		if !sameChecksum(got, want) {
+			t.Fatalf("word %d %#04x->%#04x: UpdateChecksum = %#04x, Checksum = %#04x", offset/2, oldField, newField, got, want)
+		}
+	})
+}
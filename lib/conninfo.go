@@ -0,0 +1,54 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// ConnInfo describes an open RawIPConn, as returned by RawSocketCore.Conns
+type ConnInfo struct {
+	Conn        *RawIPConn
+	Interface   string
+	Direction   string // "dial", "listen" or "multi"
+	Protocol    layers.IPProtocol
+	LocalIP     net.IP
+	RemoteIP    net.IP    // nil for listeners and multi conns
+	LastSend    time.Time // zero if the conn never wrote a packet
+	LastReceive time.Time // zero if the conn never received a packet
+	Stats       ConnStats
+}
+
+// Conns returns the conns registered with the sessions of the core, by interface then key, e.g. for a reaper deciding
+// which ones to close. It takes no conn lock.
+func (core *RawSocketCore) Conns() []ConnInfo {
+	var infos []ConnInfo
+	for _, ps := range core.sessions.all() {
+		for _, conn := range ps.conns.all() {
+			send, recv := conn.LastActivity()
+			infos = append(infos, ConnInfo{
+				Conn:        conn,
+				Interface:   ps.params.iface.Name,
+				Direction:   conn.direction(),
+				Protocol:    conn.config.Load().protocol,
+				LocalIP:     conn.config.Load().localIP,
+				RemoteIP:    conn.config.Load().remoteIP,
+				LastSend:    send,
+				LastReceive: recv,
+				Stats:       conn.Stats(),
+			})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Interface != infos[j].Interface {
+			return infos[i].Interface < infos[j].Interface
+		}
+		return infos[i].Conn.getKey() < infos[j].Conn.getKey()
+	})
+	return infos
+}
@@ -0,0 +1,65 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// defaultDuplicateWindow is the window of WithDuplicateSuppression when none is given
+const defaultDuplicateWindow = 50 * time.Millisecond
+
+// dupSlots is the number of packets a duplicateSuppressor remembers. Being a fixed size table, its memory is bounded
+// at any packet rate: at high rates packets evict each other before their window ends and repeats go through again.
+const dupSlots = 1024
+
+// duplicateSuppressor remembers the packets recently received by a conn to drop their exact repeats
+type duplicateSuppressor struct {
+	window time.Duration
+	seed   maphash.Seed
+
+	mu    sync.Mutex
+	slots [dupSlots]dupSlot
+}
+
+type dupSlot struct {
+	hash uint64
+	seen int64 // unix nanos, 0 for an empty slot
+}
+
+func newDuplicateSuppressor(window time.Duration) *duplicateSuppressor {
+	return &duplicateSuppressor{window: window, seed: maphash.MakeSeed()}
+}
+
+// duplicate records the packet and tells whether the same packet was already received within the window.
+// Packets are told apart by a hash of IP ID, fragment offset, length, checksum and addresses, so two distinct
+// packets colliding on it within the window drop the second one
+func (d *duplicateSuppressor) duplicate(ipv4 *layers.IPv4, now time.Time) bool {
+	var key [18]byte
+	binary.BigEndian.PutUint16(key[0:], ipv4.Id)
+	binary.BigEndian.PutUint16(key[2:], ipv4.FragOffset)
+	binary.BigEndian.PutUint16(key[4:], ipv4.Length)
+	binary.BigEndian.PutUint16(key[6:], ipv4.Checksum)
+	copy(key[8:12], ipv4.SrcIP.To4())
+	copy(key[12:16], ipv4.DstIP.To4())
+	key[16] = byte(ipv4.Protocol)
+	key[17] = byte(ipv4.Flags)
+	hash := maphash.Bytes(d.seed, key[:])
+
+	nanos := now.UnixNano()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	slot := &d.slots[hash%dupSlots]
+	if slot.seen != 0 && slot.hash == hash && nanos-slot.seen < int64(d.window) {
+		return true
+	}
+	slot.hash = hash
+	slot.seen = nanos
+	return false
+}
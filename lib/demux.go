@@ -0,0 +1,219 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/google/gopacket/layers"
+)
+
+// flowKey identifies the traffic a RawIPConn is interested in, seen from the local side.
+// remoteIP is the zero Addr for listeners and localIP is the zero Addr for listeners bound to every local address
+type flowKey struct {
+	protocol layers.IPProtocol
+	localIP  netip.Addr
+	remoteIP netip.Addr
+}
+
+func newFlowKey(protocol layers.IPProtocol, localIP, remoteIP net.IP) flowKey {
+	return flowKey{
+		protocol: protocol,
+		localIP:  toAddr(localIP),
+		remoteIP: toAddr(remoteIP),
+	}
+}
+
+func (k flowKey) String() string {
+	if !k.remoteIP.IsValid() {
+		return fmt.Sprintf("%s:%s", k.localIP, k.protocol)
+	}
+	return fmt.Sprintf("%s:%s:%s", k.localIP, k.remoteIP, k.protocol)
+}
+
+// toAddr converts a net.IP to a netip.Addr, unmapping IPv4-mapped IPv6 addresses. nil and unspecified IPs give the zero Addr
+func toAddr(ip net.IP) netip.Addr {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok || addr.IsUnspecified() {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// connTable is the demux index of the RawIPConns registered on a pcapSession.
+// Every lookup is a single map probe per tier so that dispatch cost does not grow with the number of conns.
+// Listeners created WithSharedListen share their flow key: the tiers map a key to the group of conns registered for it,
+// which only has several members for shared listeners.
+type connTable struct {
+	mu        sync.RWMutex
+	byKey     map[string][]*RawIPConn
+	connected map[flowKey][]*RawIPConn           // dialed conns, keyed by (protocol, localIP, remoteIP)
+	listeners map[flowKey][]*RawIPConn           // listeners, keyed by (protocol, localIP)
+	wildcard  map[layers.IPProtocol][]*RawIPConn // listeners bound to every local address, keyed by protocol
+}
+
+func newConnTable() *connTable {
+	return &connTable{
+		byKey:     make(map[string][]*RawIPConn),
+		connected: make(map[flowKey][]*RawIPConn),
+		listeners: make(map[flowKey][]*RawIPConn),
+		wildcard:  make(map[layers.IPProtocol][]*RawIPConn),
+	}
+}
+
+// register adds conn to the index. It fails with ErrAddressInUse if a conn with the same flow key is already registered,
+// ErrAlreadyListening for listeners, unless both are shared listeners. The check and the insertion are atomic, so of concurrent registrations of the same
+// key exactly one succeeds
+func (t *connTable) register(conn *RawIPConn) error {
+	key := conn.flowKey()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	group := t.byKey[conn.getKey()]
+	if len(group) > 0 && !(conn.config.Load().sharedListen && group[0].config.Load().sharedListen) {
+		if !key.remoteIP.IsValid() {
+			return fmt.Errorf("raw ip listener %s: %w", conn.getKey(), ErrAlreadyListening)
+		}
+		return fmt.Errorf("raw ip connection %s: %w", conn.getKey(), ErrAddressInUse)
+	}
+	// groups are replaced rather than appended to in place, so the slices handed out by lookup never change
+	group = append(group[:len(group):len(group)], conn)
+
+	switch {
+	case key.remoteIP.IsValid():
+		t.connected[key] = group
+	case key.localIP.IsValid():
+		t.listeners[key] = group
+	default:
+		t.wildcard[key.protocol] = group
+	}
+	t.byKey[conn.getKey()] = group
+
+	return nil
+}
+
+// deregister removes conn from the index, leaving the other members of its group registered.
+// It is a no-op if conn is not registered
+func (t *connTable) deregister(conn *RawIPConn) {
+	t.remove(conn, conn.flowKey(), conn.getKey())
+}
+
+// remove removes conn from the index, where it was registered under key and name. Migrate gives the ones the conn had
+// before leaving its session
+func (t *connTable) remove(conn *RawIPConn, key flowKey, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	old := t.byKey[name]
+	group := make([]*RawIPConn, 0, len(old))
+	for _, c := range old {
+		if c != conn {
+			group = append(group, c)
+		}
+	}
+	if len(group) == len(old) {
+		return
+	}
+
+	if len(group) == 0 {
+		delete(t.byKey, name)
+		switch {
+		case key.remoteIP.IsValid():
+			delete(t.connected, key)
+		case key.localIP.IsValid():
+			delete(t.listeners, key)
+		default:
+			delete(t.wildcard, key.protocol)
+		}
+		return
+	}
+
+	t.byKey[name] = group
+	switch {
+	case key.remoteIP.IsValid():
+		t.connected[key] = group
+	case key.localIP.IsValid():
+		t.listeners[key] = group
+	default:
+		t.wildcard[key.protocol] = group
+	}
+}
+
+// lookup finds the conn for a packet with the given protocol sent from remoteIP to localIP.
+// An exact dialed conn wins over a listener on localIP, which wins over a wildcard listener for the protocol.
+// Of a group of shared listeners, the first one is returned
+func (t *connTable) lookup(protocol layers.IPProtocol, localIP, remoteIP netip.Addr) *RawIPConn {
+	if group := t.lookupAll(protocol, localIP, remoteIP); len(group) > 0 {
+		return group[0]
+	}
+	return nil
+}
+
+// lookupAll is lookup returning every conn of the matching group, each of which gets its own copy of the packet.
+// The slice must not be modified
+func (t *connTable) lookupAll(protocol layers.IPProtocol, localIP, remoteIP netip.Addr) []*RawIPConn {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if group, ok := t.connected[flowKey{protocol: protocol, localIP: localIP, remoteIP: remoteIP}]; ok {
+		return group
+	}
+	if group, ok := t.listeners[flowKey{protocol: protocol, localIP: localIP}]; ok {
+		return group
+	}
+	if group, ok := t.wildcard[protocol]; ok {
+		return group
+	}
+	return nil
+}
+
+// lookupListeners returns the listeners on localIP, or else the wildcard listeners, ignoring connected conns
+func (t *connTable) lookupListeners(protocol layers.IPProtocol, localIP netip.Addr) []*RawIPConn {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if group, ok := t.listeners[flowKey{protocol: protocol, localIP: localIP}]; ok {
+		return group
+	}
+	return t.wildcard[protocol]
+}
+
+// lookupConnected finds the dialed conn from localIP to remoteIP for the protocol, ignoring listeners
+func (t *connTable) lookupConnected(protocol layers.IPProtocol, localIP, remoteIP netip.Addr) *RawIPConn {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if group := t.connected[flowKey{protocol: protocol, localIP: localIP, remoteIP: remoteIP}]; len(group) > 0 {
+		return group[0]
+	}
+	return nil
+}
+
+// all returns every registered conn
+func (t *connTable) all() []*RawIPConn {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	conns := make([]*RawIPConn, 0, len(t.byKey))
+	for _, group := range t.byKey {
+		conns = append(conns, group...)
+	}
+	return conns
+}
+
+// len returns the number of registered conns
+func (t *connTable) len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	n := 0
+	for _, group := range t.byKey {
+		n += len(group)
+	}
+	return n
+}
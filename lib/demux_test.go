@@ -0,0 +1,112 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// newTableConn returns a conn, never opened on a session, to register into a connTable
+func newTableConn(tb testing.TB, protocol layers.IPProtocol, localIP, remoteIP net.IP, shared bool) *RawIPConn {
+	tb.Helper()
+
+	key := newFlowKey(protocol, localIP, remoteIP)
+	conn, err := NewRawIPConn(&RawIPConnParams{isServer: remoteIP == nil, key: key.String()},
+		&RawIPConnConfig{protocol: protocol, localIP: localIP, remoteIP: remoteIP, sharedListen: shared})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return conn
+}
+
+// tableIP returns the i-th address of 10.0.0.0/8
+func tableIP(i int) net.IP {
+	return net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).To4()
+}
+
+// BenchmarkConnTableLookup measures the lookup of a packet matching each tier with n conns registered in that tier,
+// which must not depend on n. There is one wildcard key per protocol, so the wildcard conns are shared listeners of
+// the same one
+func BenchmarkConnTableLookup(b *testing.B) {
+	local := net.IPv4(192, 0, 2, 1).To4()
+	for _, tier := range []string{"exact", "listener", "wildcard"} {
+		for _, n := range []int{1, 100, 1000} {
+			b.Run(fmt.Sprintf("%s/conns=%d", tier, n), func(b *testing.B) {
+				table := newConnTable()
+				var localIP, remoteIP netip.Addr
+				for i := 0; i < n; i++ {
+					var conn *RawIPConn
+					switch tier {
+					case "exact":
+						conn = newTableConn(b, layers.IPProtocolUDP, local, tableIP(i), false)
+						localIP, remoteIP = toAddr(local), toAddr(tableIP(i))
+					case "listener":
+						conn = newTableConn(b, layers.IPProtocolUDP, tableIP(i), nil, false)
+						localIP, remoteIP = toAddr(tableIP(i)), toAddr(local)
+					default:
+						conn = newTableConn(b, layers.IPProtocolUDP, nil, nil, true)
+						localIP, remoteIP = toAddr(local), toAddr(tableIP(i))
+					}
+					if err := table.register(conn); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if len(table.lookupAll(layers.IPProtocolUDP, localIP, remoteIP)) == 0 {
+					b.Fatalf("no conn found for %v->%v", remoteIP, localIP)
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					table.lookupAll(layers.IPProtocolUDP, localIP, remoteIP)
+				}
+			})
+		}
+	}
+}
+
+func TestConnTableTiers(t *testing.T) {
+	local := net.IPv4(192, 0, 2, 1).To4()
+	peer := net.IPv4(192, 0, 2, 9).To4()
+	table := newConnTable()
+	wildcard := newTableConn(t, layers.IPProtocolUDP, nil, nil, false)
+	listener := newTableConn(t, layers.IPProtocolUDP, local, nil, false)
+	dialed := newTableConn(t, layers.IPProtocolUDP, local, peer, false)
+	for _, conn := range []*RawIPConn{wildcard, listener, dialed} {
+		if err := table.register(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		local, peer net.IP
+		want        *RawIPConn
+	}{
+		{"exact match wins", local, peer, dialed},
+		{"listener of the local address", local, net.IPv4(192, 0, 2, 10), listener},
+		{"wildcard for other local addresses", net.IPv4(192, 0, 2, 2), peer, wildcard},
+	}
+	for _, tt := range tests {
+		if got := table.lookup(layers.IPProtocolUDP, toAddr(tt.local), toAddr(tt.peer)); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if got := table.lookup(layers.IPProtocolTCP, toAddr(local), toAddr(peer)); got != nil {
+		t.Errorf("lookup of another protocol: got %v, want nil", got)
+	}
+
+	table.deregister(dialed)
+	if got := table.lookup(layers.IPProtocolUDP, toAddr(local), toAddr(peer)); got != listener {
+		t.Errorf("after deregister: got %v, want the listener", got)
+	}
+	if n := table.len(); n != 2 {
+		t.Errorf("len = %d, want 2", n)
+	}
+}
@@ -0,0 +1,178 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// defaultFallbackDelay is the head start of the IPv6 dials of DialHost unless configured otherwise with WithFallbackDelay,
+// the one of net.Dialer
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// LookupIPFunc resolves host into its addresses of the given network, "ip4", "ip6" or "ip", like net.Resolver.LookupIP
+type LookupIPFunc func(ctx context.Context, network, host string) ([]net.IP, error)
+
+// DialHost resolves host, then dials its addresses with DialIP in turn until one succeeds. Unless given WithResolver,
+// it looks up the A records of host with net.DefaultResolver. A literal IP address is dialed as is, the zone of a
+// literal IPv6 one, e.g. "fe80::1%eth0", picking its interface like WithInterface. When a host has addresses of both
+// families, the IPv6 and IPv4 dials race, see WithFallbackDelay: an IPv6 dial fails right away when no interface has
+// a route and an IPv6 address for it, so that the IPv4 ones start at once. Given srcIP, only the addresses of its
+// family are dialed, and DialHost fails with ErrAddressFamilyMismatch if host has none.
+func (core *RawSocketCore) DialHost(protocol layers.IPProtocol, srcIP net.IP, host string, opts ...ConnOption) (*RawIPConn, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if zone := addr.Zone(); zone != "" {
+			opts = append(opts[:len(opts):len(opts)], WithInterface(zoneInterface(zone)))
+		}
+		return core.DialIP(protocol, srcIP, net.IP(addr.WithZone("").AsSlice()), opts...)
+	}
+
+	config := core.newConnConfig(protocol, opts)
+	lookup, network := config.lookupIP, config.lookupNetwork
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupIP
+	}
+	if network == "" {
+		network = "ip4"
+	}
+
+	ips, err := lookup(context.Background(), network, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("failed to resolve %s: no %s address", host, network)
+	}
+
+	primaries, fallbacks := splitFamilies(srcIP, ips)
+	if len(primaries) == 0 && len(fallbacks) == 0 {
+		return nil, fmt.Errorf("failed to dial %s: no address of the family of srcIP %v: %w", host, srcIP, ErrAddressFamilyMismatch)
+	}
+	dial := func(ips []net.IP) (*RawIPConn, error) {
+		return core.dialSerial(protocol, srcIP, ips, opts)
+	}
+
+	var conn *RawIPConn
+	switch {
+	case len(primaries) == 0 || len(fallbacks) == 0:
+		conn, err = dial(append(primaries, fallbacks...))
+	case config.fallbackDelay < 0:
+		if conn, err = dial(fallbacks); err != nil {
+			conn, err = dial(primaries)
+		}
+	default:
+		delay := config.fallbackDelay
+		if delay == 0 {
+			delay = defaultFallbackDelay
+		}
+		conn, err = dialParallel(primaries, fallbacks, delay, dial)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %w", host, err)
+	}
+	return conn, nil
+}
+
+// zoneInterface returns the name of the interface zone names, a numeric zone being the index of the interface
+func zoneInterface(zone string) string {
+	if index, err := strconv.Atoi(zone); err == nil {
+		if iface, err := net.InterfaceByIndex(index); err == nil {
+			return iface.Name
+		}
+	}
+	return zone
+}
+
+// splitFamilies splits ips into their IPv6 addresses, the primaries, and their IPv4 ones, the fallbacks. Given srcIP,
+// the addresses of the other family are dropped, since a dial from srcIP to them fails
+func splitFamilies(srcIP net.IP, ips []net.IP) (primaries, fallbacks []net.IP) {
+	for _, ip := range ips {
+		switch ipv4 := ip.To4() != nil; {
+		case srcIP != nil && ipv4 != (srcIP.To4() != nil):
+		case ipv4:
+			fallbacks = append(fallbacks, ip)
+		default:
+			primaries = append(primaries, ip)
+		}
+	}
+	return primaries, fallbacks
+}
+
+// dialSerial dials ips in turn until one succeeds
+func (core *RawSocketCore) dialSerial(protocol layers.IPProtocol, srcIP net.IP, ips []net.IP, opts []ConnOption) (*RawIPConn, error) {
+	var errs []error
+	for _, ip := range ips {
+		conn, err := core.DialIP(protocol, srcIP, ip, opts...)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Errorf("%v: %w", ip, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dialParallel races the dials of primaries and fallbacks like RFC 8305 Happy Eyeballs: the fallbacks start once the
+// primaries failed or delay passed, whichever comes first. The first conn dialed wins, the other one is closed as soon
+// as its dial returns, since a dial cannot be interrupted
+func dialParallel(primaries, fallbacks []net.IP, delay time.Duration, dial func([]net.IP) (*RawIPConn, error)) (*RawIPConn, error) {
+	type result struct {
+		conn    *RawIPConn
+		err     error
+		primary bool
+	}
+	results := make(chan result, 2) // buffered so that the loser never blocks
+	race := func(ips []net.IP, primary bool) {
+		conn, err := dial(ips)
+		results <- result{conn, err, primary}
+	}
+
+	go race(primaries, true)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var (
+		errs            []error
+		fallbackStarted bool
+		pending         = 1
+	)
+	startFallback := func() {
+		if !fallbackStarted {
+			fallbackStarted = true
+			pending++
+			go race(fallbacks, false)
+		}
+	}
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			startFallback()
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					// close the loser once its dial returns
+					go func() {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			errs = append(errs, res.err)
+			if res.primary {
+				startFallback()
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
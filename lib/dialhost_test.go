@@ -0,0 +1,98 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestSplitFamilies(t *testing.T) {
+	v6, v4 := net.ParseIP("2001:db8::1"), net.IPv4(192, 0, 2, 1)
+	ips := []net.IP{v6, v4, net.ParseIP("2001:db8::2"), net.IPv4(192, 0, 2, 2).To4()}
+	tests := []struct {
+		name                 string
+		srcIP                net.IP
+		primaries, fallbacks int
+	}{
+		{"no srcIP", nil, 2, 2},
+		{"IPv4 srcIP", net.IPv4(192, 0, 2, 9), 0, 2},
+		{"mapped IPv4 srcIP", net.ParseIP("::ffff:192.0.2.9"), 0, 2},
+		{"IPv6 srcIP", net.ParseIP("2001:db8::9"), 2, 0},
+	}
+	for _, tt := range tests {
+		primaries, fallbacks := splitFamilies(tt.srcIP, ips)
+		if len(primaries) != tt.primaries || len(fallbacks) != tt.fallbacks {
+			t.Errorf("%s: %v and %v, want %d IPv6 and %d IPv4 addresses", tt.name, primaries, fallbacks, tt.primaries, tt.fallbacks)
+		}
+	}
+}
+
+func TestDialHostCandidates(t *testing.T) {
+	core := NewRawSocketCore(60, 1, WithHandleFactory(NewMemoryTransport().A()))
+	defer core.Close()
+
+	onlyIPv6 := func(ctx context.Context, network, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("2001:db8::1")}, nil
+	}
+	_, err := core.DialHost(layers.IPProtocolUDP, net.IPv4(192, 0, 2, 1), "v6only.example", WithResolver(onlyIPv6, "ip"))
+	if !errors.Is(err, ErrAddressFamilyMismatch) {
+		t.Errorf("dial from IPv4 to a host with IPv6 addresses only: %v, want ErrAddressFamilyMismatch", err)
+	}
+
+	// the zone of a literal picks the interface
+	if _, err := core.DialHost(layers.IPProtocolUDP, nil, "fe80::1%no-such-iface0"); !errors.Is(err, ErrInterfaceNotFound) {
+		t.Errorf("dial to a link-local literal zoned on a missing interface: %v, want ErrInterfaceNotFound", err)
+	}
+	if _, err := core.DialHost(layers.IPProtocolUDP, nil, "fe80::dead:beef"); !errors.Is(err, ErrZoneRequired) {
+		t.Errorf("dial to a link-local literal without a zone: %v, want ErrZoneRequired", err)
+	}
+}
+
+// TestDialParallelFallback checks that the fallbacks start as soon as the primaries fail rather than after the delay,
+// and that they start after the delay while the primaries hang
+func TestDialParallelFallback(t *testing.T) {
+	v6, v4 := []net.IP{net.ParseIP("2001:db8::1")}, []net.IP{net.IPv4(192, 0, 2, 1)}
+	conn := &RawIPConn{}
+
+	start := time.Now()
+	got, err := dialParallel(v6, v4, time.Hour, func(ips []net.IP) (*RawIPConn, error) {
+		if ips[0].To4() == nil {
+			return nil, fmt.Errorf("%v: %w", ips[0], ErrNoRouteToHost)
+		}
+		return conn, nil
+	})
+	if err != nil || got != conn {
+		t.Fatalf("IPv4 dial after a failed IPv6 one: %v, %v", got, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("IPv4 dial started %v after the IPv6 one failed", elapsed)
+	}
+
+	hang := make(chan struct{})
+	defer close(hang)
+	got, err = dialParallel(v6, v4, 10*time.Millisecond, func(ips []net.IP) (*RawIPConn, error) {
+		if ips[0].To4() == nil {
+			<-hang
+			return nil, ErrNoRouteToHost
+		}
+		return conn, nil
+	})
+	if err != nil || got != conn {
+		t.Errorf("IPv4 dial while the IPv6 one hangs: %v, %v", got, err)
+	}
+
+	_, err = dialParallel(v6, v4, time.Hour, func(ips []net.IP) (*RawIPConn, error) {
+		return nil, ErrNoRouteToHost
+	})
+	if !errors.Is(err, ErrNoRouteToHost) {
+		t.Errorf("both dials failing: %v, want their errors", err)
+	}
+}
@@ -0,0 +1,206 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Inbound packets are decoded and dispatched by a small pool of workers per pcapSession, so that a conn
+// which blocks its worker (e.g. a full receive queue) only delays the conns sharing that worker.
+// Frames are assigned to workers by a hash of their IP addresses and protocol which does not depend on direction,
+// so the packets of one flow, i.e. one address pair, are handled in capture order by one worker. For a dialed conn
+// that is all its packets, including locally originated TCP handshake packets. Listeners and wildcard listeners get
+// packets from many peers, whose flows hash to different workers: only the packets of each peer keep their order.
+
+// defaultDispatchWorkers is the number of dispatch workers of a pcapSession unless configured otherwise
+const defaultDispatchWorkers = 4
+
+// dispatchQueueLen is the number of captured frames that can wait for each dispatch worker
+const dispatchQueueLen = 256
+
+// Most captured frames are of no interest to any conn, so a dispatch worker first decodes only the link and IP
+// headers into reused layers, without allocating. Only the frames some conn wants are copied out of the pooled
+// capture buffer and fully decoded into a gopacket.Packet. That copy and the allocations of the full decode remain
+// for every packet delivered, since the packet waits in the receive queue of its conn long after the capture buffer
+// went back to the pool; BenchmarkDispatchFrame measures them. Avoiding them would take queues of pooled buffers the
+// readers hand back.
+
+// capturedFrame is a raw frame read from the pcap handle, held in a buffer of framePool
+type capturedFrame struct {
+	buf *[]byte
+	ci  gopacket.CaptureInfo
+}
+
+// frameBufferLen is the initial capacity of the frame buffers, enough for an Ethernet frame. Jumbo frames grow them
+const frameBufferLen = 1536
+
+// framePool recycles the buffers captured frames are copied into until their dispatch worker is done with them
+var framePool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, frameBufferLen)
+		return &buf
+	},
+}
+
+// newCapturedFrame copies data, which pcap reuses for the next frame, into a pooled buffer
+func newCapturedFrame(data []byte, ci gopacket.CaptureInfo) capturedFrame {
+	buf := framePool.Get().(*[]byte)
+	*buf = append((*buf)[:0], data...)
+	return capturedFrame{buf: buf, ci: ci}
+}
+
+// headerParser decodes the link and IP headers of captured frames into layers reused from frame to frame
+type headerParser struct {
+	parser  *gopacket.DecodingLayerParser
+	eth     layers.Ethernet
+	lo      layers.Loopback
+	dot1q   layers.Dot1Q
+	ipv4    layers.IPv4
+	ipv6    layers.IPv6
+	arp     checkedARP
+	decoded []gopacket.LayerType
+}
+
+func newHeaderParser(linkType gopacket.LayerType) *headerParser {
+	p := &headerParser{decoded: make([]gopacket.LayerType, 0, 4)}
+	p.parser = gopacket.NewDecodingLayerParser(linkType, &p.eth, &p.lo, &p.dot1q, &p.ipv4, &p.ipv6, &p.arp)
+	p.parser.IgnoreUnsupported = true // the parser stops at the IP payload
+	return p
+}
+
+// parse decodes the headers of data and returns its IPv4 header, nil if it has none. The header is only valid
+// until the next call. A frame truncated or corrupt before the end of its IPv4 header gives an error
+func (p *headerParser) parse(data []byte) (*layers.IPv4, error) {
+	err := p.parser.DecodeLayers(data, &p.decoded)
+	for _, layerType := range p.decoded {
+		if layerType == layers.LayerTypeIPv4 {
+			return &p.ipv4, nil
+		}
+	}
+	return nil, err
+}
+
+// decodedARP returns the ARP layer of the last frame parsed, nil if it is no ARP frame
+func (p *headerParser) decodedARP() *layers.ARP {
+	for _, layerType := range p.decoded {
+		if layerType == layers.LayerTypeARP {
+			return &p.arp.ARP
+		}
+	}
+	return nil
+}
+
+// decodedLLDP returns the Ethernet layer of the last frame parsed if it carries an LLDPDU, nil otherwise
+func (p *headerParser) decodedLLDP() *layers.Ethernet {
+	if len(p.decoded) == 1 && p.decoded[0] == layers.LayerTypeEthernet && p.eth.EthernetType == layers.EthernetTypeLinkLayerDiscovery {
+		return &p.eth
+	}
+	return nil
+}
+
+// decodedIPv6 returns the IPv6 header of the last frame parsed, nil if it carries no IPv6 packet
+func (p *headerParser) decodedIPv6() *layers.IPv6 {
+	for _, layerType := range p.decoded {
+		if layerType == layers.LayerTypeIPv6 {
+			return &p.ipv6
+		}
+	}
+	return nil
+}
+
+// untaggedEthernet tells if the last frame parsed is an Ethernet frame without 802.1Q tag, whose payload is then the
+// one of p.eth
+func (p *headerParser) untaggedEthernet() bool {
+	return len(p.decoded) > 1 && p.decoded[0] == layers.LayerTypeEthernet && p.decoded[1] != layers.LayerTypeDot1Q
+}
+
+// checkedARP is an ARP layer refusing the address sizes which overflow the 8 bit arithmetic layers.ARP computes
+// its length and address offsets with, making it slice out of range
+type checkedARP struct {
+	layers.ARP
+}
+
+func (arp *checkedARP) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) >= 6 {
+		if length := 8 + 2*int(data[4]) + 2*int(data[5]); length > 0xff {
+			return fmt.Errorf("ARP address sizes %d and %d too large", data[4], data[5])
+		}
+	}
+	return arp.ARP.DecodeFromBytes(data, df)
+}
+
+// checkIPv4 validates the fields of an IPv4 header decoded by headerParser against the bytes captured.
+// gopacket accepts a total length beyond them as a truncated packet, which only the snaplen explains: a packet
+// missing more bytes than the capture cut from its frame is corrupt
+func checkIPv4(ipv4 *layers.IPv4, ci gopacket.CaptureInfo) error {
+	if ipv4.Version != 4 {
+		return fmt.Errorf("ipv4 header: version %d", ipv4.Version)
+	}
+	captured := len(ipv4.Contents) + len(ipv4.Payload)
+	if ipv4.IHL < 5 || int(ipv4.IHL)*4 > captured || int(ipv4.IHL)*4 > int(ipv4.Length) {
+		return fmt.Errorf("ipv4 header: header length %d invalid for %d bytes captured and total length %d",
+			int(ipv4.IHL)*4, captured, ipv4.Length)
+	}
+	if missing := int(ipv4.Length) - captured; missing > 0 && missing > ci.Length-ci.CaptureLength {
+		return fmt.Errorf("ipv4 header: total length %d exceeds the %d bytes captured", ipv4.Length, captured)
+	}
+	return nil
+}
+
+// wants tells if some conn of the session, or the session itself, is interested in an IPv4 packet
+func (ps *pcapSession) wants(ipv4 *layers.IPv4) bool {
+	if ipv4.Protocol == layers.IPProtocolICMPv4 {
+		return true // echo requests and ICMP errors may concern the session without a conn listening for ICMP
+	}
+	srcIP, dstIP := toAddr(ipv4.SrcIP), toAddr(ipv4.DstIP)
+	if ps.conns.lookup(ipv4.Protocol, dstIP, srcIP) != nil {
+		return true
+	}
+	// locally originated TCP handshake packets go to the conn sending them
+	return ipv4.Protocol == layers.IPProtocolTCP && ps.conns.lookup(ipv4.Protocol, srcIP, dstIP) != nil
+}
+
+// flowHash returns a direction independent hash of the IP protocol and addresses of a frame, looking past a
+// single 802.1Q tag. Frames which carry neither IPv4 nor IPv6 hash to 0. IPv6 packets hash by the next header of
+// their fixed header, which is the protocol unless extension headers follow
+func flowHash(data []byte, linkHeaderLen int) uint32 {
+	isIP := func(etherType uint16) bool { return etherType == 0x0800 || etherType == 0x86dd }
+	if linkHeaderLen == 14 && len(data) >= 18 && binary.BigEndian.Uint16(data[12:14]) == 0x8100 {
+		// tagged frames are dispatched like untagged ones, the tag only moves the IP header
+		if !isIP(binary.BigEndian.Uint16(data[16:18])) {
+			return 0
+		}
+		linkHeaderLen = 18
+	} else if linkHeaderLen == 14 && (len(data) < 14 || !isIP(binary.BigEndian.Uint16(data[12:14]))) {
+		return 0
+	}
+	ip := data[min(linkHeaderLen, len(data)):]
+
+	var src, dst, protocol uint32
+	switch {
+	case len(ip) >= 20 && ip[0]>>4 == 4:
+		src, dst, protocol = binary.BigEndian.Uint32(ip[12:16]), binary.BigEndian.Uint32(ip[16:20]), uint32(ip[9])
+	case len(ip) >= ipv6HeaderLen && ip[0]>>4 == 6:
+		// fold the addresses into 32 bits
+		for i := 8; i < 24; i += 4 {
+			src ^= binary.BigEndian.Uint32(ip[i : i+4])
+			dst ^= binary.BigEndian.Uint32(ip[i+16 : i+20])
+		}
+		protocol = uint32(ip[6])
+	default:
+		return 0
+	}
+	h := (src ^ dst) ^ (src + dst) ^ protocol
+	// mix the bits so that adjacent addresses spread across workers
+	h ^= h >> 16
+	h *= 0x45d9f3b
+	h ^= h >> 16
+	return h
+}
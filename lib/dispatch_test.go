@@ -0,0 +1,320 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// testFrame returns the start of an untagged Ethernet frame carrying an IPv4 packet of the protocol from src to dst,
+// enough for flowHash
+func testFrame(src, dst net.IP, protocol layers.IPProtocol) []byte {
+	frame := make([]byte, 14+20)
+	binary.BigEndian.PutUint16(frame[12:], uint16(layers.EthernetTypeIPv4))
+	frame[14] = 0x45
+	frame[14+9] = byte(protocol)
+	copy(frame[14+12:], src.To4())
+	copy(frame[14+16:], dst.To4())
+	return frame
+}
+
+func TestFlowHashDirectionIndependent(t *testing.T) {
+	a, b := net.IPv4(192, 0, 2, 1), net.IPv4(198, 51, 100, 7)
+	if flowHash(testFrame(a, b, layers.IPProtocolUDP), 14) != flowHash(testFrame(b, a, layers.IPProtocolUDP), 14) {
+		t.Error("both directions of a flow hash differently")
+	}
+
+	tagged := append([]byte(nil), testFrame(a, b, layers.IPProtocolUDP)[:12]...)
+	tagged = append(tagged, 0x81, 0x00, 0x00, 0x05)
+	tagged = append(tagged, testFrame(a, b, layers.IPProtocolUDP)[12:]...)
+	if flowHash(tagged, 14) != flowHash(testFrame(a, b, layers.IPProtocolUDP), 14) {
+		t.Error("a tagged frame hashes differently from the untagged one")
+	}
+	if h := flowHash([]byte{0, 1, 2}, 14); h != 0 {
+		t.Errorf("runt frame hashes to %d, want 0", h)
+	}
+}
+
+// TestDispatchBlockedConnIsolation checks that a conn blocking its dispatch worker, with a full receive queue and
+// nobody reading, does not hold up the conns whose flows are dispatched by another worker
+func TestDispatchBlockedConnIsolation(t *testing.T) {
+	const workers = 4
+	p := newMemPair(t, WithDispatchWorkers(workers))
+
+	blockedIP := net.IPv4(198, 51, 100, 10).To4()
+	worker := func(ip net.IP) uint32 {
+		return flowHash(testFrame(testClientIP, ip, layers.IPProtocolUDP), 14) % workers
+	}
+	var freeIP net.IP
+	for i := 11; i < 255 && freeIP == nil; i++ {
+		if ip := net.IPv4(198, 51, 100, byte(i)).To4(); worker(ip) != worker(blockedIP) {
+			freeIP = ip
+		}
+	}
+	if freeIP == nil {
+		t.Fatal("no address dispatched by another worker")
+	}
+
+	blocked := p.listen(t, blockedIP, layers.IPProtocolUDP, WithReadBuffer(1))
+	free := p.listen(t, freeIP, layers.IPProtocolUDP)
+	toBlocked := p.dialTo(t, layers.IPProtocolUDP, blockedIP)
+	toFree := p.dialTo(t, layers.IPProtocolUDP, freeIP)
+
+	// the first packet fills the queue of the blocked listener, the next ones hold up its worker
+	for i := 0; i < 3; i++ {
+		if _, err := toBlocked.Write([]byte("stuck")); err != nil {
+			t.Fatalf("write to the blocked listener: %v", err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for blocked.Stats().Queued < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if blocked.Stats().Queued != 1 {
+		t.Fatalf("blocked listener queued %d packets, want 1", blocked.Stats().Queued)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := toFree.Write([]byte("flowing")); err != nil {
+			t.Fatalf("write to the free listener: %v", err)
+		}
+		if got := readTimeout(t, free, time.Second); !bytes.Equal(got, []byte("flowing")) {
+			t.Fatalf("free listener read %q, want %q", got, "flowing")
+		}
+	}
+
+	// the blocked worker resumes as soon as its conn reads
+	for i := 0; i < 3; i++ {
+		if got := readTimeout(t, blocked, time.Second); !bytes.Equal(got, []byte("stuck")) {
+			t.Fatalf("blocked listener read %q, want %q", got, "stuck")
+		}
+	}
+}
+
+// udpFrame returns a whole Ethernet frame carrying a UDP packet of payloadLen bytes from the client to the server
+func udpFrame(tb testing.TB, payloadLen int) []byte {
+	tb.Helper()
+
+	eth := &layers.Ethernet{SrcMAC: memoryMACs[0], DstMAC: memoryMACs[1], EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: testClientIP, DstIP: testServerIP}
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	frame, err := serializeLayers(eth, ip, udp, gopacket.Payload(make([]byte, payloadLen)))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return frame
+}
+
+func TestCapturePathDoesNotAllocate(t *testing.T) {
+	frame := udpFrame(t, 1400)
+	parser := newHeaderParser(layers.LayerTypeEthernet)
+	captured := newCapturedFrame(frame, gopacket.CaptureInfo{})
+	framePool.Put(captured.buf)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		captured := newCapturedFrame(frame, gopacket.CaptureInfo{CaptureLength: len(frame), Length: len(frame)})
+		if ip, err := parser.parse(*captured.buf); ip == nil || err != nil {
+			t.Fatalf("parse: %v, %v", ip, err)
+		}
+		framePool.Put(captured.buf)
+	})
+	if allocs != 0 {
+		t.Errorf("copying and parsing a captured frame allocates %v times, want 0", allocs)
+	}
+}
+
+// BenchmarkCapturePath measures what a captured frame costs before it is known to be wanted: its copy into a
+// pooled buffer and the decoding of its headers. Run it with -benchmem
+func BenchmarkCapturePath(b *testing.B) {
+	for _, size := range []int{64, 1400} {
+		b.Run(fmt.Sprintf("payload=%d", size), func(b *testing.B) {
+			frame := udpFrame(b, size)
+			parser := newHeaderParser(layers.LayerTypeEthernet)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(frame)))
+			for i := 0; i < b.N; i++ {
+				captured := newCapturedFrame(frame, gopacket.CaptureInfo{CaptureLength: len(frame), Length: len(frame)})
+				if _, err := parser.parse(*captured.buf); err != nil {
+					b.Fatal(err)
+				}
+				framePool.Put(captured.buf)
+			}
+		})
+	}
+}
+
+// BenchmarkDispatchFrame runs dispatchFrame on frames a listener reads, each of them copied and fully decoded, and
+// on frames no conn wants, which stop at the header parser
+func BenchmarkDispatchFrame(b *testing.B) {
+	for _, delivering := range []bool{true, false} {
+		for _, size := range []int{64, 1400} {
+			b.Run(fmt.Sprintf("delivering=%v/payload=%d", delivering, size), func(b *testing.B) {
+				p := newMemPair(b)
+				var listener *RawIPConn
+				if delivering {
+					listener = p.listen(b, testServerIP, layers.IPProtocolUDP)
+				}
+				frame := udpFrame(b, size)
+				parser := newHeaderParser(layers.LayerTypeEthernet)
+				buf := make([]byte, 2048)
+				b.ReportAllocs()
+				b.SetBytes(int64(len(frame)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					captured := newCapturedFrame(frame, gopacket.CaptureInfo{CaptureLength: len(frame), Length: len(frame)})
+					p.ss.dispatchFrame(parser, captured)
+					framePool.Put(captured.buf)
+					if listener != nil {
+						if _, err := listener.Read(buf); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// recoverWatch is a log output remembering whether dispatchFrame recovered from a panic
+type recoverWatch struct {
+	mu        sync.Mutex
+	recovered []string
+}
+
+func (w *recoverWatch) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("recovered from malformed packet")) {
+		w.mu.Lock()
+		w.recovered = append(w.recovered, string(p))
+		w.mu.Unlock()
+	}
+	return len(p), nil
+}
+
+func (w *recoverWatch) take() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	recovered := w.recovered
+	w.recovered = nil
+	return recovered
+}
+
+// fuzzSession opens a session of core on iface with listeners wanting whatever packets reach them, drained so that
+// dispatching never blocks on a full receive queue
+func fuzzSession(tb testing.TB, core *RawSocketCore, iface *net.Interface) *pcapSession {
+	tb.Helper()
+
+	ps, err := core.acquireSession(iface)
+	if err != nil {
+		tb.Fatalf("session on %s: %v", iface.Name, err)
+	}
+	tb.Cleanup(ps.release)
+	listeners := []struct {
+		ip       net.IP
+		protocol layers.IPProtocol
+	}{
+		{nil, layers.IPProtocolUDP},
+		{nil, layers.IPProtocolTCP},
+		{nil, layers.IPProtocolICMPv4},
+		{testServerIPv6, layers.IPProtocolUDP},
+	}
+	for _, l := range listeners {
+		config := core.newConnConfig(l.protocol, nil)
+		config.localIP = l.ip
+		conn, err := ps.listenIP(config)
+		if err != nil {
+			tb.Fatalf("listen on %s: %v", iface.Name, err)
+		}
+		tb.Cleanup(func() { conn.Close() })
+		go func() {
+			buf := make([]byte, 1<<16)
+			for {
+				if _, err := conn.Read(buf); errors.Is(err, ErrClosed) {
+					return
+				}
+			}
+		}()
+	}
+	return ps
+}
+
+// FuzzDispatchFrame feeds arbitrary frames, Ethernet or Loopback ones, to the header decoder and to dispatchFrame.
+// Neither may panic, dispatchFrame recovering from it included, and an IPv4 header checkIPv4 accepts must lie within
+// the bytes captured. missing is the number of bytes the capture pretends to have cut from the frame. The seeds in
+// testdata/fuzz/FuzzDispatchFrame hold runts, bad header lengths, truncated ARP and IPv6 extension header chains
+func FuzzDispatchFrame(f *testing.F) {
+	watch := &recoverWatch{}
+	log.SetOutput(watch)
+	f.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	core := NewRawSocketCore(60, 1, WithHandleFactory(NewMemoryTransport().A()))
+	f.Cleanup(core.Close)
+	lo := &net.Interface{Index: 998, MTU: 16384, Name: "memlo0", Flags: net.FlagUp | net.FlagLoopback}
+	sessions := map[bool]*pcapSession{false: fuzzSession(f, core, testIface()), true: fuzzSession(f, core, lo)}
+
+	f.Fuzz(func(t *testing.T, loopback bool, data []byte, missing uint16) {
+		ps := sessions[loopback]
+		ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data) + int(missing)}
+
+		parser := newHeaderParser(ps.linkType())
+		if ipv4, _ := parser.parse(data); ipv4 != nil {
+			if err := checkIPv4(ipv4, ci); err == nil {
+				if headerLen := int(ipv4.IHL) * 4; headerLen > len(ipv4.Contents)+len(ipv4.Payload) || headerLen > int(ipv4.Length) {
+					t.Errorf("checkIPv4 accepted a header of %d bytes, %d captured, total length %d",
+						headerLen, len(ipv4.Contents)+len(ipv4.Payload), ipv4.Length)
+				}
+			}
+		} else if ipv6 := parser.decodedIPv6(); ipv6 != nil {
+			ipv6UpperLayer(ipv6Payload(ipv6))
+		} else {
+			parser.decodedARP()
+			parser.decodedLLDP()
+		}
+
+		ps.dispatchFrame(parser, newCapturedFrame(data, ci))
+		if recovered := watch.take(); len(recovered) > 0 {
+			t.Errorf("dispatchFrame recovered from a panic: %s", recovered[0])
+		}
+	})
+}
+
+// TestReadWorkersKeepFlowOrder sends one flow through sessions with several read workers and checks that its packets
+// are read in the order they were captured
+func TestReadWorkersKeepFlowOrder(t *testing.T) {
+	for _, workers := range []int{1, 4, 16} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			p := newMemPair(t, WithReadWorkers(workers))
+			if got := p.ss.config.dispatchWorkers; got != workers {
+				t.Fatalf("%d dispatch workers, want %d", got, workers)
+			}
+			const packets = 200
+			listener := p.listen(t, testServerIP, layers.IPProtocolUDP, WithReadBuffer(packets))
+			conn := p.dial(t, layers.IPProtocolUDP)
+
+			for i := 0; i < packets; i++ {
+				if _, err := conn.Write(binary.BigEndian.AppendUint32(nil, uint32(i))); err != nil {
+					t.Fatalf("write %d: %v", i, err)
+				}
+			}
+			for i := 0; i < packets; i++ {
+				got := readTimeout(t, listener, time.Second)
+				if n := binary.BigEndian.Uint32(got); n != uint32(i) {
+					t.Fatalf("read packet %d at position %d", n, i)
+				}
+			}
+		})
+	}
+}
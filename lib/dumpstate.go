@@ -0,0 +1,175 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StateDump is a diagnostic snapshot of a RawSocketCore, as written by DumpState and DumpStateJSON
+type StateDump struct {
+	Time       time.Time
+	Closed     bool
+	Goroutines int // of the whole process
+	Sessions   []SessionDump
+	ARPCache   []ARPEntryDump
+}
+
+// SessionDump describes one pcapSession
+type SessionDump struct {
+	Interface string
+	LinkType  string
+	Filters   []string // BPF filter of each capture handle, "" if none
+	Closed    bool
+	Pending   int32 // dials and listens in progress, which keep the session from being reaped
+	Stats     SessionStats
+	Conns     []ConnDump
+}
+
+// ConnDump describes one RawIPConn
+type ConnDump struct {
+	Key            string
+	Direction      string // "dial", "listen" or "multi"
+	Queued         int    // inbound packets waiting for Read
+	SendQueued     int    // outbound packets waiting in the send queue
+	BudgetDropped  uint64
+	InboundDropped uint64
+	ReadDeadline   time.Time
+	WriteDeadline  time.Time
+	LastActive     time.Time
+	Closed         bool
+}
+
+// ARPEntryDump is one entry of the ARP cache
+type ARPEntryDump struct {
+	IP     string
+	MAC    string
+	Expiry time.Time
+}
+
+// DumpState writes a human readable snapshot of the sessions, conns and ARP cache of the core to w.
+// It may be called at any time, also while the core is busy or being closed.
+func (core *RawSocketCore) DumpState(w io.Writer) error {
+	dump := core.stateDump()
+
+	// build the text first so that a slow writer does not stretch the time between the snapshot and its output
+	var b strings.Builder
+	fmt.Fprintf(&b, "raw socket core at %s: closed=%v, goroutines=%d, sessions=%d\n",
+		dump.Time.Format(time.RFC3339Nano), dump.Closed, dump.Goroutines, len(dump.Sessions))
+	for _, s := range dump.Sessions {
+		fmt.Fprintf(&b, "  session %s: link=%s, closed=%v, pending=%d, conns=%d\n", s.Interface, s.LinkType, s.Closed, s.Pending, len(s.Conns))
+		for i, filter := range s.Filters {
+			fmt.Fprintf(&b, "    capture #%d filter=%q\n", i, filter)
+		}
+		fmt.Fprintf(&b, "    %v\n", s.Stats)
+		for _, c := range s.Conns {
+			fmt.Fprintf(&b, "    conn %s: %s, queued=%d, send-queued=%d, budget-dropped=%d, inbound-dropped=%d, read-deadline=%s, write-deadline=%s, last-active=%s, closed=%v\n",
+				c.Key, c.Direction, c.Queued, c.SendQueued, c.BudgetDropped, c.InboundDropped,
+				formatDumpTime(c.ReadDeadline), formatDumpTime(c.WriteDeadline), formatDumpTime(c.LastActive), c.Closed)
+		}
+	}
+	fmt.Fprintf(&b, "  arp cache: %d entries\n", len(dump.ARPCache))
+	for _, e := range dump.ARPCache {
+		fmt.Fprintf(&b, "    %s %s until %s\n", e.IP, e.MAC, formatDumpTime(e.Expiry))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// DumpStateJSON writes the snapshot of DumpState to w as an indented JSON StateDump
+func (core *RawSocketCore) DumpStateJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(core.stateDump())
+}
+
+// stateDump collects the snapshot. Locks are taken one at a time and never nested: each session's locks,
+// then the ARP cache lock
+func (core *RawSocketCore) stateDump() StateDump {
+	dump := StateDump{
+		Time:       time.Now(),
+		Closed:     core.isClosed.Load(),
+		Goroutines: runtime.NumGoroutine(),
+	}
+
+	sessions := core.sessions.all()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].params.key < sessions[j].params.key })
+
+	for _, ps := range sessions {
+		dump.Sessions = append(dump.Sessions, ps.dump())
+	}
+
+	for ip, entry := range core.arpCache.entriesSnapshot() {
+		dump.ARPCache = append(dump.ARPCache, ARPEntryDump{IP: ip, MAC: entry.MacAddress.String(), Expiry: entry.Expiry})
+	}
+	sort.Slice(dump.ARPCache, func(i, j int) bool { return dump.ARPCache[i].IP < dump.ARPCache[j].IP })
+
+	return dump
+}
+
+// dump describes the session. It tolerates a session which is being closed
+func (ps *pcapSession) dump() SessionDump {
+	n := int(ps.captureCount.Load())
+	s := SessionDump{
+		Interface: ps.params.iface.Name,
+		LinkType:  fmt.Sprint(ps.decoder),
+		Filters:   make([]string, n),
+		Closed:    ps.isClosed.Load(),
+		Pending:   ps.pending.Load(),
+		Stats:     ps.stats(),
+	}
+	if n > 1 {
+		for i := range s.Filters {
+			s.Filters[i] = capturePartitionFilter(i, n)
+		}
+	}
+
+	for _, conn := range ps.conns.all() {
+		s.Conns = append(s.Conns, conn.dump())
+	}
+	sort.Slice(s.Conns, func(i, j int) bool { return s.Conns[i].Key < s.Conns[j].Key })
+
+	return s
+}
+
+// direction tells how the conn was opened: "dial", "listen" or "multi"
+func (conn *RawIPConn) direction() string {
+	switch {
+	case conn.config.Load().multi:
+		return "multi"
+	case conn.params.Load().isServer:
+		return "listen"
+	}
+	return "dial"
+}
+
+// dump describes the conn from its immutable fields and atomics only
+func (conn *RawIPConn) dump() ConnDump {
+	return ConnDump{
+		Key:            conn.getKey(),
+		Direction:      conn.direction(),
+		Queued:         len(conn.inputChan),
+		SendQueued:     len(conn.sendQueue),
+		BudgetDropped:  conn.budgetDropped.Load(),
+		InboundDropped: conn.inboundDropped.Load(),
+		ReadDeadline:   loadDeadline(&conn.readDeadline),
+		WriteDeadline:  loadDeadline(&conn.writeDeadline),
+		LastActive:     time.Unix(0, conn.lastActive.Load()),
+		Closed:         conn.isClosed.Load(),
+	}
+}
+
+func formatDumpTime(t time.Time) string {
+	if t.IsZero() {
+		return "none"
+	}
+	return t.Format(time.RFC3339Nano)
+}
@@ -0,0 +1,146 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	echoRate       = 10   // echo replies per second sent to a single source
+	echoBurst      = 10   // echo replies a source may get in a row before being rate limited
+	echoMaxSources = 4096 // sources tracked before the ones with a full bucket are forgotten
+	echoReplyTTL   = 64
+)
+
+// echoBucket is the token bucket rate limiting the echo replies sent to one source
+type echoBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// echoResponder holds the addresses a pcapSession answers ICMP echo requests for, see RawSocketCore.RespondToEcho
+type echoResponder struct {
+	mu      sync.Mutex
+	addrs   map[netip.Addr]struct{}
+	sources map[netip.Addr]*echoBucket
+}
+
+func newEchoResponder() *echoResponder {
+	return &echoResponder{
+		addrs:   make(map[netip.Addr]struct{}),
+		sources: make(map[netip.Addr]*echoBucket),
+	}
+}
+
+// set adds addr to or removes it from the answered addresses
+func (e *echoResponder) set(addr netip.Addr, enabled bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if enabled {
+		e.addrs[addr] = struct{}{}
+	} else {
+		delete(e.addrs, addr)
+	}
+}
+
+// len returns the number of answered addresses
+func (e *echoResponder) len() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return len(e.addrs)
+}
+
+// allow tells if dst is answered and if an echo request from src gets a reply now, consuming a token of src if so
+func (e *echoResponder) allow(dst, src netip.Addr, now time.Time) (served, allowed bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.addrs[dst]; !ok {
+		return false, false
+	}
+
+	bucket, ok := e.sources[src]
+	if !ok {
+		if len(e.sources) >= echoMaxSources {
+			e.pruneSources(now)
+		}
+		bucket = &echoBucket{tokens: echoBurst, last: now}
+		e.sources[src] = bucket
+	}
+	bucket.tokens = min(echoBurst, bucket.tokens+now.Sub(bucket.last).Seconds()*echoRate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return true, false
+	}
+	bucket.tokens--
+	return true, true
+}
+
+// pruneSources forgets the sources whose bucket has refilled, which are the same as never seen. The caller must hold e.mu
+func (e *echoResponder) pruneSources(now time.Time) {
+	for src, bucket := range e.sources {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*echoRate >= echoBurst {
+			delete(e.sources, src)
+		}
+	}
+}
+
+// answerEcho replies to packet if it is an echo request to an address of the echo responder. It tells if the packet was
+// for the echo responder, even if rate limiting dropped the reply
+func (ps *pcapSession) answerEcho(packet *gopacket.Packet, ipv4 *layers.IPv4, dstIP netip.Addr) bool {
+	icmpLayer := (*packet).Layer(layers.LayerTypeICMPv4)
+	if icmpLayer == nil {
+		return false
+	}
+	icmp := icmpLayer.(*layers.ICMPv4)
+	if icmp.TypeCode.Type() != layers.ICMPv4TypeEchoRequest {
+		return false
+	}
+	served, allowed := ps.echo.allow(dstIP, toAddr(ipv4.SrcIP), time.Now())
+	if !allowed {
+		return served
+	}
+
+	reply := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      echoReplyTTL,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    ipv4.DstIP,
+		DstIP:    ipv4.SrcIP,
+	}
+	replyICMP := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0),
+		Id:       icmp.Id,
+		Seq:      icmp.Seq,
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, reply, replyICMP, gopacket.Payload(icmp.Payload)); err != nil {
+		log.Println("Error serializing echo reply:", err)
+		return true
+	}
+	replyPacket := gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+
+	// reply to the frame's sender, which is the requester itself or the router it came through
+	out := &outboundPacket{packet: &replyPacket}
+	if ethLayer := (*packet).Layer(layers.LayerTypeEthernet); ethLayer != nil {
+		out.dstMAC = ethLayer.(*layers.Ethernet).SrcMAC
+	}
+	select {
+	case ps.outgoingPackets <- out:
+	default:
+		log.Println("Dropping echo reply to", ipv4.SrcIP, ": outgoing queue is full")
+	}
+	return true
+}
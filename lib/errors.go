@@ -0,0 +1,94 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Sentinel errors returned (wrapped) by the package. Use errors.Is to check for them.
+var (
+	ErrNotLocalIP            = errors.New("rawsocket: not a local IP")
+	ErrInterfaceNotFound     = errors.New("rawsocket: interface not found")
+	ErrARPTimeout            = fmt.Errorf("rawsocket: timeout waiting for ARP reply: %w", os.ErrDeadlineExceeded)     // also matches os.ErrDeadlineExceeded
+	ErrNDTimeout             = fmt.Errorf("rawsocket: timeout waiting for Neighbor Advertisement: %w", ErrARPTimeout) // also matches ErrARPTimeout
+	ErrClosed                = fmt.Errorf("rawsocket: use of closed connection: %w", net.ErrClosed)                   // also matches net.ErrClosed
+	ErrTimeout               = fmt.Errorf("rawsocket: i/o timeout: %w", os.ErrDeadlineExceeded)                       // also matches os.ErrDeadlineExceeded
+	ErrResolving             = errors.New("rawsocket: next hop MAC address is still being resolved")
+	ErrNextHopNotOnLink      = errors.New("rawsocket: next hop is not on-link")
+	ErrAmbiguousIface        = errors.New("rawsocket: destination is reachable through several interfaces, one must be specified")
+	ErrAddressFamilyMismatch = errors.New("rawsocket: source and destination addresses are of different families")
+	ErrInvalidSessionConfig  = errors.New("rawsocket: invalid session configuration")
+	ErrUnspecifiedAddress    = errors.New("rawsocket: missing or unspecified address")
+	ErrMulticastAddress      = errors.New("rawsocket: multicast or broadcast address cannot be a local address")
+	ErrMessageTooLong        = fmt.Errorf("rawsocket: message too long: %w", syscall.EMSGSIZE)     // also matches syscall.EMSGSIZE
+	ErrNoRouteToHost         = fmt.Errorf("rawsocket: no route to host: %w", syscall.EHOSTUNREACH) // also matches syscall.EHOSTUNREACH
+	ErrHostAddress           = errors.New("rawsocket: address is served by the host's own stack")
+	ErrAddressInUse          = fmt.Errorf("rawsocket: address already in use: %w", syscall.EADDRINUSE) // also matches syscall.EADDRINUSE
+	ErrAlreadyListening      = fmt.Errorf("rawsocket: already listening: %w", ErrAddressInUse)         // also matches ErrAddressInUse
+	ErrHandleAccessDisabled  = errors.New("rawsocket: handle access needs WithUnsafeHandleAccess")
+	ErrARPRateLimited        = errors.New("rawsocket: ARP request rate limit of the interface exceeded")
+	ErrLayerAddressMismatch  = errors.New("rawsocket: addresses of the IPv4 layer differ from the ones of the conn")
+	ErrIdleTimeout           = fmt.Errorf("rawsocket: connection closed after being idle: %w", ErrClosed) // also matches ErrClosed
+	ErrIPv6Unsupported       = errors.New("rawsocket: operation not supported on IPv6 conns")
+	ErrZoneRequired          = errors.New("rawsocket: IPv6 link-local address needs a zone")
+	ErrNotMigratable         = errors.New("rawsocket: only conns dialed to a remote address can migrate")
+)
+
+// MessageTooLongError is returned by writes whose payload does not fit into a single packet of the conn.
+// It matches ErrMessageTooLong and syscall.EMSGSIZE
+type MessageTooLongError struct {
+	Size  int // payload bytes of the write
+	Limit int // largest payload the conn accepts, see RawIPConn.MaxPayload
+}
+
+func (e *MessageTooLongError) Error() string {
+	return fmt.Sprintf("%v: %d bytes payload exceeds the limit of %d bytes", ErrMessageTooLong, e.Size, e.Limit)
+}
+
+func (e *MessageTooLongError) Unwrap() error {
+	return ErrMessageTooLong
+}
+
+// BatchWriteError is returned by batch writes when some of the entries could not be written.
+// Errs has one element per batch entry, nil for the entries that were written, so the caller can retry only the failures.
+type BatchWriteError struct {
+	Errs []error
+}
+
+func (e *BatchWriteError) Error() string {
+	failed := e.Failed()
+	msgs := make([]string, 0, len(failed))
+	for _, i := range failed {
+		msgs = append(msgs, fmt.Sprintf("#%d: %v", i, e.Errs[i]))
+	}
+	return fmt.Sprintf("%d of %d batch writes failed: %s", len(failed), len(e.Errs), strings.Join(msgs, "; "))
+}
+
+// Failed returns the indexes of the batch entries that could not be written
+func (e *BatchWriteError) Failed() []int {
+	var failed []int
+	for i, err := range e.Errs {
+		if err != nil {
+			failed = append(failed, i)
+		}
+	}
+	return failed
+}
+
+// Unwrap returns the errors of the failed entries so that errors.Is and errors.As look into them
+func (e *BatchWriteError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,145 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CoreEvent is a structural event of a core, delivered by RawSocketCore.Events: one of *SessionOpened,
+// *SessionClosed, *ConnOpened, *ConnClosed, *ConnMigrated, *ARPConflict, *CaptureRestarted and *MTUChanged
+type CoreEvent interface {
+	EventTime() time.Time
+}
+
+// eventTime is embedded in the events to timestamp them
+type eventTime struct {
+	Time time.Time
+}
+
+func (e eventTime) EventTime() time.Time { return e.Time }
+
+// SessionOpened is emitted when a pcapSession opens on an interface
+type SessionOpened struct {
+	eventTime
+	Interface string
+}
+
+// SessionClosed is emitted when a pcapSession closes
+type SessionClosed struct {
+	eventTime
+	Interface string
+	Reason    string // "idle" when reaped for having no conns, "core closed" when the core closed
+}
+
+// ConnOpened is emitted when a conn is registered with its session
+type ConnOpened struct {
+	eventTime
+	Interface string
+	Key       string
+	Direction string // "dial", "listen" or "multi"
+}
+
+// ConnClosed is emitted when a closed conn leaves its session
+type ConnClosed struct {
+	eventTime
+	Interface string
+	Key       string
+	Err       error // ErrClosed, or why the conn closed itself, e.g. ErrIdleTimeout
+}
+
+// ConnMigrated is emitted when RawIPConn.Migrate moved a conn to the session of another interface or address
+type ConnMigrated struct {
+	eventTime
+	Interface     string // interface the conn moved to
+	Key           string
+	FromInterface string
+	FromKey       string
+}
+
+// ARPConflict is emitted when an ARP reply gives IP another MAC address than the ARP cache holds for it
+type ARPConflict struct {
+	eventTime
+	Interface string
+	IP        net.IP
+	KnownMAC  net.HardwareAddr // MAC in the ARP cache
+	SeenMAC   net.HardwareAddr
+}
+
+// CaptureRestarted is emitted when a session reopens its capture handles, e.g. to grow their kernel buffer. The frames
+// arriving during Gap were not captured. Err tells why the new handles could not be opened, the old ones being kept
+type CaptureRestarted struct {
+	eventTime
+	Interface  string
+	Reason     string // "kernel drops" when growing the kernel buffer
+	BufferSize int    // kernel buffer size of the handles capturing now
+	Gap        time.Duration
+	Err        error
+}
+
+// MTUChanged is emitted when a session sees the MTU of its interface change. Writes are limited by the new one from then on
+type MTUChanged struct {
+	eventTime
+	Interface string
+	Old, New  int
+}
+
+// eventHub delivers the events of a core to its subscribers, without ever blocking the emitter
+type eventHub struct {
+	mu      sync.RWMutex // held for reading while emitting, for writing while a subscriber leaves
+	subs    map[chan CoreEvent]struct{}
+	dropped atomic.Uint64
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan CoreEvent]struct{})}
+}
+
+// emit hands ev to every subscriber with room for it, dropping it for the others
+func (h *eventHub) emit(ev CoreEvent) {
+	if h == nil {
+		return
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+			h.dropped.Add(1)
+		}
+	}
+}
+
+// Events subscribes to the structural events of the core: sessions and conns opening and closing, ARP conflicts and
+// MTU changes. Events are delivered best effort on a channel buffering up to buffer of them: while it is full, new
+// events are dropped for this subscriber and counted by DroppedEvents, so that a slow subscriber never holds up the
+// core.
+// The returned func cancels the subscription and closes the channel. There may be any number of subscribers.
+func (core *RawSocketCore) Events(buffer int) (<-chan CoreEvent, func()) {
+	ch := make(chan CoreEvent, max(buffer, 0))
+	h := core.events
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs, ch)
+			h.mu.Unlock()
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
+
+// DroppedEvents returns the number of events dropped because the channel of a subscriber was full
+func (core *RawSocketCore) DroppedEvents() uint64 {
+	return core.events.dropped.Load()
+}
@@ -12,97 +12,78 @@ import (
 	"golang.org/x/net/route"
 )
 
-// getLocalIP finds the local IP that can route to the given destination IP
-func GetLocalIP(dstIP net.IP) (net.IP, *net.Interface, net.IP, error) {
+// rtfIfScope flags a route scoped to its interface. When several default routes exist, only the primary one is
+// unscoped and the others are there for interface-bound sockets
+const rtfIfScope = 0x1000000
+
+// routeCandidates lists the routes to dstIP with the local IP each one would use.
+// The metric of a candidate is 0 for a primary route and 1 for a route scoped to its interface
+func routeCandidates(dstIP net.IP) ([]RouteCandidate, error) {
 	// Handle loopback IP separately
 	loIface, err := getLoopbackInterface()
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("cannot find loopback interface")
+		return nil, fmt.Errorf("cannot find loopback interface: %w", err)
 	}
 	if dstIP.IsLoopback() {
 		if dstIP.String() == "127.0.0.1" {
-			return net.ParseIP("127.0.0.2"), loIface, nil, nil // Return a different loopback IP
+			return []RouteCandidate{{Interface: loIface, SrcIP: net.ParseIP("127.0.0.2")}}, nil // Return a different loopback IP
 		}
-		return net.ParseIP("127.0.0.1"), loIface, nil, nil
+		return []RouteCandidate{{Interface: loIface, SrcIP: net.ParseIP("127.0.0.1")}}, nil
 	}
 
 	rib, err := route.FetchRIB(syscall.AF_INET, route.RIBTypeRoute, 0)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 
 	routes, err := route.ParseRIB(route.RIBTypeRoute, rib)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 
-	var bestRoute *route.RouteMessage
-	bestMatchLength := 0
-	//var defaultRoute *route.RouteMessage
-
+	var candidates []RouteCandidate
 	for _, r := range routes {
-		if rtMsg, ok := r.(*route.RouteMessage); ok {
-			//fmt.Printf("routeMessage: %+v\n", *rtMsg)
-			destAddr := rtMsg.Addrs[syscall.RTAX_DST]
-			maskAddr := rtMsg.Addrs[syscall.RTAX_NETMASK]
-
-			destIPNet := addrToIPNet(destAddr, maskAddr)
-			if destIPNet == nil {
-				continue
-			}
-
-			/*if destIPNet.IP.Equal(net.IPv4zero) {
-				// Track the first default route found
-				if defaultRoute == nil {
-					defaultRoute = rtMsg
-				}
-				continue
-			}*/
-
-			if destIPNet.Contains(dstIP) {
-				maskSize, _ := destIPNet.Mask.Size()
-				if maskSize > bestMatchLength {
-					bestMatchLength = maskSize
-					bestRoute = rtMsg
-				}
-			}
+		rtMsg, ok := r.(*route.RouteMessage)
+		if !ok {
+			continue
+		}
+		destIPNet := addrToIPNet(rtMsg.Addrs[syscall.RTAX_DST], rtMsg.Addrs[syscall.RTAX_NETMASK])
+		if destIPNet == nil || !destIPNet.Contains(dstIP) {
+			continue
 		}
-	}
 
-	var (
-		chosenIP, gatewayIP net.IP
-		chosenIface         *net.Interface
-	)
-	if bestRoute != nil {
-		chosenIP, chosenIface, err = getInterfaceIP(bestRoute, dstIP)
+		srcIP, iface, err := getInterfaceIP(rtMsg, dstIP)
 		if err != nil {
 			log.Println("Cannot find chosenIP and chosenIface:", err)
+			continue
+		}
+
+		// Ensure the chosen IP is not the same as the destination IP
+		if srcIP.Equal(dstIP) { // dstIP must be a local IP
+			return []RouteCandidate{{Interface: loIface, SrcIP: net.ParseIP("127.0.0.1")}}, nil // Return a fallback IP for non-loopback cases
+		}
+
+		candidate := RouteCandidate{Interface: iface, SrcIP: srcIP}
+		candidate.PrefixLen, _ = destIPNet.Mask.Size()
+		if rtMsg.Flags&rtfIfScope != 0 {
+			candidate.Metric = 1
 		}
-		// check if best route is a default route
-		subnet, err := getSubnetFromIP(chosenIface, chosenIP)
+		// the gateway is only needed if the destination is outside the subnet of the chosen IP, i.e. a default route
+		subnet, err := getSubnetFromIP(iface, srcIP)
 		if err != nil {
-			log.Fatal("Cannot find chosenIP's subnet:", err)
+			log.Println("Cannot find chosenIP's subnet:", err)
+			continue
 		}
-		if !subnet.Contains(dstIP) { // default route
-			if gwAddr, ok := bestRoute.Addrs[syscall.RTAX_GATEWAY].(*route.Inet4Addr); ok {
-				fmt.Println("Gateway IP of the default route is", bestRoute.Addrs[syscall.RTAX_GATEWAY].(*route.Inet4Addr).IP)
-				gatewayIP = net.IP(gwAddr.IP[:])
-			}
+		if gwAddr, ok := rtMsg.Addrs[syscall.RTAX_GATEWAY].(*route.Inet4Addr); ok && !subnet.Contains(dstIP) {
+			candidate.Gateway = net.IP(gwAddr.IP[:])
 		}
-	} else {
-		return nil, nil, nil, fmt.Errorf("no suitable route found for IP %v", dstIP)
+		candidates = append(candidates, candidate)
 	}
 
-	if err != nil {
-		return nil, nil, nil, err
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no suitable route found for IP %v: %w", dstIP, ErrNoRouteToHost)
 	}
-
-	// Ensure the chosen IP is not the same as the destination IP
-	if chosenIP.Equal(dstIP) { // dstIP must be a local IP
-		return net.ParseIP("127.0.0.1"), loIface, nil, nil // Return a fallback IP for non-loopback cases
-	}
-
-	return chosenIP, chosenIface, gatewayIP, nil
+	return candidates, nil
 }
 
 // getInterfaceIP retrieves the local IP address and the network interface associated with the given route
@@ -223,5 +204,5 @@ func getLoopbackInterface() (*net.Interface, error) {
 	}
 
 	// "lo0" not found
-	return nil, fmt.Errorf("loopback interface 'lo0' not found")
+	return nil, fmt.Errorf("loopback interface 'lo0' not found: %w", ErrInterfaceNotFound)
 }
@@ -6,98 +6,66 @@ package lib
 import (
 	"fmt"
 	"net"
-	"os"
 
 	"github.com/moriyoshi/routewrapper"
 )
 
-// getLocalIP finds the local IP that can route to the given destination IP
-func GetLocalIP(dstIP net.IP) (net.IP, *net.Interface, net.IP, error) {
+// routeCandidates lists the routes to dstIP with the local IP each one would use, most specific first.
+// The metric of a candidate is the route metric reported by the OS
+func routeCandidates(dstIP net.IP) ([]RouteCandidate, error) {
 	w, err := routewrapper.NewRouteWrapper()
 	if err != nil {
-		fmt.Printf("Error initializing route wrapper: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("cannot initialize route wrapper: %w", err)
 	}
 
 	// Handle loopback IP separately
 	loIface, err := getLoopbackInterface()
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("cannot find loopback interface")
+		return nil, fmt.Errorf("cannot find loopback interface: %w", err)
 	}
 	if dstIP.IsLoopback() {
 		if dstIP.String() == "127.0.0.1" {
-			return net.ParseIP("127.0.0.2"), loIface, nil, nil // Return a different loopback IP
+			return []RouteCandidate{{Interface: loIface, SrcIP: net.ParseIP("127.0.0.2")}}, nil // Return a different loopback IP
 		}
-		return net.ParseIP("127.0.0.1"), loIface, nil, nil
+		return []RouteCandidate{{Interface: loIface, SrcIP: net.ParseIP("127.0.0.1")}}, nil
 	}
 
 	routes, err := w.Routes()
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 
-	var bestRoute *routewrapper.Route
-	bestMatchLength := 0
-	var defaultRoute *routewrapper.Route
-
-	for i, route := range routes {
-		if route.Destination.String() == "0.0.0.0/0" {
-			// Track the first default route found
-			if defaultRoute == nil {
-				defaultRoute = &route
-			}
+	var candidates []RouteCandidate
+	for _, route := range routes {
+		if route.Interface == nil || !route.Destination.Contains(dstIP) {
 			continue
 		}
-
-		if route.Destination.Contains(dstIP) {
-			ifName := "*"
-			if route.Interface != nil {
-				ifName = route.Interface.Name
-			}
-			fmt.Printf("%d: %s %s\n", i, route.Destination.String(), ifName)
-			_, routeNet, _ := net.ParseCIDR(route.Destination.String())
-			dstMaskSize, _ := routeNet.Mask.Size()
-			if dstMaskSize > bestMatchLength {
-				bestMatchLength = dstMaskSize
-				bestRoute = &route
-			}
+		candidate := RouteCandidate{Interface: route.Interface, Gateway: route.Gateway, Metric: route.Metric}
+		candidate.PrefixLen, _ = route.Destination.Mask.Size()
+		if candidate.Gateway != nil && candidate.Gateway.IsUnspecified() {
+			candidate.Gateway = nil // on-link route
 		}
-	}
 
-	var (
-		chosenIP, gatewayIP net.IP
-		chosenInterface     *net.Interface
-	)
-
-	if bestRoute != nil && bestRoute.Interface != nil {
-		chosenInterface = bestRoute.Interface
-		if bestRoute.Gateway != nil {
-			chosenIP, err = getInterfaceIP(bestRoute.Interface, bestRoute.Gateway)
+		if candidate.Gateway != nil {
+			candidate.SrcIP, err = getInterfaceIP(candidate.Interface, candidate.Gateway)
 		} else {
-			chosenIP, err = getInterfaceIP(bestRoute.Interface, dstIP)
+			candidate.SrcIP, err = getInterfaceIP(candidate.Interface, dstIP)
 		}
-	} else if defaultRoute != nil && defaultRoute.Interface != nil {
-		chosenInterface = defaultRoute.Interface
-		if defaultRoute.Gateway != nil {
-			chosenIP, err = getInterfaceIP(defaultRoute.Interface, defaultRoute.Gateway)
-			gatewayIP = defaultRoute.Gateway // Set the gateway IP
-		} else {
-			chosenIP, err = getInterfaceIP(defaultRoute.Interface, dstIP)
+		if err != nil {
+			continue
 		}
-	} else {
-		return nil, nil, nil, fmt.Errorf("no suitable route found for IP %v", dstIP)
-	}
 
-	if err != nil {
-		return nil, nil, nil, err
+		// Ensure the chosen IP is not the same as the destination IP
+		if candidate.SrcIP.Equal(dstIP) { // dstIP must be a local IP
+			return []RouteCandidate{{Interface: loIface, SrcIP: net.ParseIP("127.0.0.1")}}, nil // Return a fallback IP for non-loopback cases
+		}
+		candidates = append(candidates, candidate)
 	}
 
-	// Ensure the chosen IP is not the same as the destination IP
-	if chosenIP.Equal(dstIP) { // dstIP must be a local IP
-		return net.ParseIP("127.0.0.1"), loIface, nil, nil // Return a fallback IP for non-loopback cases
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no suitable route found for IP %v: %w", dstIP, ErrNoRouteToHost)
 	}
-
-	return chosenIP, chosenInterface, gatewayIP, nil
+	return candidates, nil
 }
 
 // getInterfaceIP retrieves the local IP address associated with the given network interface
@@ -135,5 +103,5 @@ func getLoopbackInterface() (*net.Interface, error) {
 	}
 
 	// Loopback interface not found
-	return nil, fmt.Errorf("loopback interface not found")
+	return nil, fmt.Errorf("loopback interface not found: %w", ErrInterfaceNotFound)
 }
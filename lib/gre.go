@@ -0,0 +1,48 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// GREOption sets an optional field of the GRE header built by BuildGRE
+type GREOption func(*layers.GRE)
+
+// WithGREChecksum adds the checksum field, computed over the GRE header and payload
+func WithGREChecksum() GREOption {
+	return func(gre *layers.GRE) {
+		gre.ChecksumPresent = true
+	}
+}
+
+// WithGREKey adds the key field (RFC 2890), used to tell apart several tunnels between the same endpoints
+func WithGREKey(key uint32) GREOption {
+	return func(gre *layers.GRE) {
+		gre.KeyPresent = true
+		gre.Key = key
+	}
+}
+
+// WithGRESequence adds the sequence number field (RFC 2890)
+func WithGRESequence(seq uint32) GREOption {
+	return func(gre *layers.GRE) {
+		gre.SeqPresent = true
+		gre.Seq = seq
+	}
+}
+
+// BuildGRE encapsulates payload, a packet of the given EtherType, into a GRE (RFC 2784) header.
+// The result is meant to be written to a RawIPConn dialed with layers.IPProtocolGRE.
+func BuildGRE(proto layers.EthernetType, payload []byte, opts ...GREOption) []byte {
+	gre := &layers.GRE{Protocol: proto}
+	for _, opt := range opts {
+		opt(gre)
+	}
+
+	// serializing a GRE header into a growing buffer cannot fail
+	b, _ := serializeLayers(gre, gopacket.Payload(payload))
+	return b
+}
@@ -0,0 +1,124 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// idleWatcher closes the conns of a session idle for longer than their idle timeout. A single goroutine sweeps all of
+// them, and only runs while some conn has an idle timeout, so that idle conns cost no timer each
+type idleWatcher struct {
+	stop <-chan struct{}
+	wake chan struct{} // the sweep period changed
+
+	mu      sync.Mutex
+	conns   map[*RawIPConn]struct{}
+	period  time.Duration
+	running bool
+}
+
+func newIdleWatcher(stop <-chan struct{}) *idleWatcher {
+	return &idleWatcher{stop: stop, wake: make(chan struct{}, 1), conns: make(map[*RawIPConn]struct{})}
+}
+
+// idleSweepPeriod returns how often conns with idle timeout d are checked: a few times per timeout
+func idleSweepPeriod(d time.Duration) time.Duration {
+	return min(max(d/4, 10*time.Millisecond), time.Second)
+}
+
+// watch starts watching conn, whose idle timeout has been set to d
+func (w *idleWatcher) watch(conn *RawIPConn, d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.conns[conn] = struct{}{}
+	period := idleSweepPeriod(d)
+	switch {
+	case !w.running:
+		w.running, w.period = true, period
+		go w.run(period)
+	case period < w.period:
+		w.period = period
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *idleWatcher) run(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-w.wake:
+			w.mu.Lock()
+			ticker.Reset(w.period)
+			w.mu.Unlock()
+		case now := <-ticker.C:
+			if !w.sweep(now) {
+				return
+			}
+		}
+	}
+}
+
+// sweep closes the conns idle for too long, and tells whether any conn is left to watch
+func (w *idleWatcher) sweep(now time.Time) bool {
+	var expired []*RawIPConn
+
+	w.mu.Lock()
+	for conn := range w.conns {
+		timeout := time.Duration(conn.idleTimeout.Load())
+		switch {
+		case conn.isClosed.Load() || timeout <= 0:
+			delete(w.conns, conn)
+		case now.Sub(time.Unix(0, conn.lastActive.Load())) >= timeout:
+			delete(w.conns, conn)
+			expired = append(expired, conn)
+		}
+	}
+	left := len(w.conns) > 0
+	if !left {
+		w.running = false
+	}
+	w.mu.Unlock()
+
+	for _, conn := range expired {
+		conn.closeIdle()
+	}
+	return left
+}
+
+// SetIdleTimeout makes the conn close itself once no packet has been written or received for d. Reads and writes then
+// fail with ErrIdleTimeout, which matches ErrClosed, and ErrIdleTimeout is delivered on Errors. Conns are checked a few
+// times per timeout, so the conn closes a little after d. 0 disables the idle timeout again.
+func (conn *RawIPConn) SetIdleTimeout(d time.Duration) {
+	d = max(d, 0)
+	conn.idleTimeout.Store(int64(d))
+	if d > 0 && conn.params.Load().watchIdle != nil {
+		conn.params.Load().watchIdle(conn, d)
+	}
+}
+
+// closeIdle closes the conn for being idle
+func (conn *RawIPConn) closeIdle() {
+	if conn.isClosed.Load() {
+		return
+	}
+	err := ErrIdleTimeout
+	conn.closeCause.Store(&err)
+	log.Printf("Raw IPConn %s idle for %v, closing it", conn.getKey(), time.Duration(conn.idleTimeout.Load()))
+	select {
+	case conn.errChan <- err:
+	default:
+	}
+	conn.Close()
+}
@@ -0,0 +1,484 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// needsZone tells if the IPv6 address ip is only meaningful on one link, so that dialing it needs an interface
+func needsZone(ip net.IP) bool {
+	return ip.To4() == nil && (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast())
+}
+
+// onLinkIPv6 tells if the IPv6 address ip is reached directly through iface: link-local and multicast addresses
+// always are, others if a prefix of iface contains them
+func onLinkIPv6(iface *net.Interface, ip net.IP) bool {
+	if ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return true
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipv6Source returns the IPv6 address of iface to send to dstIP from: its link-local one for link-local destinations,
+// else the one whose prefix contains dstIP, else its first global one, else its link-local one
+func ipv6Source(iface *net.Interface, dstIP net.IP) net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	var global, linkLocal net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil {
+			continue
+		}
+		switch {
+		case ipNet.IP.IsLinkLocalUnicast():
+			if linkLocal == nil {
+				linkLocal = ipNet.IP
+			}
+		case !needsZone(dstIP) && ipNet.Contains(dstIP):
+			return ipNet.IP
+		case global == nil:
+			global = ipNet.IP
+		}
+	}
+	if needsZone(dstIP) && linkLocal != nil {
+		return linkLocal
+	}
+	if global != nil {
+		return global
+	}
+	return linkLocal
+}
+
+// onLinkIPv6Interface returns the only up, non-loopback interface ip is on-link for
+func onLinkIPv6Interface(ip net.IP) (*net.Interface, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		iface      *net.Interface
+		candidates []string
+	)
+	for i := range interfaces {
+		if interfaces[i].Flags&net.FlagUp == 0 || interfaces[i].Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if onLinkIPv6(&interfaces[i], ip) {
+			candidates = append(candidates, interfaces[i].Name)
+			iface = &interfaces[i]
+		}
+	}
+	switch {
+	case len(candidates) > 1:
+		return nil, fmt.Errorf("%v is on-link for interfaces %v: %w", ip, candidates, ErrAmbiguousIface)
+	case iface == nil:
+		// the IPv6 routing table is not read, routed destinations need their interface and router
+		return nil, fmt.Errorf("%v is on-link for no interface, give srcIP or WithInterface, and its router WithNextHop: %w", ip, ErrNoRouteToHost)
+	}
+	return iface, nil
+}
+
+// routeIPv6 picks the interface of a dial to the IPv6 dstIP and fills in the addresses and next hop of config.
+// The interface, the zone of link-local addresses, is the one owning srcIP or the one given WithInterface, else the
+// only one dstIP is on-link for. The library does not read the IPv6 routing table: a destination off-link for the
+// interface goes to the router given WithNextHop, and fails with ErrNoRouteToHost without one
+func routeIPv6(config *RawIPConnConfig, srcIP, dstIP net.IP) (*net.Interface, error) {
+	var (
+		iface *net.Interface
+		err   error
+	)
+	nextHop := config.nextHopOverride
+	switch {
+	case srcIP != nil:
+		if iface, err = findInterfaceByIP(srcIP); err != nil {
+			return nil, fmt.Errorf("provided srcIP %v is not a local IP: %w", srcIP, errors.Join(ErrNotLocalIP, err))
+		}
+		if config.ifaceName != "" && config.ifaceName != iface.Name {
+			return nil, fmt.Errorf("provided srcIP %v is not a local IP of interface %s: %w", srcIP, config.ifaceName, ErrNotLocalIP)
+		}
+	case config.ifaceName != "":
+		if iface, err = net.InterfaceByName(config.ifaceName); err != nil {
+			return nil, fmt.Errorf("interface %s: %w", config.ifaceName, errors.Join(ErrInterfaceNotFound, err))
+		}
+	case dstIP.IsLoopback() || (nextHop == nil && config.pinnedMAC == nil && hostIface(dstIP) != nil):
+		// the host itself, through loopback or delivered locally by the session of the interface owning dstIP
+		if iface, err = findInterfaceByIP(dstIP); err != nil {
+			return nil, fmt.Errorf("destination %v: %w", dstIP, errors.Join(ErrNotLocalIP, err))
+		}
+	case needsZone(dstIP) || (nextHop != nil && needsZone(nextHop)):
+		return nil, fmt.Errorf("destination %v: %w, give its interface WithInterface", dstIP, ErrZoneRequired)
+	case nextHop != nil:
+		if iface, err = onLinkIPv6Interface(nextHop); err != nil {
+			return nil, err
+		}
+	default:
+		if iface, err = onLinkIPv6Interface(dstIP); err != nil {
+			return nil, err
+		}
+	}
+
+	if srcIP == nil {
+		if srcIP = ipv6Source(iface, dstIP); srcIP == nil {
+			return nil, fmt.Errorf("interface %s has no IPv6 address: %w", iface.Name, ErrNotLocalIP)
+		}
+	}
+	config.localIP, config.remoteIP = srcIP, dstIP
+
+	onLoopback := iface.Flags&net.FlagLoopback != 0
+	switch owner := hostIface(dstIP); {
+	case nextHop == nil && config.pinnedMAC == nil && owner != nil:
+		if owner.Index != iface.Index {
+			// the replies of the listeners to srcIP are only delivered locally by the same session
+			return nil, fmt.Errorf("provided srcIP %v is not a local IP of interface %s: %w", srcIP, owner.Name, ErrNotLocalIP)
+		}
+		config.selfDial = true
+		config.nextHopIP = nil // nothing to resolve
+	case config.pinnedMAC != nil, onLoopback:
+		config.nextHopIP = dstIP // nothing to resolve
+	case nextHop != nil:
+		if nextHop.To4() != nil || !onLinkIPv6(iface, nextHop) {
+			return nil, fmt.Errorf("%v is not on-link for interface %s: %w", nextHop, iface.Name, ErrNextHopNotOnLink)
+		}
+		config.nextHopIP = nextHop
+	case onLinkIPv6(iface, dstIP):
+		config.nextHopIP = dstIP
+	default:
+		return nil, fmt.Errorf("%v is off-link for interface %s, give its router WithNextHop: %w", dstIP, iface.Name, ErrNoRouteToHost)
+	}
+	return iface, nil
+}
+
+// eui64LinkLocal returns the link-local address derived from the Ethernet address mac (RFC 4291 appendix A)
+func eui64LinkLocal(mac net.HardwareAddr) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	ip[0], ip[1] = 0xfe, 0x80
+	copy(ip[8:11], mac[:3])
+	ip[8] ^= 0x02
+	ip[11], ip[12] = 0xff, 0xfe
+	copy(ip[13:], mac[3:])
+	return ip
+}
+
+// ndSource returns the address the Neighbor Solicitations of the session for target are sent from: the address of the
+// interface fit for target, else the link-local address derived from its MAC address
+func (ps *pcapSession) ndSource(target net.IP) net.IP {
+	if src := ipv6Source(ps.params.iface, target); src != nil {
+		return src
+	}
+	return eui64LinkLocal(ps.params.iface.HardwareAddr)
+}
+
+// neighborSolicitationFrame returns the Ethernet frame of a Neighbor Solicitation for target from src, at mac, sent to
+// the solicited-node multicast group of target (RFC 4861 7.2.2)
+func neighborSolicitationFrame(mac net.HardwareAddr, src, target net.IP) ([]byte, error) {
+	group := solicitedNodeAddr(target)
+	eth := &layers.Ethernet{SrcMAC: mac, DstMAC: ipv6MulticastMAC(group), EthernetType: layers.EthernetTypeIPv6}
+	ip := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   ndHopLimit,
+		SrcIP:      src,
+		DstIP:      group,
+	}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0)}
+	icmp.SetNetworkLayerForChecksum(ip)
+	ns := &layers.ICMPv6NeighborSolicitation{
+		TargetAddress: target,
+		Options:       layers.ICMPv6Options{{Type: layers.ICMPv6OptSourceAddress, Data: mac}},
+	}
+	return serializeLayers(eth, ip, icmp, ns)
+}
+
+// solicitNeighbor sends a Neighbor Solicitation for ip on the session and waits for the advertisement, captured by
+// the session itself. It shares the rate limit and the timeout of ARP requests
+func (ps *pcapSession) solicitNeighbor(ip net.IP) (net.HardwareAddr, error) {
+	frame, err := neighborSolicitationFrame(ps.params.iface.HardwareAddr, ps.ndSource(ip), ip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send Neighbor Solicitation: %w", err)
+	}
+
+	wait, ok := ps.arpLimit.reserve(time.Now())
+	if !ok {
+		return nil, fmt.Errorf("Neighbor Solicitation for %v: %w", ip, ErrARPRateLimited)
+	}
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ps.stopChan:
+			return nil, ErrClosed
+		}
+	}
+
+	// wait before sending, so that a fast advertisement is not missed
+	addr := toAddr(ip)
+	reply := ps.arp.wait(addr)
+	defer ps.arp.cancel(addr, reply)
+
+	// written rather than queued: handleOutgoingPackets resolves the next hop of packets sent without one itself
+	if err := ps.writeFrame(frame); err != nil {
+		ps.writeErrors.Add(1)
+		return nil, fmt.Errorf("failed to send Neighbor Solicitation: %w", err)
+	}
+
+	select {
+	case mac := <-reply:
+		return mac, nil
+	case <-time.After(ps.config.arpRequestTimeout):
+		return nil, fmt.Errorf("no Neighbor Advertisement from %v after %v: %w", ip, ps.config.arpRequestTimeout, ErrNDTimeout)
+	case <-ps.stopChan:
+		return nil, ErrClosed
+	}
+}
+
+// handleNeighborAdvertisement hands the target link-layer address of payload, the IPv6 packet of an Ethernet frame,
+// to the dials waiting for it if it is a valid Neighbor Advertisement (RFC 4861 7.1.2)
+func (ps *pcapSession) handleNeighborAdvertisement(payload []byte) {
+	packet := gopacket.NewPacket(payload, layers.LayerTypeIPv6, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	ip, _ := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	na, _ := packet.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(*layers.ICMPv6NeighborAdvertisement)
+	if ip == nil || na == nil || ip.NextHeader != layers.IPProtocolICMPv6 || ip.HopLimit != ndHopLimit || na.TargetAddress.IsMulticast() {
+		return
+	}
+	if FinishChecksum(PseudoHeaderChecksumIPv6(ip.SrcIP, ip.DstIP, layers.IPProtocolICMPv6, len(ip.Payload)), ip.Payload) != 0 {
+		ps.decodeErrors.Add(1)
+		return
+	}
+	for _, opt := range na.Options {
+		if opt.Type == layers.ICMPv6OptTargetAddress && len(opt.Data) == 6 {
+			ps.arp.deliver(toAddr(na.TargetAddress), append(net.HardwareAddr(nil), opt.Data...))
+			return
+		}
+	}
+}
+
+// ipv6Payload returns the protocol following the IPv6 header of ip and its Hop-by-Hop header, if any, and what follows
+// them. gopacket decodes the Hop-by-Hop header along with the IPv6 header, but leaves it in the payload of jumbograms
+func ipv6Payload(ip *layers.IPv6) (layers.IPProtocol, []byte) {
+	if ip.HopByHop == nil {
+		return ip.NextHeader, ip.Payload
+	}
+	payload := ip.Payload
+	if ip.Length == 0 && len(payload) >= ip.HopByHop.ActualLength {
+		payload = payload[ip.HopByHop.ActualLength:]
+	}
+	return ip.HopByHop.NextHeader, payload
+}
+
+// dispatchIPv6 handles an IPv6 packet captured in frame, whose header the parser just decoded: Neighbor Discovery
+// messages go to the resolutions and the ND proxy of the session, and packets a conn wants to it. Packets whose chain
+// of extension headers is malformed are counted as decode errors and dropped
+func (ps *pcapSession) dispatchIPv6(parser *headerParser, ip *layers.IPv6, frame capturedFrame) {
+	next, payload := ipv6Payload(ip)
+	protocol, upper, err := ipv6UpperLayer(next, payload)
+	if err != nil {
+		ps.decodeErrors.Add(1)
+		return
+	}
+	ps.params.protoCounters.add(protocol, len(ip.Contents)+len(ip.Payload))
+	if ps.params.blocklist != nil && ps.params.blocklist.drops(ip.SrcIP) {
+		return
+	}
+	if protocol == layers.IPProtocolICMPv6 && len(upper) > 0 && parser.untaggedEthernet() {
+		switch layers.ICMPv6TypeCode(uint16(upper[0]) << 8).Type() {
+		case layers.ICMPv6TypeNeighborSolicitation:
+			if ps.nd.len() > 0 {
+				ps.handleNeighborSolicitation(parser.eth.Payload, parser.eth.SrcMAC)
+			}
+		case layers.ICMPv6TypeNeighborAdvertisement:
+			ps.handleNeighborAdvertisement(parser.eth.Payload)
+		}
+	}
+	if ps.conns.lookup(protocol, toAddr(ip.DstIP), toAddr(ip.SrcIP)) == nil {
+		return
+	}
+
+	// the packet outlives the pooled buffer, and owns its copy of the data
+	data := append([]byte(nil), *frame.buf...)
+	packet := gopacket.NewPacket(data, ps.decoder, gopacket.DecodeOptions{NoCopy: true})
+	packet.Metadata().CaptureInfo = frame.ci
+	if packet.Layer(layers.LayerTypeIPv6) == nil {
+		ps.decodeErrors.Add(1)
+		return
+	}
+	ps.demuxIPv6(&packet)
+}
+
+// demuxIPv6 hands an IPv6 packet to the conns it is for
+func (ps *pcapSession) demuxIPv6(packet *gopacket.Packet) {
+	ip, _ := (*packet).Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if ip == nil {
+		return
+	}
+	protocol, _, err := ipv6UpperLayer(ipv6Payload(ip))
+	if err != nil {
+		return
+	}
+	for _, conn := range ps.conns.lookupAll(protocol, toAddr(ip.DstIP), toAddr(ip.SrcIP)) {
+		conn.enqueue(packet)
+	}
+}
+
+// isIPv6 tells if the conn sends and receives IPv6 packets
+func (conn *RawIPConn) isIPv6() bool {
+	localIP := conn.config.Load().localIP
+	return localIP != nil && localIP.To4() == nil
+}
+
+// SetTrafficClass sets the traffic class of the IPv6 packets written by the conn from then on, the TOS byte of IPv4 ones.
+// It starts out as the TOS given WithTOS
+func (conn *RawIPConn) SetTrafficClass(tc uint8) {
+	conn.trafficClass.Store(uint32(tc))
+}
+
+// SetFlowLabel sets the flow label of the IPv6 packets written by the conn from then on. 0 clears it, leaving packets
+// without label or, WithAutoFlowLabel, with the one derived from their flow. Labels beyond 20 bits are refused
+func (conn *RawIPConn) SetFlowLabel(label uint32) error {
+	if label > maxFlowLabel {
+		return fmt.Errorf("flow label %#x does not fit in 20 bits", label)
+	}
+	conn.flowLabel.Store(label)
+	return nil
+}
+
+// tos returns the TOS byte, or traffic class, of the next packet: the one of wo if any, else the one of the conn
+func (conn *RawIPConn) tos(wo *writeOptions) uint8 {
+	if wo != nil && wo.setTrafficClass {
+		return wo.trafficClass
+	}
+	return uint8(conn.trafficClass.Load())
+}
+
+// flowLabelOf returns the flow label of the next IPv6 packet to dstIP with the payload segs: the one of wo if any,
+// else the one set on the conn, else the one derived from its flow WithAutoFlowLabel
+func (conn *RawIPConn) flowLabelOf(dstIP net.IP, segs [][]byte, wo *writeOptions) uint32 {
+	if wo != nil && wo.setFlowLabel {
+		return wo.flowLabel
+	}
+	if label := conn.flowLabel.Load(); label != 0 {
+		return label
+	}
+	config := conn.config.Load()
+	if !config.autoFlowLabel {
+		return 0
+	}
+	srcPort, dstPort := flowPorts(config.protocol, segs)
+	return AutoFlowLabel(config.localIP, dstIP, config.protocol, srcPort, dstPort)
+}
+
+// flowPorts returns the ports opening the payload segs of a TCP, UDP or SCTP packet, 0 for other protocols
+func flowPorts(protocol layers.IPProtocol, segs [][]byte) (srcPort, dstPort uint16) {
+	switch protocol {
+	case layers.IPProtocolTCP, layers.IPProtocolUDP, layers.IPProtocolSCTP, layers.IPProtocolUDPLite:
+	default:
+		return 0, 0
+	}
+	var ports [4]byte
+	n := 0
+	for _, seg := range segs {
+		n += copy(ports[n:], seg)
+	}
+	if n < len(ports) {
+		return 0, 0
+	}
+	return uint16(ports[0])<<8 | uint16(ports[1]), uint16(ports[2])<<8 | uint16(ports[3])
+}
+
+// ipv6PayloadLimit returns the largest payload an IPv6 write with the extension headers exts accepts. Beyond 65535
+// bytes after the header, the packet is a jumbogram, whose Jumbo Payload option takes room as well: the limit is the
+// one of jumbograms if the MTU fits larger ones than regular packets
+func (conn *RawIPConn) ipv6PayloadLimit(exts []IPv6ExtensionHeader) int {
+	chainLen := ipv6ExtensionsLen(exts)
+	limit := conn.payloadLimit(ipv6HeaderLen + chainLen)
+	largest := 0xffff - chainLen // the largest payload of a regular packet
+	if limit > 0 && limit <= largest {
+		return limit
+	}
+	jumboExts, err := jumboChain(exts)
+	if err != nil {
+		return largest // e.g. a Fragment header, which jumbograms cannot carry
+	}
+	if jumbo := conn.payloadLimit(ipv6HeaderLen + ipv6ExtensionsLen(jumboExts)); jumbo > largest {
+		return jumbo
+	}
+	return largest
+}
+
+// buildIPv6Packet wraps the concatenation of segs, size bytes long, into an IPv6 packet from the conn to dstIP, with
+// the header fields of the conn overridden by wo, if not nil. Its TTL goes into the hop limit
+func (conn *RawIPConn) buildIPv6Packet(dstIP net.IP, size int, segs [][]byte, wo *writeOptions) (gopacket.Packet, error) {
+	config := conn.config.Load()
+	header, err := BuildIPv6Header(IPv6Config{
+		Src:          config.localIP.To16(),
+		Dst:          dstIP.To16(),
+		NextHeader:   config.protocol,
+		HopLimit:     conn.ttl(),
+		TrafficClass: conn.tos(wo),
+		FlowLabel:    conn.flowLabelOf(dstIP, segs, wo),
+		PayloadLen:   size,
+		Extensions:   wo.extensionHeaders(),
+		LinkMTU:      conn.linkMTU(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the packet owns data, upper layer checksums are left to the caller like for IPv4
+	data := make([]byte, len(header)+size)
+	offset := copy(data, header)
+	for _, seg := range segs {
+		offset += copy(data[offset:], seg)
+	}
+	return gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.DecodeOptions{NoCopy: true}), nil
+}
+
+// isIPv6Packet tells if data, an IP packet, is an IPv6 one
+func isIPv6Packet(data []byte) bool {
+	return len(data) > 0 && data[0]>>4 == 6
+}
+
+// protocolFamilyIPv6Windows is AF_INET6 of Windows, the family the Npcap loopback adapter gives IPv6 packets
+const protocolFamilyIPv6Windows layers.ProtocolFamily = 23
+
+func init() {
+	// gopacket only decodes the IPv6 families of the BSDs and Linux
+	layers.ProtocolFamilyMetadata[protocolFamilyIPv6Windows] = layers.EnumMetadata{
+		DecodeWith: layers.LayerTypeIPv6,
+		Name:       "IPv6",
+		LayerType:  layers.LayerTypeIPv6,
+	}
+}
+
+// loopbackFamily returns the address family loopback headers give to IPv4 or IPv6 packets on the platform
+func loopbackFamily(ipv6 bool) layers.ProtocolFamily {
+	switch {
+	case !ipv6:
+		return layers.ProtocolFamilyIPv4
+	case runtime.GOOS == "darwin":
+		return layers.ProtocolFamilyIPv6Darwin
+	case runtime.GOOS == "freebsd":
+		return layers.ProtocolFamilyIPv6FreeBSD
+	default:
+		return protocolFamilyIPv6Windows
+	}
+}
@@ -0,0 +1,418 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// IPv6 addresses of the client and server side of a memPair
+var (
+	testClientIPv6 = net.ParseIP("2001:db8::1")
+	testServerIPv6 = net.ParseIP("2001:db8::2")
+)
+
+// dialIPv6 opens an IPv6 conn of the client core to the server. Without opts setting a MAC, the next hop is resolved
+// with Neighbor Discovery, which the transport answers
+func (p *memPair) dialIPv6(tb testing.TB, protocol layers.IPProtocol, opts ...ConnOption) *RawIPConn {
+	tb.Helper()
+
+	config := p.client.newConnConfig(protocol, opts)
+	config.localIP, config.remoteIP, config.nextHopIP = testClientIPv6, testServerIPv6, testServerIPv6
+	conn, err := p.cs.dialIP(config)
+	if err != nil {
+		tb.Fatalf("dial: %v", err)
+	}
+	conn.resolveNextHop()
+	if err := conn.ResolutionError(); err != nil {
+		tb.Fatalf("resolve %v: %v", testServerIPv6, err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestIPv6RoundTrip(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIPv6, layers.IPProtocolUDP)
+	conn := p.dialIPv6(t, layers.IPProtocolUDP, WithTTL(9), WithTOS(0x28))
+
+	// the solicitation was answered with the MAC address of the server side, and cached
+	if conn.nextHopMAC.String() != memoryMACs[1].String() {
+		t.Fatalf("next hop %v resolved to %v, want %v", testServerIPv6, conn.nextHopMAC, memoryMACs[1])
+	}
+	if mac, found := p.cs.cachedMAC(testServerIPv6); !found || mac.String() != memoryMACs[1].String() {
+		t.Errorf("cached MAC of %v: %v, %v", testServerIPv6, mac, found)
+	}
+	if got, want := conn.MaxPayload(), testIface().MTU-ipv6HeaderLen; got != want {
+		t.Errorf("max payload %d, want %d", got, want)
+	}
+
+	if _, err := conn.Write([]byte("ping6")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	packet, err := listener.readPacket()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	ip, _ := (*packet).Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if ip == nil {
+		t.Fatalf("listener got %v, want an IPv6 packet", *packet)
+	}
+	if ip.HopLimit != 9 || ip.TrafficClass != 0x28 || ip.NextHeader != layers.IPProtocolUDP || !ip.SrcIP.Equal(testClientIPv6) {
+		t.Errorf("written with hop limit %d, traffic class %#02x and next header %v from %v", ip.HopLimit, ip.TrafficClass, ip.NextHeader, ip.SrcIP)
+	}
+	if data, src := listener.readData(*packet); string(data) != "ping6" || !src.Equal(testClientIPv6) {
+		t.Errorf("listener read %q from %v", data, src)
+	}
+
+	if _, err := listener.WriteTo([]byte("pong6"), &net.IPAddr{IP: testClientIPv6}); err != nil {
+		t.Fatalf("reply: %v", err)
+	}
+	if got := readTimeout(t, conn, time.Second); string(got) != "pong6" {
+		t.Fatalf("conn read %q, want %q", got, "pong6")
+	}
+
+	// the families of a conn do not mix
+	if _, err := conn.WriteTo([]byte("x"), &net.IPAddr{IP: testServerIP}); !errors.Is(err, ErrAddressFamilyMismatch) {
+		t.Errorf("write to IPv4 from an IPv6 conn: %v, want ErrAddressFamilyMismatch", err)
+	}
+	if _, err := conn.WriteLayers(&layers.IPv4{Protocol: layers.IPProtocolUDP}); !errors.Is(err, ErrIPv6Unsupported) {
+		t.Errorf("WriteLayers on an IPv6 conn: %v, want ErrIPv6Unsupported", err)
+	}
+}
+
+// TestIPv6ReadSkipsExtensionHeaders checks that reads return what follows the extension headers of a packet, and that
+// packets whose chain of extension headers is malformed are dropped as decode errors
+func TestIPv6ReadSkipsExtensionHeaders(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIPv6, layers.IPProtocolUDP)
+
+	frame := func(extensions []IPv6ExtensionHeader, payload []byte) []byte {
+		header, err := BuildIPv6Header(IPv6Config{
+			Src:        testClientIPv6,
+			Dst:        testServerIPv6,
+			NextHeader: layers.IPProtocolUDP,
+			PayloadLen: len(payload),
+			Extensions: extensions,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the Ethernet header alone, serialized, would be padded to the minimum frame size
+		eth := append(append([]byte(nil), memoryMACs[1]...), memoryMACs[0]...)
+		eth = binary.BigEndian.AppendUint16(eth, uint16(layers.EthernetTypeIPv6))
+		return append(append(eth, header...), payload...)
+	}
+
+	routerAlert := IPv6Option{Type: 5, Data: []byte{0, 0}}
+	for _, extensions := range [][]IPv6ExtensionHeader{
+		nil,
+		{IPv6HopByHop{Options: []IPv6Option{routerAlert}}},
+		{IPv6HopByHop{}, IPv6DestinationOptions{}},
+	} {
+		payload := []byte("after the chain")
+		if err := p.cs.writeFrame(frame(extensions, payload)); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTimeout(t, listener, time.Second); !bytes.Equal(got, payload) {
+			t.Errorf("with %d extension headers, read %q, want %q", len(extensions), got, payload)
+		}
+	}
+
+	// a Destination Options header announced but cut short
+	before := p.ss.decodeErrors.Load()
+	malformed := frame(nil, []byte{byte(layers.IPProtocolUDP), 4, 0, 0})
+	malformed[14+6] = byte(layers.IPProtocolIPv6Destination)
+	if err := p.cs.writeFrame(malformed); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for p.ss.decodeErrors.Load() == before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if p.ss.decodeErrors.Load() == before {
+		t.Error("malformed extension header chain not counted as a decode error")
+	}
+	listener.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := listener.Read(make([]byte, 64)); err == nil {
+		t.Error("packet with a malformed extension header chain delivered")
+	}
+}
+
+// TestNeighborAdvertisementValidation checks that only valid advertisements resolve addresses, and that multicast
+// addresses are never solicited
+func TestNeighborAdvertisementValidation(t *testing.T) {
+	p := newMemPair(t)
+	target := net.ParseIP("fe80::99")
+
+	advertisement := func(tb testing.TB, mutate func(payload []byte)) []byte {
+		frame, err := buildNeighborAdvertisement(memoryMACs[1], memoryMACs[0], target, testClientIPv6, ndFlagSolicited)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		payload := frame[14:]
+		mutate(payload)
+		return payload
+	}
+	tests := []struct {
+		name   string
+		mutate func(payload []byte)
+		valid  bool
+	}{
+		{"valid", func([]byte) {}, true},
+		{"forwarded", func(b []byte) { b[7] = 64 }, false}, // hop limit below 255: not from the link
+		{"bad checksum", func(b []byte) { b[ipv6HeaderLen+2] ^= 0xff }, false},
+	}
+	for _, tt := range tests {
+		reply := p.cs.arp.wait(toAddr(target))
+		before := p.cs.decodeErrors.Load()
+		p.cs.handleNeighborAdvertisement(advertisement(t, tt.mutate))
+		select {
+		case mac := <-reply:
+			if !tt.valid {
+				t.Errorf("%s advertisement resolved %v to %v", tt.name, target, mac)
+			} else if mac.String() != memoryMACs[1].String() {
+				t.Errorf("%s advertisement resolved %v to %v, want %v", tt.name, target, mac, memoryMACs[1])
+			}
+		default:
+			if tt.valid {
+				t.Errorf("%s advertisement did not resolve %v", tt.name, target)
+			}
+		}
+		p.cs.arp.cancel(toAddr(target), reply)
+		if tt.name == "bad checksum" && p.cs.decodeErrors.Load() == before {
+			t.Error("advertisement with a bad checksum not counted as a decode error")
+		}
+	}
+
+	if mac, err := p.cs.resolveMAC(net.ParseIP("ff02::1:ff00:2")); err != nil || mac.String() != "33:33:ff:00:00:02" {
+		t.Errorf("multicast address resolved to %v, %v, want 33:33:ff:00:00:02", mac, err)
+	}
+}
+
+func TestDialIPv6Errors(t *testing.T) {
+	core := NewRawSocketCore(60, 1, WithHandleFactory(NewMemoryTransport().A()))
+	defer core.Close()
+
+	if _, err := core.DialIP(layers.IPProtocolUDP, nil, net.ParseIP("fe80::1")); !errors.Is(err, ErrZoneRequired) {
+		t.Errorf("dial to a link-local address without interface: %v, want ErrZoneRequired", err)
+	}
+	if _, err := core.DialIP(layers.IPProtocolUDP, nil, net.ParseIP("2001:db8::1"), WithNextHop(net.ParseIP("fe80::1"))); !errors.Is(err, ErrZoneRequired) {
+		t.Errorf("dial through a link-local router without interface: %v, want ErrZoneRequired", err)
+	}
+	// documentation addresses are on-link for no interface of the host
+	if _, err := core.DialIP(layers.IPProtocolUDP, nil, net.ParseIP("2001:db8::1")); !errors.Is(err, ErrNoRouteToHost) {
+		t.Errorf("dial to an off-link address without router: %v, want ErrNoRouteToHost", err)
+	}
+	if _, err := core.DialIP(layers.IPProtocolUDP, net.ParseIP("2001:db8::3"), net.ParseIP("2001:db8::1")); !errors.Is(err, ErrNotLocalIP) {
+		t.Errorf("dial from an address of no interface: %v, want ErrNotLocalIP", err)
+	}
+	if _, err := core.DialIP(layers.IPProtocolUDP, nil, net.ParseIP("fe80::1"), WithInterface("nosuchiface0")); !errors.Is(err, ErrInterfaceNotFound) {
+		t.Errorf("dial through a missing interface: %v, want ErrInterfaceNotFound", err)
+	}
+}
+
+// TestIPv6FlowLabelAndTrafficClass checks the traffic class and flow label of written packets as received: from the
+// conn, its setters, per-write overrides and WithAutoFlowLabel
+func TestIPv6FlowLabelAndTrafficClass(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIPv6, layers.IPProtocolUDP)
+	conn := p.dialIPv6(t, layers.IPProtocolUDP, WithTOS(0x10))
+
+	expect := func(name string, tc uint8, label uint32) {
+		t.Helper()
+		buf := make([]byte, 64)
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		_, meta, err := listener.ReadWithMeta(buf)
+		if err != nil {
+			t.Fatalf("%s: read: %v", name, err)
+		}
+		if meta.TOS != tc || meta.FlowLabel != label {
+			t.Errorf("%s: traffic class %#02x and flow label %#x, want %#02x and %#x", name, meta.TOS, meta.FlowLabel, tc, label)
+		}
+	}
+	write := func(name string, payload []byte, opts ...WriteOption) {
+		t.Helper()
+		if _, err := conn.WriteWithOptions(payload, opts...); err != nil {
+			t.Fatalf("%s: write: %v", name, err)
+		}
+	}
+	payload := []byte("same payload")
+
+	write("conn defaults", payload)
+	expect("conn defaults", 0x10, 0)
+
+	conn.SetTrafficClass(0xb8)
+	if err := conn.SetFlowLabel(0x12345); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetFlowLabel(maxFlowLabel + 1); err == nil {
+		t.Error("flow label beyond 20 bits accepted")
+	}
+	write("setters", payload)
+	expect("setters", 0xb8, 0x12345)
+
+	// identical payloads with differing labels, the conn's being left as is
+	for _, label := range []uint32{0, 1, maxFlowLabel} {
+		write("override", payload, WithPacketFlowLabel(label), WithPacketTrafficClass(0))
+		expect("override", 0, label)
+	}
+	write("after the overrides", payload)
+	expect("after the overrides", 0xb8, 0x12345)
+	if _, err := conn.WriteWithOptions(payload, WithPacketFlowLabel(maxFlowLabel+1)); err == nil {
+		t.Error("write with a flow label beyond 20 bits accepted")
+	}
+
+	// a label derived from the 5-tuple, stable for the flow
+	conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for p.cs.conns.lookup(layers.IPProtocolUDP, toAddr(testClientIPv6), toAddr(testServerIPv6)) != nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	auto := p.dialIPv6(t, layers.IPProtocolUDP, WithAutoFlowLabel())
+	udp := func(srcPort, dstPort uint16) []byte {
+		return []byte{byte(srcPort >> 8), byte(srcPort), byte(dstPort >> 8), byte(dstPort), 0, 8, 0, 0}
+	}
+	flows := [][2]uint16{{1000, 53}, {1000, 53}, {1001, 53}}
+	for _, flow := range flows {
+		if _, err := auto.Write(udp(flow[0], flow[1])); err != nil {
+			t.Fatal(err)
+		}
+		want := AutoFlowLabel(testClientIPv6, testServerIPv6, layers.IPProtocolUDP, flow[0], flow[1])
+		expect("auto", 0, want)
+	}
+	if AutoFlowLabel(testClientIPv6, testServerIPv6, layers.IPProtocolUDP, 1000, 53) == AutoFlowLabel(testClientIPv6, testServerIPv6, layers.IPProtocolUDP, 1001, 53) {
+		t.Error("flows of different ports share their label")
+	}
+
+	// IPv4 packets have a TOS byte, but no flow label
+	listener4 := p.listen(t, testServerIP, layers.IPProtocolUDP)
+	conn4 := p.dial(t, layers.IPProtocolUDP)
+	if _, err := conn4.WriteWithOptions(payload, WithPacketFlowLabel(1)); !errors.Is(err, ErrAddressFamilyMismatch) {
+		t.Errorf("IPv4 write with a flow label: %v, want ErrAddressFamilyMismatch", err)
+	}
+	if _, err := conn4.WriteWithOptions(payload, WithPacketTrafficClass(0x28)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	listener4.SetReadDeadline(time.Now().Add(time.Second))
+	if _, meta, err := listener4.ReadWithMeta(buf); err != nil || meta.TOS != 0x28 {
+		t.Errorf("IPv4 write with a traffic class: TOS %#02x, %v, want 0x28", meta.TOS, err)
+	}
+}
+
+// TestWriteIPv6Extensions writes packets with extension headers and checks that they arrive in order, ahead of the
+// payload, and count against the payload limit
+func TestWriteIPv6Extensions(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIPv6, layers.IPProtocolUDP)
+	conn := p.dialIPv6(t, layers.IPProtocolUDP)
+
+	routerAlert := IPv6Option{Type: 5, Data: []byte{0, 0}}
+	chain := []IPv6ExtensionHeader{
+		IPv6HopByHop{Options: []IPv6Option{routerAlert}},
+		IPv6DestinationOptions{Options: []IPv6Option{{Type: 0x1e, Data: []byte("experiment")}}},
+		IPv6Fragment{ID: 42},
+	}
+	if _, err := conn.WriteWithOptions([]byte("behind the chain"), WithPacketExtensions(chain...)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	packet, err := listener.readPacket()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	ip := (*packet).Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if ip.NextHeader != layers.IPProtocolIPv6HopByHop || ip.HopByHop == nil || ip.HopByHop.NextHeader != layers.IPProtocolIPv6Destination {
+		t.Errorf("chain starts with %v, then %v", ip.NextHeader, ip.HopByHop)
+	}
+	if (*packet).Layer(layers.LayerTypeIPv6Destination) == nil || (*packet).Layer(layers.LayerTypeIPv6Fragment) == nil {
+		t.Errorf("Destination Options or Fragment header missing: %v", *packet)
+	}
+	if data, _ := listener.readData(*packet); string(data) != "behind the chain" {
+		t.Errorf("listener read %q", data)
+	}
+	if meta := newPacketMeta(*packet, testIface().Name); meta.Protocol != layers.IPProtocolUDP {
+		t.Errorf("packet meta protocol %v, want UDP", meta.Protocol)
+	}
+
+	// the chain takes room from the payload
+	chainLen := 8 + 16 + 8
+	limit := testIface().MTU - ipv6HeaderLen - chainLen
+	if _, err := conn.WriteWithOptions(make([]byte, limit), WithPacketExtensions(chain...)); err != nil {
+		t.Errorf("write of %d bytes behind %d bytes of extension headers: %v", limit, chainLen, err)
+	}
+	var tooLong *MessageTooLongError
+	if _, err := conn.WriteWithOptions(make([]byte, limit+1), WithPacketExtensions(chain...)); !errors.As(err, &tooLong) || tooLong.Limit != limit {
+		t.Errorf("write of %d bytes behind the chain: %v, want a limit of %d", limit+1, err, limit)
+	}
+
+	if _, err := conn.WriteWithOptions([]byte("x"), WithPacketExtensions(IPv6DestinationOptions{}, IPv6HopByHop{})); err == nil {
+		t.Error("Hop-by-Hop header after another one accepted")
+	}
+	if _, err := p.dial(t, layers.IPProtocolUDP).WriteWithOptions([]byte("x"), WithPacketExtensions(IPv6HopByHop{})); !errors.Is(err, ErrAddressFamilyMismatch) {
+		t.Errorf("extension headers on an IPv4 conn: %v, want ErrAddressFamilyMismatch", err)
+	}
+}
+
+// TestIPv6Jumbogram checks that on a link of a jumbo MTU, payloads beyond 65535 bytes are written as jumbograms, the
+// Jumbo Payload option taking room from the payload, and that the limit stays the one of regular packets otherwise
+func TestIPv6Jumbogram(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIPv6, layers.IPProtocolUDP)
+	conn := p.dialIPv6(t, layers.IPProtocolUDP)
+
+	const mtu = 100000
+	p.cs.setMTU(mtu)
+	limit := mtu - ipv6HeaderLen - 8 // the Hop-by-Hop header of the Jumbo Payload option
+	if got := conn.MaxPayload(); got != limit {
+		t.Errorf("MaxPayload %d on an MTU of %d, want %d", got, mtu, limit)
+	}
+	data := make([]byte, 70000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("write of %d bytes: %v", len(data), err)
+	}
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	packet, err := listener.readPacket()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	ip := (*packet).Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if ip.Length != 0 || ip.HopByHop == nil {
+		t.Errorf("jumbogram with a payload length of %d and Hop-by-Hop header %v", ip.Length, ip.HopByHop)
+	}
+	if got, _ := listener.readData(*packet); !bytes.Equal(got, data) {
+		t.Errorf("listener read %d bytes, want the %d written", len(got), len(data))
+	}
+
+	var tooLong *MessageTooLongError
+	if _, err := conn.Write(make([]byte, limit+1)); !errors.As(err, &tooLong) || tooLong.Limit != limit {
+		t.Errorf("write of %d bytes: %v, want a limit of %d", limit+1, err, limit)
+	}
+	// a Hop-by-Hop header of the conn's takes the option, a Fragment header rules jumbograms out
+	hopByHop := IPv6HopByHop{Options: []IPv6Option{{Type: 5, Data: []byte{0, 0}}}}
+	if _, err := conn.WriteWithOptions(data, WithPacketExtensions(hopByHop)); err != nil {
+		t.Errorf("jumbogram behind a Hop-by-Hop header: %v", err)
+	}
+	if _, err := conn.WriteWithOptions(data, WithPacketExtensions(IPv6Fragment{})); !errors.As(err, &tooLong) || tooLong.Limit != 0xffff-8 {
+		t.Errorf("jumbogram behind a Fragment header: %v, want a limit of %d", err, 0xffff-8)
+	}
+
+	// an MTU just large enough for regular packets does not allow jumbograms
+	p.cs.setMTU(ipv6HeaderLen + 0xffff + 4)
+	if got := conn.MaxPayload(); got != 0xffff {
+		t.Errorf("MaxPayload %d on an MTU just above the largest regular packet, want %d", got, 0xffff)
+	}
+}
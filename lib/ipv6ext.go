@@ -0,0 +1,194 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+)
+
+// maxIPv6Extensions bounds the extension headers walked before the upper layer, against chains crafted to never end
+const maxIPv6Extensions = 8
+
+// ErrMalformedIPv6Chain is returned for IPv6 extension header chains that are truncated or too long
+var ErrMalformedIPv6Chain = errors.New("rawsocket: malformed IPv6 extension header chain")
+
+// IPv6Option is a TLV option of a Hop-by-Hop or Destination Options header, e.g. Router Alert (type 5)
+type IPv6Option struct {
+	Type uint8
+	Data []byte
+}
+
+// IPv6ExtensionHeader is an extension header BuildIPv6Header places between the IPv6 header and the payload
+type IPv6ExtensionHeader interface {
+	protocol() layers.IPProtocol
+	marshal(next layers.IPProtocol) []byte
+}
+
+// IPv6HopByHop is the Hop-by-Hop Options header, which must come first in the chain
+type IPv6HopByHop struct {
+	Options []IPv6Option
+}
+
+// IPv6DestinationOptions is the Destination Options header
+type IPv6DestinationOptions struct {
+	Options []IPv6Option
+}
+
+// IPv6Fragment is the Fragment header. Offset is in 8 bytes units
+type IPv6Fragment struct {
+	Offset uint16 // 13 bits
+	More   bool
+	ID     uint32
+}
+
+func (h IPv6HopByHop) protocol() layers.IPProtocol { return layers.IPProtocolIPv6HopByHop }
+
+func (h IPv6HopByHop) marshal(next layers.IPProtocol) []byte {
+	return marshalIPv6Options(next, h.Options)
+}
+
+func (h IPv6DestinationOptions) protocol() layers.IPProtocol { return layers.IPProtocolIPv6Destination }
+
+func (h IPv6DestinationOptions) marshal(next layers.IPProtocol) []byte {
+	return marshalIPv6Options(next, h.Options)
+}
+
+func (h IPv6Fragment) protocol() layers.IPProtocol { return layers.IPProtocolIPv6Fragment }
+
+func (h IPv6Fragment) marshal(next layers.IPProtocol) []byte {
+	b := make([]byte, 8)
+	b[0] = byte(next)
+	offset := (h.Offset & 0x1fff) << 3
+	if h.More {
+		offset |= 1
+	}
+	binary.BigEndian.PutUint16(b[2:], offset)
+	binary.BigEndian.PutUint32(b[4:], h.ID)
+	return b
+}
+
+// marshalIPv6Options returns an options header carrying opts, padded to a multiple of 8 bytes with Pad1 and PadN
+func marshalIPv6Options(next layers.IPProtocol, opts []IPv6Option) []byte {
+	b := []byte{byte(next), 0}
+	for _, opt := range opts {
+		b = append(b, opt.Type, byte(len(opt.Data)))
+		b = append(b, opt.Data...)
+	}
+	switch pad := (8 - len(b)%8) % 8; pad {
+	case 0:
+	case 1:
+		b = append(b, 0) // Pad1
+	default:
+		b = append(b, 1, byte(pad-2)) // PadN
+		b = append(b, make([]byte, pad-2)...)
+	}
+	b[1] = byte(len(b)/8 - 1)
+	return b
+}
+
+// ipv6JumboOption is the type of the Jumbo Payload option (RFC 2675), whose data is the 32 bits payload length
+const ipv6JumboOption = 0xc2
+
+// jumboExtensions returns the extension header chain of the jumbogram described by cfg: its Hop-by-Hop header, added
+// if needed, starts with a Jumbo Payload option giving the length of everything after the IPv6 header
+func jumboExtensions(cfg IPv6Config) ([]byte, layers.IPProtocol, error) {
+	exts, err := jumboChain(cfg.Extensions)
+	if err != nil {
+		return nil, 0, err
+	}
+	chain, next, err := marshalIPv6Extensions(exts, cfg.NextHeader)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := ipv6HeaderLen + len(chain) + cfg.PayloadLen
+	if uint64(len(chain)+cfg.PayloadLen) > 0xffffffff || size > cfg.LinkMTU {
+		return nil, 0, fmt.Errorf("ipv6 header: jumbogram of %d bytes exceeds the link MTU %d: %w", size, cfg.LinkMTU, ErrMessageTooLong)
+	}
+	// the option data follows the Next Header, Hdr Ext Len, option type and option length bytes
+	binary.BigEndian.PutUint32(chain[4:], uint32(len(chain)+cfg.PayloadLen))
+	return chain, next, nil
+}
+
+// jumboChain returns exts with a Jumbo Payload option, still 0, first in their Hop-by-Hop header, added if needed
+func jumboChain(exts []IPv6ExtensionHeader) ([]IPv6ExtensionHeader, error) {
+	hopByHop := IPv6HopByHop{}
+	if len(exts) > 0 {
+		if h, ok := exts[0].(IPv6HopByHop); ok {
+			hopByHop, exts = h, exts[1:]
+		}
+	}
+	for _, ext := range exts {
+		if _, ok := ext.(IPv6Fragment); ok {
+			return nil, fmt.Errorf("ipv6 header: a jumbogram cannot carry a Fragment header")
+		}
+	}
+	// first, so that the option is 4n+2 aligned as it requires
+	jumbo := IPv6Option{Type: ipv6JumboOption, Data: make([]byte, 4)}
+	hopByHop.Options = append([]IPv6Option{jumbo}, hopByHop.Options...)
+	return append([]IPv6ExtensionHeader{hopByHop}, exts...), nil
+}
+
+// ipv6ExtensionsLen returns the length of the chain of exts
+func ipv6ExtensionsLen(exts []IPv6ExtensionHeader) int {
+	n := 0
+	for _, ext := range exts {
+		n += len(ext.marshal(layers.IPProtocolNoNextHeader))
+	}
+	return n
+}
+
+// marshalIPv6Extensions returns the chain of exts ending in the upper layer protocol, and the protocol of its first
+// header, for the Next Header field of the IPv6 header
+func marshalIPv6Extensions(exts []IPv6ExtensionHeader, upper layers.IPProtocol) ([]byte, layers.IPProtocol, error) {
+	var chain []byte
+	for i, ext := range exts {
+		if _, ok := ext.(IPv6HopByHop); ok && i > 0 {
+			return nil, 0, fmt.Errorf("ipv6 header: the Hop-by-Hop header must come first")
+		}
+		next := upper
+		if i+1 < len(exts) {
+			next = exts[i+1].protocol()
+		}
+		chain = append(chain, ext.marshal(next)...)
+	}
+	if len(exts) == 0 {
+		return nil, upper, nil
+	}
+	return chain, exts[0].protocol(), nil
+}
+
+// ipv6UpperLayer walks the extension headers at the start of payload, whose first one is next, and returns the upper
+// layer protocol with its payload. A Fragment header with a non zero offset ends the walk: what follows is not a header
+func ipv6UpperLayer(next layers.IPProtocol, payload []byte) (layers.IPProtocol, []byte, error) {
+	for i := 0; ; i++ {
+		var length int
+		switch next {
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+			if len(payload) < 2 {
+				return 0, nil, ErrMalformedIPv6Chain
+			}
+			length = (int(payload[1]) + 1) * 8
+		case layers.IPProtocolIPv6Fragment:
+			length = 8
+		case layers.IPProtocolAH:
+			if len(payload) < 2 {
+				return 0, nil, ErrMalformedIPv6Chain
+			}
+			length = (int(payload[1]) + 2) * 4
+		default:
+			return next, payload, nil
+		}
+		if i == maxIPv6Extensions || len(payload) < length {
+			return 0, nil, ErrMalformedIPv6Chain
+		}
+		if next == layers.IPProtocolIPv6Fragment && binary.BigEndian.Uint16(payload[2:])>>3 != 0 {
+			return layers.IPProtocol(payload[0]), payload[length:], nil
+		}
+		next, payload = layers.IPProtocol(payload[0]), payload[length:]
+	}
+}
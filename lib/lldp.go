@@ -0,0 +1,420 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// LLDP (IEEE 802.1AB) frames are sent to the nearest bridge group address, which switches consume instead of forwarding
+var lldpMulticastMAC = net.HardwareAddr{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}
+
+const (
+	defaultLLDPTTL      = 120 * time.Second
+	defaultLLDPInterval = 30 * time.Second
+)
+
+// LLDP TLV types
+const (
+	lldpTLVEnd               = 0
+	lldpTLVChassisID         = 1
+	lldpTLVPortID            = 2
+	lldpTLVTTL               = 3
+	lldpTLVPortDescription   = 4
+	lldpTLVSystemName        = 5
+	lldpTLVSystemDescription = 6
+	lldpTLVManagementAddress = 8
+)
+
+// Common LLDP chassis and port ID subtypes, telling how to read LLDPNeighbor.ChassisID and PortID.
+// LLDPAnnouncement sends a MAC address chassis ID and an interface name port ID
+const (
+	LLDPChassisIDMACAddress = 4
+	LLDPChassisIDLocal      = 7
+	LLDPPortIDMACAddress    = 3
+	LLDPPortIDInterfaceName = 5
+	LLDPPortIDLocal         = 7
+)
+
+const (
+	lldpTLVHeaderLen          = 2
+	lldpMaxTLVLen             = 511
+	lldpAddressFamilyIPv4     = 1
+	lldpAddressFamilyIPv6     = 2
+	lldpInterfaceNumberIndex  = 2  // ifIndex numbering of the management address TLV
+	lldpManagementAddrMinLen  = 9  // address string length, family, one address byte, numbering, number, OID length
+	lldpManagementAddrMaxAddr = 31 // longest management address
+)
+
+// LLDPAnnouncement describes the host to its link neighbors, see BuildLLDPFrame and RawSocketCore.AnnounceLLDP.
+// The zero value of every field selects its default.
+type LLDPAnnouncement struct {
+	ChassisID         net.HardwareAddr // chassis ID, sent as a MAC address. nil means the MAC of the interface
+	PortID            string           // port ID, sent as an interface name. "" means the name of the interface
+	TTL               time.Duration    // how long neighbors keep the information, rounded down to seconds. 0 means 120s
+	PortDescription   string           // optional TLVs, left out when empty
+	SystemName        string
+	SystemDescription string
+	ManagementAddr    net.IP // optional management address TLV, with the index of the interface. nil leaves it out
+}
+
+// LLDPNeighbor is what an LLDPDU received on an interface tells about the neighbor which sent it.
+// ChassisID and PortID are raw, to be interpreted according to their subtype.
+type LLDPNeighbor struct {
+	Interface         string // interface the LLDPDU was received on
+	SrcMAC            net.HardwareAddr
+	Received          time.Time
+	ChassisIDSubtype  uint8
+	ChassisID         []byte
+	PortIDSubtype     uint8
+	PortID            []byte
+	TTL               time.Duration // 0 means the neighbor is shutting down and its information is to be dropped
+	PortDescription   string
+	SystemName        string
+	SystemDescription string
+	ManagementAddrs   []net.IP
+}
+
+// appendLLDPTLV appends a TLV to b, its value truncated to the 511 bytes a TLV holds at most
+func appendLLDPTLV(b []byte, typ uint8, value ...[]byte) []byte {
+	n := 0
+	for _, v := range value {
+		n += len(v)
+	}
+	n = min(n, lldpMaxTLVLen)
+	b = binary.BigEndian.AppendUint16(b, uint16(typ)<<9|uint16(n))
+	for _, v := range value {
+		v = v[:min(len(v), n)]
+		b = append(b, v...)
+		n -= len(v)
+	}
+	return b
+}
+
+// BuildLLDPFrame returns the Ethernet frame of the LLDPDU announcing ann on iface, which gives its source MAC, the
+// defaults of the chassis and port IDs and the interface number of the management address
+func BuildLLDPFrame(iface *net.Interface, ann LLDPAnnouncement) ([]byte, error) {
+	if len(iface.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("interface %s has no Ethernet address", iface.Name)
+	}
+	chassisID, portID, ttl := ann.ChassisID, ann.PortID, ann.TTL
+	if chassisID == nil {
+		chassisID = iface.HardwareAddr
+	}
+	if portID == "" {
+		portID = iface.Name
+	}
+	if ttl == 0 {
+		ttl = defaultLLDPTTL
+	}
+	if ttl < 0 || ttl > 0xffff*time.Second {
+		return nil, fmt.Errorf("lldp: ttl %v out of range", ttl)
+	}
+
+	frame := make([]byte, 0, 128)
+	frame = append(frame, lldpMulticastMAC...)
+	frame = append(frame, iface.HardwareAddr...)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(layers.EthernetTypeLinkLayerDiscovery))
+
+	frame = appendLLDPTLV(frame, lldpTLVChassisID, []byte{LLDPChassisIDMACAddress}, chassisID)
+	frame = appendLLDPTLV(frame, lldpTLVPortID, []byte{LLDPPortIDInterfaceName}, []byte(portID))
+	frame = appendLLDPTLV(frame, lldpTLVTTL, binary.BigEndian.AppendUint16(nil, uint16(ttl/time.Second)))
+	if ann.PortDescription != "" {
+		frame = appendLLDPTLV(frame, lldpTLVPortDescription, []byte(ann.PortDescription))
+	}
+	if ann.SystemName != "" {
+		frame = appendLLDPTLV(frame, lldpTLVSystemName, []byte(ann.SystemName))
+	}
+	if ann.SystemDescription != "" {
+		frame = appendLLDPTLV(frame, lldpTLVSystemDescription, []byte(ann.SystemDescription))
+	}
+	if ann.ManagementAddr != nil {
+		family, addr := uint8(lldpAddressFamilyIPv6), ann.ManagementAddr.To16()
+		if ip4 := ann.ManagementAddr.To4(); ip4 != nil {
+			family, addr = lldpAddressFamilyIPv4, ip4
+		}
+		if addr == nil {
+			return nil, fmt.Errorf("lldp: invalid management address %v", ann.ManagementAddr)
+		}
+		value := []byte{byte(1 + len(addr)), family}
+		value = append(value, addr...)
+		value = append(value, lldpInterfaceNumberIndex)
+		value = binary.BigEndian.AppendUint32(value, uint32(iface.Index))
+		value = append(value, 0) // no OID
+		frame = appendLLDPTLV(frame, lldpTLVManagementAddress, value)
+	}
+	frame = appendLLDPTLV(frame, lldpTLVEnd)
+	return frame, nil
+}
+
+// parseLLDP decodes the LLDPDU payload of a frame. Real switches emit creative TLVs, so a malformed TLV is skipped and
+// decoding goes on with the next one; only a TLV running past the end of the frame stops it. It fails if the LLDPDU has
+// no chassis ID or port ID
+func parseLLDP(payload []byte) (LLDPNeighbor, error) {
+	var n LLDPNeighbor
+	var hasTTL bool
+	for len(payload) >= lldpTLVHeaderLen {
+		header := binary.BigEndian.Uint16(payload)
+		typ, length := uint8(header>>9), int(header&0x1ff)
+		if len(payload) < lldpTLVHeaderLen+length {
+			break // truncated: the next TLV cannot be found
+		}
+		value := payload[lldpTLVHeaderLen : lldpTLVHeaderLen+length]
+		payload = payload[lldpTLVHeaderLen+length:]
+
+		switch typ {
+		case lldpTLVEnd:
+			payload = nil
+		case lldpTLVChassisID:
+			if length >= 2 && n.ChassisID == nil {
+				n.ChassisIDSubtype, n.ChassisID = value[0], append([]byte(nil), value[1:]...)
+			}
+		case lldpTLVPortID:
+			if length >= 2 && n.PortID == nil {
+				n.PortIDSubtype, n.PortID = value[0], append([]byte(nil), value[1:]...)
+			}
+		case lldpTLVTTL:
+			if length >= 2 && !hasTTL {
+				n.TTL, hasTTL = time.Duration(binary.BigEndian.Uint16(value))*time.Second, true
+			}
+		case lldpTLVPortDescription:
+			n.PortDescription = string(value)
+		case lldpTLVSystemName:
+			n.SystemName = string(value)
+		case lldpTLVSystemDescription:
+			n.SystemDescription = string(value)
+		case lldpTLVManagementAddress:
+			if length < lldpManagementAddrMinLen {
+				continue
+			}
+			addrLen := int(value[0]) - 1 // the address string length counts the family byte
+			if addrLen < 1 || addrLen > lldpManagementAddrMaxAddr || 2+addrLen > length {
+				continue
+			}
+			switch addr := value[2 : 2+addrLen]; {
+			case value[1] == lldpAddressFamilyIPv4 && addrLen == net.IPv4len:
+				n.ManagementAddrs = append(n.ManagementAddrs, net.IPv4(addr[0], addr[1], addr[2], addr[3]))
+			case value[1] == lldpAddressFamilyIPv6 && addrLen == net.IPv6len:
+				n.ManagementAddrs = append(n.ManagementAddrs, append(net.IP(nil), addr...))
+			}
+		}
+	}
+	if n.ChassisID == nil || n.PortID == nil {
+		return n, errors.New("lldp: LLDPDU without chassis ID or port ID")
+	}
+	return n, nil
+}
+
+// lldpAgent holds the LLDP subscribers and announcers of a pcapSession, which keep it open
+type lldpAgent struct {
+	mu         sync.Mutex
+	subs       map[chan LLDPNeighbor]struct{}
+	announcers int
+	closed     bool // the session closed, and the channels of the subscribers with it
+}
+
+func newLLDPAgent() *lldpAgent {
+	return &lldpAgent{subs: make(map[chan LLDPNeighbor]struct{})}
+}
+
+// len returns the number of subscribers and announcers
+func (a *lldpAgent) len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.subs) + a.announcers
+}
+
+// subscribed tells if received LLDPDUs have to be decoded at all
+func (a *lldpAgent) subscribed() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.subs) > 0
+}
+
+// deliver hands n to every subscriber with room for it
+func (a *lldpAgent) deliver(n LLDPNeighbor) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for ch := range a.subs {
+		select {
+		case ch <- n:
+		default:
+		}
+	}
+}
+
+// close closes the channels of the subscribers and refuses new subscribers and announcers, when the session closes
+func (a *lldpAgent) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for ch := range a.subs {
+		close(ch)
+		delete(a.subs, ch)
+	}
+	a.closed = true
+}
+
+// handleLLDP hands the LLDPDU of a frame captured from srcMAC to the LLDP subscribers of the session
+func (ps *pcapSession) handleLLDP(payload []byte, srcMAC net.HardwareAddr, received time.Time) {
+	if !ps.lldp.subscribed() {
+		return
+	}
+	n, err := parseLLDP(payload)
+	if err != nil {
+		ps.decodeErrors.Add(1)
+		return
+	}
+	n.Interface = ps.params.iface.Name
+	n.SrcMAC = append(net.HardwareAddr(nil), srcMAC...)
+	n.Received = received
+	ps.lldp.deliver(n)
+}
+
+// lldpSession returns the acquired session of the named interface, which must carry Ethernet. The caller must release it
+func (core *RawSocketCore) lldpSession(ifaceName string) (*pcapSession, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %w", ifaceName, ErrInterfaceNotFound)
+	}
+	if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("lldp: interface %s is not an Ethernet interface", ifaceName)
+	}
+	ps, err := core.acquireSession(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pcap session: %w", err)
+	}
+	return ps, nil
+}
+
+// SubscribeLLDP returns a channel receiving the LLDPDUs captured on the named interface, decoded, and a func cancelling
+// the subscription. LLDPDUs arriving while the channel, buffering up to buffer of them, is full are dropped. The
+// pcapSession of the interface is kept open until the subscription is cancelled; the channel is closed then, or when
+// the core closes.
+func (core *RawSocketCore) SubscribeLLDP(ifaceName string, buffer int) (<-chan LLDPNeighbor, func(), error) {
+	ps, err := core.lldpSession(ifaceName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ps.release()
+
+	ch := make(chan LLDPNeighbor, max(buffer, 0))
+	ps.lldp.mu.Lock()
+	if ps.lldp.closed {
+		ps.lldp.mu.Unlock()
+		return nil, nil, ErrClosed
+	}
+	ps.lldp.subs[ch] = struct{}{}
+	ps.lldp.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			ps.lldp.mu.Lock()
+			if _, ok := ps.lldp.subs[ch]; ok {
+				delete(ps.lldp.subs, ch)
+				close(ch)
+			}
+			ps.lldp.mu.Unlock()
+			ps.lastActive.Store(time.Now().UnixNano())
+		})
+	}
+	return ch, cancel, nil
+}
+
+// AnnounceLLDP sends the LLDPDU announcing ann on the named interface right away, then every interval, 30s if
+// interval is 0, until the returned func is called. Stopping sends a last LLDPDU with a TTL of 0, telling the
+// neighbors to forget the host. The pcapSession of the interface is kept open meanwhile.
+func (core *RawSocketCore) AnnounceLLDP(ifaceName string, ann LLDPAnnouncement, interval time.Duration) (func(), error) {
+	if interval == 0 {
+		interval = defaultLLDPInterval
+	}
+	if interval < 0 {
+		return nil, fmt.Errorf("lldp: negative interval %v", interval)
+	}
+	ps, err := core.lldpSession(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+	defer ps.release()
+
+	frame, err := BuildLLDPFrame(ps.params.iface, ann)
+	if err != nil {
+		return nil, err
+	}
+	// the shutdown LLDPDU carries the mandatory TLVs only, with a TTL of 0
+	shutdown, _ := BuildLLDPFrame(ps.params.iface, LLDPAnnouncement{ChassisID: ann.ChassisID, PortID: ann.PortID})
+	shutdown = shutdownLLDPFrame(shutdown)
+
+	// registering under the lock the session takes to close the agent, so that it waits for the goroutine
+	ps.lldp.mu.Lock()
+	if ps.lldp.closed {
+		ps.lldp.mu.Unlock()
+		return nil, ErrClosed
+	}
+	ps.lldp.announcers++
+	ps.wg.Add(1)
+	ps.lldp.mu.Unlock()
+
+	stop := make(chan struct{})
+	go func() {
+		defer ps.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			ps.sendFrame(frame)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				ps.sendFrame(shutdown)
+				return
+			case <-ps.stopChan:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			ps.lldp.mu.Lock()
+			ps.lldp.announcers--
+			ps.lldp.mu.Unlock()
+			ps.lastActive.Store(time.Now().UnixNano())
+		})
+	}, nil
+}
+
+// shutdownLLDPFrame sets the TTL of an LLDP frame built by BuildLLDPFrame to 0
+func shutdownLLDPFrame(frame []byte) []byte {
+	tlvs := frame[14:]
+	for len(tlvs) >= lldpTLVHeaderLen {
+		header := binary.BigEndian.Uint16(tlvs)
+		length := int(header & 0x1ff)
+		if header>>9 == lldpTLVTTL {
+			binary.BigEndian.PutUint16(tlvs[lldpTLVHeaderLen:], 0)
+			break
+		}
+		tlvs = tlvs[lldpTLVHeaderLen+length:]
+	}
+	return frame
+}
+
+// sendFrame hands a complete link layer frame to the session for sending, unless it is stopping
+func (ps *pcapSession) sendFrame(frame []byte) {
+	select {
+	case ps.outgoingPackets <- &outboundPacket{frame: frame}:
+	case <-ps.stopChan:
+	default:
+		log.Println("Dropping link layer frame: outgoing queue is full")
+	}
+}
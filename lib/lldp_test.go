@@ -0,0 +1,95 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// lldpdu concatenates TLVs after the mandatory chassis ID, port ID and TTL ones
+func lldpdu(tlvs ...[]byte) []byte {
+	b := appendLLDPTLV(nil, lldpTLVChassisID, []byte{LLDPChassisIDLocal}, []byte("sw1"))
+	b = appendLLDPTLV(b, lldpTLVPortID, []byte{LLDPPortIDLocal}, []byte("ge-0/0/1"))
+	b = appendLLDPTLV(b, lldpTLVTTL, []byte{0, 120})
+	for _, tlv := range tlvs {
+		b = append(b, tlv...)
+	}
+	return b
+}
+
+func TestParseLLDPTolerance(t *testing.T) {
+	managementAddr := []byte{5, lldpAddressFamilyIPv4, 192, 0, 2, 7, lldpInterfaceNumberIndex, 0, 0, 0, 3, 0}
+	tests := []struct {
+		name       string
+		payload    []byte
+		systemName string
+		addrs      []net.IP
+		err        bool
+	}{
+		{"complete", lldpdu(
+			appendLLDPTLV(nil, lldpTLVSystemName, []byte("core")),
+			appendLLDPTLV(nil, lldpTLVManagementAddress, managementAddr),
+			appendLLDPTLV(nil, lldpTLVEnd),
+		), "core", []net.IP{net.IPv4(192, 0, 2, 7)}, false},
+		{"no End of LLDPDU", lldpdu(
+			appendLLDPTLV(nil, lldpTLVSystemName, []byte("core")),
+		), "core", nil, false},
+		{"TLVs after End of LLDPDU", lldpdu(
+			appendLLDPTLV(nil, lldpTLVEnd),
+			appendLLDPTLV(nil, lldpTLVSystemName, []byte("core")),
+		), "", nil, false},
+		{"half a TLV header", append(lldpdu(
+			appendLLDPTLV(nil, lldpTLVSystemName, []byte("core")),
+		), lldpTLVSystemDescription<<1), "core", nil, false},
+		{"truncated TLV", lldpdu(
+			appendLLDPTLV(nil, lldpTLVSystemName, []byte("core")),
+			appendLLDPTLV(nil, lldpTLVSystemDescription, []byte("cut short"))[:6],
+		), "core", nil, false},
+		{"length overrunning the frame", lldpdu(
+			[]byte{lldpTLVSystemName << 1, 0xff, 'c', 'o', 'r', 'e'},
+		), "", nil, false},
+		{"malformed TLVs skipped", lldpdu(
+			appendLLDPTLV(nil, lldpTLVManagementAddress, managementAddr[:4]),
+			appendLLDPTLV(nil, lldpTLVManagementAddress, append([]byte{40}, managementAddr[1:]...)),
+			appendLLDPTLV(nil, lldpTLVChassisID, []byte{LLDPChassisIDLocal}),
+			appendLLDPTLV(nil, lldpTLVSystemName, []byte("core")),
+		), "core", nil, false},
+		{"chassis ID in a truncated TLV", append(
+			appendLLDPTLV(nil, lldpTLVPortID, []byte{LLDPPortIDLocal}, []byte("ge-0/0/1")),
+			appendLLDPTLV(nil, lldpTLVChassisID, []byte{LLDPChassisIDLocal}, []byte("sw1"))[:4]...,
+		), "", nil, true},
+		{"no port ID", appendLLDPTLV(nil, lldpTLVChassisID, []byte{LLDPChassisIDLocal}, []byte("sw1")), "", nil, true},
+		{"empty", nil, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := parseLLDP(tt.payload)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("parsed %+v, want an error", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(n.ChassisID) != "sw1" || string(n.PortID) != "ge-0/0/1" || n.TTL != 120*time.Second {
+				t.Errorf("parsed chassis %q, port %q, ttl %v", n.ChassisID, n.PortID, n.TTL)
+			}
+			if n.SystemName != tt.systemName {
+				t.Errorf("system name %q, want %q", n.SystemName, tt.systemName)
+			}
+			if len(n.ManagementAddrs) != len(tt.addrs) {
+				t.Fatalf("management addresses %v, want %v", n.ManagementAddrs, tt.addrs)
+			}
+			for i, addr := range tt.addrs {
+				if !n.ManagementAddrs[i].Equal(addr) {
+					t.Errorf("management addresses %v, want %v", n.ManagementAddrs, tt.addrs)
+				}
+			}
+		})
+	}
+}
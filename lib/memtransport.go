@@ -0,0 +1,230 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// memoryQueueLen is the number of frames an endpoint of a MemoryTransport buffers before dropping newer ones, like a NIC
+const memoryQueueLen = 256
+
+// errMemoryEndpointClosed is returned by the reads and writes of a closed MemoryTransport endpoint
+var errMemoryEndpointClosed = errors.New("rawsocket: memory transport endpoint closed")
+
+// MemoryTransport wires two cores together in memory, as if each interface of one was cabled to the same interface
+// of the other, so that protocol logic can be tested in-process without privileges or real traffic:
+//
+//	transport := lib.NewMemoryTransport()
+//	client := lib.NewRawSocketCore(60, 1, lib.WithHandleFactory(transport.A()))
+//	server := lib.NewRawSocketCore(60, 1, lib.WithHandleFactory(transport.B()))
+//	listener, _ := server.ListenIP(ip, layers.IPProtocolUDP)
+//	conn, _ := client.DialIP(layers.IPProtocolUDP, ip, ip)
+//
+// The cores still pick interfaces and addresses from the host, so both sides use host addresses; a frame written by
+// a session of one core is read by the session of the other core on the same interface, never by the host.
+// The transport answers the ARP requests and Neighbor Solicitations of each side itself, with the locally administered
+// MAC address of the other side.
+type MemoryTransport struct {
+	mu      sync.Mutex
+	links   map[string]*memoryLink // by interface name
+	snaplen atomic.Int64           // bytes of each frame the endpoints capture, see SetSnaplen. 0 captures them whole
+}
+
+// memoryLink is the cable between the sessions of both sides on one interface
+type memoryLink struct {
+	mu   sync.Mutex
+	ends [2]*memoryEndpoint // current endpoint of each side, nil while the side has no session
+}
+
+// memoryMACs are the MAC addresses the transport gives in its ARP replies for the hosts of side A and B
+var memoryMACs = [2]net.HardwareAddr{
+	{0x02, 0x00, 0x00, 0x00, 0x00, 0x0a},
+	{0x02, 0x00, 0x00, 0x00, 0x00, 0x0b},
+}
+
+// NewMemoryTransport returns a transport with nothing attached yet
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{links: make(map[string]*memoryLink)}
+}
+
+// A returns the handle factory of the first core
+func (t *MemoryTransport) A() HandleFactory {
+	return t.factory(0)
+}
+
+// B returns the handle factory of the second core
+func (t *MemoryTransport) B() HandleFactory {
+	return t.factory(1)
+}
+
+// SetSnaplen makes the endpoints capture only the first n bytes of the frames read from then on, like a pcap handle of
+// that snaplen, still reporting the length of the whole frame. 0, the default, captures frames whole
+func (t *MemoryTransport) SetSnaplen(n int) {
+	t.snaplen.Store(int64(max(n, 0)))
+}
+
+func (t *MemoryTransport) factory(side int) HandleFactory {
+	return func(iface *net.Interface) (PacketIO, error) {
+		t.mu.Lock()
+		link, exists := t.links[iface.Name]
+		if !exists {
+			link = &memoryLink{}
+			t.links[iface.Name] = link
+		}
+		t.mu.Unlock()
+
+		end := &memoryEndpoint{
+			transport: t,
+			link:      link,
+			side:      side,
+			frames:    make(chan []byte, memoryQueueLen),
+			done:      make(chan struct{}),
+		}
+		link.mu.Lock()
+		link.ends[side] = end // a new session of the side replaces its closed one
+		link.mu.Unlock()
+		return end, nil
+	}
+}
+
+// memoryEndpoint is the PacketIO of a session attached to a MemoryTransport
+type memoryEndpoint struct {
+	transport *MemoryTransport
+	link      *memoryLink
+	side      int
+	frames    chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (e *memoryEndpoint) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	select {
+	case frame := <-e.frames:
+		ci := gopacket.CaptureInfo{Timestamp: time.Now(), Length: len(frame)}
+		if snaplen := int(e.transport.snaplen.Load()); snaplen > 0 && len(frame) > snaplen {
+			frame = frame[:snaplen]
+		}
+		ci.CaptureLength = len(frame)
+		return frame, ci, nil
+	case <-e.done:
+		return nil, gopacket.CaptureInfo{}, errMemoryEndpointClosed
+	}
+}
+
+// WritePacketData hands a copy of the frame to the other side, and answers it itself if it is an ARP request or a
+// Neighbor Solicitation
+func (e *memoryEndpoint) WritePacketData(data []byte) error {
+	select {
+	case <-e.done:
+		return errMemoryEndpointClosed
+	default:
+	}
+
+	if reply := memoryARPReply(data, memoryMACs[1-e.side]); reply != nil {
+		e.receive(reply)
+	} else if reply := memoryNDReply(data, memoryMACs[1-e.side]); reply != nil {
+		e.receive(reply)
+	}
+
+	e.link.mu.Lock()
+	peer := e.link.ends[1-e.side]
+	e.link.mu.Unlock()
+	if peer != nil {
+		peer.receive(append([]byte(nil), data...))
+	}
+	return nil
+}
+
+// SetBPFFilter accepts any filter without applying it: the sessions demultiplex by themselves
+func (e *memoryEndpoint) SetBPFFilter(expr string) error {
+	return nil
+}
+
+func (e *memoryEndpoint) Close() {
+	e.closeOnce.Do(func() {
+		close(e.done)
+		e.link.mu.Lock()
+		if e.link.ends[e.side] == e {
+			e.link.ends[e.side] = nil
+		}
+		e.link.mu.Unlock()
+	})
+}
+
+// receive queues a frame for the session of the endpoint, dropping it if the queue is full or the endpoint closed
+func (e *memoryEndpoint) receive(frame []byte) {
+	select {
+	case <-e.done:
+	case e.frames <- frame:
+	default:
+	}
+}
+
+// memoryARPReply returns the reply to frame, if it is an ARP request, giving mac as the address of the target
+func memoryARPReply(frame []byte, mac net.HardwareAddr) []byte {
+	if len(frame) < 14 || binary.BigEndian.Uint16(frame[12:14]) != uint16(layers.EthernetTypeARP) {
+		return nil
+	}
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	arpLayer := packet.Layer(layers.LayerTypeARP)
+	if arpLayer == nil {
+		return nil
+	}
+	request := arpLayer.(*layers.ARP)
+	if request.Operation != layers.ARPRequest {
+		return nil
+	}
+
+	eth := &layers.Ethernet{
+		SrcMAC:       mac,
+		DstMAC:       net.HardwareAddr(request.SourceHwAddress),
+		EthernetType: layers.EthernetTypeARP,
+	}
+	reply := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPReply,
+		SourceHwAddress:   []byte(mac),
+		SourceProtAddress: request.DstProtAddress,
+		DstHwAddress:      request.SourceHwAddress,
+		DstProtAddress:    request.SourceProtAddress,
+	}
+	b, err := serializeLayers(eth, reply)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// memoryNDReply returns the Neighbor Advertisement answering frame, if it is a Neighbor Solicitation, giving mac as the
+// address of the target
+func memoryNDReply(frame []byte, mac net.HardwareAddr) []byte {
+	if len(frame) < 14 || binary.BigEndian.Uint16(frame[12:14]) != uint16(layers.EthernetTypeIPv6) {
+		return nil
+	}
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	eth, _ := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip, _ := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	ns, _ := packet.Layer(layers.LayerTypeICMPv6NeighborSolicitation).(*layers.ICMPv6NeighborSolicitation)
+	if eth == nil || ip == nil || ns == nil || ip.SrcIP.IsUnspecified() {
+		return nil // Duplicate Address Detection probes are left unanswered
+	}
+
+	reply, err := buildNeighborAdvertisement(mac, eth.SrcMAC, ns.TargetAddress, ip.SrcIP, ndFlagSolicited|ndFlagOverride)
+	if err != nil {
+		return nil
+	}
+	return reply
+}
@@ -0,0 +1,220 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// addresses of the client and server side of a memPair. The sessions are opened on testIface directly, so they need
+// not be addresses of the host
+var (
+	testClientIP = net.IPv4(198, 51, 100, 1).To4()
+	testServerIP = net.IPv4(198, 51, 100, 2).To4()
+)
+
+// testIface is the interface the sessions of a memPair run on. A MemoryTransport never opens it, so it does not exist
+func testIface() *net.Interface {
+	return &net.Interface{
+		Index:        999,
+		MTU:          1500,
+		Name:         "memtest0",
+		HardwareAddr: net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01},
+		Flags:        net.FlagUp | net.FlagBroadcast | net.FlagMulticast,
+	}
+}
+
+// memPair is a client and a server core cabled together by a MemoryTransport, with the session of each on testIface
+type memPair struct {
+	transport      *MemoryTransport
+	client, server *RawSocketCore
+	cs, ss         *pcapSession
+}
+
+// newMemPair returns a pair of cores both created with opts, closed at the end of the test
+func newMemPair(tb testing.TB, opts ...CoreOption) *memPair {
+	tb.Helper()
+
+	transport := NewMemoryTransport()
+	p := &memPair{
+		transport: transport,
+		client:    NewRawSocketCore(60, 1, append(opts[:len(opts):len(opts)], WithHandleFactory(transport.A()))...),
+		server:    NewRawSocketCore(60, 1, append(opts[:len(opts):len(opts)], WithHandleFactory(transport.B()))...),
+	}
+	tb.Cleanup(func() {
+		p.client.Close()
+		p.server.Close()
+	})
+
+	// the sessions stay acquired until the end of the test, so that they are not reaped while they have no conn
+	var err error
+	if p.cs, err = p.client.acquireSession(testIface()); err != nil {
+		tb.Fatalf("client session: %v", err)
+	}
+	tb.Cleanup(p.cs.release)
+	if p.ss, err = p.server.acquireSession(testIface()); err != nil {
+		tb.Fatalf("server session: %v", err)
+	}
+	tb.Cleanup(p.ss.release)
+	return p
+}
+
+// dial opens a conn of the client core to the server, sending its frames to the MAC address the transport gives the server
+func (p *memPair) dial(tb testing.TB, protocol layers.IPProtocol, opts ...ConnOption) *RawIPConn {
+	tb.Helper()
+	return p.dialTo(tb, protocol, testServerIP, opts...)
+}
+
+// dialTo is dial to another address of the server than testServerIP
+func (p *memPair) dialTo(tb testing.TB, protocol layers.IPProtocol, dst net.IP, opts ...ConnOption) *RawIPConn {
+	tb.Helper()
+
+	config := p.client.newConnConfig(protocol, opts)
+	config.localIP, config.remoteIP, config.nextHopIP = testClientIP, dst, dst
+	config.pinnedMAC = memoryMACs[1]
+	conn, err := p.cs.dialIP(config)
+	if err != nil {
+		tb.Fatalf("dial: %v", err)
+	}
+	conn.resolveNextHop()
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// listen opens a listener of the server core on ip, nil listening on every address
+func (p *memPair) listen(tb testing.TB, ip net.IP, protocol layers.IPProtocol, opts ...ConnOption) *RawIPConn {
+	tb.Helper()
+
+	conn, err := p.tryListen(ip, protocol, opts...)
+	if err != nil {
+		tb.Fatalf("listen: %v", err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// tryListen is listen returning the error of the listen
+func (p *memPair) tryListen(ip net.IP, protocol layers.IPProtocol, opts ...ConnOption) (*RawIPConn, error) {
+	config := p.server.newConnConfig(protocol, opts)
+	config.localIP = ip
+	return p.ss.listenIP(config)
+}
+
+// readTimeout reads one payload from conn, failing the test if none arrives within d
+func readTimeout(tb testing.TB, conn *RawIPConn, d time.Duration) []byte {
+	tb.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(d))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		tb.Fatalf("read: %v", err)
+	}
+	return buf[:n]
+}
+
+func TestMemoryTransportRoundTrip(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIP, layers.IPProtocolUDP)
+	conn := p.dial(t, layers.IPProtocolUDP)
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := readTimeout(t, listener, time.Second); !bytes.Equal(got, []byte("ping")) {
+		t.Fatalf("listener read %q, want %q", got, "ping")
+	}
+
+	// testIface has no address to ARP from, so the reply goes straight to the MAC the transport gives the client
+	if _, err := listener.WriteToWithMAC([]byte("pong"), testClientIP, memoryMACs[0]); err != nil {
+		t.Fatalf("write to: %v", err)
+	}
+	if got := readTimeout(t, conn, time.Second); !bytes.Equal(got, []byte("pong")) {
+		t.Fatalf("conn read %q, want %q", got, "pong")
+	}
+}
+
+// rawFrames attaches a bare PacketIO to side A of transport on testIface, in place of a session, and returns the
+// frames side B sends it. The transport's own ARP and Neighbor Discovery answers to what is written on it arrive too
+func rawFrames(tb testing.TB, transport *MemoryTransport) (PacketIO, <-chan []byte) {
+	tb.Helper()
+
+	handle, err := transport.A()(testIface())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(handle.Close)
+	frames := make(chan []byte, 16)
+	go func() {
+		for {
+			frame, _, err := handle.ReadPacketData()
+			if err != nil {
+				return
+			}
+			select {
+			case frames <- frame:
+			default:
+			}
+		}
+	}()
+	return handle, frames
+}
+
+// TestWriteToWithMACSkipsARP checks that WriteToWithMAC sends its frame to the MAC address given, without looking up
+// or resolving the destination first
+func TestWriteToWithMACSkipsARP(t *testing.T) {
+	transport := NewMemoryTransport()
+	server := NewRawSocketCore(60, 1, WithHandleFactory(transport.B()))
+	defer server.Close()
+	_, frames := rawFrames(t, transport)
+
+	ps, err := server.acquireSession(testIface())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.release()
+	config := server.newConnConfig(layers.IPProtocolUDP, nil)
+	config.localIP = testServerIP
+	listener, err := ps.listenIP(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// the MAC given wins over the cached one, and over any the transport would answer an ARP request with
+	dst, mac := net.IPv4(198, 51, 100, 77).To4(), net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x42}
+	server.arpCache.Add(dst.String(), memoryMACs[0])
+	if _, err := listener.WriteToWithMAC([]byte("no ARP"), dst, mac); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	timeout := time.After(100 * time.Millisecond)
+	var sent [][]byte
+	for done := false; !done; {
+		select {
+		case frame := <-frames:
+			sent = append(sent, frame)
+		case <-timeout:
+			done = true
+		}
+	}
+	if len(sent) != 1 {
+		t.Fatalf("%d frames sent, want the packet alone", len(sent))
+	}
+	packet := gopacket.NewPacket(sent[0], layers.LayerTypeEthernet, gopacket.Default)
+	eth, _ := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if eth == nil || ip == nil || eth.EthernetType != layers.EthernetTypeIPv4 {
+		t.Fatalf("frame sent is no IPv4 packet: %v", packet)
+	}
+	if !bytes.Equal(eth.DstMAC, mac) || !ip.DstIP.Equal(dst) || !bytes.Equal(ip.Payload, []byte("no ARP")) {
+		t.Errorf("packet to %v at %v, want %v at %v", ip.DstIP, eth.DstMAC, dst, mac)
+	}
+}
@@ -0,0 +1,156 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// Migrate moves the conn to the interface ifaceName, e.g. once its own interface failed, without closing it: the conn
+// joins the pcapSession of that interface, resolves its next hop there and sends from newSrcIP from then on. Its
+// queued packets, deadlines and stats are kept. newSrcIP must be an address of the interface; if nil, the address of the
+// interface on-link for the remote address is used, else its first IPv4 address. Writes issued meanwhile wait until
+// the conn has moved. Packets written before, still waiting in a send queue or write buffer, leave through the new
+// interface as they were built. A next hop given WithNextHop is dropped in favor of the routes of the new interface.
+// Only conns dialed to a remote address by DialIP or DialHost can migrate, the others fail with ErrNotMigratable.
+// IPv6 conns fail with ErrIPv6Unsupported.
+// If Migrate fails, the conn stays where it was.
+func (conn *RawIPConn) Migrate(ifaceName string, newSrcIP net.IP) error {
+	if conn.isClosed.Load() {
+		return conn.closedError()
+	}
+	params := conn.params.Load()
+	if params.migrate == nil || params.isServer {
+		return fmt.Errorf("conn %s: %w", conn.getKey(), ErrNotMigratable)
+	}
+	return params.migrate(conn, ifaceName, newSrcIP)
+}
+
+// migrate implements RawIPConn.Migrate for the conns of the core
+func (core *RawSocketCore) migrate(conn *RawIPConn, ifaceName string, srcIP net.IP) error {
+	config := conn.config.Load()
+	if config.multi || config.replay || config.selfDial || config.pinnedMAC != nil || config.remoteIP == nil {
+		return fmt.Errorf("conn %s: %w", conn.getKey(), ErrNotMigratable)
+	}
+	dstIP := config.remoteIP
+	if dstIP.To4() == nil {
+		return fmt.Errorf("conn %s: %w", conn.getKey(), ErrIPv6Unsupported)
+	}
+
+	srcIP, err := checkLocal(srcIP, true)
+	if err != nil {
+		return err
+	}
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return fmt.Errorf("interface %s: %w", ifaceName, errors.Join(ErrInterfaceNotFound, err))
+	}
+	if srcIP == nil {
+		if srcIP = preferredAddr(iface, dstIP); srcIP == nil {
+			return fmt.Errorf("interface %s has no IPv4 address: %w", iface.Name, ErrNotLocalIP)
+		}
+	} else if owner, err := findInterfaceByIP(srcIP); err != nil || owner.Index != iface.Index {
+		return fmt.Errorf("provided srcIP %v is not a local IP of interface %s: %w", srcIP, iface.Name, ErrNotLocalIP)
+	}
+	if srcIP.To4() == nil {
+		return fmt.Errorf("srcIP %v and dstIP %v: %w", srcIP, dstIP, ErrAddressFamilyMismatch)
+	}
+
+	nextHop := dstIP // nothing to resolve on loopback
+	if iface.Flags&net.FlagLoopback == 0 {
+		subnet := ifaceSubnet(iface, srcIP)
+		if nextHop, err = nextHopFor(subnet, dstIP, offLinkGateway(iface, subnet, dstIP, routeCandidates)); err != nil {
+			return err
+		}
+	}
+	return core.migrateTo(conn, iface, srcIP, nextHop)
+}
+
+// migrateTo moves conn to the session of iface, sending from srcIP to its remote address through nextHop
+func (core *RawSocketCore) migrateTo(conn *RawIPConn, iface *net.Interface, srcIP, nextHop net.IP) error {
+	dstIP := conn.config.Load().remoteIP
+
+	// a resolution in progress on the old interface must not overwrite the one done here
+	select {
+	case <-conn.ready:
+	case <-conn.closeChan:
+		return conn.closedError()
+	}
+
+	ps, err := core.acquireSession(iface)
+	if err != nil {
+		return err
+	}
+	defer ps.release()
+
+	// resolve before taking conn.mu, so that the writes only wait for the swap
+	mac, err := ps.resolveMAC(nextHop)
+	if err != nil {
+		return fmt.Errorf("failed to resolve next hop %v on %s: %w", nextHop, iface.Name, err)
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.isClosed.Load() {
+		return conn.closedError()
+	}
+
+	oldParams, oldConfig := conn.params.Load(), conn.config.Load()
+	key := newFlowKey(oldConfig.protocol, srcIP, dstIP)
+	newConfig := *oldConfig
+	newConfig.localIP = srcIP
+	newConfig.nextHopIP = nextHop
+	newConfig.nextHopOverride = nil
+	newConfig.ifaceName = iface.Name
+	newParams := ps.newConnParams(false, key.String())
+
+	old, _ := core.sessions.get(oldParams.pcapIface.Name)
+	moving := old != ps || newParams.key != oldParams.key
+	if moving {
+		conn.memMu.Lock()
+		conn.params.Store(newParams)
+		conn.config.Store(&newConfig)
+		if err := ps.conns.register(conn); err != nil {
+			conn.params.Store(oldParams)
+			conn.config.Store(oldConfig)
+			conn.memMu.Unlock()
+			return fmt.Errorf("cannot migrate to %s: %w", iface.Name, err)
+		}
+		oldParams.mem.moveTo(newParams.mem, conn.memHeld.Load())
+		conn.memMu.Unlock()
+	}
+
+	conn.resolveMu.Lock()
+	conn.nextHopMAC, conn.resolveErr = mac, nil
+	conn.resolveMu.Unlock()
+
+	if !moving {
+		return nil // same interface and address: only the next hop was resolved again
+	}
+
+	if old != nil {
+		old.conns.remove(conn, newFlowKey(oldConfig.protocol, oldConfig.localIP, dstIP), oldParams.key)
+		// the old session may have lost its last conn
+		old.lastActive.Store(time.Now().UnixNano())
+		select {
+		case old.unused <- struct{}{}:
+		default:
+		}
+	}
+	if d := conn.idleTimeout.Load(); d > 0 {
+		newParams.watchIdle(conn, time.Duration(d))
+	}
+	// a Close which picked the old session before the swap did not deregister the conn from the new one
+	if conn.isClosed.Load() {
+		ps.conns.deregister(conn)
+	}
+
+	log.Printf("Raw IPConn %s migrated from %s to %s as %s", oldParams.key, oldParams.pcapIface.Name, iface.Name, newParams.key)
+	core.events.emit(&ConnMigrated{eventTime{time.Now()}, iface.Name, newParams.key, oldParams.pcapIface.Name, oldParams.key})
+	return nil
+}
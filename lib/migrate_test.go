@@ -0,0 +1,146 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// TestMigrateMovesSession migrates the conns of a client between two interfaces of a MemoryTransport, one with a read
+// blocked and one with a packet queued, and checks that reads go on through the new session, that the queued bytes
+// are accounted by the new session only, and that the old session is reaped once it lost its conns
+func TestMigrateMovesSession(t *testing.T) {
+	transport := NewMemoryTransport()
+	client := NewRawSocketCore(60, 1, WithHandleFactory(transport.A()), WithSessionMemoryBudget(1<<20))
+	defer client.Close()
+	server := NewRawSocketCore(60, 1, WithHandleFactory(transport.B()))
+	defer server.Close()
+
+	oldIface, newIface := testIface(), testIface()
+	newIface.Index, newIface.Name = 1000, "memtest1"
+	// the fake interfaces have no address to send ARP requests from
+	client.arpCache.Add(testServerIP.String(), memoryMACs[1])
+
+	const queuedProtocol = layers.IPProtocol(253) // experimental, left alone by the session
+	listeners := map[string]map[layers.IPProtocol]*RawIPConn{}
+	for _, iface := range []*net.Interface{oldIface, newIface} {
+		ps, err := server.acquireSession(iface)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ps.release()
+		listeners[iface.Name] = map[layers.IPProtocol]*RawIPConn{}
+		for _, protocol := range []layers.IPProtocol{layers.IPProtocolUDP, queuedProtocol} {
+			config := server.newConnConfig(protocol, nil)
+			config.localIP = testServerIP
+			listener, err := ps.listenIP(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			listeners[iface.Name][protocol] = listener
+		}
+	}
+	reply := func(iface string, protocol layers.IPProtocol, data string) {
+		t.Helper()
+		if _, err := listeners[iface][protocol].WriteToWithMAC([]byte(data), testClientIP, memoryMACs[0]); err != nil {
+			t.Fatalf("reply on %s: %v", iface, err)
+		}
+	}
+
+	old, err := client.acquireSession(oldIface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(protocol layers.IPProtocol) *RawIPConn {
+		config := client.newConnConfig(protocol, nil)
+		config.localIP, config.remoteIP, config.nextHopIP = testClientIP, testServerIP, testServerIP
+		conn, err := old.dialIP(config)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conn.resolveNextHop()
+		return conn
+	}
+	reading, queued := dial(layers.IPProtocolUDP), dial(queuedProtocol)
+	defer reading.Close()
+	defer queued.Close()
+	old.release() // the conns alone keep the session open now
+
+	reply(oldIface.Name, queuedProtocol, "queued before")
+	waitQueued(t, queued, 1)
+	held := old.mem.inUse.Load()
+	if held == 0 {
+		t.Fatal("queued packet not accounted by the session")
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	reads := make(chan result, 1)
+	go func() {
+		buf := make([]byte, 256)
+		n, err := reading.Read(buf)
+		reads <- result{buf[:n], err}
+	}()
+	time.Sleep(20 * time.Millisecond) // let the read block
+
+	for _, conn := range []*RawIPConn{reading, queued} {
+		if err := client.migrateTo(conn, newIface, testClientIP, testServerIP); err != nil {
+			t.Fatalf("migrate: %v", err)
+		}
+	}
+	current, exists := client.sessions.get(newIface.Name)
+	if !exists {
+		t.Fatal("no session on the new interface")
+	}
+	if got := old.mem.inUse.Load(); got != 0 {
+		t.Errorf("old session still accounts %d bytes, want 0", got)
+	}
+	if got := current.mem.inUse.Load(); got != held {
+		t.Errorf("new session accounts %d bytes, want the %d queued", got, held)
+	}
+
+	// the blocked read is served by the new session
+	reply(newIface.Name, layers.IPProtocolUDP, "after the move")
+	select {
+	case res := <-reads:
+		if res.err != nil || !bytes.Equal(res.data, []byte("after the move")) {
+			t.Errorf("blocked read returned %q, %v", res.data, res.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked read not served after the migration")
+	}
+	if got := readTimeout(t, queued, time.Second); !bytes.Equal(got, []byte("queued before")) {
+		t.Errorf("queued packet read as %q", got)
+	}
+	if got := current.mem.inUse.Load(); got != 0 {
+		t.Errorf("new session accounts %d bytes once the queue is read, want 0", got)
+	}
+
+	// the conns write through the new interface
+	if _, err := reading.Write([]byte("from the new interface")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := readTimeout(t, listeners[newIface.Name][layers.IPProtocolUDP], time.Second); !bytes.Equal(got, []byte("from the new interface")) {
+		t.Errorf("listener on %s read %q", newIface.Name, got)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if got, exists := client.sessions.get(oldIface.Name); !exists || got != old {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("old session not reaped after its conns migrated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,51 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// mtuCheckInterval is how often a pcapSession looks up the MTU of its interface again
+const mtuCheckInterval = 5 * time.Second
+
+// dot1QTagLen is the length of an 802.1Q tag
+const dot1QTagLen = 4
+
+// watchMTU follows the MTU of the interface of the session, so that the writes of its conns are limited by the
+// current one rather than by the one the session opened with
+func (ps *pcapSession) watchMTU() {
+	defer ps.wg.Done()
+
+	ticker := time.NewTicker(mtuCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ps.stopChan:
+			return
+		case <-ticker.C:
+		}
+		// interfaces a handle factory makes up may not exist, their MTU stays the one they were given
+		if iface, err := net.InterfaceByName(ps.params.iface.Name); err == nil {
+			ps.setMTU(iface.MTU)
+		}
+	}
+}
+
+// setMTU records the MTU of the interface of the session, emitting MTUChanged if it changed
+func (ps *pcapSession) setMTU(mtu int) {
+	old := int(ps.mtu.Swap(int32(mtu)))
+	if old == mtu {
+		return
+	}
+	log.Printf("pcapSession %s: MTU changed from %d to %d", ps.params.key, old, mtu)
+	ps.params.events.emit(&MTUChanged{eventTime{time.Now()}, ps.params.key, old, mtu})
+}
+
+// linkMTU returns the current MTU of the interface of the session
+func (ps *pcapSession) linkMTU() int {
+	return int(ps.mtu.Load())
+}
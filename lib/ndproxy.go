@@ -0,0 +1,255 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	ndHopLimit      = 255 // hop limit of every Neighbor Discovery message (RFC 4861 7.1.1)
+	ndFlagSolicited = 0x40
+	ndFlagOverride  = 0x20
+)
+
+// ndProxy holds the IPv6 addresses a pcapSession answers Neighbor Solicitations for, see RawSocketCore.AddProxyND
+type ndProxy struct {
+	mu     sync.Mutex
+	addrs  map[netip.Addr]io.Closer // membership of the solicited-node multicast group of each address, nil if none
+	n      atomic.Int32             // len(addrs), checked for every IPv6 frame captured
+	closed bool                     // the session closed, no address can be added anymore
+}
+
+func newNDProxy() *ndProxy {
+	return &ndProxy{addrs: make(map[netip.Addr]io.Closer)}
+}
+
+// add starts answering for addr. group is the membership of its solicited-node multicast group, closed with it.
+// It returns false if addr is answered already or the session closed, the caller closing group then
+func (p *ndProxy) add(addr netip.Addr, group io.Closer) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, exists := p.addrs[addr]; exists || p.closed {
+		return false
+	}
+	p.addrs[addr] = group
+	p.n.Add(1)
+	return true
+}
+
+// remove stops answering for addr. It tells if addr was answered
+func (p *ndProxy) remove(addr netip.Addr) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	group, exists := p.addrs[addr]
+	if !exists {
+		return false
+	}
+	delete(p.addrs, addr)
+	p.n.Add(-1)
+	if group != nil {
+		group.Close()
+	}
+	return true
+}
+
+// serves tells if the solicitations for addr are answered
+func (p *ndProxy) serves(addr netip.Addr) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, exists := p.addrs[addr]
+	return exists
+}
+
+// len returns the number of answered addresses
+func (p *ndProxy) len() int {
+	return int(p.n.Load())
+}
+
+// close stops answering for every address and leaves their multicast groups
+func (p *ndProxy) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for addr, group := range p.addrs {
+		if group != nil {
+			group.Close()
+		}
+		delete(p.addrs, addr)
+	}
+	p.n.Store(0)
+}
+
+// solicitedNodeAddr returns the solicited-node multicast address of ip (RFC 4291 2.7.1)
+func solicitedNodeAddr(ip net.IP) net.IP {
+	addr := net.ParseIP("ff02::1:ff00:0")
+	copy(addr[13:], ip.To16()[13:])
+	return addr
+}
+
+// ipv6MulticastMAC returns the Ethernet address the IPv6 multicast address ip is sent to (RFC 2464 7)
+func ipv6MulticastMAC(ip net.IP) net.HardwareAddr {
+	ip = ip.To16()
+	return net.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+}
+
+// joinSolicitedNode has the host join the solicited-node multicast group of ip on iface, so that the interface does not
+// filter out the solicitations for ip when it is not promiscuous. Leaving the group is closing the returned conn
+func joinSolicitedNode(iface *net.Interface, ip net.IP) (io.Closer, error) {
+	return net.ListenMulticastUDP("udp6", iface, &net.UDPAddr{IP: solicitedNodeAddr(ip)})
+}
+
+// AddProxyND makes the session of the named interface answer the IPv6 Neighbor Solicitations for ip with Neighbor
+// Advertisements carrying the MAC address of the interface, to serve ip, a virtual address, from user space. The host
+// joins the solicited-node multicast group of ip on the interface, so that the solicitations reach the capture.
+// The advertisements have the override flag set, as the library owns ip: the neighbors update their cache to the
+// interface even if another node answered for ip before. Duplicate Address Detection probes for ip are answered as
+// RFC 4862 says, to the all-nodes group, which makes the probing node give ip up instead of using it too. Solicitations
+// carried in 802.1Q tagged frames are not answered. Addresses of the host itself are refused with ErrHostAddress, since
+// the host answers them already. While ip is proxied, the pcapSession of the interface is kept open.
+func (core *RawSocketCore) AddProxyND(ifaceName string, ip net.IP) error {
+	if ip.To4() != nil || ip.To16() == nil || ip.IsUnspecified() || ip.IsMulticast() || ip.IsLoopback() {
+		return fmt.Errorf("nd proxy for %v: not an IPv6 unicast address", ip)
+	}
+	if _, err := findInterfaceByIP(ip); err == nil {
+		return fmt.Errorf("nd proxy for %v: %w", ip, ErrHostAddress)
+	}
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return fmt.Errorf("interface %s: %w", ifaceName, ErrInterfaceNotFound)
+	}
+	if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) != 6 {
+		return fmt.Errorf("nd proxy: interface %s is not an Ethernet interface", ifaceName)
+	}
+	return core.addProxyND(iface, ip)
+}
+
+// addProxyND has the session of iface answer the solicitations for ip, see AddProxyND
+func (core *RawSocketCore) addProxyND(iface *net.Interface, ip net.IP) error {
+	ps, err := core.acquireSession(iface)
+	if err != nil {
+		return fmt.Errorf("failed to create pcap session: %w", err)
+	}
+	defer ps.release()
+
+	group, err := joinSolicitedNode(iface, ip)
+	if err != nil {
+		log.Printf("Warning: cannot join the solicited-node group of %v on %s, solicitations only reach a promiscuous capture: %v", ip, iface.Name, err)
+		group = nil
+	}
+	if !ps.nd.add(toAddr(ip), group) {
+		if group != nil {
+			group.Close()
+		}
+		return fmt.Errorf("nd proxy for %v on %s: %w", ip, iface.Name, ErrAddressInUse)
+	}
+	return nil
+}
+
+// RemoveProxyND stops answering the Neighbor Solicitations for ip on the named interface, see AddProxyND. It is a no-op
+// if ip is not proxied there
+func (core *RawSocketCore) RemoveProxyND(ifaceName string, ip net.IP) error {
+	ps, exists := core.sessions.get(ifaceName)
+	if !exists {
+		return nil
+	}
+	if ps.nd.remove(toAddr(ip)) {
+		// the session may not be needed anymore
+		select {
+		case ps.unused <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// handleNeighborSolicitation answers payload, the IPv6 packet of an untagged Ethernet frame from srcMAC, if it is a
+// valid Neighbor Solicitation (RFC 4861 7.1.1) for a proxied address
+func (ps *pcapSession) handleNeighborSolicitation(payload []byte, srcMAC net.HardwareAddr) {
+	packet := gopacket.NewPacket(payload, layers.LayerTypeIPv6, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	ip, _ := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	icmp, _ := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+	if ip == nil || icmp == nil || ip.NextHeader != layers.IPProtocolICMPv6 || icmp.TypeCode != layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0) {
+		return
+	}
+	ns, _ := packet.Layer(layers.LayerTypeICMPv6NeighborSolicitation).(*layers.ICMPv6NeighborSolicitation)
+	if ns == nil || ip.HopLimit != ndHopLimit || ns.TargetAddress.IsMulticast() || !ps.nd.serves(toAddr(ns.TargetAddress)) {
+		return
+	}
+	message := ip.Payload // no extension header precedes the ICMPv6 message
+	if FinishChecksum(PseudoHeaderChecksumIPv6(ip.SrcIP, ip.DstIP, layers.IPProtocolICMPv6, len(message)), message) != 0 {
+		ps.decodeErrors.Add(1)
+		return
+	}
+	if _, err := findInterfaceByIP(ns.TargetAddress); err == nil {
+		return // the host took the address meanwhile and answers itself
+	}
+
+	var sourceLinkAddr net.HardwareAddr
+	for _, opt := range ns.Options {
+		if opt.Type == layers.ICMPv6OptSourceAddress && len(opt.Data) == 6 {
+			sourceLinkAddr = opt.Data
+		}
+	}
+
+	flags := uint8(ndFlagOverride)
+	var dstIP net.IP
+	var dstMAC net.HardwareAddr
+	if ip.SrcIP.IsUnspecified() {
+		// Duplicate Address Detection: a valid probe goes to the solicited-node group of its target without source
+		// link-layer address, and is answered to all nodes, unsolicited (RFC 4861 7.2.4, RFC 4862 5.4.3)
+		if !ip.DstIP.Equal(solicitedNodeAddr(ns.TargetAddress)) || sourceLinkAddr != nil {
+			return
+		}
+		dstIP = net.IPv6linklocalallnodes
+		dstMAC = ipv6MulticastMAC(dstIP)
+	} else {
+		flags |= ndFlagSolicited
+		dstIP = ip.SrcIP
+		dstMAC = sourceLinkAddr
+		if dstMAC == nil {
+			dstMAC = srcMAC
+		}
+	}
+
+	frame, err := buildNeighborAdvertisement(ps.params.iface.HardwareAddr, dstMAC, ns.TargetAddress, dstIP, flags)
+	if err != nil {
+		log.Println("pcapSession.handleNeighborSolicitation: cannot build the advertisement:", err)
+		return
+	}
+	ps.sendFrame(frame)
+}
+
+// buildNeighborAdvertisement returns the Ethernet frame of a Neighbor Advertisement from target, at mac, to dstIP
+func buildNeighborAdvertisement(mac, dstMAC net.HardwareAddr, target, dstIP net.IP, flags uint8) ([]byte, error) {
+	eth := &layers.Ethernet{SrcMAC: mac, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv6}
+	ip := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   ndHopLimit,
+		SrcIP:      target,
+		DstIP:      dstIP,
+	}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0)}
+	icmp.SetNetworkLayerForChecksum(ip)
+	na := &layers.ICMPv6NeighborAdvertisement{
+		Flags:         flags,
+		TargetAddress: target,
+		Options:       layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: mac}},
+	}
+	return serializeLayers(eth, ip, icmp, na)
+}
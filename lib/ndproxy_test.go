@@ -0,0 +1,89 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// TestProxyNDAnswers injects Neighbor Solicitations for a proxied address and checks the advertisements of the
+// session, then that the session no longer answers once the address is removed
+func TestProxyNDAnswers(t *testing.T) {
+	transport := NewMemoryTransport()
+	// the session stays open once the address is removed, so that its silence is its own
+	server := NewRawSocketCore(60, 1, WithHandleFactory(transport.B()), WithKeepIdleSessions())
+	defer server.Close()
+	peer, frames := rawFrames(t, transport)
+
+	iface, proxied := testIface(), net.ParseIP("2001:db8::99")
+	if err := server.addProxyND(iface, proxied); err != nil {
+		t.Fatalf("add proxy: %v", err)
+	}
+	solicit := func() {
+		t.Helper()
+		ns, err := neighborSolicitationFrame(memoryMACs[0], testClientIPv6, proxied)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := peer.WritePacketData(ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// advertisement returns the next frame the session sent, skipping the answers of the transport itself
+	advertisement := func(d time.Duration) []byte {
+		timeout := time.After(d)
+		for {
+			select {
+			case frame := <-frames:
+				if len(frame) >= 12 && bytes.Equal(frame[6:12], iface.HardwareAddr) {
+					return frame
+				}
+			case <-timeout:
+				return nil
+			}
+		}
+	}
+
+	solicit()
+	frame := advertisement(time.Second)
+	if frame == nil {
+		t.Fatal("solicitation for the proxied address not answered")
+	}
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	eth, _ := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip, _ := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	na, _ := packet.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(*layers.ICMPv6NeighborAdvertisement)
+	if eth == nil || ip == nil || na == nil {
+		t.Fatalf("answer is no Neighbor Advertisement: %v", packet)
+	}
+	if !bytes.Equal(eth.DstMAC, memoryMACs[0]) || !ip.SrcIP.Equal(proxied) || !ip.DstIP.Equal(testClientIPv6) || ip.HopLimit != ndHopLimit {
+		t.Errorf("advertisement %v->%v to %v, hop limit %d", ip.SrcIP, ip.DstIP, eth.DstMAC, ip.HopLimit)
+	}
+	if !na.TargetAddress.Equal(proxied) || na.Flags != ndFlagSolicited|ndFlagOverride {
+		t.Errorf("advertisement for %v with flags %#02x, want %v and %#02x", na.TargetAddress, na.Flags, proxied, ndFlagSolicited|ndFlagOverride)
+	}
+	if len(na.Options) != 1 || na.Options[0].Type != layers.ICMPv6OptTargetAddress || !bytes.Equal(na.Options[0].Data, iface.HardwareAddr) {
+		t.Errorf("advertisement options %v, want the target link-layer address %v", na.Options, iface.HardwareAddr)
+	}
+	if sum := FinishChecksum(PseudoHeaderChecksumIPv6(ip.SrcIP, ip.DstIP, layers.IPProtocolICMPv6, len(ip.Payload)), ip.Payload); sum != 0 {
+		t.Errorf("advertisement checksum off by %#04x", sum)
+	}
+
+	if err := server.RemoveProxyND(iface.Name, proxied); err != nil {
+		t.Fatalf("remove proxy: %v", err)
+	}
+	if _, exists := server.sessions.get(iface.Name); !exists {
+		t.Fatal("session closed with the proxied address")
+	}
+	solicit()
+	if frame := advertisement(100 * time.Millisecond); frame != nil {
+		t.Errorf("answered a solicitation after RemoveProxyND: % x", frame)
+	}
+}
@@ -0,0 +1,441 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"net"
+	"runtime"
+	"time"
+)
+
+// CoreOption configures optional behaviour of a RawSocketCore
+type CoreOption func(*RawSocketCore)
+
+// ConnOption configures optional behaviour of a RawIPConn created by DialIP or ListenIP
+type ConnOption func(*RawIPConnConfig)
+
+// WithSessionMemoryBudget limits the number of bytes each pcapSession may hold in the receive queues of its conns.
+// Once the budget is used up, newly arrived packets are dropped instead of queued. 0 means unlimited. Only the queued
+// packets count: the buffers the session pools for capturing and serializing are not part of the budget.
+func WithSessionMemoryBudget(bytes int64) CoreOption {
+	return func(core *RawSocketCore) {
+		core.sessionConfig.MemoryBudget = max(bytes, 0)
+	}
+}
+
+// WithDispatchWorkers sets the number of goroutines each pcapSession uses to decode and dispatch inbound packets, to
+// spread high packet rates over several cores. The capture loops feed the n workers, and a flow always goes to the same
+// worker: packets of one conn are therefore delivered in capture order, while packets of different conns may be
+// delivered in any order. Use WithCaptureWorkers to add capture loops reading from the interface as well.
+func WithDispatchWorkers(n int) CoreOption {
+	return func(core *RawSocketCore) {
+		if n > 0 {
+			core.sessionConfig.DispatchWorkers = n
+		}
+	}
+}
+
+// WithReadWorkers sets the number of goroutines each pcapSession uses to process inbound packets. It is another name
+// for WithDispatchWorkers, whose ordering guarantees it has: packets of one conn are delivered in capture order.
+func WithReadWorkers(n int) CoreOption {
+	return WithDispatchWorkers(n)
+}
+
+// WithCaptureWorkers sets the number of capture loops each pcapSession runs on its interface, all feeding the same dispatch workers.
+// See openCaptureHandles for how the traffic is split between them and the platform caveats.
+func WithCaptureWorkers(n int) CoreOption {
+	return func(core *RawSocketCore) {
+		if n > 0 {
+			core.sessionConfig.CaptureWorkers = n
+		}
+	}
+}
+
+// WithReadCPUAffinity pins the capture loops of each pcapSession to a CPU, the first one to cpu and the next ones,
+// with WithCaptureWorkers, to the following CPUs, to avoid the jitter of the scheduler moving them around.
+// Each loop locks its goroutine to an OS thread whose affinity is set: with SetThreadAffinityMask on Windows and
+// cpuset_setaffinity on FreeBSD. macOS offers no way to pin a thread, there the loops are only locked to their thread.
+// CPUs outside 0..runtime.NumCPU()-1 are ignored.
+func WithReadCPUAffinity(cpu int) CoreOption {
+	return func(core *RawSocketCore) {
+		if cpu >= 0 && cpu < runtime.NumCPU() {
+			core.sessionConfig.PinReadLoop = true
+			core.sessionConfig.ReadCPU = cpu
+		}
+	}
+}
+
+// WithIdleSessionTimeout makes a pcapSession left without conns linger for d before closing, so that a quick dial again
+// on its interface reuses its pcap handle instead of opening a new one. 0 closes it as soon as its last conn closes, a
+// negative d keeps it open like WithKeepIdleSessions.
+// Without this option, a session closes as soon as its last conn closes, where it used to stay open until the core
+// closed: give WithKeepIdleSessions to keep that behaviour.
+func WithIdleSessionTimeout(d time.Duration) CoreOption {
+	return func(core *RawSocketCore) {
+		core.sessionConfig.KeepIdle = d < 0
+		core.sessionConfig.IdleTimeout = max(d, 0)
+	}
+}
+
+// WithSessionIdleTimeout makes a pcapSession close itself, releasing its pcap handle, once it has had no conns for longer than d.
+// The next DialIP or ListenIP on that interface transparently opens a new session. 0 disables reaping, keeping the
+// session open like WithKeepIdleSessions.
+//
+// Deprecated: Use WithIdleSessionTimeout, which it is an alias of except for a d <= 0, which keeps the sessions open
+// here as it always did, like WithIdleSessionTimeout(-1), rather than closing them with their last conn.
+func WithSessionIdleTimeout(d time.Duration) CoreOption {
+	if d <= 0 {
+		return WithKeepIdleSessions()
+	}
+	return WithIdleSessionTimeout(d)
+}
+
+// WithARPRateLimit bounds the ARP requests each session sends to perSecond, 50 by default. A resolution beyond the
+// limit waits up to a second for its turn, then fails with ErrARPRateLimited. A negative perSecond removes the limit.
+func WithARPRateLimit(perSecond int) CoreOption {
+	return func(core *RawSocketCore) {
+		core.sessionConfig.ARPRateLimit = perSecond
+	}
+}
+
+// WithARPNegativeCache makes a session fail the resolutions of an address which did not answer ARP within the last ttl
+// right away, with ErrARPTimeout, instead of asking it again. 0 keeps the default of 3s, a negative ttl disables it.
+func WithARPNegativeCache(ttl time.Duration) CoreOption {
+	return func(core *RawSocketCore) {
+		core.sessionConfig.ARPNegativeTTL = ttl
+	}
+}
+
+// WithAdaptiveBufferSize makes each pcapSession double its pcap kernel buffer, up to ceiling bytes, whenever the kernel
+// drop counter has grown over consecutive samples. The buffer starts at the BufferSize of the session, 2 MiB without
+// one, and never shrinks. Growing reopens the capture handles, which loses the frames of a brief gap reported by a
+// CaptureRestarted event. Cores created WithHandleFactory do not grow their buffers. A ceiling <= 0 is ignored.
+func WithAdaptiveBufferSize(ceiling int) CoreOption {
+	return func(core *RawSocketCore) {
+		if ceiling > 0 {
+			core.sessionConfig.MaxBufferSize = ceiling
+		}
+	}
+}
+
+// WithKeepIdleSessions keeps the pcapSessions open once their last conn closed, until the core closes, instead of
+// closing them and their pcap handle. It saves reopening the handle for workloads dialing again and again.
+func WithKeepIdleSessions() CoreOption {
+	return func(core *RawSocketCore) {
+		core.sessionConfig.KeepIdle = true
+	}
+}
+
+// WithDefaultTTL sets the TTL of the packets written by the conns of the core, unless they are given WithTTL.
+// 0 is ignored, keeping the library default of 64
+func WithDefaultTTL(ttl uint8) CoreOption {
+	return func(core *RawSocketCore) {
+		if ttl > 0 {
+			core.defaultTTL = ttl
+		}
+	}
+}
+
+// WithDefaultTOS sets the TOS byte of the packets written by the conns of the core, unless they are given WithTOS
+func WithDefaultTOS(tos uint8) CoreOption {
+	return func(core *RawSocketCore) {
+		core.defaultTOS = tos
+	}
+}
+
+// WithDefaultIPIDStrategy sets how the conns of the core fill in the IP ID of their packets, unless they are given
+// WithIPIDStrategy. Unknown strategies are ignored
+func WithDefaultIPIDStrategy(s IPIDStrategy) CoreOption {
+	return func(core *RawSocketCore) {
+		if s.valid() {
+			core.defaultIPIDStrategy = s
+		}
+	}
+}
+
+// HandleFactory opens the PacketIO, typically a *pcap.Handle, a new pcapSession on iface captures from and writes to
+type HandleFactory func(iface *net.Interface) (PacketIO, error)
+
+// WithHandleFactory makes the core build its sessions around the PacketIO returned by factory instead of opening the
+// live devices, so the send and receive logic can run against a capture file, a veth, an in-memory transport or a
+// handle set up by a test, without root rights or a real NIC. Such sessions run a single capture loop whatever
+// WithCaptureWorkers says, and resolve next hops with ARP over the PacketIO as well. The session closes the PacketIO
+// when it closes. nil keeps the live devices.
+func WithHandleFactory(factory HandleFactory) CoreOption {
+	return func(core *RawSocketCore) {
+		core.handleFactory = factory
+	}
+}
+
+// WithUnsafeHandleAccess enables UnsafeHandle, which is refused otherwise so that no caller reaches the live handles
+// of the sessions by accident
+func WithUnsafeHandleAccess() CoreOption {
+	return func(core *RawSocketCore) {
+		core.unsafeHandleAccess = true
+	}
+}
+
+// WithRouteSelector replaces the way dials without srcIP choose their route among the candidates found in the
+// routing table. An error returned by the selector aborts the dial. It is called without any core lock held, so it may
+// call back into the core. nil keeps DefaultRouteSelector.
+func WithRouteSelector(selector RouteSelector) CoreOption {
+	return func(core *RawSocketCore) {
+		if selector != nil {
+			core.routeSelector = selector
+		}
+	}
+}
+
+// WithRouteLogging makes dials without srcIP log the routes as specific as the one they picked which they did not use,
+// to debug the choice of the route selector. They are not logged by default.
+func WithRouteLogging() CoreOption {
+	return func(core *RawSocketCore) {
+		core.logRoutes = true
+	}
+}
+
+// WithARPCacheSize bounds the ARP cache to n entries, 65536 by default. Adding an entry to a full cache evicts the
+// least recently used one, looked up or refreshed the longest ago. Dialed conns keep the MAC address of their next
+// hop, so evicting its entry does not affect them. n <= 0 keeps the default.
+func WithARPCacheSize(n int) CoreOption {
+	return func(core *RawSocketCore) {
+		if n > 0 {
+			core.arpCache.setMaxEntries(n)
+		}
+	}
+}
+
+// WithAsyncResolve makes DialIP return the conn immediately and resolve the next hop MAC address in the background.
+// Until it is known, up to queueLen writes are queued and sent once it is; further writes, or all of them with a
+// queueLen of 0, fail fast with ErrResolving. Use Ready and ResolutionError to wait for the resolution.
+// Reads work right away since inbound matching does not need the next hop MAC.
+func WithAsyncResolve(queueLen int) ConnOption {
+	return func(config *RawIPConnConfig) {
+		config.asyncResolve = true
+		config.asyncQueueLen = queueLen
+	}
+}
+
+// WithVLAN tags the frames the conn writes with the 802.1Q VLAN ID id, to send into a VLAN from its parent interface.
+// The tag takes 4 bytes of the interface MTU, which MaxPayload accounts for. Frames on loopback are never tagged.
+// Inbound frames are matched by their addresses whatever their tag. An id outside 1-4094 is ignored.
+func WithVLAN(id uint16) ConnOption {
+	return func(config *RawIPConnConfig) {
+		if id >= 1 && id <= 4094 {
+			config.vlanID = id
+		}
+	}
+}
+
+// WithMaxWriteSize makes writes of more than n bytes of payload fail with a *MessageTooLongError.
+// Writes are limited by the interface MTU in any case since packets are never fragmented.
+func WithMaxWriteSize(n int) ConnOption {
+	return func(config *RawIPConnConfig) {
+		config.maxWriteSize = n
+	}
+}
+
+// WithSendQueue gives the conn an outbound queue of depth packets drained to pcap in the background. Writes return as
+// soon as their packet is queued, and block while the queue is full until there is room or the write deadline passes.
+// Packets still queued when the conn is closed are dropped.
+func WithSendQueue(depth int) ConnOption {
+	return func(config *RawIPConnConfig) {
+		config.sendQueueLen = max(depth, 0)
+	}
+}
+
+// WithWriteBuffer makes the conn collect the packets it writes into a batch instead of handing each of them to the
+// session right away. The batch is sent in one go by Flush, once it holds maxPackets packets or maxBytes bytes, or once
+// linger has passed since its first packet; linger 0 waits for the other two. Close flushes the batch and reports the
+// packets it could not send. maxPackets and maxBytes of 0 or less mean 64 packets and 64KiB.
+func WithWriteBuffer(maxPackets, maxBytes int, linger time.Duration) ConnOption {
+	return func(config *RawIPConnConfig) {
+		if maxPackets <= 0 {
+			maxPackets = defaultWriteBufferPackets
+		}
+		if maxBytes <= 0 {
+			maxBytes = defaultWriteBufferBytes
+		}
+		config.writeBuffer = &writeBufferConfig{maxPackets: maxPackets, maxBytes: maxBytes, linger: max(linger, 0)}
+	}
+}
+
+// WithReadBuffer sets to n packets the inbound queue between the session and the reads of the conn, 64 by default, so
+// that bursts can wait there for a slow reader. It is not the pcap capture buffer. Stats reports how full it is.
+// n of 0 or less keeps the default.
+func WithReadBuffer(n int) ConnOption {
+	return func(config *RawIPConnConfig) {
+		config.readQueueLen = max(n, 0)
+	}
+}
+
+// WithLayerAddresses lets WriteLayers send IPv4 layers whose addresses differ from the ones of the conn, e.g. to spoof
+// the source of a test packet. Without it, such writes fail with ErrLayerAddressMismatch.
+func WithLayerAddresses() ConnOption {
+	return func(config *RawIPConnConfig) {
+		config.layerAddrs = true
+	}
+}
+
+// WithDropWhenFull makes the conn drop the inbound packets it has no room for in its inbound queue, counting them in
+// the InboundDropped stat, instead of holding up its session, and so every other conn on the interface, until a read
+// makes room. Shared listeners always behave this way.
+func WithDropWhenFull() ConnOption {
+	return func(config *RawIPConnConfig) {
+		config.dropWhenFull = true
+	}
+}
+
+// WithTTL sets the TTL of the packets written by the conn instead of the core's default.
+// 0 is ignored, keeping the core's default
+func WithTTL(ttl uint8) ConnOption {
+	return func(config *RawIPConnConfig) {
+		if ttl > 0 {
+			config.ttl = ttl
+		}
+	}
+}
+
+// WithStrictErrors makes the next write after an ICMP error about the conn's packets fail with that error, as well
+// as delivering it on Errors. Without it, ICMP errors are only advisory and writes keep succeeding.
+func WithStrictErrors() ConnOption {
+	return func(config *RawIPConnConfig) {
+		config.strictErrors = true
+	}
+}
+
+// WithTOS sets the TOS byte, DSCP and ECN, of the packets written by the conn, the traffic class of IPv6 ones, instead
+// of the core's default. SetTrafficClass changes it later
+func WithTOS(tos uint8) ConnOption {
+	return func(config *RawIPConnConfig) {
+		config.tos = tos
+	}
+}
+
+// WithAutoFlowLabel gives the IPv6 packets written by the conn without flow label the one AutoFlowLabel derives from
+// their addresses, protocol and, for TCP, UDP and SCTP, ports (RFC 6437), so that each flow keeps one stable label
+func WithAutoFlowLabel() ConnOption {
+	return func(config *RawIPConnConfig) {
+		config.autoFlowLabel = true
+	}
+}
+
+// WithIPIDStrategy sets how the conn fills in the IP ID of its packets instead of the core's default.
+// Unknown strategies are ignored
+func WithIPIDStrategy(s IPIDStrategy) ConnOption {
+	return func(config *RawIPConnConfig) {
+		if s.valid() {
+			config.ipIDStrategy = s
+		}
+	}
+}
+
+// WithSharedListen lets several listeners created with it share the same address and protocol. Each of them receives
+// every matching packet in its own queue, with its own stats and overflow drops, and closing one leaves the others
+// listening. The packet is decoded once for all of them. A listener created without it still makes ListenIP fail with
+// ErrAddressInUse, and is refused while shared listeners are open.
+func WithSharedListen() ConnOption {
+	return func(config *RawIPConnConfig) {
+		config.sharedListen = true
+	}
+}
+
+// WithDuplicateSuppression drops the exact repeats of a packet received by the conn within window, e.g. when an L2
+// loop, a broadcast bond or a mirror port makes the capture see the same frame several times. 0 means 50ms.
+// Repeats are recognised by a hash of their IP header fields, so a distinct packet colliding with a recent one is
+// dropped too; the conn remembers a fixed number of packets whatever the rate, and at high rates some repeats get through.
+// Suppressed packets are counted in Stats.
+func WithDuplicateSuppression(window time.Duration) ConnOption {
+	return func(config *RawIPConnConfig) {
+		if window <= 0 {
+			window = defaultDuplicateWindow
+		}
+		config.dupWindow = window
+	}
+}
+
+// WithReorderBuffer makes reads return the packets of the conn by capture timestamp, as far as window allows: every
+// packet is held for window before it can be read, so that the ones captured before it but dispatched after it, e.g.
+// by another dispatch worker, get ahead of it. The buffer holds as many packets as the inbound queue, see
+// WithReadBuffer, and lets the earliest one go without waiting when full. It adds window to the latency of every
+// packet. 0 or a negative window is ignored.
+func WithReorderBuffer(window time.Duration) ConnOption {
+	return func(config *RawIPConnConfig) {
+		if window > 0 {
+			config.reorderWindow = window
+		}
+	}
+}
+
+// WithSequenceReorder makes reads return the packets of the conn in the order of the sequence numbers seqOf extracts
+// from their IP payload, for links reordering packets. A packet ahead of the number expected next is held until the
+// ones before it arrived, but at most for window and while fewer than maxPackets are held: then the missing numbers
+// are given up, counted in the SequenceLost stat, and reading goes on from the held packet. Packets with a number
+// already read or given up are dropped, counted in SequenceDuplicates. The packets seqOf has no number for are
+// returned as they arrive. The first packet sets the number expected next once it has waited for window.
+// maxPackets <= 0 means the capacity of the inbound queue. It takes precedence over WithReorderBuffer.
+// A nil seqOf or a window <= 0 is ignored.
+func WithSequenceReorder(seqOf SequenceFunc, maxPackets int, window time.Duration) ConnOption {
+	return func(config *RawIPConnConfig) {
+		if seqOf != nil && window > 0 {
+			config.seqOf = seqOf
+			config.seqMaxHeld = maxPackets
+			config.seqWindow = window
+		}
+	}
+}
+
+// WithRawFrames makes Read, ReadFrom and ReadWithMeta return the whole captured frame of the packets, link layer
+// header included, instead of the payload of their IP header: the Ethernet header on Ethernet interfaces, the 4 byte
+// loopback header on loopback ones. Packets the session delivers locally, see DialIP, have no link layer and are
+// returned from their IP header on. PacketMeta carries the MAC addresses anyway. SetStripLinkLayer changes it later.
+func WithRawFrames(enabled bool) ConnOption {
+	return func(config *RawIPConnConfig) {
+		config.rawFrames = enabled
+	}
+}
+
+// WithNextHop makes DialIP send all frames of the conn to the MAC address of nextHop instead of the gateway the routing
+// table picks. nextHop must be on-link for the interface of the conn: the one owning srcIP if given, otherwise the one
+// whose subnet contains nextHop. DialIP fails with ErrNextHopNotOnLink otherwise.
+func WithNextHop(nextHop net.IP) ConnOption {
+	return func(config *RawIPConnConfig) {
+		config.nextHopOverride = normalizeIP(nextHop)
+	}
+}
+
+// WithResolver makes DialHost resolve host names with lookup, e.g. the LookupIP method of a net.Resolver pointed at
+// a given DNS server, or a stub. network picks the records asked for: "ip4" for A records only, the default, "ip6" for
+// AAAA records only, or "ip" for both, whose dials race, see WithFallbackDelay. A nil lookup keeps net.DefaultResolver,
+// and an empty network keeps "ip4".
+func WithResolver(lookup LookupIPFunc, network string) ConnOption {
+	return func(config *RawIPConnConfig) {
+		if lookup != nil {
+			config.lookupIP = lookup
+		}
+		switch network {
+		case "ip4", "ip6", "ip":
+			config.lookupNetwork = network
+		}
+	}
+}
+
+// WithFallbackDelay sets how long DialHost gives the dials of the IPv6 addresses of a host as a head start before it
+// dials its IPv4 ones in parallel, when it has both, like net.Dialer.FallbackDelay. The first conn dialed is returned
+// and the other one closed. 0 means 300ms, a negative d dials the IPv4 addresses first, and the IPv6 ones only if they
+// all fail.
+func WithFallbackDelay(d time.Duration) ConnOption {
+	return func(config *RawIPConnConfig) {
+		config.fallbackDelay = d
+	}
+}
+
+// WithInterface pins a dialed conn to the named interface. Unless srcIP is given, the source address is the interface
+// address on-link for the destination, or its first IPv4 address. It is required to dial a link-local (169.254.0.0/16)
+// destination when several interfaces carry link-local addresses.
+func WithInterface(name string) ConnOption {
+	return func(config *RawIPConnConfig) {
+		config.ifaceName = name
+	}
+}
@@ -0,0 +1,30 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// PacketIO is the link layer access a pcapSession captures from and writes frames to. A *pcap.Handle is the
+// implementation used on live interfaces; a capture file or an in-memory channel pair can back a session as well
+// through WithHandleFactory, e.g. for deterministic tests of demux, ARP resolution and deadlines.
+//
+// ReadPacketData blocks until a frame is available, and returns an error once the PacketIO is closed.
+// Frames read and written include their link layer header: Ethernet, or the 4 bytes BSD loopback header on loopback.
+type PacketIO interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	WritePacketData(data []byte) error
+	SetBPFFilter(expr string) error
+	Close()
+}
+
+var _ PacketIO = (*pcap.Handle)(nil)
+
+// zeroCopyReader is implemented by a PacketIO able to return frames in a buffer reused by the next read,
+// like *pcap.Handle
+type zeroCopyReader interface {
+	ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+}
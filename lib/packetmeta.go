@@ -0,0 +1,80 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PacketMeta carries the metadata of a received packet: its capture information and the fields of its IP header.
+// It is what ReadWithMeta returns, so callers never need to decode the packet with gopacket themselves.
+type PacketMeta struct {
+	Timestamp      time.Time // capture timestamp
+	CaptureLength  int       // number of bytes captured
+	OriginalLength int       // length of the frame on the wire
+	Truncated      bool      // the snaplen cut the packet: CaptureLength < OriginalLength and the payload read is incomplete
+	Interface      string    // name of the interface the packet was captured on
+	SrcIP          net.IP
+	DstIP          net.IP
+	Protocol       layers.IPProtocol
+	TTL            uint8            // TTL for IPv4, hop limit for IPv6
+	TOS            uint8            // TOS byte for IPv4, traffic class for IPv6. DSCP is the upper 6 bits
+	FlowLabel      uint32           // IPv6 flow label, 0 for IPv4
+	VLANIDs        []uint16         // 802.1Q VLAN IDs of the frame, outermost first. nil for untagged frames
+	SrcMAC         net.HardwareAddr // Ethernet addresses of the frame. nil without Ethernet header, e.g. on loopback
+	DstMAC         net.HardwareAddr
+	EtherType      layers.EthernetType // EtherType of the Ethernet header, 802.1Q for tagged frames
+}
+
+// newPacketMeta extracts the metadata of a packet captured on the given interface
+func newPacketMeta(packet gopacket.Packet, ifaceName string) PacketMeta {
+	ci := packet.Metadata().CaptureInfo
+	meta := PacketMeta{
+		Timestamp:      ci.Timestamp,
+		CaptureLength:  ci.CaptureLength,
+		OriginalLength: ci.Length,
+		Interface:      ifaceName,
+		Truncated:      ci.CaptureLength < ci.Length,
+	}
+
+	if ethLayer := packet.Layer(layers.LayerTypeEthernet); ethLayer != nil {
+		eth, _ := ethLayer.(*layers.Ethernet)
+		meta.SrcMAC = eth.SrcMAC
+		meta.DstMAC = eth.DstMAC
+		meta.EtherType = eth.EthernetType
+	}
+
+	for _, layer := range packet.Layers() {
+		if dot1q, ok := layer.(*layers.Dot1Q); ok {
+			meta.VLANIDs = append(meta.VLANIDs, dot1q.VLANIdentifier)
+		}
+	}
+
+	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		ip, _ := ipLayer.(*layers.IPv4)
+		meta.SrcIP = ip.SrcIP
+		meta.DstIP = ip.DstIP
+		meta.Protocol = ip.Protocol
+		meta.TTL = ip.TTL
+		meta.TOS = ip.TOS
+	} else if ipLayer := packet.Layer(layers.LayerTypeIPv6); ipLayer != nil {
+		ip, _ := ipLayer.(*layers.IPv6)
+		meta.SrcIP = ip.SrcIP
+		meta.DstIP = ip.DstIP
+		// the protocol is the one after the extension headers, if their chain is well formed
+		meta.Protocol = ip.NextHeader
+		if protocol, _, err := ipv6UpperLayer(ipv6Payload(ip)); err == nil {
+			meta.Protocol = protocol
+		}
+		meta.TTL = ip.HopLimit
+		meta.TOS = ip.TrafficClass
+		meta.FlowLabel = ip.FlowLabel
+	}
+
+	return meta
+}
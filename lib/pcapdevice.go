@@ -0,0 +1,69 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// LookupPcapDevice returns the name of the pcap device capturing on the named interface, as opened by the sessions
+// of the interface, e.g. \Device\NPF_{GUID} for "Ethernet 2" on Windows. It is meant for diagnosing "device not found"
+// errors: when no device matches, the error lists the devices pcap knows of.
+func LookupPcapDevice(ifaceName string) (string, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return "", fmt.Errorf("interface %s: %w", ifaceName, ErrInterfaceNotFound)
+	}
+	return getPcapDeviceName(iface)
+}
+
+// getPcapDeviceName finds the pcap device of iface: first by the platform's naming of devices, the adapter GUID on
+// Windows and the interface name elsewhere, then by the IP addresses of the interface
+func getPcapDeviceName(iface *net.Interface) (string, error) {
+	devices, err := pcap.FindAllDevs()
+	if err != nil {
+		return "", fmt.Errorf("failed to list pcap devices: %w", err)
+	}
+
+	if name, ok := platformDeviceName(iface); ok {
+		for _, device := range devices {
+			if strings.EqualFold(device.Name, name) {
+				return device.Name, nil
+			}
+		}
+	}
+
+	var ifaceIPs []net.IP
+	if addrs, err := iface.Addrs(); err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				ifaceIPs = append(ifaceIPs, ipnet.IP)
+			}
+		}
+	}
+	for _, device := range devices {
+		for _, address := range device.Addresses {
+			for _, ifaceIP := range ifaceIPs {
+				if address.IP.Equal(ifaceIP) {
+					return device.Name, nil
+				}
+			}
+		}
+	}
+
+	candidates := make([]string, 0, len(devices))
+	for _, device := range devices {
+		ips := make([]string, 0, len(device.Addresses))
+		for _, address := range device.Addresses {
+			ips = append(ips, address.IP.String())
+		}
+		candidates = append(candidates, fmt.Sprintf("%s (%q, addresses [%s])", device.Name, device.Description, strings.Join(ips, " ")))
+	}
+	return "", fmt.Errorf("no pcap device matches interface %s (index %d, MAC %v, addresses %v) among: %s: %w",
+		iface.Name, iface.Index, iface.HardwareAddr, ifaceIPs, strings.Join(candidates, "; "), ErrInterfaceNotFound)
+}
@@ -0,0 +1,13 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package lib
+
+import (
+	"net"
+)
+
+// platformDeviceName returns the pcap device name of iface, which is the interface name on BSD systems
+func platformDeviceName(iface *net.Interface) (string, bool) {
+	return iface.Name, true
+}
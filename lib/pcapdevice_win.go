@@ -0,0 +1,54 @@
+//go:build windows
+// +build windows
+
+package lib
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// platformDeviceName returns the Npcap device name of iface, \Device\NPF_ followed by the GUID of the adapter.
+// The adapter is found by interface index, or by MAC address as the index may differ for some virtual adapters.
+// Adapters are listed with GetAdaptersAddresses, like net.Interfaces does, so that IPv6-only ones are found too
+func platformDeviceName(iface *net.Interface) (string, bool) {
+	if iface.Flags&net.FlagLoopback != 0 {
+		return `\Device\NPF_Loopback`, true // the Npcap loopback adapter has no GUID
+	}
+
+	size := uint32(16 * 1024)
+	var buf []byte
+	for {
+		buf = make([]byte, size)
+		err := windows.GetAdaptersAddresses(syscall.AF_UNSPEC, windows.GAA_FLAG_INCLUDE_PREFIX, 0,
+			(*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0])), &size)
+		if err == nil {
+			break
+		}
+		if err != windows.ERROR_BUFFER_OVERFLOW || size <= uint32(len(buf)) {
+			return "", false
+		}
+	}
+
+	var byMAC string
+	for aa := (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0])); aa != nil; aa = aa.Next {
+		guid := windows.BytePtrToString(aa.AdapterName)
+		// the index net.Interface reports: the IPv4 one, or the IPv6 one of adapters without IPv4
+		index := aa.IfIndex
+		if index == 0 {
+			index = aa.Ipv6IfIndex
+		}
+		if int(index) == iface.Index {
+			return `\Device\NPF_` + guid, true
+		}
+		mac := aa.PhysicalAddress[:min(int(aa.PhysicalAddressLength), len(aa.PhysicalAddress))]
+		if byMAC == "" && len(iface.HardwareAddr) > 0 && bytes.Equal(mac, iface.HardwareAddr) {
+			byMAC = `\Device\NPF_` + guid
+		}
+	}
+	return byMAC, byMAC != ""
+}
@@ -4,10 +4,13 @@
 package lib
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
@@ -17,48 +20,161 @@ import (
 
 // pcapSession manages raw IP connections on the same iface
 type pcapSessionConfig struct {
-	arpRequestTimeout time.Duration
+	public             SessionConfig // the configuration the session was opened with, before defaults were applied
+	arpRequestTimeout  time.Duration
+	arpRateLimit       int           // ARP requests per second. 0 means unlimited
+	arpNegativeTTL     time.Duration // how long a failed ARP resolution is remembered. 0 means not at all
+	memoryBudget       int64         // receive memory budget in bytes. 0 means unlimited
+	dispatchWorkers    int           // number of goroutines decoding and dispatching inbound packets
+	captureWorkers     int           // number of pcap handles capturing on the interface
+	idleTimeout        time.Duration // close the session after having no conns for this long. 0 closes it with its last conn
+	keepIdle           bool          // never close the session for having no conns
+	snaplen            int
+	promiscuous        bool
+	bufferSize         int // 0 keeps the platform default
+	maxBufferSize      int // ceiling of the kernel buffer grown by watchDrops. 0 disables growing
+	dropSampleInterval time.Duration
+	immediateMode      bool
+	timestampSource    string // "" keeps the platform default
+	readCPU            int    // CPU the first capture loop is pinned to, the next ones to the following CPUs. -1 disables pinning
 }
 type pcapSessionParams struct {
 	key                 string
 	iface               *net.Interface
-	handle              *pcap.Handle
+	handle              PacketIO
 	pcapSessionCloseSig chan *pcapSession
 	arpCache            *ARPCache
+	protoCounters       *protoCounters                                              // shared by all sessions of the core
+	handleFactory       HandleFactory                                               // opens the handle instead of the live device when set
+	blocklist           *blocklist                                                  // sources dropped by all sessions of the core. nil drops none
+	events              *eventHub                                                   // subscribers to the events of the core. nil emits none
+	migrate             func(conn *RawIPConn, ifaceName string, srcIP net.IP) error // moves a conn to another session of the core
 }
 
 type pcapSession struct {
-	config *pcapSessionConfig
-	params *pcapSessionParams
-	//mu                 sync.Mutex
-	rawIPConnMap       sync.Map
-	outgoingPackets    chan *gopacket.Packet // Channel for outgoing packets
+	config             *pcapSessionConfig
+	params             *pcapSessionParams
+	captureHandles     []PacketIO    // params.handle followed by the extra capture handles. Guarded by handleMu once running
+	captureRetired     chan struct{} // closed when reopenHandles closes the capture handles, guarded by handleMu
+	captureCount       atomic.Int32  // len(captureHandles), readable without lock
+	device             string        // pcap device of the interface. "" with a handle factory
+	bufferSize         atomic.Int64  // kernel buffer size the capture handles were opened with. 0 for the platform default
+	mtu                atomic.Int32  // current MTU of the interface, see watchMTU
+	retiredPcap        pcap.Stats    // pcap counters of the handles closed by reopenHandles, guarded by handleMu
+	captureRestarts    atomic.Uint64 // handles swapped by reopenHandles
+	arp                *arpWaiters   // dials waiting for an ARP reply
+	arpLimit           *arpLimiter   // rate limit and negative cache of the ARP requests
+	idle               *idleWatcher  // closes the conns idle for longer than their idle timeout
+	conns              *connTable
+	echo               *echoResponder       // addresses whose echo requests the session answers itself
+	lldp               *lldpAgent           // LLDP subscribers and announcers of the interface
+	nd                 *ndProxy             // IPv6 addresses whose Neighbor Solicitations are answered
+	outgoingPackets    chan *outboundPacket // Channel for outgoing packets
 	rawIPConnCloseChan chan *RawIPConn
+	unused             chan struct{} // signaled by release when no dial or listen is pending anymore
+	mem                *memAccount   // bytes held in the receive queues of all conns of the session
+	decoder            gopacket.Decoder
+	dispatchQueues     []chan capturedFrame // one queue per dispatch worker
+	pending            atomic.Int32         // number of dials/listens in progress on the session. -1 once the core retired it
+	lastActive         atomic.Int64         // unix nanos of the creation of the session or the last conn leaving it
+	decodeErrors       atomic.Uint64        // captured frames which could not be fully decoded
+	writeErrors        atomic.Uint64        // frames the handle failed to send
 	stopChan           chan struct{}
 	wg                 sync.WaitGroup
-	isClosed           bool
+	isClosed           atomic.Bool
+	handleMu           sync.RWMutex // held for writing while the pcap handles are closed, so stats never use a closed handle
 }
 
 // NewPcapSession creates a new NewPcapSession with a global ARP cache
 func newPcapSession(params *pcapSessionParams, config *pcapSessionConfig) (*pcapSession, error) {
-	var err error
-	params.handle, err = pcap.OpenLive(getPcapDeviceName(params.iface), 65536, true, pcap.BlockForever)
+	var (
+		device string
+		err    error
+	)
+	if params.handleFactory != nil {
+		params.handle, err = params.handleFactory(params.iface)
+		if err == nil && params.handle == nil {
+			err = fmt.Errorf("handle factory returned no handle for %s", params.iface.Name)
+		}
+	} else {
+		device, err = getPcapDeviceName(params.iface)
+		var handle *pcap.Handle
+		if err == nil {
+			handle, err = openHandle(device, config)
+			params.handle = handle
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	session := &pcapSession{
-		config: config,
-		params: params,
-		//rawIPConnMap:       make(map[string]*RawIPConn),
-		outgoingPackets:    make(chan *gopacket.Packet, 100),
+		config:             config,
+		params:             params,
+		conns:              newConnTable(),
+		echo:               newEchoResponder(),
+		lldp:               newLLDPAgent(),
+		nd:                 newNDProxy(),
+		arp:                newARPWaiters(),
+		arpLimit:           newARPLimiter(config.arpRateLimit, config.arpNegativeTTL),
+		outgoingPackets:    make(chan *outboundPacket, 100),
 		rawIPConnCloseChan: make(chan *RawIPConn),
+		unused:             make(chan struct{}, 1),
+		mem:                newMemAccount(config.memoryBudget),
 		stopChan:           make(chan struct{}),
+		captureRetired:     make(chan struct{}),
+		device:             device,
 		wg:                 sync.WaitGroup{},
 	}
+	session.bufferSize.Store(int64(config.bufferSize))
+	session.mtu.Store(int32(params.iface.MTU))
+	session.lastActive.Store(time.Now().UnixNano())
+	session.idle = newIdleWatcher(session.stopChan)
+
+	session.decoder = session.linkType()
+
+	workers := config.dispatchWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	session.dispatchQueues = make([]chan capturedFrame, workers)
+	for i := range session.dispatchQueues {
+		session.dispatchQueues[i] = make(chan capturedFrame, dispatchQueueLen)
+		session.wg.Add(1)
+		go session.dispatchPackets(session.dispatchQueues[i])
+	}
+
+	if handle, ok := params.handle.(*pcap.Handle); ok && params.handleFactory == nil {
+		for _, h := range openCaptureHandles(device, handle, config) {
+			session.captureHandles = append(session.captureHandles, h)
+		}
+	} else {
+		session.captureHandles = []PacketIO{params.handle} // extra capture handles need the live device
+	}
+	session.captureCount.Store(int32(len(session.captureHandles)))
+
+	if params.blocklist != nil {
+		if block := params.blocklist.filter(); block != "" {
+			session.setBlockFilter(block)
+		}
+	}
+
+	// the capture goroutines are not tracked by wg since they only return once their handle is closed
+	for i, handle := range session.captureHandles {
+		go session.handleIncomingPackets(handle, i, session.captureRetired)
+	}
+
+	if config.maxBufferSize > 0 {
+		if params.handleFactory == nil {
+			session.wg.Add(1)
+			go session.watchDrops()
+		} else {
+			log.Printf("Warning: no adaptive buffer size on %s, its handle comes from a handle factory", params.key)
+		}
+	}
 
 	session.wg.Add(1)
-	go session.handleIncomingPackets()
+	go session.watchMTU()
 
 	session.wg.Add(1)
 	go session.handleOutgoingPackets()
@@ -69,101 +185,188 @@ func newPcapSession(params *pcapSessionParams, config *pcapSessionConfig) (*pcap
 	return session, nil
 }
 
-// DialIP creates or retrieves a RawIPConn based on the given parameters
-func (ps *pcapSession) dialIP(srcIP, dstIP net.IP, protocol layers.IPProtocol) (*RawIPConn, error) {
-	//ps.mu.Lock()
-	//defer ps.mu.Unlock()
+// DialIP creates a new client RawIPConn based on the given parameters
+func (ps *pcapSession) dialIP(ipConnConfig *RawIPConnConfig) (*RawIPConn, error) {
+	key := newFlowKey(ipConnConfig.protocol, ipConnConfig.localIP, ipConnConfig.remoteIP)
 
-	// construct RawIPConn key and lookup to see if it already exists
-	key := srcIP.To4().String() + ":" + dstIP.To4().String() + ":" + string(protocol)
-	if _, exists := ps.rawIPConnMap.Load(key); exists {
-		return nil, fmt.Errorf("raw ip connection with the same source/destination IP and protocol type already exists. Cannot dial again")
+	// Create a new RawIPConn
+	conn, err := NewRawIPConn(ps.newConnParams(false, key.String()), ipConnConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing raw IPConn: %v", err)
 	}
 
-	// Create a new RawIPConn
-	ipConnConfig := &RawIPConnConfig{
-		localIP:  srcIP,
-		remoteIP: dstIP,
-		protocol: protocol,
+	// Add to the demux index
+	if err := ps.conns.register(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("raw ip connection with the same source/destination IP and protocol type already exists. Cannot dial again: %w", err)
 	}
-	ipConnParams := &RawIPConnParams{
-		isServer:           false,
+	ps.params.events.emit(&ConnOpened{eventTime{time.Now()}, ps.params.key, conn.getKey(), conn.direction()})
+	return conn, nil
+}
+
+// newConnParams returns the params tying a new conn, named key, to the session
+func (ps *pcapSession) newConnParams(isServer bool, key string) *RawIPConnParams {
+	return &RawIPConnParams{
+		isServer:           isServer,
 		key:                key,
 		pcapIface:          ps.params.iface,
-		handle:             ps.params.handle,
+		handle:             ps.currentHandle(),
 		outputChan:         ps.outgoingPackets,
 		rawIPConnCloseChan: ps.rawIPConnCloseChan,
+		sessionDone:        ps.stopChan,
+		mem:                ps.mem,
+		resolveMAC:         ps.resolveMAC,
+		cachedMAC:          ps.cachedMAC,
+		linkMTU:            ps.linkMTU,
+		watchIdle:          ps.idle.watch,
+		migrate:            ps.params.migrate,
 	}
-	conn, err := NewRawIPConn(ipConnParams, ipConnConfig)
-	if err != nil {
-		log.Fatalln("Error dialing raw IPConn:", err)
-	}
-
-	// Add to map
-	ps.rawIPConnMap.Store(key, conn)
-	return conn, nil
 }
 
-func (ps *pcapSession) listenIP(ip net.IP, protocol layers.IPProtocol) (*RawIPConn, error) {
-	// Create a unique key for the RawIPConn
-	connKey := fmt.Sprintf("%s:%s", ip.String(), protocol.String())
-	log.Println("service key is", connKey)
+func (ps *pcapSession) listenIP(ipConnConfig *RawIPConnConfig) (*RawIPConn, error) {
+	ip, protocol := ipConnConfig.localIP, ipConnConfig.protocol
 
-	_, exists := ps.rawIPConnMap.Load(connKey)
-	if exists {
-		return nil, fmt.Errorf("IPConn Listener already exists for IP: %v and protocol: %v", ip, protocol)
-	}
+	// Create a unique key for the RawIPConn
+	key := newFlowKey(protocol, ip, nil)
+	log.Println("service key is", key)
 
 	// Create a new RawIPConn
-	ipConnConfig := &RawIPConnConfig{
-		localIP:  ip,
-		remoteIP: nil,
-		protocol: protocol,
-	}
-	ipConnParams := &RawIPConnParams{
-		isServer:           true,
-		key:                connKey,
-		pcapIface:          ps.params.iface,
-		handle:             ps.params.handle,
-		outputChan:         ps.outgoingPackets,
-		rawIPConnCloseChan: ps.rawIPConnCloseChan,
-	}
-	conn, err := NewRawIPConn(ipConnParams, ipConnConfig)
+	conn, err := NewRawIPConn(ps.newConnParams(true, key.String()), ipConnConfig)
 	if err != nil {
-		log.Fatalln("Error dialing raw IPConn:", err)
+		return nil, fmt.Errorf("error listening raw IPConn: %v", err)
 	}
 
-	// Add to map
-	ps.rawIPConnMap.Store(connKey, conn)
+	// Add to the demux index
+	if err := ps.conns.register(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("IPConn Listener already exists for IP: %v and protocol: %v: %w", ip, protocol, err)
+	}
+	ps.params.events.emit(&ConnOpened{eventTime{time.Now()}, ps.params.key, conn.getKey(), conn.direction()})
 	return conn, nil
 }
 
-func (ps *pcapSession) handleIncomingPackets() {
-	defer ps.wg.Done()
+// handleIncomingPackets reads frames from a capture handle and hands each one to the dispatch worker owning its flow.
+// retired is closed when reopenHandles closes the handle
+func (ps *pcapSession) handleIncomingPackets(handle PacketIO, index int, retired <-chan struct{}) {
+	if ps.config.readCPU >= 0 {
+		// the goroutine keeps its thread, and so its affinity, until the handle closes
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		cpu := (ps.config.readCPU + index) % runtime.NumCPU()
+		if err := setThreadAffinity(cpu); err != nil {
+			log.Printf("pcapSession %s: cannot pin capture loop %d to CPU %d: %v", ps.params.key, index, cpu, err)
+		}
+	}
 
-	// Check if the interface is a loopback interface
-	var decoder gopacket.Decoder
-	if (ps.params.iface.Flags & net.FlagLoopback) != 0 {
-		decoder = layers.LayerTypeLoopback
-	} else {
-		decoder = layers.LayerTypeEthernet
+	linkHeaderLen := 14 // Ethernet
+	if ps.decoder == layers.LayerTypeLoopback {
+		linkHeaderLen = 4
 	}
 
-	src := gopacket.NewPacketSource(ps.params.handle, decoder)
-	in := src.Packets()
-	defer ps.params.handle.Close()
 	for {
+		var (
+			data []byte
+			ci   gopacket.CaptureInfo
+			err  error
+		)
+		if zc, ok := handle.(zeroCopyReader); ok {
+			data, ci, err = zc.ZeroCopyReadPacketData()
+		} else {
+			data, ci, err = handle.ReadPacketData()
+		}
+		if err != nil {
+			if err == pcap.NextErrorTimeoutExpired {
+				continue
+			}
+			select {
+			case <-ps.stopChan:
+			case <-retired:
+			default:
+				log.Println("pcapSession.handleIncomingPackets: stop capturing:", err)
+			}
+			return
+		}
+
+		queue := ps.dispatchQueues[flowHash(data, linkHeaderLen)%uint32(len(ps.dispatchQueues))]
 		select {
 		case <-ps.stopChan:
 			return
-		case packet, ok := <-in:
-			if !ok {
-				// Channel closed
-				return
-			}
-			ps.processIncomingPacket(&packet)
+		case queue <- newCapturedFrame(data, ci):
+		}
+	}
+}
+
+// dispatchPackets decodes captured frames and forwards them to the matching RawIPConn
+func (ps *pcapSession) dispatchPackets(frames <-chan capturedFrame) {
+	defer ps.wg.Done()
+
+	parser := newHeaderParser(ps.linkType())
+	for {
+		select {
+		case <-ps.stopChan:
+			return
+		case frame := <-frames:
+			ps.dispatchFrame(parser, frame)
+			framePool.Put(frame.buf)
+		}
+	}
+}
+
+// linkType returns the link layer of the frames captured by the session
+func (ps *pcapSession) linkType() gopacket.LayerType {
+	if (ps.params.iface.Flags & net.FlagLoopback) != 0 {
+		return layers.LayerTypeLoopback
+	}
+	return layers.LayerTypeEthernet
+}
+
+// dispatchFrame decodes one captured frame and forwards it. A runt or corrupt frame is counted as a decode error
+// and never takes the dispatch worker down. The frame's buffer is recycled once it returns
+func (ps *pcapSession) dispatchFrame(parser *headerParser, frame capturedFrame) {
+	defer func() {
+		if r := recover(); r != nil {
+			ps.decodeErrors.Add(1)
+			log.Println("pcapSession.dispatchFrame: recovered from malformed packet:", r)
+		}
+	}()
+
+	ipv4, err := parser.parse(*frame.buf)
+	if ipv4 == nil {
+		if arp := parser.decodedARP(); arp != nil {
+			ps.handleARP(arp)
+		} else if eth := parser.decodedLLDP(); eth != nil {
+			ps.handleLLDP(eth.Payload, eth.SrcMAC, frame.ci.Timestamp)
+		} else if ipv6 := parser.decodedIPv6(); ipv6 != nil {
+			ps.dispatchIPv6(parser, ipv6, frame)
+		} else if err != nil {
+			ps.decodeErrors.Add(1)
 		}
+		return // ARP, IPv6 and the like, or no usable IP header
 	}
+	if err := checkIPv4(ipv4, frame.ci); err != nil {
+		ps.decodeErrors.Add(1)
+		return
+	}
+	ps.params.protoCounters.add(ipv4.Protocol, int(ipv4.Length))
+	if ps.params.blocklist != nil && ps.params.blocklist.drops(ipv4.SrcIP) {
+		return
+	}
+	if !ps.wants(ipv4) {
+		return
+	}
+
+	// the packet outlives the pooled buffer, and owns its copy of the data
+	data := append([]byte(nil), *frame.buf...)
+	packet := gopacket.NewPacket(data, ps.decoder, gopacket.DecodeOptions{NoCopy: true})
+	packet.Metadata().CaptureInfo = frame.ci
+	if errLayer := packet.ErrorLayer(); errLayer != nil {
+		ps.decodeErrors.Add(1)
+		if packet.Layer(layers.LayerTypeIPv4) == nil {
+			return // nothing usable in it
+		}
+		// the IP header is fine, only an upper layer is malformed. The payload can still be delivered
+	}
+	ps.processIncomingPacket(&packet)
 }
 
 // processPacket processes an incoming packet and forwards it to the appropriate RawIPConn
@@ -183,57 +386,48 @@ func (ps *pcapSession) processIncomingPacket(packet *gopacket.Packet) {
 
 	// Determine the Layer 4 protocol
 	protocol := ipv4.Protocol
+	srcIP, dstIP := toAddr(ipv4.SrcIP), toAddr(ipv4.DstIP)
 
-	// Construct the client connection key for RawIPConn lookup
-	key := ipv4.DstIP.String() + ":" + ipv4.SrcIP.String() + ":" + protocol.String()
-	log.Println("Client key is", key)
-	value, exists := ps.rawIPConnMap.Load(key)
-	if exists {
-		conn := value.(*RawIPConn)
-		// Forward the packet to the RawIPConn's input channel
-		conn.inputChan <- packet
+	answered := protocol == layers.IPProtocolICMPv4 && (ps.answerEcho(packet, ipv4, dstIP) || ps.reportUnreachable(packet, ipv4))
+
+	// Look up the client connection first, then listeners
+	if conns := ps.conns.lookupAll(protocol, dstIP, srcIP); len(conns) > 0 {
+		// Forward the packet to the RawIPConn's input channel. Shared listeners all get the same decoded packet,
+		// which they only read
+		for _, conn := range conns {
+			conn.enqueue(packet)
+		}
 		return
 	}
 
-	// Construct the server connection key for RawIPConn lookup
-	key = ipv4.DstIP.String() + ":" + protocol.String()
-	log.Println("Server key is", key)
-	value, exists = ps.rawIPConnMap.Load(key)
-	if exists {
-		conn := value.(*RawIPConn)
-		// Forward the packet to the RawIPConn's input channel
-		conn.inputChan <- packet
+	if answered {
 		return
 	}
 
-	// Check for TCP 3-way handshake packets originated locally
+	// Check for TCP 3-way handshake packets originated locally. Only for TCP itself: a TCP segment carried inside
+	// AH, GRE or any other protocol is opaque payload of that protocol
+	if protocol != layers.IPProtocolTCP {
+		log.Println("No RawIPConn found for packet", ipv4.SrcIP, "->", ipv4.DstIP, protocol)
+		return
+	}
 	tcpLayer := (*packet).Layer(layers.LayerTypeTCP)
 	if tcpLayer != nil {
 		tcp, _ := tcpLayer.(*layers.TCP)
-
-		// Construct the client connection key (outbound packet) for RawIPConn lookup
-		key = ipv4.SrcIP.String() + ":" + ipv4.DstIP.String() + ":" + protocol.String()
-		ps.sendSynPacket(packet, key, tcp)
-
-		// Construct the server connection key for RawIPConn lookup
-		key = ipv4.SrcIP.String() + ":" + protocol.String()
-		ps.sendSynPacket(packet, key, tcp)
+		if conn := ps.conns.lookup(protocol, srcIP, dstIP); conn != nil {
+			ps.sendSynPacket(packet, conn, tcp)
+			return
+		}
 	}
 
-	log.Println("No RawIPConn found for key:", key)
+	log.Println("No RawIPConn found for packet", ipv4.SrcIP, "->", ipv4.DstIP, protocol)
 }
 
-func (ps *pcapSession) sendSynPacket(packet *gopacket.Packet, key string, tcp *layers.TCP) {
-	value, exists := ps.rawIPConnMap.Load(key)
-	if exists {
-		// Check for SYN/SYN-ACK packet
-		if tcp.SYN || (tcp.ACK && len(tcp.Payload) == 0) {
-			log.Println("Detected locally originated SYN or zero-length ACK packet")
-			conn := value.(*RawIPConn)
-			// Forward the packet to the RawIPConn's input channel. Note that it's RawIPConn's resposiblity to tell which ACK belongs to 3-way handshake
-			conn.inputChan <- packet
-			return
-		}
+func (ps *pcapSession) sendSynPacket(packet *gopacket.Packet, conn *RawIPConn, tcp *layers.TCP) {
+	// Check for SYN/SYN-ACK packet
+	if tcp.SYN || (tcp.ACK && len(tcp.Payload) == 0) {
+		log.Println("Detected locally originated SYN or zero-length ACK packet")
+		// Forward the packet to the RawIPConn's input channel. Note that it's RawIPConn's resposiblity to tell which ACK belongs to 3-way handshake
+		conn.enqueue(packet)
 	}
 }
 
@@ -245,57 +439,86 @@ func (ps *pcapSession) handleOutgoingPackets() {
 		case <-ps.stopChan:
 			return
 		case pkt := <-ps.outgoingPackets:
+			if pkt.local {
+				ps.deliverLocal(pkt)
+				continue
+			}
+			if pkt.frame != nil {
+				if err := ps.writeFrame(pkt.frame); err != nil {
+					ps.writeErrors.Add(1)
+					log.Println("Error writing frame:", err)
+				}
+				continue
+			}
+
 			var buffer gopacket.SerializeBuffer
 			var err error
 			options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+			ipv6 := isIPv6Packet((*pkt.packet).Data())
+			etherType := layers.EthernetTypeIPv4
+			if ipv6 {
+				etherType = layers.EthernetTypeIPv6
+			}
 
 			if (ps.params.iface.Flags & net.FlagLoopback) != 0 {
 				// Loopback interface: No Ethernet layer
 				buffer = gopacket.NewSerializeBuffer()
 				// Used for loopback interface
 				lo := layers.Loopback{
-					Family: layers.ProtocolFamilyIPv4,
+					Family: loopbackFamily(ipv6),
 				}
-				err = gopacket.SerializeLayers(buffer, options, &lo, gopacket.Payload((*pkt).Data()))
+				err = gopacket.SerializeLayers(buffer, options, &lo, gopacket.Payload((*pkt.packet).Data()))
 				if err != nil {
 					log.Println("Error serializing packet:", err)
 					continue
 				}
 			} else { // currently we only support ethernet besides loopback
 				// Ethernet interface: Add Ethernet layer
-				// get pkt's destination ip
-				ipLayer := (*pkt).Layer(layers.LayerTypeIPv4)
-				if ipLayer == nil {
-					log.Println("pcapSession.handleOutgoingPackets: packet does not contain an IPv4 layer")
-					continue // skip the packet
-				}
-
-				ipv4, _ := ipLayer.(*layers.IPv4)
-				destIP := ipv4.DstIP
-
-				// find out nextHopIP
-				_, _, gatewayIP, _ := GetLocalIP(destIP)
-				var nextHopIp = destIP
-				if gatewayIP != nil {
-					nextHopIp = gatewayIP
-				}
-				// get remote mac address of nextHopIP
-				dstMAC, err := getRemoteMAC(ps.params.iface, nextHopIp, ps.config.arpRequestTimeout)
-				if err != nil {
-					log.Println("pcapSession.handleOutgoingPackets: failed to retrieve remote mac address:", err)
-					continue
+				dstMAC := pkt.dstMAC
+				if dstMAC == nil {
+					// the conn did not resolve the next hop. get pkt's destination ip
+					var nextHopIp net.IP
+					switch ip := (*pkt.packet).NetworkLayer().(type) {
+					case *layers.IPv4:
+						// find out nextHopIP
+						_, _, gatewayIP, _ := GetLocalIP(ip.DstIP)
+						nextHopIp = ip.DstIP
+						if gatewayIP != nil {
+							nextHopIp = gatewayIP
+						}
+					case *layers.IPv6:
+						nextHopIp = ip.DstIP // the IPv6 routing table is not read: the destination is on-link
+					default:
+						log.Println("pcapSession.handleOutgoingPackets: packet does not contain an IP layer")
+						continue // skip the packet
+					}
+					// get remote mac address of nextHopIP
+					dstMAC, err = ps.resolveMAC(nextHopIp)
+					if err != nil {
+						log.Println("pcapSession.handleOutgoingPackets: failed to retrieve remote mac address:", err)
+						continue
+					}
 				}
 
 				// construct ethernet layer
+				srcMAC := pkt.srcMAC
+				if srcMAC == nil {
+					srcMAC = ps.params.iface.HardwareAddr
+				}
 				ethernetLayer := &layers.Ethernet{
-					SrcMAC:       ps.params.iface.HardwareAddr,
+					SrcMAC:       srcMAC,
 					DstMAC:       dstMAC,
-					EthernetType: layers.EthernetTypeIPv4,
+					EthernetType: etherType,
+				}
+				linkLayers := []gopacket.SerializableLayer{ethernetLayer}
+				if pkt.vlanID != 0 {
+					ethernetLayer.EthernetType = layers.EthernetTypeDot1Q
+					linkLayers = append(linkLayers, &layers.Dot1Q{VLANIdentifier: pkt.vlanID, Type: etherType})
 				}
 
 				// Serialize the full packet including Ethernet layer
 				buffer = gopacket.NewSerializeBuffer()
-				err = gopacket.SerializeLayers(buffer, options, ethernetLayer, gopacket.Payload((*pkt).Data()))
+				err = gopacket.SerializeLayers(buffer, options, append(linkLayers, gopacket.Payload((*pkt.packet).Data()))...)
 				if err != nil {
 					log.Println("Error serializing packet:", err)
 					continue
@@ -303,54 +526,265 @@ func (ps *pcapSession) handleOutgoingPackets() {
 			}
 
 			// Write the raw packet data to the pcap handle
-			if err := ps.params.handle.WritePacketData(buffer.Bytes()); err != nil {
+			if err := ps.writeFrame(buffer.Bytes()); err != nil {
+				ps.writeErrors.Add(1)
 				log.Println("Error writing packet:", err)
 			}
 		}
 	}
 }
 
+// writeFrame sends frame on the handle of the session, which reopenHandles may be swapping meanwhile
+func (ps *pcapSession) writeFrame(frame []byte) error {
+	ps.handleMu.RLock()
+	defer ps.handleMu.RUnlock()
+	return ps.params.handle.WritePacketData(frame)
+}
+
+// currentHandle returns the handle the session writes to, the first capture handle
+func (ps *pcapSession) currentHandle() PacketIO {
+	ps.handleMu.RLock()
+	defer ps.handleMu.RUnlock()
+	return ps.params.handle
+}
+
+// deliverLocal hands a packet written to an address of the host to the conns of the session, as if it had been captured
+func (ps *pcapSession) deliverLocal(pkt *outboundPacket) {
+	packet := *pkt.packet
+	length := len(packet.Data())
+	packet.Metadata().CaptureInfo = gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: length, Length: length}
+
+	ipv6, isIPv6 := packet.NetworkLayer().(*layers.IPv6)
+	if !pkt.listenersOnly {
+		if isIPv6 {
+			ps.demuxIPv6(pkt.packet)
+			return
+		}
+		ps.processIncomingPacket(pkt.packet)
+		return
+	}
+	// sent from an address to itself: the connected conn that wrote it would match first
+	var (
+		protocol layers.IPProtocol
+		dstIP    net.IP
+	)
+	if isIPv6 {
+		protocol, _, _ = ipv6UpperLayer(ipv6Payload(ipv6))
+		dstIP = ipv6.DstIP
+	} else {
+		ipv4, _ := packet.NetworkLayer().(*layers.IPv4)
+		protocol, dstIP = ipv4.Protocol, ipv4.DstIP
+	}
+	for _, conn := range ps.conns.lookupListeners(protocol, toAddr(dstIP)) {
+		conn.enqueue(pkt.packet)
+	}
+}
+
+// cachedMAC returns the MAC address of ip if it is known without an ARP request or a Neighbor Solicitation
+func (ps *pcapSession) cachedMAC(ip net.IP) (net.HardwareAddr, bool) {
+	if (ps.params.iface.Flags & net.FlagLoopback) != 0 {
+		return nil, true // no link layer addresses on loopback
+	}
+	if mac := groupMAC(ps.params.iface, ip); mac != nil {
+		return mac, true // broadcast and multicast are never resolved
+	}
+	return ps.params.arpCache.Lookup(ip.String())
+}
+
+// resolveMAC returns the MAC address of ip from the ARP cache, or resolves it on the session's interface with an ARP
+// request, or a Neighbor Solicitation for IPv6 addresses. Both share the cache, keyed by address
+func (ps *pcapSession) resolveMAC(ip net.IP) (net.HardwareAddr, error) {
+	if mac, found := ps.cachedMAC(ip); found {
+		return mac, nil
+	}
+	if ps.arpLimit.recentlyFailed(toAddr(ip), time.Now()) {
+		return nil, fmt.Errorf("no ARP reply from %v less than %v ago: %w", ip, ps.config.arpNegativeTTL, ErrARPTimeout)
+	}
+
+	resolve := ps.requestARP
+	if ip.To4() == nil {
+		resolve = ps.solicitNeighbor
+	}
+	start := time.Now()
+	mac, err := resolve(ip)
+	if err != nil {
+		if errors.Is(err, ErrARPTimeout) {
+			ps.params.arpCache.observeResolution(ps.params.iface.Name, time.Since(start), true)
+			ps.arpLimit.failed(toAddr(ip), time.Now())
+		}
+		return nil, err
+	}
+	ps.params.arpCache.observeResolution(ps.params.iface.Name, time.Since(start), false)
+	ps.params.arpCache.Add(ip.String(), mac)
+
+	return mac, nil
+}
+
 func (ps *pcapSession) handleRawIPConnClose() {
 	defer ps.wg.Done()
 
+	// check for idleness a few times per timeout period. Without timeout, the session is checked whenever it may have
+	// lost its last user instead
+	var idleCheck <-chan time.Time
+	if ps.config.idleTimeout > 0 && !ps.config.keepIdle {
+		ticker := time.NewTicker(max(ps.config.idleTimeout/4, 10*time.Millisecond))
+		defer ticker.Stop()
+		idleCheck = ticker.C
+	}
+
 	for {
 		select {
 		case <-ps.stopChan:
 			return
 		case conn := <-ps.rawIPConnCloseChan:
-			ps.rawIPConnMap.Delete(conn.getKey())
-
-			if mapLength(&(ps.rawIPConnMap)) == 0 {
-				// Start a timeout timer for 10 seconds
-				timer := time.NewTimer(10 * time.Second)
-				defer timer.Stop()
-
-				select {
-				case <-ps.stopChan:
-					return
-				case <-timer.C:
-					if mapLength(&(ps.rawIPConnMap)) == 0 {
-						ps.close() // Close the pcapsession if empty after timeout
-					}
-				}
+			ps.conns.deregister(conn)
+			ps.params.events.emit(&ConnClosed{eventTime{time.Now()}, ps.params.key, conn.getKey(), conn.closedError()})
+			ps.lastActive.Store(time.Now().UnixNano())
+			if !ps.reapIfIdle() {
+				return
+			}
+		case <-ps.unused:
+			if !ps.reapIfIdle() {
+				return
+			}
+		case <-idleCheck:
+			if !ps.reapIfIdle() {
+				return
 			}
 		}
 	}
 }
 
-func (ps *pcapSession) close() {
-	if ps.isClosed {
-		return
+// reapIfIdle asks the core to reap the session if it is idle. The core closes the session, which stops
+// handleRawIPConnClose. It returns false if the session stopped meanwhile
+func (ps *pcapSession) reapIfIdle() bool {
+	if !ps.isIdle() {
+		return true
+	}
+	select {
+	case <-ps.stopChan:
+		return false
+	case ps.params.pcapSessionCloseSig <- ps:
+		return true
+	}
+}
+
+// tryAcquire marks a dial or listen in progress on the session, which keeps it from being reaped.
+// It fails if the core has retired the session already
+func (ps *pcapSession) tryAcquire() bool {
+	for {
+		n := ps.pending.Load()
+		if n < 0 {
+			return false
+		}
+		if ps.pending.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// retire makes every later tryAcquire fail if the session is idle. It tells if the session was retired
+func (ps *pcapSession) retire() bool {
+	if !ps.pending.CompareAndSwap(0, -1) {
+		return false
+	}
+	// a dial may have registered its conn and released the session before the swap
+	if !ps.isIdle() {
+		ps.pending.Store(0)
+		return false
+	}
+	return true
+}
+
+// release ends a dial or listen started with tryAcquire
+func (ps *pcapSession) release() {
+	ps.lastActive.Store(time.Now().UnixNano())
+	if ps.pending.Add(-1) == 0 {
+		// a failed dial may leave the session without conn
+		select {
+		case ps.unused <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// isIdle tells if the session has had no conns and no dial in progress for longer than the idle timeout
+func (ps *pcapSession) isIdle() bool {
+	if ps.config.keepIdle || ps.pending.Load() > 0 || ps.conns.len() > 0 || ps.echo.len() > 0 || ps.lldp.len() > 0 || ps.nd.len() > 0 {
+		return false
+	}
+	return ps.config.idleTimeout <= 0 || time.Since(time.Unix(0, ps.lastActive.Load())) >= ps.config.idleTimeout
+}
+
+// Handle returns the pcap handle the session captures from and writes to, see RawSocketCore.SessionHandle.
+// It is nil for a session built around a PacketIO which is not a *pcap.Handle
+func (ps *pcapSession) Handle() *pcap.Handle {
+	handle, _ := ps.currentHandle().(*pcap.Handle)
+	return handle
+}
+
+// stats returns a snapshot of the session statistics
+func (ps *pcapSession) stats() SessionStats {
+	stats := SessionStats{
+		Interface:       ps.params.iface.Name,
+		MemoryBudget:    ps.mem.budget.Load(),
+		MemoryInUse:     ps.mem.inUse.Load(),
+		MemoryHighWater: ps.mem.highWater.Load(),
+		CaptureWorkers:  int(ps.captureCount.Load()),
+		BufferSize:      int(ps.bufferSize.Load()),
+		CaptureRestarts: ps.captureRestarts.Load(),
+		DecodeErrors:    ps.decodeErrors.Load(),
+		WriteErrors:     ps.writeErrors.Load(),
+		ARPRateLimited:  ps.arpLimit.rateLimited.Load(),
+		ARPNegativeHits: ps.arpLimit.negativeHits.Load(),
 	}
-	ps.isClosed = true
 
-	var ipConns []*RawIPConn
-	ps.rawIPConnMap.Range(func(key, value interface{}) bool {
-		ipConns = append(ipConns, value.(*RawIPConn))
-		return true // continue iteration
-	})
+	// aggregate the pcap counters of all capture handles, unless they are being or have been closed
+	ps.handleMu.RLock()
+	defer ps.handleMu.RUnlock()
+	stats.PcapReceived = ps.retiredPcap.PacketsReceived
+	stats.PcapDropped = ps.retiredPcap.PacketsDropped
+	stats.PcapIfDropped = ps.retiredPcap.PacketsIfDropped
+	if ps.isClosed.Load() {
+		return stats
+	}
+	for _, io := range ps.captureHandles {
+		handle, ok := io.(*pcap.Handle)
+		if !ok {
+			continue // no kernel counters
+		}
+		pcapStats, err := handle.Stats()
+		if err != nil {
+			continue
+		}
+		stats.PcapReceived += pcapStats.PacketsReceived
+		stats.PcapDropped += pcapStats.PacketsDropped
+		stats.PcapIfDropped += pcapStats.PacketsIfDropped
+	}
 
-	for _, ipConn := range ipConns {
+	return stats
+}
+
+// String describes the session on one line without taking any lock
+func (ps *pcapSession) String() string {
+	state := "open"
+	if ps.isClosed.Load() {
+		state = "closed"
+	}
+	return fmt.Sprintf("pcap-session %s, captures=%d, dialing=%d, mem=%d/%d, decode-errors=%d, state=%s",
+		ps.params.key, ps.captureCount.Load(), ps.pending.Load(), ps.mem.inUse.Load(), ps.mem.budget.Load(),
+		ps.decodeErrors.Load(), state)
+}
+
+// close closes the session and its conns. reason ends up in the SessionClosed event
+func (ps *pcapSession) close(reason string) {
+	if !ps.isClosed.CompareAndSwap(false, true) {
+		return
+	}
+
+	ps.lldp.close()
+	ps.nd.close()
+	for _, ipConn := range ps.conns.all() {
 		ipConn.Close()
 	}
 
@@ -358,17 +792,14 @@ func (ps *pcapSession) close() {
 
 	ps.wg.Wait()
 
-	close(ps.outgoingPackets)
+	// outgoingPackets is left open: conns may still hand it packets, which they drop once they see stopChan closed
+	ps.handleMu.Lock()
+	for _, handle := range ps.captureHandles[1:] {
+		handle.Close()
+	}
 	ps.params.handle.Close()
+	ps.handleMu.Unlock()
 
 	log.Printf("Pcap Session %s closed", ps.params.key)
-}
-
-func mapLength(m *sync.Map) int {
-	count := 0
-	m.Range(func(key, value interface{}) bool {
-		count++
-		return true
-	})
-	return count
+	ps.params.events.emit(&SessionClosed{eventTime{time.Now()}, ps.params.key, reason})
 }
@@ -0,0 +1,158 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestListenIPDuplicateRejected(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIP, layers.IPProtocolUDP)
+
+	_, err := p.tryListen(testServerIP, layers.IPProtocolUDP)
+	if !errors.Is(err, ErrAlreadyListening) || !errors.Is(err, ErrAddressInUse) {
+		t.Fatalf("second listen: %v, want ErrAlreadyListening", err)
+	}
+	// a shared listener cannot join an exclusive one either
+	if _, err := p.tryListen(testServerIP, layers.IPProtocolUDP, WithSharedListen()); !errors.Is(err, ErrAlreadyListening) {
+		t.Fatalf("shared listen on an exclusive listener: %v, want ErrAlreadyListening", err)
+	}
+	// other protocols are other listeners
+	p.listen(t, testServerIP, layers.IPProtocolTCP)
+
+	// the failed listens left the first listener registered and working
+	if n := p.ss.conns.len(); n != 2 {
+		t.Fatalf("%d conns registered, want 2", n)
+	}
+	conn := p.dial(t, layers.IPProtocolUDP)
+	if _, err := conn.Write([]byte("still there")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := readTimeout(t, listener, time.Second); !bytes.Equal(got, []byte("still there")) {
+		t.Fatalf("listener read %q, want %q", got, "still there")
+	}
+
+	// once closed, its address can be listened on again
+	listener.Close()
+	deadline := time.Now().Add(time.Second)
+	for p.ss.conns.lookup(layers.IPProtocolUDP, toAddr(testServerIP), toAddr(testClientIP)) != nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	p.listen(t, testServerIP, layers.IPProtocolUDP)
+}
+
+func TestListenIPConcurrentDuplicates(t *testing.T) {
+	p := newMemPair(t)
+
+	const n = 16
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		winners  []*RawIPConn
+		rejected int
+	)
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			conn, err := p.tryListen(testServerIP, layers.IPProtocolUDP)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				winners = append(winners, conn)
+			case errors.Is(err, ErrAlreadyListening):
+				rejected++
+			default:
+				t.Errorf("listen: %v", err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if len(winners) != 1 || rejected != n-1 {
+		t.Fatalf("%d listens succeeded and %d were rejected, want 1 and %d", len(winners), rejected, n-1)
+	}
+	listener := winners[0]
+	t.Cleanup(func() { listener.Close() })
+
+	conn := p.dial(t, layers.IPProtocolUDP)
+	if _, err := conn.Write([]byte("winner")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := readTimeout(t, listener, time.Second); !bytes.Equal(got, []byte("winner")) {
+		t.Fatalf("listener read %q, want %q", got, "winner")
+	}
+}
+
+func TestListenIPShared(t *testing.T) {
+	p := newMemPair(t)
+
+	const n = 8
+	listeners := make([]*RawIPConn, n)
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := range listeners {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := p.tryListen(testServerIP, layers.IPProtocolUDP, WithSharedListen())
+			if err != nil {
+				errs <- err
+				return
+			}
+			listeners[i] = conn
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("shared listen: %v", err)
+	}
+	for _, l := range listeners {
+		t.Cleanup(func() { l.Close() })
+	}
+
+	// an exclusive listener cannot take the address of shared ones
+	if _, err := p.tryListen(testServerIP, layers.IPProtocolUDP); !errors.Is(err, ErrAlreadyListening) {
+		t.Fatalf("exclusive listen on shared listeners: %v, want ErrAlreadyListening", err)
+	}
+
+	conn := p.dial(t, layers.IPProtocolUDP)
+	if _, err := conn.Write([]byte("fanout")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for i, l := range listeners {
+		if got := readTimeout(t, l, time.Second); !bytes.Equal(got, []byte("fanout")) {
+			t.Fatalf("listener %d read %q, want %q", i, got, "fanout")
+		}
+	}
+
+	// closing some of them leaves the others receiving
+	for _, l := range listeners[:n/2] {
+		l.Close()
+	}
+	deadline := time.Now().Add(time.Second)
+	for p.ss.conns.len() != n/2+1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := conn.Write([]byte("survivors")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for i, l := range listeners[n/2:] {
+		if got := readTimeout(t, l, time.Second); !bytes.Equal(got, []byte("survivors")) {
+			t.Fatalf("surviving listener %d read %q, want %q", i, got, "survivors")
+		}
+	}
+}
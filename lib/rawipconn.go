@@ -6,90 +6,210 @@ package lib
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
 type RawIPConnParams struct {
 	isServer           bool
 	key                string
 	pcapIface          *net.Interface
-	handle             *pcap.Handle
-	outputChan         chan *gopacket.Packet
-	rawIPConnCloseChan chan *RawIPConn
+	handle             PacketIO
+	outputChan         chan *outboundPacket
+	rawIPConnCloseChan chan *RawIPConn                                             // tells the owning pcapSession to deregister the closed conn
+	sessionDone        <-chan struct{}                                             // closed once the owning pcapSession stops
+	mem                *memAccount                                                 // receive memory accounting of the owning pcapSession
+	resolveMAC         func(ip net.IP) (net.HardwareAddr, error)                   // next hop MAC resolution of the owning pcapSession
+	cachedMAC          func(ip net.IP) (net.HardwareAddr, bool)                    // next hop MAC known to the owning pcapSession without ARP
+	linkMTU            func() int                                                  // current MTU of the interface of the owning pcapSession. nil means pcapIface.MTU
+	watchIdle          func(conn *RawIPConn, d time.Duration)                      // idle timeout watching of the owning pcapSession
+	migrate            func(conn *RawIPConn, ifaceName string, srcIP net.IP) error // see Migrate. nil if the conn cannot migrate
 }
 
 type RawIPConnConfig struct {
-	localIP  net.IP
-	remoteIP net.IP // only used for client connection
-	protocol layers.IPProtocol
+	localIP       net.IP
+	remoteIP      net.IP // only used for client connection
+	nextHopIP     net.IP // only used for client connection: remoteIP itself or the gateway towards it
+	protocol      layers.IPProtocol
+	asyncResolve  bool   // resolve the next hop MAC in the background instead of during DialIP
+	asyncQueueLen int    // number of writes queued while the next hop MAC is being resolved
+	maxWriteSize  int    // largest payload accepted by writes. 0 means limited by the interface MTU only
+	sendQueueLen  int    // depth of the outbound queue of the conn. 0 means writes go straight to the pcapSession
+	readQueueLen  int    // depth of the inbound queue of the conn. 0 means inputQueueLen
+	ttl           uint8  // TTL of written packets. 0 means 64
+	tos           uint8  // TOS byte of written packets, the traffic class of IPv6 ones
+	autoFlowLabel bool   // IPv6 conns: packets without flow label get the one AutoFlowLabel derives from their flow
+	vlanID        uint16 // 802.1Q VLAN ID the frames written are tagged with. 0 sends them untagged
+	ipIDStrategy  IPIDStrategy
+	strictErrors  bool               // ICMP errors also fail the next write
+	sharedListen  bool               // listeners: share the address with other shared listeners, each receiving every packet
+	dropWhenFull  bool               // drop inbound packets while the inbound queue is full instead of holding up the session
+	dupWindow     time.Duration      // drop repeats of a packet received within it. 0 disables duplicate suppression
+	reorderWindow time.Duration      // hold inbound packets for it to read them by capture timestamp. 0 disables reordering
+	rawFrames     bool               // reads start out returning the whole captured frame instead of the IP payload
+	seqOf         SequenceFunc       // reads return the packets by the sequence number it extracts. nil disables it
+	seqWindow     time.Duration      // WithSequenceReorder: how long a packet waits for the ones before it
+	seqMaxHeld    int                // WithSequenceReorder: packets held at most. 0 means the inbound queue capacity
+	writeBuffer   *writeBufferConfig // bounds of the write buffer, nil unless WithWriteBuffer was given
+
+	nextHopOverride net.IP           // next hop chosen by the caller instead of the routing table
+	pinnedMAC       net.HardwareAddr // DialIPWithMAC conns: MAC address every frame is sent to, never resolved
+	selfDial        bool             // client conns to an address of the host: delivered by the session, never sent out
+	layerAddrs      bool             // WriteLayers may use other addresses than the ones of the conn
+	ifaceName       string           // interface the conn is pinned to by the caller
+	lookupIP        LookupIPFunc     // DialHost: resolution of the host name. nil means net.DefaultResolver
+	lookupNetwork   string           // DialHost: address family of the resolution, "ip4", "ip6" or "ip". "" means "ip4"
+	fallbackDelay   time.Duration    // DialHost: head start of the IPv6 dials over the IPv4 ones. Negative dials IPv4 only first
+
+	replay       bool       // created by OpenReplay: fed from a capture file, cannot write
+	multi        bool       // created by DialMulti: no fixed destination, SendTo finds the next hop of each one
+	localSubnet  *net.IPNet // multi conns: subnet of localIP, whose destinations are on-link
+	multiGateway net.IP     // multi conns: default gateway of the interface for off-link destinations, nil if none
+}
+
+// outboundPacket is an L3 packet handed by a RawIPConn to its pcapSession for sending
+type outboundPacket struct {
+	packet *gopacket.Packet
+	dstMAC net.HardwareAddr // destination MAC of the frame. nil lets the pcapSession look up the next hop itself
+	srcMAC net.HardwareAddr // source MAC of the frame. nil means the MAC of the interface
+	vlanID uint16           // 802.1Q VLAN ID the frame is tagged with. 0 sends it untagged
+	frame  []byte           // a complete link layer frame sent as is instead of packet, e.g. an ARP announcement
+	local  bool             // packet is for an address of the host: the pcapSession delivers it to its conns instead
+	// local packets of a conn dialed from an address to itself, which only its listeners must get
+	listenersOnly bool
 }
 
 // RawIPConn represents a connection for raw IP packets.
 type RawIPConn struct {
-	params        *RawIPConnParams
-	config        *RawIPConnConfig
-	readDeadline  time.Time
-	inputChan     chan *gopacket.Packet
-	tcpSignalChan chan *gopacket.Packet // to receive TCP signalling packets sniffed by pcapSession. For client side, it's SYN and ACK. For Server, it's SYN-ACK
-	isClosed      bool
-	mu            sync.Mutex
+	params         atomic.Pointer[RawIPConnParams] // replaced by Migrate, never nil
+	config         atomic.Pointer[RawIPConnConfig] // replaced by Migrate, never nil
+	readDeadline   atomic.Int64                    // unix nanos, 0 means none
+	writeDeadline  atomic.Int64                    // unix nanos, 0 means none. Only honoured by writes waiting for room in the send queue
+	lastActive     atomic.Int64                    // unix nanos of the creation of the conn or its last packet in or out
+	lastSend       atomic.Int64                    // unix nanos of the last packet written, 0 if none
+	lastReceive    atomic.Int64                    // unix nanos of the last packet received, queued or not. 0 if none
+	idleTimeout    atomic.Int64                    // nanos, see SetIdleTimeout. 0 means none
+	closeCause     atomic.Pointer[error]           // why the conn closed itself, nil if it did not
+	sendQueue      chan *outboundPacket            // nil unless the conn was created WithSendQueue
+	wbuf           *writeBuffer                    // nil unless the conn was created WithWriteBuffer
+	closeChan      chan struct{}                   // closed by Close
+	inputMu        sync.RWMutex                    // held for reading while sending to inputChan, for writing while closing it
+	inputClosed    bool                            // guarded by inputMu
+	replayEOF      atomic.Bool                     // replay conns: the capture file has been read to the end
+	inputChan      chan *gopacket.Packet
+	drainMu        sync.Mutex            // held by Close while it moves the unread packets to drained
+	drained        []*gopacket.Packet    // packets still unread at Close, already released from the session budget
+	tcpSignalChan  chan *gopacket.Packet // to receive TCP signalling packets sniffed by pcapSession. For client side, it's SYN and ACK. For Server, it's SYN-ACK
+	isClosed       atomic.Bool
+	mu             sync.Mutex   // serializes the writes, and Migrate with them
+	readMu         sync.Mutex   // serializes the reads
+	memMu          sync.RWMutex // held for writing by Migrate while it moves memHeld to the budget of the new session
+	memHeld        atomic.Int64 // bytes of the packets held by the conn, reserved from the budget of its session
+	budgetDropped  atomic.Uint64
+	dupSuppressed  atomic.Uint64
+	inboundDropped atomic.Uint64
+	sourceFiltered atomic.Uint64
+	truncated      atomic.Uint64
+	rawFrames      atomic.Bool                      // reads return whole frames, see WithRawFrames and SetStripLinkLayer
+	allowlist      atomic.Pointer[sourceAllowlist]  // nil accepts every source
+	sourceMAC      atomic.Pointer[net.HardwareAddr] // source MAC of the frames set by SetSourceMAC. nil means the interface's
+	dups           *duplicateSuppressor             // nil unless the conn was created WithDuplicateSuppression
+	reorder        *reorderBuffer                   // nil unless the conn was created WithReorderBuffer or WithSequenceReorder
+	nextIPID       atomic.Uint32                    // IPIDIncrement conns: IP ID of the next packet
+	trafficClass   atomic.Uint32                    // TOS of IPv4 packets, traffic class of IPv6 ones. WithTOS, then SetTrafficClass
+	flowLabel      atomic.Uint32                    // IPv6 conns: flow label set by SetFlowLabel, 0 if none
+	errChan        chan error                       // ICMP errors about the packets of the conn. Never closed
+	strictErr      atomic.Pointer[UnreachableError] // strict conns: the error failing the next write
+
+	// next hop resolution. ready is closed once nextHopMAC/resolveErr are set; pending holds writes issued before that
+	resolveMu  sync.Mutex
+	ready      chan struct{}
+	nextHopMAC net.HardwareAddr
+	resolveErr error
+	pending    []*outboundPacket
 }
 
+// inputQueueLen is the number of inbound packets a RawIPConn can queue before the pcapSession blocks, unless
+// WithReadBuffer says otherwise
+const inputQueueLen = 64
+
 func NewRawIPConn(params *RawIPConnParams, config *RawIPConnConfig) (*RawIPConn, error) {
+	if params.mem == nil {
+		params.mem = newMemAccount(0)
+	}
+
+	readQueueLen := config.readQueueLen
+	if readQueueLen <= 0 {
+		readQueueLen = inputQueueLen
+	}
+
 	conn := &RawIPConn{
-		params:        params,
-		config:        config,
-		inputChan:     make(chan *gopacket.Packet),
+		inputChan:     make(chan *gopacket.Packet, readQueueLen),
 		tcpSignalChan: make(chan *gopacket.Packet),
 		mu:            sync.Mutex{},
+		ready:         make(chan struct{}),
+		closeChan:     make(chan struct{}),
+		errChan:       make(chan error, errorQueueLen),
+	}
+	conn.params.Store(params)
+	conn.config.Store(config)
+	conn.rawFrames.Store(config.rawFrames)
+	conn.trafficClass.Store(uint32(config.tos))
+	conn.lastActive.Store(time.Now().UnixNano())
+	if config.dupWindow > 0 {
+		conn.dups = newDuplicateSuppressor(config.dupWindow)
+	}
+	switch {
+	case config.seqOf != nil:
+		limit := config.seqMaxHeld
+		if limit <= 0 {
+			limit = cap(conn.inputChan)
+		}
+		conn.reorder = newSequenceReorderBuffer(config.seqOf, config.seqWindow, limit, func(packet *gopacket.Packet) {
+			conn.releaseMem(int64(len((*packet).Data())))
+		})
+	case config.reorderWindow > 0:
+		conn.reorder = newReorderBuffer(config.reorderWindow, cap(conn.inputChan))
+	}
+	if wb := config.writeBuffer; wb != nil {
+		conn.wbuf = &writeBuffer{writeBufferConfig: *wb}
+	}
+	if config.sendQueueLen > 0 {
+		conn.sendQueue = make(chan *outboundPacket, config.sendQueueLen)
+		go conn.drainSendQueue()
+	}
+	if params.isServer || config.nextHopIP == nil {
+		// nothing to resolve: the pcapSession looks up the next hop of every packet
+		close(conn.ready)
 	}
 
 	return conn, nil
 }
 
-// Read reads data from the RawIPConn.
+// Read reads data from the RawIPConn. The data is the IP payload as received, whatever the protocol: the headers of
+// protocols like ESP, AH or GRE are not stripped. The payload starts after the IHL*4 bytes of the IPv4 header, or
+// after the extension headers of IPv6 packets, so IP options are never part of it.
 func (conn *RawIPConn) Read(buffer []byte) (int, error) {
-	conn.mu.Lock()
-	defer conn.mu.Unlock()
+	conn.readMu.Lock()
+	defer conn.readMu.Unlock()
 
-	var (
-		packet *gopacket.Packet
-		ok     bool
-	)
-
-	// Check if the read deadline is in the past
-	if time.Now().After(conn.readDeadline) {
-		// Perform a blocking read
-		packet, ok = <-conn.inputChan
-		if !ok {
-			return 0, fmt.Errorf("connection closed")
-		}
-	} else {
-		// non-blocking read
-		select {
-		case packet, ok = <-conn.inputChan:
-			if !ok {
-				return 0, fmt.Errorf("connection closed")
-			}
-		case <-time.After(time.Until(conn.readDeadline)):
-			return 0, &TimeoutError{msg: "read timeout"}
-		}
+	packet, err := conn.readPacket()
+	if err != nil {
+		return 0, err
 	}
 
 	// Extract the L4 payload
-	if ipLayer := (*packet).Layer(layers.LayerTypeIPv4); ipLayer != nil {
-		ip, _ := ipLayer.(*layers.IPv4)
-		if ip.Protocol == conn.config.protocol {
-			copy(buffer, ip.Payload)
-			return len(ip.Payload), nil
-		}
+	if data, srcIP := conn.readData(*packet); srcIP != nil {
+		copy(buffer, data)
+		return len(data), nil
 	}
 
 	return 0, fmt.Errorf("no valid L4 payload found")
@@ -97,135 +217,981 @@ func (conn *RawIPConn) Read(buffer []byte) (int, error) {
 
 // ReadFrom reads a packet from the RawIPConn and returns the payload and the source address.
 func (conn *RawIPConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
-	conn.mu.Lock()
-	defer conn.mu.Unlock()
+	conn.readMu.Lock()
+	defer conn.readMu.Unlock()
 
+	packet, err := conn.readPacket()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Extract the L4 payload and source IP
+	if data, srcIP := conn.readData(*packet); srcIP != nil {
+		copy(buffer, data)
+		return len(data), &net.IPAddr{IP: srcIP}, nil
+	}
+
+	return 0, nil, fmt.Errorf("no valid L4 payload found")
+}
+
+// ReadWithMeta reads data from the RawIPConn like Read and also returns the metadata of the received packet.
+func (conn *RawIPConn) ReadWithMeta(buffer []byte) (int, PacketMeta, error) {
+	conn.readMu.Lock()
+	defer conn.readMu.Unlock()
+
+	packet, err := conn.readPacket()
+	if err != nil {
+		return 0, PacketMeta{}, err
+	}
+
+	meta := newPacketMeta(*packet, conn.params.Load().pcapIface.Name)
+	if data, srcIP := conn.readData(*packet); srcIP != nil {
+		copy(buffer, data)
+		return len(data), meta, nil
+	}
+
+	return 0, meta, fmt.Errorf("no valid L4 payload found")
+}
+
+// readData returns what reads return of packet, its IP payload or its whole frame WithRawFrames, along with its
+// source address. The address is nil if packet carries no IP packet of the protocol of the conn
+func (conn *RawIPConn) readData(packet gopacket.Packet) ([]byte, net.IP) {
+	var (
+		payload []byte
+		srcIP   net.IP
+	)
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		if ip.Protocol != conn.config.Load().protocol {
+			return nil, nil
+		}
+		payload, srcIP = ip.Payload, ip.SrcIP
+	case *layers.IPv6:
+		protocol, upper, err := ipv6UpperLayer(ipv6Payload(ip))
+		if err != nil || protocol != conn.config.Load().protocol {
+			return nil, nil
+		}
+		payload, srcIP = upper, ip.SrcIP
+	default:
+		return nil, nil
+	}
+	if conn.rawFrames.Load() {
+		return packet.Data(), srcIP
+	}
+	return payload, srcIP
+}
+
+// SetStripLinkLayer switches the reads of the conn between returning the IP payload of the packets, when strip is set,
+// and their whole captured frame as WithRawFrames does. It applies from the next read on, and is safe to call while
+// reads are in progress.
+func (conn *RawIPConn) SetStripLinkLayer(strip bool) {
+	conn.rawFrames.Store(!strip)
+}
+
+// readPacket waits for the next inbound packet, honoring the read deadline. The caller must hold conn.readMu
+func (conn *RawIPConn) readPacket() (*gopacket.Packet, error) {
 	var (
 		packet *gopacket.Packet
 		ok     bool
 	)
 
-	// Check if the read deadline is in the past
-	if time.Now().After(conn.readDeadline) {
-		// Perform a blocking read
+	if conn.isClosed.Load() {
+		return conn.popDrained()
+	}
+	if conn.reorder != nil {
+		return conn.readReordered()
+	}
+
+	readDeadline := loadDeadline(&conn.readDeadline)
+	switch {
+	case readDeadline.IsZero():
+		// no deadline: block until a packet arrives or the conn closes
 		packet, ok = <-conn.inputChan
 		if !ok {
-			return 0, nil, fmt.Errorf("connection closed")
+			return conn.popDrained()
 		}
-	} else {
-		// Non-blocking read
+	case !time.Now().Before(readDeadline):
+		// like net.Conn, a deadline in the past fails the read even if packets are queued
+		return nil, &TimeoutError{msg: "read timeout"}
+	default:
+		timer := time.NewTimer(time.Until(readDeadline))
+		defer timer.Stop()
 		select {
 		case packet, ok = <-conn.inputChan:
 			if !ok {
-				return 0, nil, fmt.Errorf("connection closed")
+				return conn.popDrained()
 			}
-		case <-time.After(time.Until(conn.readDeadline)):
-			return 0, nil, &TimeoutError{msg: "read timeout"}
+		case <-timer.C:
+			return nil, &TimeoutError{msg: "read timeout"}
 		}
 	}
+	conn.releaseMem(int64(len((*packet).Data())))
 
-	// Extract the L4 payload and source IP
-	if ipLayer := (*packet).Layer(layers.LayerTypeIPv4); ipLayer != nil {
-		ip, _ := ipLayer.(*layers.IPv4)
-		if ip.Protocol == conn.config.protocol {
-			copy(buffer, ip.Payload)
-			return len(ip.Payload), &net.IPAddr{IP: ip.SrcIP}, nil
-		}
+	return packet, nil
+}
+
+// popDrained returns the next packet left unread by Close, or the error ending the input once there is none left
+func (conn *RawIPConn) popDrained() (*gopacket.Packet, error) {
+	conn.drainMu.Lock()
+	defer conn.drainMu.Unlock()
+
+	if len(conn.drained) == 0 {
+		return nil, conn.inputEndError()
 	}
+	packet := conn.drained[0]
+	conn.drained[0] = nil
+	conn.drained = conn.drained[1:]
+	return packet, nil
+}
 
-	return 0, nil, fmt.Errorf("no valid L4 payload found")
+// inputEndError tells why inputChan has been closed: the end of the capture file of a replay conn, or Close
+func (conn *RawIPConn) inputEndError() error {
+	if conn.replayEOF.Load() && !conn.isClosed.Load() {
+		return io.EOF
+	}
+	return conn.closedError()
+}
+
+// closedError is the error of reads and writes on the closed conn: ErrClosed, or why the conn closed itself
+func (conn *RawIPConn) closedError() error {
+	if cause := conn.closeCause.Load(); cause != nil {
+		return *cause
+	}
+	return ErrClosed
+}
+
+// closeInput closes inputChan, once
+func (conn *RawIPConn) closeInput() {
+	conn.inputMu.Lock()
+	defer conn.inputMu.Unlock()
+
+	if !conn.inputClosed {
+		conn.inputClosed = true
+		close(conn.inputChan)
+	}
 }
 
-// Write writes data to the RawIPConn.
+// Write writes data to the RawIPConn. It returns len(data) once the packet is handed to the pcapSession, or 0 and an
+// error: a packet is never sent in part. The pcapSession sends it later, its failures being counted by
+// SessionStats.WriteErrors.
 func (conn *RawIPConn) Write(data []byte) (int, error) {
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
 
-	// Create the L3 packet (IPv4 layer)
-	ipLayer := &layers.IPv4{
-		Version:  4,
-		IHL:      5,
-		TTL:      64,
-		Protocol: conn.config.protocol,
-		SrcIP:    conn.config.localIP,
-		DstIP:    conn.config.remoteIP,
+	return conn.writePacket(conn.config.Load().remoteIP, data)
+}
+
+// WriteTo sends data to the specified destination address.
+func (conn *RawIPConn) WriteTo(data []byte, addr net.Addr) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	// Type assert the address to net.IPAddr
+	ipAddr, ok := addr.(*net.IPAddr)
+	if !ok {
+		return 0, fmt.Errorf("unsupported address type")
+	}
+	dstIP, err := checkDestination(ipAddr.IP)
+	if err != nil {
+		return 0, err
 	}
 
-	// Serialize the packet.
-	buffer := gopacket.NewSerializeBuffer()
-	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
-	err := gopacket.SerializeLayers(buffer, options, ipLayer, gopacket.Payload(data))
+	return conn.writePacket(dstIP, data)
+}
+
+// WriteToWithMAC is WriteTo sending the packet to nextHop, the MAC address of the next hop towards dst, instead of
+// looking it up, e.g. to reply to a peer through the source MAC of the packet just received from it (PacketMeta.SrcMAC).
+// Neither the ARP cache nor the MAC pinned to the conn are consulted, and no ARP request is sent.
+func (conn *RawIPConn) WriteToWithMAC(p []byte, dst net.IP, nextHop net.HardwareAddr) (int, error) {
+	if len(nextHop) != 6 {
+		return 0, fmt.Errorf("next hop MAC %v is not an Ethernet address", nextHop)
+	}
+	dstIP, err := checkDestination(dst)
 	if err != nil {
 		return 0, err
 	}
 
-	// Create a gopacket.Packet from the serialized data
-	packet := gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.isClosed.Load() {
+		return 0, conn.closedError()
+	}
+	if err := conn.strictErr.Swap(nil); err != nil {
+		return 0, err
+	}
+	out, n, err := conn.buildPacket(dstIP, p)
+	if err != nil {
+		return 0, err
+	}
+	out.dstMAC = append(net.HardwareAddr(nil), nextHop...) // the caller may reuse nextHop, e.g. a pooled read buffer
+	if err := conn.send(out); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
 
-	// Send the L3 packet to pcapSession's outputChan
-	conn.params.outputChan <- &packet
+// WriteV writes the concatenation of bufs as the payload of a single packet to the remote IP of the RawIPConn,
+// copying them straight into the packet instead of joining them first. Size limits apply to their total length.
+func (conn *RawIPConn) WriteV(bufs ...[]byte) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
 
-	return len(data), nil
+	return conn.writePacket(conn.config.Load().remoteIP, bufs...)
 }
 
-// WriteTo sends data to the specified destination address.
-func (conn *RawIPConn) WriteTo(data []byte, addr net.Addr) (int, error) {
+// WriteBuffers is WriteV taking net.Buffers, like net.Buffers.WriteTo. Unlike it, bufs is left untouched
+func (conn *RawIPConn) WriteBuffers(bufs net.Buffers) (int64, error) {
+	n, err := conn.WriteV(bufs...)
+	return int64(n), err
+}
+
+// WriteBatch writes every payload of the batch to the remote IP of the RawIPConn and returns the number of payloads written.
+// If some of them fail, the returned error is a *BatchWriteError telling which ones.
+func (conn *RawIPConn) WriteBatch(payloads [][]byte) (int, error) {
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
 
-	// Type assert the address to net.IPAddr
-	ipAddr, ok := addr.(*net.IPAddr)
-	if !ok {
-		return 0, fmt.Errorf("unsupported address type")
+	var (
+		errs    []error
+		written int
+	)
+	for i, payload := range payloads {
+		if _, err := conn.writePacket(conn.config.Load().remoteIP, payload); err != nil {
+			if errs == nil {
+				errs = make([]error, len(payloads))
+			}
+			errs[i] = err
+			continue
+		}
+		written++
 	}
 
-	// Create the L3 packet (IPv4 layer)
-	ipLayer := &layers.IPv4{
-		Version:  4,
-		IHL:      5,
-		TTL:      64,
-		Protocol: conn.config.protocol,
-		SrcIP:    conn.config.localIP,
-		DstIP:    ipAddr.IP,
+	if errs != nil {
+		return written, &BatchWriteError{Errs: errs}
 	}
+	return written, nil
+}
 
-	// Serialize the packet.
-	buffer := gopacket.NewSerializeBuffer()
-	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
-	err := gopacket.SerializeLayers(buffer, options, ipLayer, gopacket.Payload(data))
+// SendTo sends payload to dst through a conn created by DialMulti. The next hop is dst itself if it is on-link, else
+// the default gateway of the interface. Its MAC address is taken from the ARP cache or resolved on demand, in which case
+// SendTo blocks until the ARP reply arrives or the ARP request times out.
+func (conn *RawIPConn) SendTo(dst net.IP, payload []byte) (int, error) {
+	if !conn.config.Load().multi {
+		return 0, fmt.Errorf("SendTo needs a conn created by DialMulti")
+	}
+	dst, err := checkDestination(dst)
 	if err != nil {
 		return 0, err
 	}
+	if dst.To4() == nil {
+		return 0, fmt.Errorf("dst %v: %w", dst, ErrAddressFamilyMismatch)
+	}
 
-	// Create a gopacket.Packet from the serialized data
+	nextHop, err := nextHopFor(conn.config.Load().localSubnet, dst, conn.config.Load().multiGateway)
+	if err != nil {
+		return 0, err
+	}
+	// resolve before taking conn.mu so that a slow ARP resolution does not hold up the sends to other destinations
+	dstMAC, err := conn.params.Load().resolveMAC(nextHop)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve next hop %v: %w", nextHop, err)
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	out, _, err := conn.buildPacket(dst, payload)
+	if err != nil {
+		return 0, err
+	}
+	out.dstMAC = dstMAC
+	if err := conn.send(out); err != nil {
+		return 0, err
+	}
+
+	return len(payload), nil
+}
+
+// WriteToMany sends payload to every destination of dsts through a conn created by DialMulti, and returns the number
+// of destinations it was sent or queued to. Next hops in the ARP cache get their packet right away; the packets to the
+// others are queued while their next hop is resolved in the background, so that a silent destination does not hold up
+// the rest, and dropped if it cannot be. If some destinations fail, the returned error is a *BatchWriteError telling
+// which ones.
+func (conn *RawIPConn) WriteToMany(dsts []net.IP, payload []byte) (int, error) {
+	if !conn.config.Load().multi {
+		return 0, fmt.Errorf("WriteToMany needs a conn created by DialMulti")
+	}
+	if conn.isClosed.Load() {
+		return 0, conn.closedError()
+	}
+
+	var (
+		errs    []error
+		sent    int
+		pending = make(map[string][]*outboundPacket) // packets waiting for the resolution of their next hop
+	)
+	fail := func(i int, err error) {
+		if errs == nil {
+			errs = make([]error, len(dsts))
+		}
+		errs[i] = err
+	}
+
+	conn.mu.Lock()
+	for i, dst := range dsts {
+		dst, err := checkDestination(dst)
+		if err != nil {
+			fail(i, err)
+			continue
+		}
+		if dst.To4() == nil {
+			fail(i, fmt.Errorf("dst %v: %w", dst, ErrAddressFamilyMismatch))
+			continue
+		}
+		nextHop, err := nextHopFor(conn.config.Load().localSubnet, dst, conn.config.Load().multiGateway)
+		if err != nil {
+			fail(i, err)
+			continue
+		}
+		out, _, err := conn.buildPacket(dst, payload)
+		if err != nil {
+			fail(i, err)
+			continue
+		}
+
+		if mac, found := conn.params.Load().cachedMAC(nextHop); found {
+			out.dstMAC = mac
+			if err := conn.send(out); err != nil {
+				fail(i, err)
+				continue
+			}
+		} else {
+			pending[nextHop.String()] = append(pending[nextHop.String()], out)
+		}
+		sent++
+	}
+	conn.mu.Unlock()
+
+	for nextHop, outs := range pending {
+		go conn.sendResolved(net.ParseIP(nextHop), outs)
+	}
+
+	if errs != nil {
+		return sent, &BatchWriteError{Errs: errs}
+	}
+	return sent, nil
+}
+
+// sendResolved resolves the MAC address of nextHop, then sends the packets WriteToMany queued for it
+func (conn *RawIPConn) sendResolved(nextHop net.IP, outs []*outboundPacket) {
+	mac, err := conn.params.Load().resolveMAC(nextHop)
+	if err != nil {
+		log.Printf("Raw IPConn %s: dropped %d writes queued while resolving next hop %v: %v", conn.getKey(), len(outs), nextHop, err)
+		return
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for _, out := range outs {
+		if conn.isClosed.Load() {
+			return
+		}
+		out.dstMAC = mac
+		if err := conn.send(out); err != nil {
+			log.Printf("Raw IPConn %s: dropped write queued for %v: %v", conn.getKey(), nextHop, err)
+		}
+	}
+}
+
+// writePacket wraps the concatenation of segs into an IP packet to dstIP and hands it to the pcapSession.
+// The caller must hold conn.mu
+func (conn *RawIPConn) writePacket(dstIP net.IP, segs ...[]byte) (int, error) {
+	return conn.writePacketWith(dstIP, nil, segs...)
+}
+
+// writePacketWith is writePacket overriding the header fields of the conn with wo, if not nil
+func (conn *RawIPConn) writePacketWith(dstIP net.IP, wo *writeOptions, segs ...[]byte) (int, error) {
+	if conn.isClosed.Load() {
+		return 0, conn.closedError()
+	}
+	if err := conn.strictErr.Swap(nil); err != nil {
+		return 0, err
+	}
+	out, n, err := conn.buildPacketWith(dstIP, wo, segs...)
+	if err != nil {
+		return 0, err
+	}
+	return conn.sendPacket(out, dstIP, n)
+}
+
+// sendPacket hands out, a packet to dstIP carrying n bytes of payload, to the pcapSession once the next hop MAC is
+// known, or queues it while it is being resolved. The caller must hold conn.mu
+func (conn *RawIPConn) sendPacket(out *outboundPacket, dstIP net.IP, n int) (int, error) {
+	if !dstIP.Equal(conn.config.Load().remoteIP) {
+		// Send the L3 packet to pcapSession's outputChan
+		out.dstMAC = conn.config.Load().pinnedMAC
+		if err := conn.send(out); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+
+	select {
+	case <-conn.ready:
+		// nextHopMAC and resolveErr only change once ready is closed by Migrate, which holds conn.mu
+		if conn.resolveErr != nil {
+			return 0, conn.resolveErr
+		}
+		out.dstMAC = conn.nextHopMAC
+		if err := conn.send(out); err != nil {
+			return 0, err
+		}
+		return n, nil
+	default:
+	}
+
+	conn.resolveMu.Lock()
+	select {
+	case <-conn.ready:
+		// resolved in the meantime
+		conn.resolveMu.Unlock()
+		return conn.sendPacket(out, dstIP, n)
+	default:
+	}
+	defer conn.resolveMu.Unlock()
+
+	// the next hop MAC is still being resolved
+	if len(conn.pending) >= conn.config.Load().asyncQueueLen {
+		return 0, ErrResolving
+	}
+	conn.pending = append(conn.pending, out)
+
+	return n, nil
+}
+
+// send hands out to the pcapSession, or adds it to the write buffer of the conn if it has one
+func (conn *RawIPConn) send(out *outboundPacket) error {
+	now := time.Now().UnixNano()
+	conn.lastActive.Store(now)
+	conn.lastSend.Store(now)
+	if conn.wbuf != nil {
+		return conn.bufferPacket(out)
+	}
+	return conn.transmit(out)
+}
+
+// transmit hands out to the pcapSession. If the conn has a send queue, it goes through it: when the queue is full,
+// transmit blocks until there is room or the write deadline passes
+func (conn *RawIPConn) transmit(out *outboundPacket) error {
+	if conn.sendQueue == nil {
+		conn.handOff(out)
+		return nil
+	}
+
+	select {
+	case conn.sendQueue <- out:
+		return nil
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if writeDeadline := loadDeadline(&conn.writeDeadline); !writeDeadline.IsZero() {
+		timer := time.NewTimer(time.Until(writeDeadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case conn.sendQueue <- out:
+		return nil
+	case <-conn.closeChan:
+		return ErrClosed
+	case <-timeout:
+		return &TimeoutError{msg: "write timeout"}
+	}
+}
+
+// drainSendQueue hands the packets of the send queue to the pcapSession until the conn is closed.
+// Packets still queued at that point are dropped
+func (conn *RawIPConn) drainSendQueue() {
+	for {
+		select {
+		case <-conn.closeChan:
+			return
+		case out := <-conn.sendQueue:
+			conn.handOff(out)
+		}
+	}
+}
+
+// handOff hands out to the pcapSession of the conn, dropping it if the session has stopped
+func (conn *RawIPConn) handOff(out *outboundPacket) {
+	params := conn.params.Load()
+	select {
+	case params.outputChan <- out:
+	case <-params.sessionDone:
+	}
+}
+
+// serializeBufferPool recycles the serialize buffers of buildPacket across the writes of all conns
+var serializeBufferPool = sync.Pool{
+	New: func() any {
+		return gopacket.NewSerializeBuffer()
+	},
+}
+
+// buildPacket wraps the concatenation of segs into an IP packet from the conn to dstIP, and returns it with its payload length
+func (conn *RawIPConn) buildPacket(dstIP net.IP, segs ...[]byte) (*outboundPacket, int, error) {
+	return conn.buildPacketWith(dstIP, nil, segs...)
+}
+
+// buildPacketWith is buildPacket overriding the header fields of the conn with wo, if not nil
+func (conn *RawIPConn) buildPacketWith(dstIP net.IP, wo *writeOptions, segs ...[]byte) (*outboundPacket, int, error) {
+	if conn.config.Load().replay {
+		return nil, 0, fmt.Errorf("cannot write to a conn replaying a capture file")
+	}
+	size := 0
+	for _, seg := range segs {
+		size += len(seg)
+	}
+	if local := conn.config.Load().localIP; local != nil && (local.To4() == nil) != (dstIP.To4() == nil) {
+		return nil, 0, fmt.Errorf("write from %v to %v: %w", local, dstIP, ErrAddressFamilyMismatch)
+	}
+	if err := wo.check(dstIP.To4() == nil); err != nil {
+		return nil, 0, err
+	}
+	limit := conn.payloadLimit(ipv4HeaderLen)
+	if dstIP.To4() == nil {
+		limit = conn.ipv6PayloadLimit(wo.extensionHeaders())
+	}
+	if limit > 0 && size > limit {
+		return nil, 0, &MessageTooLongError{Size: size, Limit: limit}
+	}
+	if dstIP.To4() == nil {
+		packet, err := conn.buildIPv6Packet(dstIP, size, segs, wo)
+		if err != nil {
+			return nil, 0, err
+		}
+		return conn.outboundPacket(packet, dstIP), size, nil
+	}
+
+	// Create the L3 packet (IPv4 layer)
+	ipLayer := IPv4Config{
+		Src:          conn.config.Load().localIP,
+		Dst:          dstIP,
+		Protocol:     conn.config.Load().protocol,
+		TTL:          conn.ttl(),
+		TOS:          conn.tos(wo),
+		ID:           conn.ipID(),
+		DontFragment: true, // packets are never fragmented, so neither should routers on the path
+	}.layer()
+
+	// Serialize the packet into a pooled buffer: the segments are copied in first, then the IP header is prepended to them
+	buffer := serializeBufferPool.Get().(gopacket.SerializeBuffer)
+	defer serializeBufferPool.Put(buffer)
+	if err := buffer.Clear(); err != nil {
+		return nil, 0, err
+	}
+	payload, err := buffer.PrependBytes(size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset := 0
+	for _, seg := range segs {
+		offset += copy(payload[offset:], seg)
+	}
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := ipLayer.SerializeTo(buffer, options); err != nil {
+		return nil, 0, err
+	}
+
+	// Create a gopacket.Packet from the serialized data. It copies the data, so the buffer can be reused right away
 	packet := gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	return conn.outboundPacket(packet, dstIP), size, nil
+}
+
+// outboundPacket returns packet, built by the conn for dstIP, ready to be handed to the pcapSession
+func (conn *RawIPConn) outboundPacket(packet gopacket.Packet, dstIP net.IP) *outboundPacket {
+	out := &outboundPacket{packet: &packet, vlanID: conn.config.Load().vlanID}
+	if mac := conn.sourceMAC.Load(); mac != nil {
+		out.srcMAC = *mac
+	}
+	conn.markLocal(out, dstIP)
+	return out
+}
+
+// markLocal flags out, a packet to dstIP, for local delivery if it is for the host itself. Outside loopback, packets to
+// the own address of the conn, or to the host address a conn was dialed to, would never come back from the wire
+func (conn *RawIPConn) markLocal(out *outboundPacket, dstIP net.IP) {
+	onLoopback := conn.params.Load().pcapIface != nil && conn.params.Load().pcapIface.Flags&net.FlagLoopback != 0
+	if !onLoopback && (dstIP.Equal(conn.config.Load().localIP) || (conn.config.Load().selfDial && dstIP.Equal(conn.config.Load().remoteIP))) {
+		out.local = true
+		out.listenersOnly = conn.config.Load().selfDial && conn.config.Load().localIP.Equal(conn.config.Load().remoteIP)
+	}
+}
+
+// ipID returns the IP ID of the next packet written by the conn
+func (conn *RawIPConn) ipID() uint16 {
+	switch conn.config.Load().ipIDStrategy {
+	case IPIDIncrement:
+		return uint16(conn.nextIPID.Add(1))
+	case IPIDRandom:
+		return uint16(rand.Uint32())
+	default:
+		return 0
+	}
+}
 
-	// Send the L3 packet to pcapSession's outputChan
-	conn.params.outputChan <- &packet
+// ipv4HeaderLen is the length of the IPv4 header of written packets, which never carry options
+const ipv4HeaderLen = 20
 
-	return len(data), nil
+// ttl returns the TTL of the packets written by the conn
+func (conn *RawIPConn) ttl() uint8 {
+	if conn.config.Load().ttl > 0 {
+		return conn.config.Load().ttl
+	}
+	return 64
+}
+
+// MaxPayload returns the largest payload a write accepts, larger writes failing with a *MessageTooLongError.
+// It follows the MTU of the interface, which the session checks every few seconds. 0 means no limit is known.
+// On links whose MTU allows it, IPv6 conns write payloads beyond 65535 bytes as jumbograms (RFC 2675)
+func (conn *RawIPConn) MaxPayload() int {
+	return conn.maxPayload()
+}
+
+// maxPayload returns the largest payload a write with the IP header of the conn accepts
+func (conn *RawIPConn) maxPayload() int {
+	if conn.isIPv6() {
+		return conn.ipv6PayloadLimit(nil)
+	}
+	return conn.payloadLimit(ipv4HeaderLen)
+}
+
+// payloadLimit returns the largest payload a packet with a header of headerLen bytes accepts: the configured maximum
+// write size or what fits into the current interface MTU after the header and the VLAN tag of the conn, whichever is
+// smaller, since packets are never fragmented. 0 means no limit is known
+func (conn *RawIPConn) payloadLimit(headerLen int) int {
+	limit := conn.config.Load().maxWriteSize
+	if mtu := conn.linkMTU(); mtu > 0 {
+		if conn.config.Load().vlanID != 0 {
+			mtu -= dot1QTagLen // the tag added by the conn travels in the frame the interface sends
+		}
+		if mtuLimit := mtu - headerLen; limit <= 0 || mtuLimit < limit {
+			limit = max(mtuLimit, 0)
+		}
+	}
+	return limit
 }
 
+// linkMTU returns the current MTU of the interface of the conn, 0 if unknown
+func (conn *RawIPConn) linkMTU() int {
+	params := conn.params.Load()
+	if params.linkMTU != nil {
+		return params.linkMTU()
+	}
+	if params.pcapIface != nil {
+		return params.pcapIface.MTU
+	}
+	return 0
+}
+
+// resolveNextHop resolves the MAC address of the next hop of a client conn, then sends the writes queued meanwhile
+func (conn *RawIPConn) resolveNextHop() {
+	var (
+		mac net.HardwareAddr
+		err error
+	)
+	switch {
+	case conn.config.Load().pinnedMAC != nil:
+		mac = conn.config.Load().pinnedMAC
+	case conn.params.Load().resolveMAC != nil:
+		mac, err = conn.params.Load().resolveMAC(conn.config.Load().nextHopIP)
+	}
+
+	conn.resolveMu.Lock()
+	defer conn.resolveMu.Unlock()
+
+	select {
+	case <-conn.ready:
+		return // already resolved
+	default:
+	}
+
+	conn.nextHopMAC, conn.resolveErr = mac, err
+	close(conn.ready)
+
+	for _, out := range conn.pending {
+		if err == nil {
+			out.dstMAC = mac
+			conn.handOff(out)
+		}
+	}
+	if err != nil && len(conn.pending) > 0 {
+		log.Printf("Raw IPConn %s: dropped %d writes queued while resolving next hop: %v", conn.getKey(), len(conn.pending), err)
+	}
+	conn.pending = nil
+}
+
+// Errors returns the channel receiving the ICMP Destination Unreachable messages about the packets written by a dialed conn,
+// as *UnreachableError. They are advisory: the conn stays usable. It also receives ErrIdleTimeout when the conn closes
+// itself, see SetIdleTimeout. Errors arriving while the channel is full are dropped, and the channel is never closed.
+func (conn *RawIPConn) Errors() <-chan error {
+	return conn.errChan
+}
+
+// reportError delivers an ICMP error about the packets of the conn
+func (conn *RawIPConn) reportError(err *UnreachableError) {
+	if conn.config.Load().strictErrors {
+		conn.strictErr.Store(err)
+	}
+	select {
+	case conn.errChan <- err:
+	default:
+		log.Printf("Raw IPConn %s: dropped ICMP error, error channel full: %v", conn.getKey(), err)
+	}
+}
+
+// Ready returns a channel which is closed once the next hop MAC of the conn has been resolved or its resolution failed.
+// It is closed from the start for listeners and for conns dialed without WithAsyncResolve.
+func (conn *RawIPConn) Ready() <-chan struct{} {
+	return conn.ready
+}
+
+// ResolutionError returns the error of the next hop MAC resolution, or nil if it succeeded or is still in progress
+func (conn *RawIPConn) ResolutionError() error {
+	conn.resolveMu.Lock()
+	defer conn.resolveMu.Unlock()
+
+	return conn.resolveErr
+}
+
+// enqueue queues an inbound packet for Read unless the session memory budget is exhausted
+func (conn *RawIPConn) enqueue(packet *gopacket.Packet) {
+	// inputMu keeps Close from closing inputChan under our feet
+	conn.inputMu.RLock()
+	defer conn.inputMu.RUnlock()
+	if conn.inputClosed || conn.isClosed.Load() {
+		return
+	}
+
+	if list := conn.allowlist.Load(); list != nil {
+		if ip := (*packet).NetworkLayer(); ip != nil && !list.allows(toAddr(net.IP(ip.NetworkFlow().Src().Raw()))) {
+			conn.sourceFiltered.Add(1)
+			return
+		}
+	}
+	// the peer is alive even if the packet is dropped below
+	conn.lastReceive.Store(time.Now().UnixNano())
+	if ci := (*packet).Metadata().CaptureInfo; ci.CaptureLength < ci.Length {
+		conn.truncated.Add(1)
+	}
+	if conn.dups != nil {
+		if ipv4, ok := (*packet).NetworkLayer().(*layers.IPv4); ok && conn.dups.duplicate(ipv4, time.Now()) {
+			conn.dupSuppressed.Add(1)
+			return
+		}
+	}
+
+	size := int64(len((*packet).Data()))
+	if !conn.reserveMem(size) {
+		conn.budgetDropped.Add(1)
+		return
+	}
+	conn.lastActive.Store(time.Now().UnixNano())
+	if conn.config.Load().sharedListen || conn.config.Load().dropWhenFull {
+		// a slow reader must not hold up the session and the other conns: it loses the packets it has no room for
+		select {
+		case conn.inputChan <- packet:
+		default:
+			conn.releaseMem(size)
+			conn.inboundDropped.Add(1)
+		}
+		return
+	}
+	select {
+	case conn.inputChan <- packet:
+	case <-conn.closeChan:
+		conn.releaseMem(size)
+	}
+}
+
+// reserveMem accounts n bytes of a received packet to the memory budget of the session. It returns false without
+// accounting anything if the budget would be exceeded
+func (conn *RawIPConn) reserveMem(n int64) bool {
+	conn.memMu.RLock()
+	defer conn.memMu.RUnlock()
+	if !conn.params.Load().mem.reserve(n) {
+		return false
+	}
+	conn.memHeld.Add(n)
+	return true
+}
+
+// releaseMem gives back n bytes reserved by reserveMem
+func (conn *RawIPConn) releaseMem(n int64) {
+	conn.memMu.RLock()
+	defer conn.memMu.RUnlock()
+	conn.params.Load().mem.release(n)
+	conn.memHeld.Add(-n)
+}
+
+// LastActivity returns when the conn last wrote a packet and last received one, whether it could queue it for reading
+// or had to drop it. A zero time means never. It takes no lock, so it is cheap to call for many conns.
+func (conn *RawIPConn) LastActivity() (send, recv time.Time) {
+	return unixNanoTime(conn.lastSend.Load()), unixNanoTime(conn.lastReceive.Load())
+}
+
+// unixNanoTime converts unix nanos to a time, 0 to the zero time
+func unixNanoTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// Stats returns a snapshot of the conn statistics
+func (conn *RawIPConn) Stats() ConnStats {
+	stats := ConnStats{
+		BudgetDropped:       conn.budgetDropped.Load(),
+		DuplicateSuppressed: conn.dupSuppressed.Load(),
+		InboundDropped:      conn.inboundDropped.Load(),
+		SourceFiltered:      conn.sourceFiltered.Load(),
+		Truncated:           conn.truncated.Load(),
+		Queued:              len(conn.inputChan),
+		QueueCapacity:       cap(conn.inputChan),
+	}
+	if conn.reorder != nil {
+		stats.Reordered = conn.reorder.reordered.Load()
+		stats.SequenceDuplicates = conn.reorder.duplicates.Load()
+		stats.SequenceLost = conn.reorder.lost.Load()
+	}
+	return stats
+}
+
+// SetReadDeadline sets the deadline of reads. Once it passes, reads fail with a *TimeoutError even if packets are
+// queued. The zero value means no deadline
 func (conn *RawIPConn) SetReadDeadline(t time.Time) error {
-	conn.readDeadline = t
+	storeDeadline(&conn.readDeadline, t)
 	return nil
 }
 
+// SetWriteDeadline sets the deadline of writes blocked on a full send queue. The zero value means no deadline
+func (conn *RawIPConn) SetWriteDeadline(t time.Time) error {
+	storeDeadline(&conn.writeDeadline, t)
+	return nil
+}
+
+// SetSourceMAC makes the frames written from now on carry mac as their Ethernet source address instead of the hardware
+// address of the interface, e.g. to emulate a device behind the host. Replies to mac are only captured if the session
+// is promiscuous. nil restores the interface address. A mac of another length than 6 bytes is ignored.
+func (conn *RawIPConn) SetSourceMAC(mac net.HardwareAddr) {
+	switch len(mac) {
+	case 0:
+		conn.sourceMAC.Store(nil)
+	case 6:
+		mac = append(net.HardwareAddr(nil), mac...)
+		conn.sourceMAC.Store(&mac)
+	}
+}
+
+// storeDeadline stores t into d as unix nanos, the zero time as 0
+func storeDeadline(d *atomic.Int64, t time.Time) {
+	if t.IsZero() {
+		d.Store(0)
+		return
+	}
+	d.Store(t.UnixNano())
+}
+
+// loadDeadline returns the time stored by storeDeadline
+func loadDeadline(d *atomic.Int64) time.Time {
+	if nanos := d.Load(); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
 func (conn *RawIPConn) getKey() string {
-	return conn.params.key
+	return conn.params.Load().key
+}
+
+// flowKey returns the demux key of the conn
+func (conn *RawIPConn) flowKey() flowKey {
+	return newFlowKey(conn.config.Load().protocol, conn.config.Load().localIP, conn.config.Load().remoteIP)
+}
+
+// String describes the conn on one line, e.g. "raw-ip proto=ICMPv4 10.0.0.5->10.0.0.9 via en0, queued=3, state=open".
+// It takes no lock so that it can be logged from anywhere.
+func (conn *RawIPConn) String() string {
+	remote := "*"
+	if conn.config.Load().remoteIP != nil {
+		remote = conn.config.Load().remoteIP.String()
+	}
+
+	state := "open"
+	select {
+	case <-conn.ready:
+	default:
+		state = "resolving"
+	}
+	if conn.isClosed.Load() {
+		state = "closed"
+	}
+
+	return fmt.Sprintf("raw-ip proto=%v %v->%s via %s, queued=%d, state=%s",
+		conn.config.Load().protocol, conn.config.Load().localIP, remote, conn.params.Load().pcapIface.Name, len(conn.inputChan), state)
 }
 
-// Close closes the RawIPConn.
+// Close closes the RawIPConn. No packet is queued for reading after it, but the ones already queued can still be read:
+// once they all are, reads blocked on the conn and any later read return ErrClosed, which matches net.ErrClosed.
+// A conn is also closed when its pcapSession is torn down.
+// The write buffer of the conn is flushed first: if some of its packets cannot be sent, Close returns the error of Flush.
 func (conn *RawIPConn) Close() error {
-	if conn.isClosed {
+	if conn.wbuf != nil {
+		// taking wbuf.mu orders the close after any write adding to the batch, so that Flush gets all of them
+		conn.wbuf.mu.Lock()
+	}
+	if !conn.isClosed.CompareAndSwap(false, true) {
+		if conn.wbuf != nil {
+			conn.wbuf.mu.Unlock()
+		}
 		return nil
 	}
-	conn.isClosed = true
+	var flushErr error
+	if conn.wbuf != nil {
+		conn.wbuf.mu.Unlock()
+		flushErr = conn.Flush()
+	}
+	close(conn.closeChan) // unblocks the pcapSession if it waits for room in inputChan
 
-	close(conn.inputChan)
-	//conn.params.handle.Close()
-	log.Printf("Raw IPConn %s->%s with protocol id %d closed.\n", conn.config.localIP, conn.config.remoteIP, conn.config.protocol)
-	return nil
+	conn.closeInput() // unblocks the readers once the queue is empty
+	// the packets still queued stay readable, but give their memory back to the session budget right away,
+	// whether or not they are ever read
+	conn.drainMu.Lock()
+	if conn.reorder != nil {
+		// the held packets were received before the queued ones
+		for _, packet := range conn.reorder.takeAll() {
+			conn.releaseMem(int64(len((*packet).Data())))
+			conn.drained = append(conn.drained, packet)
+		}
+	}
+	for packet := range conn.inputChan {
+		conn.releaseMem(int64(len((*packet).Data())))
+		conn.drained = append(conn.drained, packet)
+	}
+	conn.drainMu.Unlock()
+
+	// free the demux entry of the conn, so that its address can be reused and its session become idle
+	if conn.params.Load().rawIPConnCloseChan != nil {
+		select {
+		case conn.params.Load().rawIPConnCloseChan <- conn:
+		case <-conn.params.Load().sessionDone:
+		}
+	}
+	//conn.params.Load().handle.Close()
+	log.Printf("Raw IPConn %s->%s with protocol id %d closed.\n", conn.config.Load().localIP, conn.config.Load().remoteIP, conn.config.Load().protocol)
+	return flushErr
 }
 
 // Htons converts a 16-bit number from host byte order to network byte order.
@@ -263,15 +1229,15 @@ func findInterfaceByIP(ip net.IP) (*net.Interface, error) {
 		}
 	}
 
-	return nil, fmt.Errorf("no interface found with IP %v", ip)
+	return nil, fmt.Errorf("no interface found with IP %v: %w", ip, ErrInterfaceNotFound)
 }
 
 func (conn *RawIPConn) LocalIP() net.IP {
-	return conn.config.localIP
+	return conn.config.Load().localIP
 }
 
 func (conn *RawIPConn) RemoteIP() net.IP {
-	return conn.config.remoteIP
+	return conn.config.Load().remoteIP
 }
 
 type TimeoutError struct {
@@ -289,3 +1255,8 @@ func (e *TimeoutError) Timeout() bool {
 func (e *TimeoutError) Temporary() bool {
 	return false
 }
+
+// Unwrap makes errors.Is(err, ErrTimeout) and, like for net.Conn, errors.Is(err, os.ErrDeadlineExceeded) hold for a TimeoutError
+func (e *TimeoutError) Unwrap() error {
+	return ErrTimeout
+}
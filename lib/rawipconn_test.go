@@ -0,0 +1,707 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// waitQueued waits until conn has n packets queued for reading
+func waitQueued(tb testing.TB, conn *RawIPConn, n int) {
+	tb.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for conn.Stats().Queued < n {
+		if time.Now().After(deadline) {
+			tb.Fatalf("%d packets queued, want %d", conn.Stats().Queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCloseKeepsQueuedPacketsReadable(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIP, layers.IPProtocolUDP)
+	conn := p.dial(t, layers.IPProtocolUDP)
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		if _, err := conn.Write([]byte(fmt.Sprintf("packet %d", i))); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	waitQueued(t, listener, n)
+
+	if err := listener.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if used := p.ss.mem.inUse.Load(); used != 0 {
+		t.Errorf("session budget still holds %d bytes of the drained packets", used)
+	}
+
+	buf := make([]byte, 64)
+	for i := 0; i < n; i++ {
+		m, addr, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("read %d after close: %v", i, err)
+		}
+		if want := fmt.Sprintf("packet %d", i); string(buf[:m]) != want {
+			t.Errorf("read %d after close: %q, want %q", i, buf[:m], want)
+		}
+		if !addr.(*net.IPAddr).IP.Equal(testClientIP) {
+			t.Errorf("read %d after close: from %v, want %v", i, addr, testClientIP)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := listener.Read(buf); !errors.Is(err, ErrClosed) || !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("read once drained: %v, want ErrClosed", err)
+		}
+	}
+
+	// packets arriving after Close are not queued anymore
+	if _, err := conn.Write([]byte("late")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := listener.Read(buf); !errors.Is(err, ErrClosed) {
+		t.Fatalf("read after a late packet: %v, want ErrClosed", err)
+	}
+}
+
+func TestCloseUnblocksPendingRead(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIP, layers.IPProtocolUDP)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := listener.Read(make([]byte, 64))
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	listener.Close()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrClosed) {
+			t.Fatalf("pending read: %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending read not unblocked by Close")
+	}
+}
+
+func TestReadDeadlineExceeded(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIP, layers.IPProtocolUDP)
+	reordered := p.listen(t, nil, layers.IPProtocolUDP, WithReorderBuffer(10*time.Millisecond))
+	buf := make([]byte, 64)
+
+	reads := []struct {
+		name string
+		conn *RawIPConn
+		read func(conn *RawIPConn) error
+	}{
+		{"Read", listener, func(conn *RawIPConn) error { _, err := conn.Read(buf); return err }},
+		{"ReadFrom", listener, func(conn *RawIPConn) error { _, _, err := conn.ReadFrom(buf); return err }},
+		{"ReadWithMeta", listener, func(conn *RawIPConn) error { _, _, err := conn.ReadWithMeta(buf); return err }},
+		{"Read reordered", reordered, func(conn *RawIPConn) error { _, err := conn.Read(buf); return err }},
+	}
+	for _, tt := range reads {
+		for _, deadline := range []time.Time{time.Now().Add(20 * time.Millisecond), time.Now().Add(-time.Second)} {
+			tt.conn.SetReadDeadline(deadline)
+			start := time.Now()
+			err := tt.read(tt.conn)
+			if !errors.Is(err, os.ErrDeadlineExceeded) || !errors.Is(err, ErrTimeout) {
+				t.Errorf("%s with deadline in %v: %v, want os.ErrDeadlineExceeded", tt.name, time.Until(deadline).Round(time.Millisecond), err)
+			}
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				t.Errorf("%s: %v is not a net.Error timing out", tt.name, err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("%s returned after %v", tt.name, elapsed)
+			}
+		}
+		tt.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func TestReadDeadlinePassedWithQueuedPacket(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIP, layers.IPProtocolUDP)
+	conn := p.dial(t, layers.IPProtocolUDP)
+
+	if _, err := conn.Write([]byte("queued")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	waitQueued(t, listener, 1)
+
+	listener.SetReadDeadline(time.Now().Add(-time.Millisecond))
+	if _, err := listener.Read(make([]byte, 64)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past the deadline: %v, want os.ErrDeadlineExceeded", err)
+	}
+	// clearing the deadline makes the packet readable again
+	listener.SetReadDeadline(time.Time{})
+	if got := readTimeout(t, listener, time.Second); string(got) != "queued" {
+		t.Fatalf("read %q, want %q", got, "queued")
+	}
+}
+
+func TestWriteDeadlineExceeded(t *testing.T) {
+	// nobody takes the packets a session would send, so the send queue fills up
+	outputChan := make(chan *outboundPacket)
+	sessionDone := make(chan struct{})
+	conn, err := NewRawIPConn(&RawIPConnParams{key: "write-deadline", pcapIface: testIface(), outputChan: outputChan, sessionDone: sessionDone},
+		&RawIPConnConfig{protocol: layers.IPProtocolUDP, localIP: testClientIP, remoteIP: testServerIP, sendQueueLen: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		close(sessionDone)
+		// take what the send queue drainer still hands out, so that it sees the close
+		for {
+			select {
+			case <-outputChan:
+			case <-time.After(50 * time.Millisecond):
+				return
+			}
+		}
+	})
+
+	// the first packet is held by the drainer, the second one fills the queue
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Write([]byte("fill")); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(conn.sendQueue) < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, deadline := range []time.Time{time.Now().Add(20 * time.Millisecond), time.Now().Add(-time.Second)} {
+		conn.SetWriteDeadline(deadline)
+		if _, err := conn.Write([]byte("late")); !errors.Is(err, os.ErrDeadlineExceeded) || !errors.Is(err, ErrTimeout) {
+			t.Errorf("write with deadline in %v: %v, want os.ErrDeadlineExceeded", time.Until(deadline).Round(time.Millisecond), err)
+		}
+	}
+}
+
+func TestMaxPayloadBoundary(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIP, layers.IPProtocolUDP)
+	events, cancel := p.client.Events(64)
+	defer cancel()
+
+	tests := []struct {
+		name  string
+		opts  []ConnOption
+		mtu   int
+		limit int
+	}{
+		{"interface MTU", nil, 1500, 1500 - ipv4HeaderLen},
+		{"VLAN tag", []ConnOption{WithVLAN(100)}, 1500, 1500 - ipv4HeaderLen - dot1QTagLen},
+		{"max write size", []ConnOption{WithMaxWriteSize(512)}, 1500, 512},
+		{"MTU raised", nil, 9000, 9000 - ipv4HeaderLen},
+		{"MTU lowered below the max write size", []ConnOption{WithMaxWriteSize(1400)}, 1280, 1280 - ipv4HeaderLen},
+	}
+	for _, tt := range tests {
+		p.cs.setMTU(tt.mtu)
+		conn := p.dial(t, layers.IPProtocolUDP, tt.opts...)
+		if got := conn.MaxPayload(); got != tt.limit {
+			t.Errorf("%s: MaxPayload = %d, want %d", tt.name, got, tt.limit)
+		}
+
+		if _, err := conn.Write(make([]byte, tt.limit)); err != nil {
+			t.Errorf("%s: write of MaxPayload bytes: %v", tt.name, err)
+		}
+		_, err := conn.Write(make([]byte, tt.limit+1))
+		var tooLong *MessageTooLongError
+		if !errors.As(err, &tooLong) || !errors.Is(err, ErrMessageTooLong) {
+			t.Errorf("%s: write of MaxPayload+1 bytes: %v, want a *MessageTooLongError", tt.name, err)
+		} else if tooLong.Size != tt.limit+1 || tooLong.Limit != tt.limit {
+			t.Errorf("%s: %+v, want size %d and limit %d", tt.name, tooLong, tt.limit+1, tt.limit)
+		}
+
+		// the packet of MaxPayload bytes made it through whole, and only it did
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 10000)
+		n, meta, err := listener.ReadWithMeta(buf)
+		if err != nil || n != tt.limit {
+			t.Errorf("%s: listener read %d bytes, %v, want %d", tt.name, n, err, tt.limit)
+		}
+		if vlan := conn.config.Load().vlanID; vlan != 0 && (len(meta.VLANIDs) != 1 || meta.VLANIDs[0] != vlan) {
+			t.Errorf("%s: frame tagged %v, want [%d]", tt.name, meta.VLANIDs, vlan)
+		}
+		conn.Close()
+		deadline := time.Now().Add(time.Second)
+		for p.cs.conns.lookup(layers.IPProtocolUDP, toAddr(testClientIP), toAddr(testServerIP)) != nil && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if listener.Stats().Queued != 0 {
+		t.Errorf("%d packets too long were sent", listener.Stats().Queued)
+	}
+
+	var changes []int
+	for len(events) > 0 {
+		if ev, ok := (<-events).(*MTUChanged); ok {
+			changes = append(changes, ev.New)
+		}
+	}
+	if fmt.Sprint(changes) != "[9000 1280]" {
+		t.Errorf("MTUChanged events to %v, want [9000 1280]", changes)
+	}
+}
+
+func TestWriteLayersLimitCountsOptions(t *testing.T) {
+	p := newMemPair(t)
+	conn := p.dial(t, layers.IPProtocolUDP)
+
+	// a Router Alert option makes the header 24 bytes long
+	option := layers.IPv4Option{OptionType: 148, OptionLength: 4, OptionData: []byte{0, 0}}
+	limit := 1500 - 24
+	write := func(size int) error {
+		ip := &layers.IPv4{Protocol: layers.IPProtocolUDP, Options: []layers.IPv4Option{option}}
+		_, err := conn.WriteLayers(ip, gopacket.Payload(make([]byte, size)))
+		return err
+	}
+	if err := write(limit); err != nil {
+		t.Fatalf("write of %d bytes after a 24 bytes header: %v", limit, err)
+	}
+	var tooLong *MessageTooLongError
+	if err := write(limit + 1); !errors.As(err, &tooLong) || tooLong.Limit != limit {
+		t.Fatalf("write of %d bytes after a 24 bytes header: %v, want a limit of %d", limit+1, err, limit)
+	}
+}
+
+// aliasPayload returns the payload number v of TestSerializeBufferNotAliased: made only of v, and of a length
+// telling it apart from the payloads of the other values
+func aliasPayload(v byte) []byte {
+	return bytes.Repeat([]byte{v}, 64+int(v)*5)
+}
+
+// TestSerializeBufferNotAliased writes from many goroutines at once, so that the pooled serialize buffers are reused
+// while the packets built in them are still queued, and checks that no packet is changed by a later write. Run it
+// with -race
+func TestSerializeBufferNotAliased(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIP, layers.IPProtocolUDP)
+	conn := p.dial(t, layers.IPProtocolUDP)
+
+	const writers, perWriter = 8, 32
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		built = make(map[byte]*outboundPacket)
+	)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				v := byte(w*perWriter + i)
+				// every other payload is only built and kept, the others are written
+				if i%2 == 0 {
+					out, _, err := conn.buildPacket(testServerIP, aliasPayload(v))
+					if err != nil {
+						t.Errorf("build: %v", err)
+						return
+					}
+					mu.Lock()
+					built[v] = out
+					mu.Unlock()
+				} else if _, err := conn.Write(aliasPayload(v)); err != nil {
+					t.Errorf("write: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	received := make(map[byte]bool)
+	for n := 0; n < writers*perWriter/2; n++ {
+		got := readTimeout(t, listener, time.Second)
+		if len(got) == 0 || !bytes.Equal(got, aliasPayload(got[0])) {
+			t.Fatalf("received a payload of %d bytes mixing several writes", len(got))
+		}
+		if received[got[0]] {
+			t.Fatalf("payload %d received twice", got[0])
+		}
+		received[got[0]] = true
+	}
+	wg.Wait()
+
+	// the packets built but never sent still hold their own payload
+	for v, out := range built {
+		got := (*out.packet).NetworkLayer().LayerPayload()
+		if !bytes.Equal(got, aliasPayload(v)) {
+			t.Errorf("packet built for payload %d now carries %d bytes starting with %v", v, len(got), got[:min(len(got), 4)])
+		}
+	}
+}
+
+// BenchmarkWrite measures the write path, building the packet in a pooled serialize buffer and handing it to the
+// session, for payloads of a few sizes. Run it with -benchmem
+func BenchmarkWrite(b *testing.B) {
+	for _, size := range []int{64, 512, 1400} {
+		payload := make([]byte, size)
+		b.Run(fmt.Sprintf("build/payload=%d", size), func(b *testing.B) {
+			conn := newMemPair(b).dial(b, layers.IPProtocolUDP)
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if _, _, err := conn.buildPacket(testServerIP, payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("write/payload=%d", size), func(b *testing.B) {
+			conn := newMemPair(b).dial(b, layers.IPProtocolUDP)
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if _, err := conn.Write(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// writeVSegments are the segments of a typical scattered write: a header, a body and a trailer
+func writeVSegments(bodyLen int) [][]byte {
+	return [][]byte{make([]byte, 8), bytes.Repeat([]byte{0xab}, bodyLen), make([]byte, 16)}
+}
+
+func TestWriteVMatchesWrite(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIP, layers.IPProtocolUDP)
+	conn := p.dial(t, layers.IPProtocolUDP)
+
+	segs := [][]byte{[]byte("head-"), nil, []byte("body-"), []byte("tail")}
+	if n, err := conn.WriteV(segs...); err != nil || n != len("head-body-tail") {
+		t.Fatalf("WriteV = %d, %v, want %d", n, err, len("head-body-tail"))
+	}
+	if n, err := conn.WriteBuffers(net.Buffers(segs)); err != nil || n != int64(len("head-body-tail")) {
+		t.Fatalf("WriteBuffers = %d, %v, want %d", n, err, len("head-body-tail"))
+	}
+	for i := 0; i < 2; i++ {
+		if got := readTimeout(t, listener, time.Second); string(got) != "head-body-tail" {
+			t.Fatalf("listener read %q, want %q", got, "head-body-tail")
+		}
+	}
+
+	// the segments together are held to the limit of a single payload
+	limit := conn.MaxPayload()
+	var tooLong *MessageTooLongError
+	if _, err := conn.WriteV(make([]byte, limit/2), make([]byte, limit-limit/2+1)); !errors.As(err, &tooLong) || tooLong.Size != limit+1 {
+		t.Fatalf("WriteV of %d bytes: %v, want a *MessageTooLongError", limit+1, err)
+	}
+}
+
+// BenchmarkWriteV compares writing scattered segments with WriteV to appending them into one buffer for Write, either
+// a new one per write or one reused. Run it with -benchmem
+func BenchmarkWriteV(b *testing.B) {
+	for _, size := range []int{64, 1400} {
+		segs := writeVSegments(size)
+		total := 0
+		for _, seg := range segs {
+			total += len(seg)
+		}
+		b.Run(fmt.Sprintf("WriteV/body=%d", size), func(b *testing.B) {
+			conn := newMemPair(b).dial(b, layers.IPProtocolUDP)
+			b.ReportAllocs()
+			b.SetBytes(int64(total))
+			for i := 0; i < b.N; i++ {
+				if _, err := conn.WriteV(segs...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("append/body=%d", size), func(b *testing.B) {
+			conn := newMemPair(b).dial(b, layers.IPProtocolUDP)
+			b.ReportAllocs()
+			b.SetBytes(int64(total))
+			for i := 0; i < b.N; i++ {
+				var buf []byte
+				for _, seg := range segs {
+					buf = append(buf, seg...)
+				}
+				if _, err := conn.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("append-reused/body=%d", size), func(b *testing.B) {
+			conn := newMemPair(b).dial(b, layers.IPProtocolUDP)
+			buf := make([]byte, 0, total)
+			b.ReportAllocs()
+			b.SetBytes(int64(total))
+			for i := 0; i < b.N; i++ {
+				buf = buf[:0]
+				for _, seg := range segs {
+					buf = append(buf, seg...)
+				}
+				if _, err := conn.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestJumboRoundTrip sends a payload of 8500 bytes between two sessions on a link of an MTU of 9000, which the default
+// snaplen captures whole, and checks that the write limit follows that MTU
+func TestJumboRoundTrip(t *testing.T) {
+	p := newMemPair(t)
+	p.cs.setMTU(9000)
+	p.ss.setMTU(9000)
+	listener := p.listen(t, testServerIP, layers.IPProtocolUDP)
+	conn := p.dial(t, layers.IPProtocolUDP)
+
+	if got, want := conn.MaxPayload(), 9000-ipv4HeaderLen; got != want {
+		t.Errorf("MaxPayload %d on an MTU of 9000, want %d", got, want)
+	}
+	data := make([]byte, 8500)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("write of %d bytes: %v", len(data), err)
+	}
+	buf := make([]byte, 9000)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, meta, err := listener.ReadWithMeta(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(buf[:n], data) || meta.Truncated {
+		t.Errorf("listener read %d bytes, truncated %v, want the %d written", n, meta.Truncated, len(data))
+	}
+	if got := listener.Stats().Truncated; got != 0 {
+		t.Errorf("%d packets counted truncated", got)
+	}
+
+	var tooLong *MessageTooLongError
+	if _, err := conn.Write(make([]byte, 9000-ipv4HeaderLen+1)); !errors.As(err, &tooLong) {
+		t.Errorf("write beyond the MTU of 9000: %v, want a *MessageTooLongError", err)
+	}
+}
+
+// TestSnaplenTruncationCounted checks that a packet the capture cut short is delivered as far as it was captured,
+// flagged in its metadata and counted by the conn
+func TestSnaplenTruncationCounted(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIP, layers.IPProtocolUDP)
+	conn := p.dial(t, layers.IPProtocolUDP)
+
+	const snaplen = 200
+	p.transport.SetSnaplen(snaplen)
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 2048)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, meta, err := listener.ReadWithMeta(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if captured := snaplen - 14 - ipv4HeaderLen; n != captured || !bytes.Equal(buf[:n], data[:captured]) {
+		t.Errorf("listener read %d bytes, want the first %d", n, captured)
+	}
+	if !meta.Truncated {
+		t.Error("truncated packet not flagged in its metadata")
+	}
+	if got := listener.Stats().Truncated; got != 1 {
+		t.Errorf("%d packets counted truncated, want 1", got)
+	}
+
+	p.transport.SetSnaplen(0)
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := readTimeout(t, listener, time.Second); !bytes.Equal(got, data) {
+		t.Errorf("listener read %d bytes once the snaplen was lifted, want %d", len(got), len(data))
+	}
+	if got := listener.Stats().Truncated; got != 1 {
+		t.Errorf("%d packets counted truncated after a whole one, want 1", got)
+	}
+}
+
+func TestDefaultSnaplenFromMTU(t *testing.T) {
+	tests := []struct {
+		name    string
+		snaplen int
+		mtu     int
+		want    int
+	}{
+		{"Ethernet", 0, 1500, defaultSnaplen},
+		{"jumbo", 0, 9000, defaultSnaplen},
+		{"beyond 64KiB", 0, 100000, 100000 + maxLinkOverhead},
+		{"beyond the libpcap maximum", 0, maxSnaplen, maxSnaplen},
+		{"explicit", 1000, 9000, 1000},
+	}
+	for _, tt := range tests {
+		if got := newPcapSessionConfig(SessionConfig{Snaplen: tt.snaplen}, time.Second, tt.mtu).snaplen; got != tt.want {
+			t.Errorf("%s: snaplen %d for an MTU of %d, want %d", tt.name, got, tt.mtu, tt.want)
+		}
+	}
+}
+
+// TestIPv4OptionsRoundTrip writes IPv4 packets carrying options and checks that Read returns exactly the bytes after
+// the IHL*4 of their header, and that a header length beyond the total length is counted as a decode error rather
+// than delivered
+func TestIPv4OptionsRoundTrip(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIP, layers.IPProtocolUDP)
+	conn := p.dial(t, layers.IPProtocolUDP)
+
+	routerAlert := layers.IPv4Option{OptionType: 148, OptionLength: 4, OptionData: []byte{0, 0}}
+	recordRoute := layers.IPv4Option{OptionType: 7, OptionLength: 11, OptionData: []byte{4, 0, 0, 0, 0, 0, 0, 0, 0}}
+	for _, tt := range []struct {
+		name      string
+		options   []layers.IPv4Option
+		headerLen int
+	}{
+		{"Router Alert", []layers.IPv4Option{routerAlert}, 24},
+		{"Router Alert and Record Route", []layers.IPv4Option{routerAlert, recordRoute}, 36},
+	} {
+		payload := []byte("after the options: " + tt.name)
+		write := func() {
+			ip := &layers.IPv4{Protocol: layers.IPProtocolUDP, Options: tt.options}
+			if _, err := conn.WriteLayers(ip, gopacket.Payload(payload)); err != nil {
+				t.Fatalf("%s: write: %v", tt.name, err)
+			}
+		}
+		write()
+		if got := readTimeout(t, listener, time.Second); !bytes.Equal(got, payload) {
+			t.Errorf("%s: read %q, want %q", tt.name, got, payload)
+		}
+		write()
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		packet, err := listener.readPacket()
+		if err != nil {
+			t.Fatalf("%s: read: %v", tt.name, err)
+		}
+		if ip := (*packet).Layer(layers.LayerTypeIPv4).(*layers.IPv4); int(ip.IHL)*4 != tt.headerLen {
+			t.Errorf("%s: header of %d bytes, want %d", tt.name, int(ip.IHL)*4, tt.headerLen)
+		}
+		if got, _ := listener.readData(*packet); !bytes.Equal(got, payload) {
+			t.Errorf("%s: data %q, want %q", tt.name, got, payload)
+		}
+	}
+
+	// a header of 60 bytes in a packet of a total length of 40
+	frame := append(append([]byte(nil), memoryMACs[1]...), memoryMACs[0]...)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(layers.EthernetTypeIPv4))
+	header := make([]byte, 60)
+	header[0] = 0x4f
+	binary.BigEndian.PutUint16(header[2:], 40)
+	header[8], header[9] = 64, byte(layers.IPProtocolUDP)
+	copy(header[12:], testClientIP)
+	copy(header[16:], testServerIP)
+	frame = append(append(frame, header...), "beyond the total length"...)
+
+	before := p.ss.decodeErrors.Load()
+	if err := p.cs.writeFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for p.ss.decodeErrors.Load() == before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if p.ss.decodeErrors.Load() == before {
+		t.Error("header length beyond the total length not counted as a decode error")
+	}
+	listener.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := listener.Read(make([]byte, 128)); err == nil {
+		t.Errorf("packet with a header length beyond its total length delivered: %d bytes", n)
+	}
+}
+
+// TestSetStripLinkLayer reads packets before and after switching a listener between payloads and whole frames
+func TestSetStripLinkLayer(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIP, layers.IPProtocolUDP)
+	conn := p.dial(t, layers.IPProtocolUDP)
+
+	read := func(payload string) []byte {
+		t.Helper()
+		if _, err := conn.Write([]byte(payload)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		return readTimeout(t, listener, time.Second)
+	}
+	if got := read("stripped"); string(got) != "stripped" {
+		t.Errorf("read %q before the switch, want the payload", got)
+	}
+
+	listener.SetStripLinkLayer(false)
+	const whole = "whole frame, long enough not to be padded"
+	frame := read(whole)
+	if len(frame) != 14+ipv4HeaderLen+len(whole) || !bytes.Equal(frame[:6], memoryMACs[1]) || !bytes.HasSuffix(frame, []byte(whole)) {
+		t.Errorf("read % x with the link layer kept, want the whole frame", frame)
+	}
+
+	listener.SetStripLinkLayer(true)
+	if got := read("stripped again"); string(got) != "stripped again" {
+		t.Errorf("read %q once stripping again, want the payload", got)
+	}
+}
+
+// TestSetSourceMAC checks the Ethernet source of the frames a conn writes before, while and after it sets its own
+func TestSetSourceMAC(t *testing.T) {
+	p := newMemPair(t)
+	listener := p.listen(t, testServerIP, layers.IPProtocolUDP)
+	conn := p.dial(t, layers.IPProtocolUDP)
+
+	srcMAC := func() net.HardwareAddr {
+		t.Helper()
+		if _, err := conn.Write([]byte("which source")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		_, meta, err := listener.ReadWithMeta(make([]byte, 64))
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return meta.SrcMAC
+	}
+	if got := srcMAC(); !bytes.Equal(got, testIface().HardwareAddr) {
+		t.Errorf("frame from %v, want the interface address %v", got, testIface().HardwareAddr)
+	}
+
+	emulated := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x77}
+	conn.SetSourceMAC(emulated)
+	emulated[5] = 0x78 // the conn keeps its own copy
+	if got := srcMAC(); !bytes.Equal(got, net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x77}) {
+		t.Errorf("frame from %v after SetSourceMAC, want 02:00:00:00:00:77", got)
+	}
+	conn.SetSourceMAC(net.HardwareAddr{1, 2, 3}) // ignored
+	if got := srcMAC(); !bytes.Equal(got, net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x77}) {
+		t.Errorf("frame from %v after a MAC of 3 bytes, want the one set before", got)
+	}
+
+	conn.SetSourceMAC(nil)
+	if got := srcMAC(); !bytes.Equal(got, testIface().HardwareAddr) {
+		t.Errorf("frame from %v once restored, want the interface address %v", got, testIface().HardwareAddr)
+	}
+}
@@ -4,36 +4,60 @@
 package lib
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
 )
 
 type RawSocketCore struct {
-	mu                  sync.RWMutex
-	pcapSessionMap      map[string]*pcapSession
+	mu                  sync.RWMutex // guards sessionConfig and ifaceConfigs. Always taken after sessions.createMu, never before
+	sessions            *sessionMap
 	arpCacheTimeout     time.Duration
 	arpRequestTimeout   time.Duration
 	pcapSessionCloseSig chan *pcapSession
 	arpCache            *ARPCache
 	stopChan            chan struct{}
 	wg                  sync.WaitGroup
-	isClosed            bool
+	isClosed            atomic.Bool
+	sessionConfig       SessionConfig            // configuration of the sessions of interfaces without their own
+	ifaceConfigs        map[string]SessionConfig // per interface name configurations set by ConfigureInterface
+	protoCounters       protoCounters            // inbound packets per IP protocol over all sessions, reaped ones included
+	routeSelector       RouteSelector            // picks the route of dials without srcIP
+	logRoutes           bool                     // log the routes dials without srcIP did not pick
+	defaultTTL          uint8                    // TTL of new conns. 0 means 64
+	defaultTOS          uint8                    // TOS byte of new conns
+	defaultIPIDStrategy IPIDStrategy             // IP ID strategy of new conns
+	handleFactory       HandleFactory            // opens the handles of new sessions instead of the live devices
+	unsafeHandleAccess  bool                     // UnsafeHandle is enabled
+	blocklist           *blocklist               // sources dropped by all sessions
+	events              *eventHub                // subscribers of Events
 }
 
-func NewRawSocketCore(arpCacheTimeout, arpRequestTimeout int) *RawSocketCore {
+func NewRawSocketCore(arpCacheTimeout, arpRequestTimeout int, opts ...CoreOption) *RawSocketCore {
 	core := &RawSocketCore{
-		pcapSessionMap:      make(map[string]*pcapSession),
+		sessions:            newSessionMap(),
 		arpCacheTimeout:     time.Duration(arpCacheTimeout) * time.Second,
 		arpRequestTimeout:   time.Duration(arpRequestTimeout) * time.Second,
 		pcapSessionCloseSig: make(chan *pcapSession),
 		arpCache:            NewARPCache(time.Duration(arpCacheTimeout) * time.Second),
 		stopChan:            make(chan struct{}),
 		wg:                  sync.WaitGroup{},
+		ifaceConfigs:        make(map[string]SessionConfig),
+		routeSelector:       DefaultRouteSelector,
+	}
+
+	core.blocklist = newBlocklist(core.refreshBlockFilters)
+	core.events = newEventHub()
+
+	for _, opt := range opts {
+		opt(core)
 	}
 
 	core.wg.Add(1)
@@ -42,110 +66,483 @@ func NewRawSocketCore(arpCacheTimeout, arpRequestTimeout int) *RawSocketCore {
 	return core
 }
 
-func (core *RawSocketCore) DialIP(protocol layers.IPProtocol, srcIP, dstIP net.IP) (*RawIPConn, error) {
+// DialIP opens a RawIPConn from srcIP to dstIP. If srcIP is nil or unspecified, the local IP routable to dstIP is used.
+// Unless WithAsyncResolve is given, it returns once the MAC address of the next hop towards dstIP has been resolved.
+// IPv4 addresses may be given in their 4-byte or 16-byte form. IPv6 dials pick their interface, the zone of link-local
+// addresses, from srcIP or WithInterface, else the only interface dstIP is on-link for: link-local destinations
+// fail with ErrZoneRequired without one. The IPv6 routing table is not read, so routed IPv6 destinations need
+// their router WithNextHop. Next hops are resolved with Neighbor Discovery.
+// A dstIP of the host itself, outside loopback interfaces, is not sent out: the session of its interface hands the packets to its listeners, and
+// srcIP, dstIP itself if nil, must then be an address of the same interface.
+func (core *RawSocketCore) DialIP(protocol layers.IPProtocol, srcIP, dstIP net.IP, opts ...ConnOption) (*RawIPConn, error) {
 	var (
 		err       error
 		iface     *net.Interface
 		gatewayIP net.IP
 	)
 
+	if dstIP, err = checkDestination(dstIP); err != nil {
+		return nil, err
+	}
+	if srcIP, err = checkLocal(srcIP, true); err != nil {
+		return nil, err
+	}
+	if srcIP != nil && (srcIP.To4() == nil) != (dstIP.To4() == nil) {
+		return nil, fmt.Errorf("srcIP %v and dstIP %v: %w", srcIP, dstIP, ErrAddressFamilyMismatch)
+	}
+
+	config := core.newConnConfig(protocol, opts)
+	if dstIP.To4() == nil {
+		if iface, err = routeIPv6(config, srcIP, dstIP); err != nil {
+			return nil, err
+		}
+		return core.dialOn(iface, config)
+	}
+
 	// Step 1: Determine the local IP used for source IP
-	if srcIP == nil {
-		// Determine the local IP routable to the destination
-		srcIP, iface, gatewayIP, err = GetLocalIP(dstIP)
+	switch {
+	case config.nextHopOverride == nil && config.pinnedMAC == nil && hostIface(dstIP) != nil:
+		// the host's own address on a non-loopback interface: the session of the interface delivers the packets
+		// to its listeners itself, as neither ARP nor the wire would bring them back
+		iface = hostIface(dstIP)
+		if srcIP == nil {
+			srcIP = dstIP
+		} else if srcIface, err := findInterfaceByIP(srcIP); err != nil || srcIface.Index != iface.Index {
+			// the replies of the listeners to srcIP are only delivered locally by the same session
+			return nil, fmt.Errorf("provided srcIP %v is not a local IP of interface %s: %w", srcIP, iface.Name, ErrNotLocalIP)
+		}
+		config.selfDial = true
+	case isLinkLocalIPv4(dstIP) && config.nextHopOverride == nil:
+		// link-local destinations are always on-link and must never be sent to a gateway
+		iface, srcIP, err = linkLocalInterface(dstIP, srcIP, config.ifaceName)
+		if err != nil {
+			return nil, err
+		}
+	case config.nextHopOverride != nil:
+		// the caller decides on the next hop, which must be on-link for the interface
+		iface, srcIP, err = findOnLinkInterface(config.nextHopOverride, srcIP)
 		if err != nil {
 			return nil, err
 		}
-	} else {
+	case srcIP == nil && config.ifaceName != "":
+		// pinned to an interface: use its address on-link for dstIP, or its first one
+		iface, err = net.InterfaceByName(config.ifaceName)
+		if err != nil {
+			return nil, fmt.Errorf("interface %s: %w", config.ifaceName, errors.Join(ErrInterfaceNotFound, err))
+		}
+		if srcIP = preferredAddr(iface, dstIP); srcIP == nil {
+			return nil, fmt.Errorf("interface %s has no IPv4 address: %w", iface.Name, ErrNotLocalIP)
+		}
+	case srcIP == nil:
+		// Determine the local IP routable to the destination. The selector runs without any core lock held
+		route, err := selectRoute(dstIP, core.routeSelector, core.logRoutes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot select route to %v: %w", dstIP, err)
+		}
+		srcIP, iface, gatewayIP = route.SrcIP, route.Interface, route.Gateway
+	default:
 		// Ensure srcIP is one of the local interfaces
 		iface, err = findInterfaceByIP(srcIP)
 		if err != nil {
-			return nil, fmt.Errorf("provided srcIP %v is not a local IP: %v", srcIP, err)
+			return nil, fmt.Errorf("provided srcIP %v is not a local IP: %w", srcIP, errors.Join(ErrNotLocalIP, err))
 		}
+		// off-link destinations go through a gateway of the interface owning srcIP, as for dials without srcIP
+		gatewayIP = offLinkGateway(iface, ifaceSubnet(iface, srcIP), dstIP, routeCandidates)
 	}
-	if gatewayIP != nil {
-		log.Println("interface name is", iface.Name, " Gateway IP is", gatewayIP, " source ip is", srcIP)
-	} else {
-		log.Println("interface name is", iface.Name, " Gateway IP is <nil>", " source ip is", srcIP)
+	config.localIP = srcIP
+	config.remoteIP = dstIP
+	switch {
+	case config.selfDial:
+		config.nextHopIP = nil // nothing to resolve
+	case config.pinnedMAC != nil:
+		config.nextHopIP = dstIP // only names the next hop in logs, its MAC is never resolved
+	case config.nextHopOverride != nil:
+		config.nextHopIP = config.nextHopOverride
+	case iface.Flags&net.FlagLoopback != 0:
+		config.nextHopIP = dstIP // nothing to resolve on loopback
+	default:
+		config.nextHopIP, err = nextHopFor(ifaceSubnet(iface, srcIP), dstIP, gatewayIP)
+		if err != nil {
+			return nil, err
+		}
 	}
+	return core.dialOn(iface, config)
+}
+
+// dialOn opens the conn described by config on the session of iface, then resolves its next hop
+func (core *RawSocketCore) dialOn(iface *net.Interface, config *RawIPConnConfig) (*RawIPConn, error) {
+	log.Println("interface name is", iface.Name, " next hop IP is", config.nextHopIP, " source ip is", config.localIP)
 
 	// first we need to check if there is an pcapSession already listening at this iface
-	core.mu.Lock()
-	ps, exists := core.pcapSessionMap[iface.Name]
-	core.mu.Unlock()
+	ps, err := core.acquireSession(iface)
+	if err != nil {
+		return nil, err
+	}
+	defer ps.release()
 
-	if !exists {
-		conf := &pcapSessionConfig{
-			arpRequestTimeout: core.arpRequestTimeout,
-		}
+	conn, err := ps.dialIP(config)
+	if err != nil {
+		return nil, err
+	}
 
-		params := &pcapSessionParams{
-			key:                 iface.Name,
-			iface:               iface,
-			pcapSessionCloseSig: core.pcapSessionCloseSig,
-			arpCache:            core.arpCache,
-			// handle will be added in NewPcapSession
-		}
+	if config.asyncResolve {
+		go conn.resolveNextHop()
+		return conn, nil
+	}
 
-		ps, err = newPcapSession(params, conf)
-		if err != nil {
-			return nil, err
-		}
+	conn.resolveNextHop()
+	if err := conn.ResolutionError(); err != nil {
+		ps.conns.deregister(conn)
+		conn.Close()
+		return nil, fmt.Errorf("failed to resolve next hop %v: %w", config.nextHopIP, err)
+	}
 
-		core.mu.Lock()
-		core.pcapSessionMap[iface.Name] = ps
-		core.mu.Unlock()
+	return conn, nil
+}
+
+// DialIPWithMAC opens a RawIPConn from srcIP to dstIP like DialIP, but sends all its frames to the next hop MAC address
+// nextHop as is: neither the ARP cache nor ARP requests are involved. srcIP must still be a local IP if given, and picks
+// the interface of the conn. This is meant for test harnesses and known L2 fabrics, where the MAC is known in advance.
+func (core *RawSocketCore) DialIPWithMAC(protocol layers.IPProtocol, srcIP, dstIP net.IP, nextHop net.HardwareAddr, opts ...ConnOption) (*RawIPConn, error) {
+	if len(nextHop) != 6 {
+		return nil, fmt.Errorf("next hop MAC %v is not an Ethernet address", nextHop)
 	}
+	mac := append(net.HardwareAddr(nil), nextHop...)
+	return core.DialIP(protocol, srcIP, dstIP, append(opts, func(config *RawIPConnConfig) {
+		config.pinnedMAC = mac
+	})...)
+}
 
-	conn, err := ps.dialIP(srcIP, dstIP, protocol)
+// DialMulti opens a RawIPConn from srcIP without a fixed destination, to send to many destinations with SendTo.
+// Like a listener, it receives every packet of the protocol sent to srcIP. Off-link destinations are always sent
+// through the default gateway of the interface of srcIP, more specific routes are not considered.
+func (core *RawSocketCore) DialMulti(protocol layers.IPProtocol, srcIP net.IP, opts ...ConnOption) (*RawIPConn, error) {
+	srcIP, err := checkLocal(srcIP, false)
 	if err != nil {
 		return nil, err
 	}
+	if srcIP.To4() == nil {
+		return nil, fmt.Errorf("srcIP %v must be an IPv4 address: %w", srcIP, ErrAddressFamilyMismatch)
+	}
 
-	ps.rawIPConnMap.Store(conn.getKey(), conn)
+	config := core.newConnConfig(protocol, opts)
+	config.localIP = srcIP
+	config.multi = true
+
+	iface, err := findInterfaceByIP(srcIP)
+	if err != nil {
+		return nil, fmt.Errorf("provided srcIP %v is not a local IP: %w", srcIP, errors.Join(ErrNotLocalIP, err))
+	}
+	config.localSubnet = ifaceSubnet(iface, srcIP)
+	if iface.Flags&net.FlagLoopback == 0 {
+		config.multiGateway = defaultGateway(iface, routeCandidates)
+	}
+
+	ps, err := core.acquireSession(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pcap session: %w", err)
+	}
+	defer ps.release()
+
+	conn, err := ps.listenIP(config)
+	if err != nil {
+		return nil, fmt.Errorf("rawSocketCore.DialMulti: %w", err)
+	}
 
 	return conn, nil
 }
 
-func (core *RawSocketCore) ListenIP(ip net.IP, protocol layers.IPProtocol) (*RawIPConn, error) {
+// RespondToEcho enables or disables answering ICMP echo requests for ip on the named interface. It is meant for addresses
+// served only by this library, which the host would leave unanswered: addresses of the host itself are refused with
+// ErrHostAddress, since the host already answers them and the peer would get two replies. Replies are rate limited per source.
+// While enabled, the pcapSession of the interface is kept open.
+func (core *RawSocketCore) RespondToEcho(ifaceName string, ip net.IP, enabled bool) error {
+	ip, err := checkLocal(ip, false)
+	if err != nil {
+		return err
+	}
+	if ip.To4() == nil {
+		return fmt.Errorf("echo responder for %v: only IPv4 is supported", ip)
+	}
+	if _, err := findInterfaceByIP(ip); err == nil {
+		return fmt.Errorf("echo responder for %v: %w", ip, ErrHostAddress)
+	}
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return fmt.Errorf("interface %s: %w", ifaceName, ErrInterfaceNotFound)
+	}
+
+	ps, err := core.acquireSession(iface)
+	if err != nil {
+		return fmt.Errorf("failed to create pcap session: %w", err)
+	}
+	defer ps.release()
+
+	ps.echo.set(toAddr(ip), enabled)
+	return nil
+}
+
+// newConnConfig returns the config of a new conn: the core's defaults overridden by opts
+func (core *RawSocketCore) newConnConfig(protocol layers.IPProtocol, opts []ConnOption) *RawIPConnConfig {
+	config := &RawIPConnConfig{
+		protocol:     protocol,
+		ttl:          core.defaultTTL,
+		tos:          core.defaultTOS,
+		ipIDStrategy: core.defaultIPIDStrategy,
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+	return config
+}
+
+// DefaultTTL returns the TTL of the packets written by conns not given WithTTL
+func (core *RawSocketCore) DefaultTTL() uint8 {
+	if core.defaultTTL > 0 {
+		return core.defaultTTL
+	}
+	return 64
+}
+
+// DefaultTOS returns the TOS byte of the packets written by conns not given WithTOS
+func (core *RawSocketCore) DefaultTOS() uint8 {
+	return core.defaultTOS
+}
+
+// DefaultIPIDStrategy returns how conns not given WithIPIDStrategy fill in the IP ID of their packets
+func (core *RawSocketCore) DefaultIPIDStrategy() IPIDStrategy {
+	return core.defaultIPIDStrategy
+}
+
+// listenGroup opens a RawIPConn receiving every packet of the protocol sent to the multicast group on iface
+func (core *RawSocketCore) listenGroup(iface *net.Interface, group net.IP, protocol layers.IPProtocol) (*RawIPConn, error) {
+	ps, err := core.acquireSession(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pcap session: %w", err)
+	}
+	defer ps.release()
+
+	config := core.newConnConfig(protocol, nil)
+	config.localIP = normalizeIP(group)
+	return ps.listenIP(config)
+}
+
+// ListenIP opens a RawIPConn receiving every packet of the protocol sent to the local address ip.
+// There is at most one listener per address and protocol: while one is open, ListenIP on the same ones fails with
+// ErrAlreadyListening, which matches ErrAddressInUse, leaving the open listener untouched. Listeners created
+// WithSharedListen may share them instead.
+func (core *RawSocketCore) ListenIP(ip net.IP, protocol layers.IPProtocol, opts ...ConnOption) (*RawIPConn, error) {
+	ip, err := checkLocal(ip, false)
+	if err != nil {
+		return nil, err
+	}
+
+	config := core.newConnConfig(protocol, opts)
+	config.localIP = ip
+
 	// Find the appropriate interface for the given IP
 	iface, err := findInterfaceByIP(ip)
 	if err != nil {
-		return nil, fmt.Errorf("interface not found for IP: %v", err)
+		return nil, fmt.Errorf("interface not found for IP: %w", err)
 	}
 
 	// Look up or create a pcap session for the interface
-	psKey := iface.Name
-	core.mu.Lock()
-	ps, ok := core.pcapSessionMap[psKey]
-	core.mu.Unlock()
-	if !ok {
-		conf := &pcapSessionConfig{
-			arpRequestTimeout: core.arpRequestTimeout,
-		}
+	ps, err := core.acquireSession(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pcap session: %w", err)
+	}
+	defer ps.release()
+
+	conn, err := ps.listenIP(config)
+	if err != nil {
+		return nil, fmt.Errorf("rawSocketCore.ListenIP: %w", err)
+	}
+
+	return conn, nil
+}
+
+// ListenIPFanout opens a listener like ListenIP WithSharedListen: every listener opened with it on the same address
+// and protocol receives a copy of each packet, in its own queue. A listener whose queue is full drops the packets
+// instead of holding up the others, and counts them in the InboundDropped stat.
+func (core *RawSocketCore) ListenIPFanout(ip net.IP, protocol layers.IPProtocol, opts ...ConnOption) (*RawIPConn, error) {
+	return core.ListenIP(ip, protocol, append(opts, WithSharedListen())...)
+}
+
+// acquireSession returns the pcapSession of iface, creating it if there is none yet.
+// The session cannot be reaped until the caller calls release on it, which it must do once its conn is registered.
+func (core *RawSocketCore) acquireSession(iface *net.Interface) (*pcapSession, error) {
+	// the reaper retires a session before removing it, so a session acquired here is never reaped under a dialer's feet
+	if ps, exists := core.sessions.get(iface.Name); exists && ps.tryAcquire() {
+		return ps, nil
+	}
+
+	core.sessions.createMu.Lock()
+	defer core.sessions.createMu.Unlock()
+
+	// sessions are retired and removed under createMu, so one found here can always be acquired
+	ps, exists := core.sessions.get(iface.Name)
+	if !exists {
+		conf := core.newPcapSessionConfig(iface)
 
 		params := &pcapSessionParams{
 			key:                 iface.Name,
 			iface:               iface,
 			pcapSessionCloseSig: core.pcapSessionCloseSig,
 			arpCache:            core.arpCache,
+			protoCounters:       &core.protoCounters,
+			handleFactory:       core.handleFactory,
+			blocklist:           core.blocklist,
+			events:              core.events,
+			migrate:             core.migrate,
 			// handle will be added in NewPcapSession
 		}
+
+		var err error
 		ps, err = newPcapSession(params, conf)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create pcap session: %v", err)
+			return nil, err
 		}
-		core.mu.Lock()
-		core.pcapSessionMap[psKey] = ps
-		core.mu.Unlock()
+		core.sessions.sessions.Store(iface.Name, ps)
+		core.events.emit(&SessionOpened{eventTime{time.Now()}, iface.Name})
 	}
+	ps.tryAcquire()
 
-	conn, err := ps.listenIP(ip, protocol)
-	if err != nil {
-		return nil, fmt.Errorf("rawSocketCore.ListenIP: %s", err)
+	return ps, nil
+}
+
+// newPcapSessionConfig builds the session config for a new pcapSession on iface
+func (core *RawSocketCore) newPcapSessionConfig(iface *net.Interface) *pcapSessionConfig {
+	core.mu.RLock()
+	defer core.mu.RUnlock()
+
+	cfg, exists := core.ifaceConfigs[iface.Name]
+	if !exists {
+		cfg = core.sessionConfig
 	}
+	return newPcapSessionConfig(cfg, core.arpRequestTimeout, iface.MTU)
+}
 
-	return conn, nil
+// SessionConfig returns the configuration used for the sessions of interfaces not configured by ConfigureInterface
+func (core *RawSocketCore) SessionConfig() SessionConfig {
+	core.mu.RLock()
+	defer core.mu.RUnlock()
+
+	return core.sessionConfig
+}
+
+// SetSessionConfig validates cfg and makes it the configuration of the sessions opened from now on on interfaces
+// not configured by ConfigureInterface. Sessions already open keep their configuration.
+func (core *RawSocketCore) SetSessionConfig(cfg SessionConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	core.mu.Lock()
+	defer core.mu.Unlock()
+
+	core.sessionConfig = cfg
+	return nil
+}
+
+// ConfigureInterface validates cfg and makes it the configuration of the session on the named interface, overriding
+// the core's one. It must be called before the first dial or listen touches the interface: if its session is already
+// open with different settings, a *SessionConfigConflictError is returned. Only the memory budget may differ,
+// it is then applied to the open session.
+func (core *RawSocketCore) ConfigureInterface(name string, cfg SessionConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	core.sessions.createMu.Lock()
+	defer core.sessions.createMu.Unlock()
+	core.mu.Lock()
+	defer core.mu.Unlock()
+
+	if ps, exists := core.sessions.get(name); exists {
+		if !ps.config.public.sameExceptBudget(cfg) {
+			return &SessionConfigConflictError{Interface: name, Current: ps.config.public}
+		}
+		ps.config.public.MemoryBudget = cfg.MemoryBudget
+		ps.mem.setBudget(cfg.MemoryBudget)
+	}
+	core.ifaceConfigs[name] = cfg
+	return nil
+}
+
+// SetSessionMemoryBudget changes the receive memory budget of all current and future pcapSessions.
+// A budget of 0 or less means unlimited.
+func (core *RawSocketCore) SetSessionMemoryBudget(bytes int64) {
+	// createMu keeps sessions from being created with the old budget after the open ones were updated
+	core.sessions.createMu.Lock()
+	defer core.sessions.createMu.Unlock()
+
+	core.mu.Lock()
+	core.sessionConfig.MemoryBudget = max(bytes, 0)
+	for name, cfg := range core.ifaceConfigs {
+		cfg.MemoryBudget = max(bytes, 0)
+		core.ifaceConfigs[name] = cfg
+	}
+	core.mu.Unlock()
+
+	for _, ps := range core.sessions.all() {
+		ps.mem.setBudget(bytes)
+	}
+}
+
+// SessionStats returns the statistics of the pcapSession opened on the given interface
+func (core *RawSocketCore) SessionStats(ifaceName string) (SessionStats, error) {
+	ps, exists := core.sessions.get(ifaceName)
+	if !exists {
+		return SessionStats{}, fmt.Errorf("no pcap session found for interface %s: %w", ifaceName, ErrInterfaceNotFound)
+	}
+
+	return ps.stats(), nil
+}
+
+// SessionHandle returns the pcap handle of the pcapSession opened on the given interface, for pcap calls the library
+// does not wrap, e.g. SetDirection. The library keeps reading from and writing to the handle: using it concurrently
+// for anything but settings that are safe to change on a live handle is unsafe. It must not be closed, and becomes
+// invalid once the session closes, or reopens its capture WithAdaptiveBufferSize.
+func (core *RawSocketCore) SessionHandle(ifaceName string) (*pcap.Handle, error) {
+	ps, exists := core.sessions.get(ifaceName)
+	if !exists {
+		return nil, fmt.Errorf("no pcap session found for interface %s: %w", ifaceName, ErrInterfaceNotFound)
+	}
+
+	handle := ps.Handle()
+	if handle == nil {
+		return nil, fmt.Errorf("pcap session on %s is not backed by a pcap handle", ifaceName)
+	}
+	return handle, nil
+}
+
+// UnsafeHandle returns the live PacketIO of the pcapSession opened on the given interface, a *pcap.Handle unless the
+// core was created WithHandleFactory, for whatever the library does not wrap: handle options of a platform, or a
+// ZeroCopyReadPacketData loop while debugging. It fails with ErrHandleAccessDisabled unless the core was created
+// WithUnsafeHandleAccess.
+//
+// UNSAFE: the session keeps capturing from and writing to the handle. Reading from it steals packets from the session,
+// and any concurrent use is on the caller. It must not be closed, and must not be used once the session closes.
+func (core *RawSocketCore) UnsafeHandle(ifaceName string) (PacketIO, error) {
+	if !core.unsafeHandleAccess {
+		return nil, ErrHandleAccessDisabled
+	}
+	ps, exists := core.sessions.get(ifaceName)
+	if !exists {
+		return nil, fmt.Errorf("no pcap session found for interface %s: %w", ifaceName, ErrInterfaceNotFound)
+	}
+	return ps.currentHandle(), nil
+}
+
+// CacheStats returns the statistics of the ARP cache shared by all sessions, including the ARP resolution latency per interface
+func (core *RawSocketCore) CacheStats() CacheStats {
+	return core.arpCache.Stats()
+}
+
+// ProtocolStats returns the number of inbound IPv4 packets and bytes per IP protocol seen by all sessions,
+// whether or not a conn received them
+func (core *RawSocketCore) ProtocolStats() map[layers.IPProtocol]ProtoStats {
+	return core.protoCounters.snapshot()
 }
 
 func (core *RawSocketCore) handlePcapSessionClose() {
@@ -156,28 +553,28 @@ func (core *RawSocketCore) handlePcapSessionClose() {
 		case <-core.stopChan:
 			return
 		case ps := <-core.pcapSessionCloseSig:
-			core.mu.Lock()
-			delete(core.pcapSessionMap, ps.params.key)
-			core.mu.Unlock()
+			// the session asks to be reaped because it has been idle. Retiring it checks again, as a dial may have grabbed it since
+			core.sessions.createMu.Lock()
+			if current, _ := core.sessions.get(ps.params.key); current != ps || !ps.retire() {
+				core.sessions.createMu.Unlock()
+				continue
+			}
+			core.sessions.sessions.Delete(ps.params.key)
+			core.sessions.createMu.Unlock()
+
+			log.Printf("Pcap Session %s has had no conns for %v, closing it", ps.params.key, time.Since(time.Unix(0, ps.lastActive.Load())).Round(time.Millisecond))
+			ps.close("idle")
 		}
 	}
 }
 
 func (core *RawSocketCore) Close() {
-	if core.isClosed {
+	if !core.isClosed.CompareAndSwap(false, true) {
 		return
 	}
-	core.isClosed = true
-
-	var pcapSessions []*pcapSession
-	core.mu.Lock()
-	for _, session := range core.pcapSessionMap {
-		pcapSessions = append(pcapSessions, session)
-	}
-	core.mu.Unlock()
 
-	for _, session := range pcapSessions {
-		session.close()
+	for _, session := range core.sessions.all() {
+		session.close("core closed")
 	}
 
 	close(core.stopChan)
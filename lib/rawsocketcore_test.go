@@ -0,0 +1,288 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// countedIO is a PacketIO counting the handles left open in open
+type countedIO struct {
+	PacketIO
+	open *atomic.Int64
+	once sync.Once
+}
+
+func (c *countedIO) Close() {
+	c.once.Do(func() { c.open.Add(-1) })
+	c.PacketIO.Close()
+}
+
+// countingFactory wraps factory so that open counts the handles it opened which are not closed yet
+func countingFactory(factory HandleFactory, open *atomic.Int64) HandleFactory {
+	return func(iface *net.Interface) (PacketIO, error) {
+		handle, err := factory(iface)
+		if err != nil {
+			return nil, err
+		}
+		open.Add(1)
+		return &countedIO{PacketIO: handle, open: open}, nil
+	}
+}
+
+// waitGoroutines waits for the number of goroutines to drop back to at most n, and returns it
+func waitGoroutines(n int) int {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := runtime.NumGoroutine()
+		if got <= n || time.Now().After(deadline) {
+			return got
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestSessionChurnLeaksNothing opens and closes many sessions, each with a conn written to, and checks that every
+// handle is closed and every goroutine of the sessions and conns ends
+func TestSessionChurnLeaksNothing(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	var open atomic.Int64
+	transport := NewMemoryTransport()
+	core := NewRawSocketCore(60, 1, WithHandleFactory(countingFactory(transport.A(), &open)))
+	peer := NewRawSocketCore(60, 1, WithHandleFactory(transport.B()), WithKeepIdleSessions())
+	defer peer.Close()
+	peerSession, err := peer.acquireSession(testIface())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerSession.release()
+
+	const rounds = 200
+	for i := 0; i < rounds; i++ {
+		ps, err := core.acquireSession(testIface())
+		if err != nil {
+			t.Fatalf("round %d: %v", i, err)
+		}
+		config := core.newConnConfig(layers.IPProtocolUDP, []ConnOption{WithSendQueue(4)})
+		config.localIP, config.remoteIP, config.nextHopIP = testClientIP, testServerIP, testServerIP
+		config.pinnedMAC = memoryMACs[1]
+		conn, err := ps.dialIP(config)
+		ps.release()
+		if err != nil {
+			t.Fatalf("round %d: dial: %v", i, err)
+		}
+		conn.resolveNextHop()
+		if _, err := conn.Write([]byte("churn")); err != nil {
+			t.Fatalf("round %d: write: %v", i, err)
+		}
+		conn.Close()
+
+		// the session closes with its last conn
+		deadline := time.Now().Add(time.Second)
+		for {
+			if _, exists := core.sessions.get(testIface().Name); !exists {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("round %d: session not closed after its last conn", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for open.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := open.Load(); n != 0 {
+		t.Errorf("%d handles left open by %d sessions", n, rounds)
+	}
+
+	core.Close()
+	peer.Close()
+	if got := waitGoroutines(baseline); got > baseline {
+		buf := make([]byte, 1<<16)
+		t.Errorf("%d goroutines running, %d before the sessions opened:\n%s", got, baseline, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+// TestSessionIdleOptions checks when a session left without conns closes with each idle option
+func TestSessionIdleOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []CoreOption
+		kept bool // still open well after its last user left
+	}{
+		{"default", nil, false},
+		{"WithKeepIdleSessions", []CoreOption{WithKeepIdleSessions()}, true},
+		{"WithSessionIdleTimeout(0)", []CoreOption{WithSessionIdleTimeout(0)}, true},
+		{"WithSessionIdleTimeout(20ms)", []CoreOption{WithSessionIdleTimeout(20 * time.Millisecond)}, false},
+		{"WithIdleSessionTimeout(0)", []CoreOption{WithIdleSessionTimeout(0)}, false},
+		{"WithIdleSessionTimeout(-1)", []CoreOption{WithIdleSessionTimeout(-1)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core := NewRawSocketCore(60, 1, append([]CoreOption{WithHandleFactory(NewMemoryTransport().A())}, tt.opts...)...)
+			defer core.Close()
+			ps, err := core.acquireSession(testIface())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ps.release()
+
+			deadline := time.Now().Add(500 * time.Millisecond)
+			for {
+				_, exists := core.sessions.get(testIface().Name)
+				if !exists || time.Now().After(deadline) {
+					if exists != tt.kept {
+						t.Errorf("session open %v after its last user left, want %v", exists, tt.kept)
+					}
+					return
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		})
+	}
+}
+
+// BenchmarkSessionMapParallel acquires and releases the sessions of a core from many goroutines at once. Run it with
+// -race: the lookup tier keeps its sessions open and only reads the map, the churn tier lets each session be reaped
+// when released, so that lookups race the creation and removal of sessions
+func BenchmarkSessionMapParallel(b *testing.B) {
+	for _, tier := range []struct {
+		name string
+		opts []CoreOption
+	}{
+		{"lookup", []CoreOption{WithKeepIdleSessions()}},
+		{"churn", nil},
+	} {
+		for _, n := range []int{1, 16} {
+			b.Run(fmt.Sprintf("%s/ifaces=%d", tier.name, n), func(b *testing.B) {
+				transport := NewMemoryTransport()
+				core := NewRawSocketCore(60, 1, append([]CoreOption{WithHandleFactory(transport.A())}, tier.opts...)...)
+				defer core.Close()
+
+				ifaces := make([]*net.Interface, n)
+				for i := range ifaces {
+					iface := *testIface()
+					iface.Index, iface.Name = 1000+i, fmt.Sprintf("memtest%d", i)
+					ifaces[i] = &iface
+				}
+
+				var next atomic.Uint32
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					i := int(next.Add(1))
+					for pb.Next() {
+						iface := ifaces[i%n]
+						i++
+						ps, err := core.acquireSession(iface)
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						if got, exists := core.sessions.get(iface.Name); !exists || got.params.key != iface.Name {
+							b.Errorf("session of %s missing while acquired", iface.Name)
+						}
+						ps.release()
+					}
+				})
+			})
+		}
+	}
+}
+
+// TestHeaderFieldPrecedence checks which level sets the TTL, TOS and IP ID of written packets: the IPv4 layer given
+// to WriteLayers, then the options of the conn, then the defaults of the core, then the library defaults
+func TestHeaderFieldPrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		core     []CoreOption
+		conn     []ConnOption
+		packet   *layers.IPv4 // written with WriteLayers if not nil, with Write otherwise
+		ttl, tos uint8
+		ipID     IPIDStrategy
+	}{
+		{"library defaults", nil, nil, nil, 64, 0, IPIDZero},
+		{"core defaults", []CoreOption{WithDefaultTTL(100), WithDefaultTOS(0x10), WithDefaultIPIDStrategy(IPIDIncrement)}, nil, nil, 100, 0x10, IPIDIncrement},
+		{"conn over core",
+			[]CoreOption{WithDefaultTTL(100), WithDefaultTOS(0x10), WithDefaultIPIDStrategy(IPIDIncrement)},
+			[]ConnOption{WithTTL(7), WithTOS(0x28), WithIPIDStrategy(IPIDZero)},
+			nil, 7, 0x28, IPIDZero},
+		{"conn over library", nil, []ConnOption{WithTTL(7), WithTOS(0x28), WithIPIDStrategy(IPIDIncrement)}, nil, 7, 0x28, IPIDIncrement},
+		{"conn TOS of 0 over core", []CoreOption{WithDefaultTOS(0x10)}, []ConnOption{WithTOS(0)}, nil, 64, 0, IPIDZero},
+		{"conn TTL of 0 keeps the core's", []CoreOption{WithDefaultTTL(100)}, []ConnOption{WithTTL(0)}, nil, 100, 0, IPIDZero},
+		{"core TTL of 0 keeps the library's", []CoreOption{WithDefaultTTL(0)}, nil, nil, 64, 0, IPIDZero},
+		{"packet over conn",
+			[]CoreOption{WithDefaultTTL(100), WithDefaultTOS(0x10)},
+			[]ConnOption{WithTTL(7), WithTOS(0x28), WithIPIDStrategy(IPIDZero)},
+			&layers.IPv4{TTL: 3, TOS: 0xb8, Id: 4242},
+			3, 0xb8, IPIDZero},
+		{"packet zero fields from conn",
+			[]CoreOption{WithDefaultTTL(100)},
+			[]ConnOption{WithTOS(0x28), WithIPIDStrategy(IPIDIncrement)},
+			&layers.IPv4{},
+			100, 0x28, IPIDIncrement},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newMemPair(t, tt.core...)
+			listener := p.listen(t, testServerIP, layers.IPProtocolUDP)
+			conn := p.dial(t, layers.IPProtocolUDP, tt.conn...)
+
+			for i := 0; i < 2; i++ {
+				var err error
+				if tt.packet != nil {
+					ip := *tt.packet
+					ip.Protocol = layers.IPProtocolUDP
+					_, err = conn.WriteLayers(&ip, gopacket.Payload("precedence"))
+				} else {
+					_, err = conn.Write([]byte("precedence"))
+				}
+				if err != nil {
+					t.Fatalf("write: %v", err)
+				}
+			}
+
+			var ids []uint16
+			listener.SetReadDeadline(time.Now().Add(time.Second))
+			for i := 0; i < 2; i++ {
+				packet, err := listener.readPacket()
+				if err != nil {
+					t.Fatalf("read: %v", err)
+				}
+				ip := (*packet).Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+				if ip.TTL != tt.ttl || ip.TOS != tt.tos {
+					t.Errorf("packet %d written with TTL %d and TOS %#02x, want %d and %#02x", i, ip.TTL, ip.TOS, tt.ttl, tt.tos)
+				}
+				ids = append(ids, ip.Id)
+			}
+
+			switch {
+			case tt.packet != nil && tt.packet.Id != 0:
+				if ids[0] != tt.packet.Id || ids[1] != tt.packet.Id {
+					t.Errorf("IP IDs %v, want the %d of the packet", ids, tt.packet.Id)
+				}
+			case tt.ipID == IPIDZero:
+				if ids[0] != 0 || ids[1] != 0 {
+					t.Errorf("IP IDs %v, want 0", ids)
+				}
+			case tt.ipID == IPIDIncrement:
+				if ids[1] != ids[0]+1 {
+					t.Errorf("IP IDs %v, want consecutive ones", ids)
+				}
+			}
+		})
+	}
+}
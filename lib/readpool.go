@@ -0,0 +1,64 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ReadBuffer holds a payload read by ReadPooled in a buffer borrowed from a pool shared by all conns.
+// Release gives the buffer back; neither the ReadBuffer nor the slices returned by Bytes may be used afterwards.
+type ReadBuffer struct {
+	buf []byte
+	n   int
+}
+
+// readBufferPool recycles ReadBuffers, sized to the default snaplen so that any captured payload fits
+var readBufferPool = sync.Pool{
+	New: func() any {
+		return &ReadBuffer{buf: make([]byte, defaultSnaplen)}
+	},
+}
+
+// Bytes returns the payload
+func (b *ReadBuffer) Bytes() []byte {
+	return b.buf[:b.n]
+}
+
+// Release returns the buffer to the pool
+func (b *ReadBuffer) Release() {
+	b.n = 0
+	readBufferPool.Put(b)
+}
+
+// ReadPooled reads the next payload like Read, into a pooled buffer instead of one provided by the caller.
+// High rate listeners releasing every buffer once done with it receive without allocating a buffer per packet:
+//
+//	buf, err := conn.ReadPooled()
+//	if err != nil {
+//		return err
+//	}
+//	process(buf.Bytes())
+//	buf.Release()
+func (conn *RawIPConn) ReadPooled() (*ReadBuffer, error) {
+	conn.readMu.Lock()
+	defer conn.readMu.Unlock()
+
+	packet, err := conn.readPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	if data, srcIP := conn.readData(*packet); srcIP != nil {
+		b := readBufferPool.Get().(*ReadBuffer)
+		if len(data) > len(b.buf) {
+			b.buf = make([]byte, len(data)) // a snaplen above the default
+		}
+		b.n = copy(b.buf, data)
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("no valid L4 payload found")
+}
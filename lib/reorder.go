@@ -0,0 +1,236 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// SequenceFunc extracts the sequence number of a packet from its IP payload, see WithSequenceReorder. ok is false
+// for the packets carrying none
+type SequenceFunc func(payload []byte) (seq uint64, ok bool)
+
+// reorderBuffer holds the inbound packets of a conn created WithReorderBuffer for a while before they are read, so
+// that the ones captured earlier but dispatched later by another worker overtake them. The packets are returned by
+// capture timestamp once they have been held for the window, or right away when the buffer is full.
+// Created WithSequenceReorder, it returns them by the sequence number seqOf extracts instead: the next expected one
+// right away, the others once held for the window or when the buffer is full, giving up the numbers before them
+type reorderBuffer struct {
+	window time.Duration
+	limit  int                    // packets held at most, the capacity of the inbound queue by default
+	seqOf  SequenceFunc           // nil orders by capture timestamp
+	drop   func(*gopacket.Packet) // releases a packet dropped as a duplicate
+
+	mu        sync.Mutex // held by readers and Close, never while blocking
+	held      reorderHeap
+	inputDone bool // the inbound queue closed, e.g. at the end of a replay: held packets need not wait anymore
+	closed    bool // Close moved the held packets to the drained ones
+
+	// sequence ordering, guarded by mu
+	started bool   // a packet has been returned, nextSeq is set
+	nextSeq uint64 // sequence number expected next
+	seen    bool   // a packet with a sequence number has been pushed, maxSeq is set
+	maxSeq  uint64 // highest sequence number pushed
+
+	reordered  atomic.Uint64 // packets pushed after one with a higher sequence number
+	duplicates atomic.Uint64 // packets dropped for a sequence number already returned or given up
+	lost       atomic.Uint64 // sequence numbers given up when a gap was flushed
+}
+
+type reorderEntry struct {
+	packet *gopacket.Packet
+	seq    uint64    // sequence number, 0 when ordering by timestamp
+	ts     time.Time // capture timestamp
+	due    time.Time // when the packet has been held for the window
+}
+
+// reorderHeap is a min-heap of held packets by sequence number, then capture timestamp
+type reorderHeap []reorderEntry
+
+func (h reorderHeap) Len() int { return len(h) }
+func (h reorderHeap) Less(i, j int) bool {
+	if h[i].seq != h[j].seq {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].ts.Before(h[j].ts)
+}
+func (h reorderHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *reorderHeap) Push(x any)   { *h = append(*h, x.(reorderEntry)) }
+func (h *reorderHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = reorderEntry{}
+	*h = old[:len(old)-1]
+	return e
+}
+
+func newReorderBuffer(window time.Duration, limit int) *reorderBuffer {
+	return &reorderBuffer{window: window, limit: max(limit, 1)}
+}
+
+// newSequenceReorderBuffer returns a reorderBuffer ordering by the sequence numbers of seqOf. drop is given the
+// duplicates
+func newSequenceReorderBuffer(seqOf SequenceFunc, window time.Duration, limit int, drop func(*gopacket.Packet)) *reorderBuffer {
+	return &reorderBuffer{window: window, limit: max(limit, 1), seqOf: seqOf, drop: drop}
+}
+
+// push holds packet, received now. It returns false if the caller keeps packet: once Close took the held packets, or
+// when ordering by sequence number and packet has none
+func (r *reorderBuffer) push(packet *gopacket.Packet, now time.Time) bool {
+	var seq uint64
+	if r.seqOf != nil {
+		ipLayer := (*packet).Layer(layers.LayerTypeIPv4)
+		if ipLayer == nil {
+			return false
+		}
+		var ok bool
+		if seq, ok = r.seqOf(ipLayer.LayerPayload()); !ok {
+			return false
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return false
+	}
+	if r.seqOf != nil {
+		if r.started && seq < r.nextSeq {
+			r.duplicates.Add(1)
+			r.drop(packet)
+			return true
+		}
+		if r.seen && seq < r.maxSeq {
+			r.reordered.Add(1)
+		}
+		if !r.seen || seq > r.maxSeq {
+			r.seen, r.maxSeq = true, seq
+		}
+	}
+	heap.Push(&r.held, reorderEntry{packet: packet, seq: seq, ts: (*packet).Metadata().Timestamp, due: now.Add(r.window)})
+	return true
+}
+
+// next pops the earliest packet if it is due, the buffer is full or the input ended. Otherwise it returns how long
+// to wait for the earliest packet to be due, 0 if there is none
+func (r *reorderBuffer) next(now time.Time) (*gopacket.Packet, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for len(r.held) > 0 {
+		earliest := r.held[0]
+		if r.seqOf == nil {
+			if !r.inputDone && len(r.held) < r.limit && now.Before(earliest.due) {
+				return nil, earliest.due.Sub(now)
+			}
+			return heap.Pop(&r.held).(reorderEntry).packet, 0
+		}
+
+		if r.started && earliest.seq < r.nextSeq {
+			// held twice
+			heap.Pop(&r.held)
+			r.duplicates.Add(1)
+			r.drop(earliest.packet)
+			continue
+		}
+		inOrder := r.started && earliest.seq == r.nextSeq
+		if !inOrder && !r.inputDone && len(r.held) < r.limit && now.Before(earliest.due) {
+			return nil, earliest.due.Sub(now)
+		}
+		heap.Pop(&r.held)
+		if r.started {
+			r.lost.Add(earliest.seq - r.nextSeq)
+		}
+		r.started, r.nextSeq = true, earliest.seq+1
+		return earliest.packet, 0
+	}
+	return nil, 0
+}
+
+// endInput lets the held packets go without waiting. It tells if there are none left
+func (r *reorderBuffer) endInput() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.inputDone = true
+	return len(r.held) == 0
+}
+
+// takeAll empties the buffer for Close, returning the held packets in their order
+func (r *reorderBuffer) takeAll() []*gopacket.Packet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	sort.Slice(r.held, r.held.Less)
+	packets := make([]*gopacket.Packet, len(r.held))
+	for i, e := range r.held {
+		packets[i] = e.packet
+	}
+	r.held = nil
+	return packets
+}
+
+// readReordered is readPacket for conns created WithReorderBuffer or WithSequenceReorder. The caller must hold conn.readMu
+func (conn *RawIPConn) readReordered() (*gopacket.Packet, error) {
+	var expired <-chan time.Time
+	if readDeadline := loadDeadline(&conn.readDeadline); !readDeadline.IsZero() {
+		if !time.Now().Before(readDeadline) {
+			return nil, &TimeoutError{msg: "read timeout"}
+		}
+		timer := time.NewTimer(time.Until(readDeadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		if conn.isClosed.Load() {
+			return conn.popDrained()
+		}
+		packet, wait := conn.reorder.next(time.Now())
+		if packet != nil {
+			conn.releaseMem(int64(len((*packet).Data())))
+			return packet, nil
+		}
+
+		var (
+			due   <-chan time.Time
+			timer *time.Timer
+		)
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			due = timer.C
+		}
+		select {
+		case packet, ok := <-conn.inputChan:
+			if timer != nil {
+				timer.Stop()
+			}
+			if !ok {
+				if conn.reorder.endInput() {
+					return conn.popDrained()
+				}
+				continue
+			}
+			if !conn.reorder.push(packet, time.Now()) {
+				conn.releaseMem(int64(len((*packet).Data())))
+				return packet, nil
+			}
+		case <-due:
+		case <-expired:
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil, &TimeoutError{msg: "read timeout"}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// seqPacket returns a packet whose IP payload starts with seq, as seqOfPayload reads it
+func seqPacket(tb testing.TB, seq uint64) *gopacket.Packet {
+	tb.Helper()
+
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: testClientIP, DstIP: testServerIP}
+	data, err := serializeLayers(ip, gopacket.Payload(binary.BigEndian.AppendUint64(nil, seq)))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+	return &packet
+}
+
+func seqOfPayload(payload []byte) (uint64, bool) {
+	if len(payload) < 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(payload), true
+}
+
+// reorderStep pushes the packet of sequence number push at ms milliseconds, or, when push is 0, asks for the next
+// packet then, expecting the one of sequence number want, none for 0
+type reorderStep struct {
+	ms   int
+	push uint64
+	want uint64
+}
+
+func TestSequenceReorder(t *testing.T) {
+	const window = 10 * time.Millisecond
+	tests := []struct {
+		name                        string
+		limit                       int
+		steps                       []reorderStep
+		lost, duplicates, reordered uint64
+	}{
+		{"in order", 8, []reorderStep{
+			{ms: 0, push: 1},
+			{ms: 0, want: 0}, // the first packet waits for the window
+			{ms: 10, want: 1},
+			{ms: 11, push: 2},
+			{ms: 11, want: 2}, // the next one expected goes right away
+			{ms: 12, push: 3},
+			{ms: 12, want: 3},
+		}, 0, 0, 0},
+		{"gap filled late", 8, []reorderStep{
+			{ms: 0, push: 1},
+			{ms: 10, want: 1},
+			{ms: 11, push: 3},
+			{ms: 12, want: 0},
+			{ms: 15, push: 2},
+			{ms: 15, want: 2},
+			{ms: 15, want: 3},
+		}, 0, 0, 1},
+		{"gap given up after the window", 8, []reorderStep{
+			{ms: 0, push: 1},
+			{ms: 10, want: 1},
+			{ms: 11, push: 4},
+			{ms: 20, want: 0},
+			{ms: 21, want: 4},
+		}, 2, 0, 0},
+		{"duplicate after a give-up", 8, []reorderStep{
+			{ms: 0, push: 1},
+			{ms: 10, want: 1},
+			{ms: 11, push: 3},
+			{ms: 21, want: 3},
+			{ms: 22, push: 2}, // given up
+			{ms: 22, push: 3}, // read already
+			{ms: 40, want: 0},
+		}, 1, 2, 0},
+		{"duplicate held twice", 8, []reorderStep{
+			{ms: 0, push: 1},
+			{ms: 10, want: 1},
+			{ms: 11, push: 3},
+			{ms: 12, push: 3},
+			{ms: 21, want: 3},
+			{ms: 22, want: 0},
+		}, 1, 1, 0},
+		{"maxPackets cap", 2, []reorderStep{
+			{ms: 0, push: 1},
+			{ms: 10, want: 1},
+			{ms: 11, push: 3},
+			{ms: 11, want: 0},
+			{ms: 11, push: 4},
+			{ms: 11, want: 3}, // the buffer is full: 2 is given up without waiting
+			{ms: 11, want: 4},
+		}, 1, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dropped uint64
+			r := newSequenceReorderBuffer(seqOfPayload, window, tt.limit, func(*gopacket.Packet) { dropped++ })
+			start := time.Now()
+			for i, step := range tt.steps {
+				now := start.Add(time.Duration(step.ms) * time.Millisecond)
+				if step.push != 0 {
+					if !r.push(seqPacket(t, step.push), now) {
+						t.Fatalf("step %d: packet %d not held", i, step.push)
+					}
+					continue
+				}
+				packet, _ := r.next(now)
+				var got uint64
+				if packet != nil {
+					got, _ = seqOfPayload((*packet).Layer(layers.LayerTypeIPv4).LayerPayload())
+				}
+				if got != step.want {
+					t.Fatalf("step %d at %dms: next returned %d, want %d", i, step.ms, got, step.want)
+				}
+			}
+			if lost, dups, reordered := r.lost.Load(), r.duplicates.Load(), r.reordered.Load(); lost != tt.lost || dups != tt.duplicates || reordered != tt.reordered {
+				t.Errorf("%d lost, %d duplicates, %d reordered, want %d, %d and %d", lost, dups, reordered, tt.lost, tt.duplicates, tt.reordered)
+			}
+			if dropped != tt.duplicates {
+				t.Errorf("%d packets dropped, want the %d duplicates", dropped, tt.duplicates)
+			}
+		})
+	}
+}
+
+func TestSequenceReorderKeepsUnnumbered(t *testing.T) {
+	r := newSequenceReorderBuffer(seqOfPayload, time.Second, 8, func(*gopacket.Packet) {})
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: testClientIP, DstIP: testServerIP}
+	data, err := serializeLayers(ip, gopacket.Payload("short"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+	if r.push(&packet, time.Now()) {
+		t.Error("packet without sequence number held")
+	}
+}
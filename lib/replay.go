@@ -0,0 +1,78 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// OpenReplay opens a RawIPConn fed from the capture file at path instead of a live interface. It receives the packets
+// of the protocol sent to ip, like a listener on ip would, in file order and as fast as they are read.
+// Once the file is exhausted, Read returns io.EOF, which live conns never do. Writes to a replay conn fail.
+func OpenReplay(path string, ip net.IP, protocol layers.IPProtocol) (*RawIPConn, error) {
+	ip, err := checkLocal(ip, false)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open capture file %s: %w", path, err)
+	}
+
+	config := &RawIPConnConfig{localIP: ip, protocol: protocol, replay: true}
+	params := &RawIPConnParams{
+		isServer:  true,
+		key:       newFlowKey(protocol, ip, nil).String(),
+		pcapIface: &net.Interface{Name: path},
+		handle:    handle,
+	}
+	conn, err := NewRawIPConn(params, config)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	go conn.replay(handle)
+	return conn, nil
+}
+
+// replay feeds the packets of the capture file read by handle to the conn until the end of the file or Close
+func (conn *RawIPConn) replay(handle *pcap.Handle) {
+	defer handle.Close()
+
+	key := conn.flowKey()
+	decoder := handle.LinkType()
+	for {
+		data, ci, err := handle.ReadPacketData()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("Raw IPConn %s: error reading capture file: %v", conn.getKey(), err)
+			}
+			conn.replayEOF.Store(true)
+			conn.closeInput()
+			return
+		}
+
+		packet := gopacket.NewPacket(data, decoder, gopacket.Default)
+		packet.Metadata().CaptureInfo = ci
+		ipLayer, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if !ok || ipLayer.Protocol != key.protocol || toAddr(ipLayer.DstIP) != key.localIP {
+			continue
+		}
+
+		conn.enqueue(&packet)
+		if conn.isClosed.Load() {
+			return
+		}
+	}
+}
@@ -0,0 +1,357 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+
+	"github.com/google/gopacket/layers"
+)
+
+// findOnLinkInterface finds the interface on which ip is on-link, i.e. inside the subnet of one of its IPv4 addresses,
+// and returns it with that address. If srcIP is given, only the interface owning srcIP is considered and srcIP is returned.
+func findOnLinkInterface(ip, srcIP net.IP) (*net.Interface, net.IP, error) {
+	if srcIP != nil {
+		iface, err := findInterfaceByIP(srcIP)
+		if err != nil {
+			return nil, nil, fmt.Errorf("provided srcIP %v is not a local IP: %w", srcIP, errors.Join(ErrNotLocalIP, err))
+		}
+		if onLinkAddr(iface, ip) == nil {
+			return nil, nil, fmt.Errorf("%v is not on-link for interface %s: %w", ip, iface.Name, ErrNextHopNotOnLink)
+		}
+		return iface, srcIP, nil
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range interfaces {
+		if addr := onLinkAddr(&interfaces[i], ip); addr != nil {
+			return &interfaces[i], addr, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("%v is not on-link for any interface: %w", ip, ErrNextHopNotOnLink)
+}
+
+// onLinkAddr returns the IPv4 address of iface whose subnet contains ip, or nil if ip is not on-link for iface
+func onLinkAddr(iface *net.Interface, ip net.IP) net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && ipNet.Contains(ip) {
+			return ipNet.IP.To4()
+		}
+	}
+	return nil
+}
+
+// linkLocalNet is the IPv4 link-local prefix (RFC 3927)
+var linkLocalNet = &net.IPNet{IP: net.IPv4(169, 254, 0, 0).To4(), Mask: net.CIDRMask(16, 32)}
+
+// isLinkLocalIPv4 tells if ip is an IPv4 link-local address, which is always on-link and never forwarded
+func isLinkLocalIPv4(ip net.IP) bool {
+	return ip.To4() != nil && linkLocalNet.Contains(ip)
+}
+
+// linkLocalInterface picks the interface and source address to reach the link-local dstIP.
+// The interface is the one owning srcIP, the named one, or the only one carrying a link-local address; it is an error
+// if several do. The source address prefers the interface's own link-local address over its regular one.
+func linkLocalInterface(dstIP, srcIP net.IP, ifaceName string) (*net.Interface, net.IP, error) {
+	var (
+		iface *net.Interface
+		err   error
+	)
+
+	switch {
+	case srcIP != nil:
+		iface, err = findInterfaceByIP(srcIP)
+		if err != nil {
+			return nil, nil, fmt.Errorf("provided srcIP %v is not a local IP: %w", srcIP, errors.Join(ErrNotLocalIP, err))
+		}
+		return iface, srcIP, nil
+	case ifaceName != "":
+		iface, err = net.InterfaceByName(ifaceName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("interface %s: %w", ifaceName, errors.Join(ErrInterfaceNotFound, err))
+		}
+	default:
+		interfaces, err := net.Interfaces()
+		if err != nil {
+			return nil, nil, err
+		}
+		var candidates []string
+		for i := range interfaces {
+			if interfaces[i].Flags&net.FlagUp == 0 || interfaces[i].Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			if onLinkAddr(&interfaces[i], dstIP) != nil {
+				candidates = append(candidates, interfaces[i].Name)
+				iface = &interfaces[i]
+			}
+		}
+		if len(candidates) > 1 {
+			return nil, nil, fmt.Errorf("link-local %v is reachable through interfaces %v: %w", dstIP, candidates, ErrAmbiguousIface)
+		}
+		if iface == nil {
+			// no interface carries a link-local address. Talk to the device from the regular address of the routed interface
+			_, iface, _, err = GetLocalIP(dstIP)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if srcIP = preferredAddr(iface, dstIP); srcIP == nil {
+		return nil, nil, fmt.Errorf("interface %s has no IPv4 address: %w", iface.Name, ErrNotLocalIP)
+	}
+	return iface, srcIP, nil
+}
+
+// preferredAddr returns the IPv4 address of iface on-link for dstIP, else its first regular IPv4 address,
+// else its first link-local one
+func preferredAddr(iface *net.Interface, dstIP net.IP) net.IP {
+	if addr := onLinkAddr(iface, dstIP); addr != nil {
+		return addr
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	var fallback net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		if !isLinkLocalIPv4(ipNet.IP) {
+			return ipNet.IP.To4()
+		}
+		if fallback == nil {
+			fallback = ipNet.IP.To4()
+		}
+	}
+	return fallback
+}
+
+// routeLookup returns the candidate routes to dstIP, as routeCandidates does from the routing table of the host
+type routeLookup func(dstIP net.IP) ([]RouteCandidate, error)
+
+// defaultGateway returns the gateway of the default route of iface with the lowest metric, or nil if it has none
+func defaultGateway(iface *net.Interface, lookup routeLookup) net.IP {
+	candidates, err := lookup(net.IPv4zero)
+	if err != nil {
+		return nil
+	}
+
+	var best *RouteCandidate
+	for i := range candidates {
+		c := &candidates[i]
+		if c.PrefixLen != 0 || c.Gateway == nil || c.Interface == nil || c.Interface.Index != iface.Index {
+			continue
+		}
+		if best == nil || c.Metric < best.Metric {
+			best = c
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.Gateway
+}
+
+// gatewayVia returns the gateway towards dstIP for traffic leaving through iface: the one of the most specific route
+// to dstIP on iface, else the default gateway of iface. It is nil if iface has no gateway towards dstIP
+func gatewayVia(iface *net.Interface, dstIP net.IP, lookup routeLookup) net.IP {
+	candidates, err := lookup(dstIP)
+	if err == nil {
+		var onIface []RouteCandidate
+		for _, c := range candidates {
+			if c.Interface != nil && c.Interface.Index == iface.Index {
+				onIface = append(onIface, c)
+			}
+		}
+		if len(onIface) > 0 {
+			if route, err := DefaultRouteSelector(dstIP, onIface); err == nil && route.Gateway != nil {
+				return route.Gateway
+			}
+		}
+	}
+	return defaultGateway(iface, lookup)
+}
+
+// offLinkGateway returns the gateway for traffic to dstIP from an address of iface in subnet, chosen by the caller
+// rather than by a route: nil if dstIP is on-link, else the gatewayVia iface
+func offLinkGateway(iface *net.Interface, subnet *net.IPNet, dstIP net.IP, lookup routeLookup) net.IP {
+	if isOnLink(subnet, dstIP) {
+		return nil
+	}
+	return gatewayVia(iface, dstIP, lookup)
+}
+
+// nextHopFor decides the next hop towards dstIP leaving through the interface subnet. Destinations inside the subnet,
+// broadcast, multicast and link-local ones are on-link and are the next hop themselves. Anything else goes through
+// gatewayIP, and without a gateway there is no route to it.
+func nextHopFor(subnet *net.IPNet, dstIP, gatewayIP net.IP) (net.IP, error) {
+	if isOnLink(subnet, dstIP) {
+		return dstIP, nil
+	}
+	if gatewayIP == nil || gatewayIP.IsUnspecified() {
+		return nil, fmt.Errorf("%v is off-link for subnet %v and there is no gateway: %w", dstIP, subnet, ErrNoRouteToHost)
+	}
+	return gatewayIP, nil
+}
+
+// isOnLink tells if ip can be reached directly from an interface in subnet
+func isOnLink(subnet *net.IPNet, ip net.IP) bool {
+	return ip.Equal(net.IPv4bcast) || ip.IsMulticast() || isLinkLocalIPv4(ip) || (subnet != nil && subnet.Contains(ip))
+}
+
+// ifaceSubnet returns the subnet of the address ip of iface, or nil if iface does not own ip
+func ifaceSubnet(iface *net.Interface, ip net.IP) *net.IPNet {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask}
+		}
+	}
+	return nil
+}
+
+// groupMAC returns the MAC address that a broadcast or multicast ip maps to on iface, or nil for a unicast ip
+func groupMAC(iface *net.Interface, ip net.IP) net.HardwareAddr {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		if ip.IsMulticast() {
+			return ipv6MulticastMAC(ip) // RFC 2464: 33:33 followed by the low 32 bits of the group address
+		}
+		return nil
+	}
+	if ip4.IsMulticast() {
+		// RFC 1112: 01:00:5e followed by the low 23 bits of the group address
+		return net.HardwareAddr{0x01, 0x00, 0x5e, ip4[1] & 0x7f, ip4[2], ip4[3]}
+	}
+	if ip4.Equal(net.IPv4bcast) {
+		return layers.EthernetBroadcast
+	}
+
+	// subnet-directed broadcast
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil || len(ipNet.Mask) != net.IPv4len {
+			continue
+		}
+		if ones, _ := ipNet.Mask.Size(); ones >= 31 {
+			continue // point-to-point subnets have no broadcast address (RFC 3021)
+		}
+		network := ipNet.IP.To4().Mask(ipNet.Mask)
+		broadcast := make(net.IP, net.IPv4len)
+		for i := range broadcast {
+			broadcast[i] = network[i] | ^ipNet.Mask[i]
+		}
+		if ip4.Equal(broadcast) {
+			return layers.EthernetBroadcast
+		}
+	}
+	return nil
+}
+
+// RouteCandidate is a combination of egress interface, source address and gateway able to reach a destination
+type RouteCandidate struct {
+	Interface *net.Interface // egress interface
+	SrcIP     net.IP         // local address used as source
+	Gateway   net.IP         // nil if the destination is on-link
+	Metric    int            // metric or priority of the route as reported by the platform, lower is preferred
+	PrefixLen int            // prefix length of the matching route, 0 for a default route
+}
+
+// RouteSelector picks the route to dst out of the candidates found in the routing table, of which there is at least one
+type RouteSelector func(dst net.IP, candidates []RouteCandidate) (RouteCandidate, error)
+
+// GetLocalIP finds the local IP that can route to the given destination IP, with its interface and the gateway
+// to go through, nil if the destination is on-link
+func GetLocalIP(dstIP net.IP) (net.IP, *net.Interface, net.IP, error) {
+	r, err := LookupRoute(dstIP)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return r.SrcIP, r.Interface, r.Gateway, nil
+}
+
+// LookupRoute returns the route the OS uses to reach dstIP, as chosen by DefaultRouteSelector
+func LookupRoute(dstIP net.IP) (RouteCandidate, error) {
+	return selectRoute(dstIP, DefaultRouteSelector, false)
+}
+
+// selectRoute lets selector pick the route to dstIP among the candidates of the routing table. With logLosers, the
+// candidates as specific as the chosen route which lost to it are logged
+func selectRoute(dstIP net.IP, selector RouteSelector, logLosers bool) (RouteCandidate, error) {
+	candidates, err := routeCandidates(dstIP)
+	if err != nil {
+		return RouteCandidate{}, err
+	}
+	route, err := selector(dstIP, candidates)
+	if err != nil {
+		return RouteCandidate{}, err
+	}
+	if route.Interface == nil || route.SrcIP == nil {
+		return RouteCandidate{}, fmt.Errorf("route to %v has no interface or source IP: %w", dstIP, ErrNoRouteToHost)
+	}
+	if logLosers {
+		for _, c := range candidates {
+			if c.PrefixLen == route.PrefixLen && !sameRoute(c, route) {
+				log.Printf("route to %v: not using /%d via %s gateway %v metric %d", dstIP, c.PrefixLen, c.Interface.Name, c.Gateway, c.Metric)
+			}
+		}
+	}
+	return route, nil
+}
+
+// sameRoute tells if a and b are the same candidate
+func sameRoute(a, b RouteCandidate) bool {
+	return a.Interface != nil && b.Interface != nil && a.Interface.Index == b.Interface.Index &&
+		a.SrcIP.Equal(b.SrcIP) && a.Gateway.Equal(b.Gateway) && a.Metric == b.Metric && a.PrefixLen == b.PrefixLen
+}
+
+// DefaultRouteSelector picks the route the OS would use: the longest prefix, then the lowest metric. Ties are broken
+// by interface index then gateway, so that the choice does not depend on the routing table order.
+// candidates is left as is.
+func DefaultRouteSelector(dst net.IP, candidates []RouteCandidate) (RouteCandidate, error) {
+	if len(candidates) == 0 {
+		return RouteCandidate{}, fmt.Errorf("no suitable route found for IP %v: %w", dst, ErrNoRouteToHost)
+	}
+
+	sorted := append([]RouteCandidate(nil), candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.PrefixLen != b.PrefixLen {
+			return a.PrefixLen > b.PrefixLen
+		}
+		if a.Metric != b.Metric {
+			return a.Metric < b.Metric
+		}
+		if a.Interface.Index != b.Interface.Index {
+			return a.Interface.Index < b.Interface.Index
+		}
+		return bytes.Compare(a.Gateway.To16(), b.Gateway.To16()) < 0
+	})
+	return sorted[0], nil
+}
@@ -0,0 +1,210 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func mustCIDR(tb testing.TB, s string) *net.IPNet {
+	tb.Helper()
+
+	ip, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if ip.To4() != nil {
+		subnet.IP = subnet.IP.To4()
+	}
+	return subnet
+}
+
+func TestIsOnLink(t *testing.T) {
+	subnet := mustCIDR(t, "192.0.2.0/24")
+	tests := []struct {
+		name   string
+		subnet *net.IPNet
+		ip     net.IP
+		want   bool
+	}{
+		{"inside the subnet", subnet, net.IPv4(192, 0, 2, 77), true},
+		{"network address", subnet, net.IPv4(192, 0, 2, 0), true},
+		{"subnet broadcast", subnet, net.IPv4(192, 0, 2, 255), true},
+		{"16 bytes form", subnet, net.ParseIP("::ffff:192.0.2.9"), true},
+		{"outside the subnet", subnet, net.IPv4(198, 51, 100, 1), false},
+		{"next subnet", subnet, net.IPv4(192, 0, 3, 1), false},
+		{"limited broadcast", subnet, net.IPv4bcast, true},
+		{"multicast", subnet, net.IPv4(224, 0, 0, 251), true},
+		{"link-local", subnet, net.IPv4(169, 254, 10, 1), true},
+		{"no subnet, unicast", nil, net.IPv4(192, 0, 2, 77), false},
+		{"no subnet, multicast", nil, net.IPv4(239, 1, 2, 3), true},
+		{"point-to-point /31", mustCIDR(t, "10.0.0.0/31"), net.IPv4(10, 0, 0, 1), true},
+		{"host route /32", mustCIDR(t, "10.0.0.5/32"), net.IPv4(10, 0, 0, 6), false},
+	}
+	for _, tt := range tests {
+		if got := isOnLink(tt.subnet, tt.ip); got != tt.want {
+			t.Errorf("%s: isOnLink(%v, %v) = %v, want %v", tt.name, tt.subnet, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestNextHopFor(t *testing.T) {
+	subnet := mustCIDR(t, "192.0.2.0/24")
+	gateway := net.IPv4(192, 0, 2, 1)
+	tests := []struct {
+		name    string
+		subnet  *net.IPNet
+		dst     net.IP
+		gateway net.IP
+		want    net.IP
+		wantErr error
+	}{
+		{"on-link goes direct", subnet, net.IPv4(192, 0, 2, 50), gateway, net.IPv4(192, 0, 2, 50), nil},
+		{"on-link without gateway", subnet, net.IPv4(192, 0, 2, 50), nil, net.IPv4(192, 0, 2, 50), nil},
+		{"off-link goes through the gateway", subnet, net.IPv4(198, 51, 100, 1), gateway, gateway, nil},
+		{"off-link without gateway", subnet, net.IPv4(198, 51, 100, 1), nil, nil, ErrNoRouteToHost},
+		{"off-link with unspecified gateway", subnet, net.IPv4(198, 51, 100, 1), net.IPv4zero, nil, ErrNoRouteToHost},
+		{"multicast is never routed", subnet, net.IPv4(239, 1, 2, 3), gateway, net.IPv4(239, 1, 2, 3), nil},
+		{"broadcast is never routed", subnet, net.IPv4bcast, gateway, net.IPv4bcast, nil},
+		{"link-local is never routed", subnet, net.IPv4(169, 254, 1, 1), gateway, net.IPv4(169, 254, 1, 1), nil},
+		{"unknown subnet goes through the gateway", nil, net.IPv4(192, 0, 2, 50), gateway, gateway, nil},
+	}
+	for _, tt := range tests {
+		got, err := nextHopFor(tt.subnet, tt.dst, tt.gateway)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: error %v, want %v", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("%s: nextHopFor = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestDefaultRouteSelectorTieBreak(t *testing.T) {
+	eth0 := &net.Interface{Index: 2, Name: "eth0"}
+	eth1 := &net.Interface{Index: 3, Name: "eth1"}
+	src := net.IPv4(192, 0, 2, 10)
+	candidates := []RouteCandidate{
+		{Interface: eth1, SrcIP: src, Gateway: net.IPv4(192, 0, 2, 1), Metric: 10, PrefixLen: 0},
+		{Interface: eth1, SrcIP: src, Gateway: net.IPv4(192, 0, 2, 2), Metric: 10, PrefixLen: 0},
+		{Interface: eth0, SrcIP: src, Gateway: net.IPv4(192, 0, 2, 9), Metric: 10, PrefixLen: 0},
+		{Interface: eth0, SrcIP: src, Gateway: net.IPv4(192, 0, 2, 3), Metric: 10, PrefixLen: 0},
+		{Interface: eth0, SrcIP: src, Gateway: net.IPv4(192, 0, 2, 4), Metric: 5, PrefixLen: 0},
+		{Interface: eth1, SrcIP: src, Gateway: net.IPv4(192, 0, 2, 5), Metric: 100, PrefixLen: 24},
+	}
+	// the longest prefix wins whatever its metric
+	want := candidates[5]
+
+	// every order of the candidates picks the same route, and leaves the slice of the caller as it was
+	var permute func(k int)
+	permute = func(k int) {
+		if k == len(candidates) {
+			before := append([]RouteCandidate(nil), candidates...)
+			got, err := DefaultRouteSelector(net.IPv4(198, 51, 100, 1), candidates)
+			if err != nil || !sameRoute(got, want) {
+				t.Fatalf("order %v: picked %v via %v, %v, want %v", candidates, got.Interface.Name, got.Gateway, err, want.Gateway)
+			}
+			for i := range before {
+				if !sameRoute(before[i], candidates[i]) {
+					t.Fatalf("candidate %d changed from %v to %v", i, before[i], candidates[i])
+				}
+			}
+			return
+		}
+		for i := k; i < len(candidates); i++ {
+			candidates[k], candidates[i] = candidates[i], candidates[k]
+			permute(k + 1)
+			candidates[k], candidates[i] = candidates[i], candidates[k]
+		}
+	}
+	permute(0)
+
+	// among the default routes, the lowest metric wins, then the lowest interface index, then the lowest gateway
+	defaults := candidates[:5]
+	tieBreaks := []struct {
+		drop    int // candidate removed before selecting
+		gateway net.IP
+	}{
+		{-1, net.IPv4(192, 0, 2, 4)},
+		{4, net.IPv4(192, 0, 2, 3)},
+	}
+	for _, tt := range tieBreaks {
+		var pool []RouteCandidate
+		for i, c := range defaults {
+			if i != tt.drop {
+				pool = append(pool, c)
+			}
+		}
+		for n := 0; n < len(pool); n++ {
+			rotated := append(append([]RouteCandidate(nil), pool[n:]...), pool[:n]...)
+			got, err := DefaultRouteSelector(net.IPv4(198, 51, 100, 1), rotated)
+			if err != nil || !got.Gateway.Equal(tt.gateway) {
+				t.Errorf("without candidate %d, rotation %d: picked gateway %v, %v, want %v", tt.drop, n, got.Gateway, err, tt.gateway)
+			}
+		}
+	}
+
+	if _, err := DefaultRouteSelector(net.IPv4(198, 51, 100, 1), nil); !errors.Is(err, ErrNoRouteToHost) {
+		t.Errorf("no candidates: %v, want ErrNoRouteToHost", err)
+	}
+}
+
+// TestExplicitSourceOffSubnet is the regression test of dials given a srcIP to a destination outside its subnet,
+// which used to fail with ErrNoRouteToHost instead of going through a gateway of the interface owning srcIP
+func TestExplicitSourceOffSubnet(t *testing.T) {
+	eth0 := &net.Interface{Index: 2, Name: "eth0"}
+	eth1 := &net.Interface{Index: 3, Name: "eth1"}
+	subnet := mustCIDR(t, "192.0.2.0/24") // of the srcIP 192.0.2.10 on eth0
+	src := net.IPv4(192, 0, 2, 10)
+	offSubnet := net.IPv4(198, 51, 100, 1)
+
+	defaultEth0 := RouteCandidate{Interface: eth0, SrcIP: src, Gateway: net.IPv4(192, 0, 2, 1), Metric: 100}
+	defaultEth1 := RouteCandidate{Interface: eth1, SrcIP: net.IPv4(203, 0, 113, 10), Gateway: net.IPv4(203, 0, 113, 1), Metric: 10}
+	specificEth0 := RouteCandidate{Interface: eth0, SrcIP: src, Gateway: net.IPv4(192, 0, 2, 254), Metric: 100, PrefixLen: 24}
+
+	// table returns a lookup answering the defaults for the default route and routes for any other destination
+	table := func(defaults []RouteCandidate, routes ...RouteCandidate) routeLookup {
+		return func(dstIP net.IP) ([]RouteCandidate, error) {
+			if dstIP.Equal(net.IPv4zero) {
+				return defaults, nil
+			}
+			return append(routes, defaults...), nil
+		}
+	}
+	failing := func(net.IP) ([]RouteCandidate, error) { return nil, fmt.Errorf("no routing table") }
+
+	tests := []struct {
+		name    string
+		dst     net.IP
+		lookup  routeLookup
+		want    net.IP
+		wantErr error
+	}{
+		{"on-link goes direct", net.IPv4(192, 0, 2, 50), table([]RouteCandidate{defaultEth0}), net.IPv4(192, 0, 2, 50), nil},
+		{"off-subnet through the default gateway", offSubnet, table([]RouteCandidate{defaultEth0}), defaultEth0.Gateway, nil},
+		{"off-subnet through a more specific route", offSubnet, table([]RouteCandidate{defaultEth0}, specificEth0), specificEth0.Gateway, nil},
+		{"a better route on another interface is ignored", offSubnet, table([]RouteCandidate{defaultEth0, defaultEth1}), defaultEth0.Gateway, nil},
+		{"no gateway on the interface of srcIP", offSubnet, table([]RouteCandidate{defaultEth1}), nil, ErrNoRouteToHost},
+		{"no routing table", offSubnet, failing, nil, ErrNoRouteToHost},
+		{"multicast never needs a gateway", net.IPv4(239, 1, 2, 3), failing, net.IPv4(239, 1, 2, 3), nil},
+	}
+	for _, tt := range tests {
+		got, err := nextHopFor(subnet, tt.dst, offLinkGateway(eth0, subnet, tt.dst, tt.lookup))
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: next hop %v, %v, want %v", tt.name, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("%s: next hop %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+const (
+	defaultSnaplen  = 65536
+	maxSnaplen      = 262144 // largest snapshot length libpcap accepts
+	maxLinkOverhead = 22     // Ethernet header and two 802.1Q tags, on top of the MTU
+
+	defaultAdaptiveBufferSize = 2 << 20 // first kernel buffer size of adaptive sessions without BufferSize
+	defaultDropSampleInterval = 5 * time.Second
+)
+
+// SessionConfig holds the settings of the pcapSession opened on an interface.
+// The zero value of every field selects its default.
+type SessionConfig struct {
+	ARPRequestTimeout  time.Duration // 0 means the arpRequestTimeout given to NewRawSocketCore
+	ARPRateLimit       int           // ARP requests sent per second at most. 0 means 50, negative means unlimited
+	ARPNegativeTTL     time.Duration // how long a failed ARP resolution is not retried. 0 means 3s, negative means retry at once
+	MemoryBudget       int64         // receive memory budget in bytes. 0 means unlimited
+	DispatchWorkers    int           // goroutines decoding and dispatching inbound packets. 0 means 4
+	CaptureWorkers     int           // pcap handles capturing on the interface. 0 means 1
+	IdleTimeout        time.Duration // close the session after having no conns for this long. 0 closes it with its last conn
+	KeepIdle           bool          // keep the session open without conns, see WithKeepIdleSessions
+	Snaplen            int           // bytes captured per packet. 0 means 65536, or the MTU and link header if larger
+	NonPromiscuous     bool          // do not put the interface into promiscuous mode
+	BufferSize         int           // pcap kernel buffer size in bytes. 0 means the platform default, or 2 MiB with MaxBufferSize
+	MaxBufferSize      int           // ceiling up to which the kernel buffer grows while the kernel drops packets. 0 disables growing
+	DropSampleInterval time.Duration // how often the kernel drops are sampled with MaxBufferSize. 0 means 5s
+	ImmediateMode      bool          // deliver packets as soon as they arrive instead of in batches
+	TimestampSource    string        // pcap timestamp source name, e.g. "adapter". "" means the platform default
+	PinReadLoop        bool          // pin the capture loops to the CPUs from ReadCPU on, see WithReadCPUAffinity
+	ReadCPU            int           // CPU of the first capture loop when PinReadLoop is set
+}
+
+// validate checks the values of cfg, at configure time rather than when the session opens
+func (cfg SessionConfig) validate() error {
+	switch {
+	case cfg.Snaplen < 0 || cfg.Snaplen > maxSnaplen:
+		return fmt.Errorf("snaplen %d not within 0..%d: %w", cfg.Snaplen, maxSnaplen, ErrInvalidSessionConfig)
+	case cfg.ARPRequestTimeout < 0:
+		return fmt.Errorf("negative ARP request timeout %v: %w", cfg.ARPRequestTimeout, ErrInvalidSessionConfig)
+	case cfg.IdleTimeout < 0:
+		return fmt.Errorf("negative idle timeout %v: %w", cfg.IdleTimeout, ErrInvalidSessionConfig)
+	case cfg.MemoryBudget < 0:
+		return fmt.Errorf("negative memory budget %d: %w", cfg.MemoryBudget, ErrInvalidSessionConfig)
+	case cfg.DispatchWorkers < 0 || cfg.CaptureWorkers < 0:
+		return fmt.Errorf("negative worker count: %w", ErrInvalidSessionConfig)
+	case cfg.BufferSize < 0 || cfg.MaxBufferSize < 0:
+		return fmt.Errorf("negative buffer size: %w", ErrInvalidSessionConfig)
+	case cfg.MaxBufferSize > 0 && cfg.BufferSize > cfg.MaxBufferSize:
+		return fmt.Errorf("buffer size %d over the maximum %d: %w", cfg.BufferSize, cfg.MaxBufferSize, ErrInvalidSessionConfig)
+	case cfg.DropSampleInterval < 0:
+		return fmt.Errorf("negative drop sample interval %v: %w", cfg.DropSampleInterval, ErrInvalidSessionConfig)
+	case cfg.PinReadLoop && (cfg.ReadCPU < 0 || cfg.ReadCPU >= runtime.NumCPU()):
+		return fmt.Errorf("read CPU %d not within 0..%d: %w", cfg.ReadCPU, runtime.NumCPU()-1, ErrInvalidSessionConfig)
+	}
+	if cfg.TimestampSource != "" {
+		if _, err := pcap.TimestampSourceFromString(cfg.TimestampSource); err != nil {
+			return fmt.Errorf("timestamp source %q: %w: %v", cfg.TimestampSource, ErrInvalidSessionConfig, err)
+		}
+	}
+	return nil
+}
+
+// sameExceptBudget tells if cfg and other only differ by their memory budget, the one setting a running session can change
+func (cfg SessionConfig) sameExceptBudget(other SessionConfig) bool {
+	cfg.MemoryBudget, other.MemoryBudget = 0, 0
+	return cfg == other
+}
+
+// SessionConfigConflictError is returned when configuring an interface whose pcapSession is already open with
+// settings that cannot be changed anymore
+type SessionConfigConflictError struct {
+	Interface string
+	Current   SessionConfig // configuration of the open session
+}
+
+func (e *SessionConfigConflictError) Error() string {
+	return fmt.Sprintf("rawsocket: pcap session on %s is already open with a different configuration", e.Interface)
+}
+
+// newPcapSessionConfig resolves cfg into the settings of a new pcapSession on an interface of the given MTU
+func newPcapSessionConfig(cfg SessionConfig, arpRequestTimeout time.Duration, mtu int) *pcapSessionConfig {
+	conf := &pcapSessionConfig{
+		public:             cfg,
+		arpRequestTimeout:  cfg.ARPRequestTimeout,
+		arpRateLimit:       cfg.ARPRateLimit,
+		arpNegativeTTL:     cfg.ARPNegativeTTL,
+		memoryBudget:       cfg.MemoryBudget,
+		dispatchWorkers:    cfg.DispatchWorkers,
+		captureWorkers:     cfg.CaptureWorkers,
+		idleTimeout:        cfg.IdleTimeout,
+		keepIdle:           cfg.KeepIdle,
+		snaplen:            cfg.Snaplen,
+		promiscuous:        !cfg.NonPromiscuous,
+		bufferSize:         cfg.BufferSize,
+		maxBufferSize:      cfg.MaxBufferSize,
+		dropSampleInterval: cfg.DropSampleInterval,
+		immediateMode:      cfg.ImmediateMode,
+		timestampSource:    cfg.TimestampSource,
+		readCPU:            -1,
+	}
+	if cfg.PinReadLoop {
+		conf.readCPU = cfg.ReadCPU
+	}
+	if conf.arpRequestTimeout == 0 {
+		conf.arpRequestTimeout = arpRequestTimeout
+	}
+	switch {
+	case conf.arpRateLimit == 0:
+		conf.arpRateLimit = defaultARPRateLimit
+	case conf.arpRateLimit < 0:
+		conf.arpRateLimit = 0
+	}
+	switch {
+	case conf.arpNegativeTTL == 0:
+		conf.arpNegativeTTL = defaultARPNegativeTTL
+	case conf.arpNegativeTTL < 0:
+		conf.arpNegativeTTL = 0
+	}
+	if conf.dispatchWorkers == 0 {
+		conf.dispatchWorkers = defaultDispatchWorkers
+	}
+	if conf.captureWorkers == 0 {
+		conf.captureWorkers = 1
+	}
+	if conf.maxBufferSize > 0 {
+		if conf.bufferSize == 0 {
+			conf.bufferSize = min(defaultAdaptiveBufferSize, conf.maxBufferSize)
+		}
+		if conf.dropSampleInterval == 0 {
+			conf.dropSampleInterval = defaultDropSampleInterval
+		}
+	}
+	if conf.snaplen == 0 {
+		// offloads may hand frames larger than the MTU to the capture, so the default never gets below 65536
+		conf.snaplen = min(max(defaultSnaplen, mtu+maxLinkOverhead), maxSnaplen)
+	}
+	return conf
+}
@@ -0,0 +1,38 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"sync"
+)
+
+// sessionMap holds the pcapSessions of a core keyed by interface name. Sessions are created rarely but looked up on
+// every dial and listen, so lookups are lock-free and only creating or removing a session takes createMu
+type sessionMap struct {
+	sessions sync.Map   // interface name -> *pcapSession
+	createMu sync.Mutex // serializes the creation and removal of sessions
+}
+
+func newSessionMap() *sessionMap {
+	return &sessionMap{}
+}
+
+// get returns the session of the named interface
+func (m *sessionMap) get(ifaceName string) (*pcapSession, bool) {
+	v, exists := m.sessions.Load(ifaceName)
+	if !exists {
+		return nil, false
+	}
+	return v.(*pcapSession), true
+}
+
+// all returns every session
+func (m *sessionMap) all() []*pcapSession {
+	var sessions []*pcapSession
+	m.sessions.Range(func(_, v any) bool {
+		sessions = append(sessions, v.(*pcapSession))
+		return true
+	})
+	return sessions
+}
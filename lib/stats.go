@@ -0,0 +1,134 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/google/gopacket/layers"
+)
+
+// SessionStats is a snapshot of the statistics of a pcapSession
+type SessionStats struct {
+	Interface       string
+	MemoryBudget    int64  // 0 means unlimited
+	MemoryInUse     int64  // bytes currently held in the receive queues of the session's conns
+	MemoryHighWater int64  // highest value MemoryInUse has reached
+	CaptureWorkers  int    // number of capture loops actually running
+	BufferSize      int    // kernel buffer size of the capture handles. 0 means the platform default
+	CaptureRestarts uint64 // times the capture handles were reopened, e.g. to grow the kernel buffer
+	PcapReceived    int    // pcap counters, summed over all capture handles
+	PcapDropped     int
+	PcapIfDropped   int
+	DecodeErrors    uint64 // captured frames which could not be fully decoded
+	WriteErrors     uint64 // frames the pcap handle failed to send, after the writes queuing them had returned
+	ARPRateLimited  uint64 // ARP resolutions failed with ErrARPRateLimited
+	ARPNegativeHits uint64 // ARP resolutions failed without a request, the address having not answered recently
+}
+
+func (s SessionStats) String() string {
+	return fmt.Sprintf("session %s: captures=%d, buffer=%d, mem=%d/%d (high %d), pcap recv=%d drop=%d ifdrop=%d, decode-errors=%d, write-errors=%d",
+		s.Interface, s.CaptureWorkers, s.BufferSize, s.MemoryInUse, s.MemoryBudget, s.MemoryHighWater,
+		s.PcapReceived, s.PcapDropped, s.PcapIfDropped, s.DecodeErrors, s.WriteErrors)
+}
+
+// ConnStats is a snapshot of the statistics of a RawIPConn
+type ConnStats struct {
+	BudgetDropped       uint64 // inbound packets dropped because the session memory budget was exceeded
+	DuplicateSuppressed uint64 // inbound packets dropped as repeats by WithDuplicateSuppression
+	InboundDropped      uint64 // inbound packets dropped because the inbound queue was full, see WithDropWhenFull
+	SourceFiltered      uint64 // inbound packets dropped because their source is not in the allowlist of the conn
+	Truncated           uint64 // inbound packets cut by the snaplen of the capture, see PacketMeta.Truncated
+	Queued              int    // inbound packets waiting to be read
+	QueueCapacity       int    // size of the inbound queue, see WithReadBuffer
+	Reordered           uint64 // WithSequenceReorder: packets received after one with a higher sequence number
+	SequenceDuplicates  uint64 // WithSequenceReorder: packets dropped for a sequence number already read or given up
+	SequenceLost        uint64 // WithSequenceReorder: sequence numbers given up, their packets not received within the window
+}
+
+// ProtoStats counts the inbound IPv4 packets of one IP protocol
+type ProtoStats struct {
+	Packets uint64
+	Bytes   uint64 // IP total length, headers included
+}
+
+// protoCounters counts inbound packets per IP protocol. Indexed by protocol number so that counting needs no lock
+type protoCounters [256]struct {
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+}
+
+func (c *protoCounters) add(protocol layers.IPProtocol, n int) {
+	c[protocol].packets.Add(1)
+	c[protocol].bytes.Add(uint64(n))
+}
+
+// snapshot returns the counters of the protocols seen so far
+func (c *protoCounters) snapshot() map[layers.IPProtocol]ProtoStats {
+	stats := make(map[layers.IPProtocol]ProtoStats)
+	for i := range c {
+		if packets := c[i].packets.Load(); packets > 0 {
+			stats[layers.IPProtocol(i)] = ProtoStats{Packets: packets, Bytes: c[i].bytes.Load()}
+		}
+	}
+	return stats
+}
+
+// memAccount tracks the bytes held in receive queues against a budget. The pooled capture and serialize buffers are
+// not accounted: they are shared by all sessions and bounded by the frames in flight, not by the packets queued
+type memAccount struct {
+	budget    atomic.Int64
+	inUse     atomic.Int64
+	highWater atomic.Int64
+}
+
+func newMemAccount(budget int64) *memAccount {
+	m := &memAccount{}
+	m.budget.Store(budget)
+	return m
+}
+
+func (m *memAccount) setBudget(budget int64) {
+	m.budget.Store(budget)
+}
+
+// reserve accounts n more bytes. It returns false without accounting anything if the budget would be exceeded, even
+// by workers reserving concurrently
+func (m *memAccount) reserve(n int64) bool {
+	for {
+		inUse := m.inUse.Load()
+		if budget := m.budget.Load(); budget > 0 && inUse+n > budget {
+			return false
+		}
+		if m.inUse.CompareAndSwap(inUse, inUse+n) {
+			m.raiseHighWater(inUse + n)
+			return true
+		}
+	}
+}
+
+// raiseHighWater makes inUse the high water mark if it is higher
+func (m *memAccount) raiseHighWater(inUse int64) {
+	for {
+		high := m.highWater.Load()
+		if inUse <= high || m.highWater.CompareAndSwap(high, inUse) {
+			return
+		}
+	}
+}
+
+// moveTo hands n reserved bytes over to other, regardless of its budget
+func (m *memAccount) moveTo(other *memAccount, n int64) {
+	if m == other {
+		return
+	}
+	m.inUse.Add(-n)
+	other.raiseHighWater(other.inUse.Add(n))
+}
+
+// release gives back n bytes previously reserved
+func (m *memAccount) release(n int64) {
+	m.inUse.Add(-n)
+}
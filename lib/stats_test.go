@@ -0,0 +1,75 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestMemAccountConcurrentReserve reserves from many goroutines at once, and checks that the budget is never
+// overshot and that exactly as many reservations as fit into it succeed
+func TestMemAccountConcurrentReserve(t *testing.T) {
+	const (
+		budget   = 1000
+		size     = 10
+		workers  = 16
+		attempts = 1000
+	)
+	m := newMemAccount(budget)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	granted := 0
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < attempts; j++ {
+				if m.reserve(size) {
+					mu.Lock()
+					granted++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if granted != budget/size {
+		t.Errorf("%d reservations granted, want the %d fitting into the budget", granted, budget/size)
+	}
+	if got := m.inUse.Load(); got != budget {
+		t.Errorf("%d bytes in use, want %d", got, budget)
+	}
+	if got := m.highWater.Load(); got != budget {
+		t.Errorf("high water mark %d, want %d", got, budget)
+	}
+
+	// reservations released concurrently make room again, up to the budget only
+	wg = sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < attempts; j++ {
+				if m.reserve(size) {
+					m.release(size)
+				}
+				if m.inUse.Load() > budget {
+					t.Error("budget overshot")
+					return
+				}
+			}
+		}()
+	}
+	m.release(budget)
+	wg.Wait()
+	if got := m.inUse.Load(); got != 0 {
+		t.Errorf("%d bytes in use once all is released, want 0", got)
+	}
+	if got := m.highWater.Load(); got > budget {
+		t.Errorf("high water mark %d above the budget %d", got, budget)
+	}
+}
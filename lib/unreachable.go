@@ -0,0 +1,73 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// errorQueueLen is the number of ICMP errors a conn queues on its Errors channel before newer ones are dropped
+const errorQueueLen = 16
+
+// UnreachableError reports an ICMP Destination Unreachable message about a packet written by a conn.
+// It matches the syscall error a kernel socket would report for the same code, e.g. syscall.ECONNREFUSED for
+// protocol and port unreachable, syscall.EHOSTUNREACH for host unreachable and syscall.ENETUNREACH for network unreachable
+type UnreachableError struct {
+	Code     uint8        // ICMP code, one of the layers.ICMPv4CodeXxx of type Destination Unreachable
+	Router   net.IP       // sender of the ICMP message: the destination host itself or a router on the path
+	Original *layers.IPv4 // IPv4 header of the packet the message is about, as quoted in it
+}
+
+func (e *UnreachableError) Error() string {
+	typeCode := layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, e.Code)
+	return fmt.Sprintf("rawsocket: %v reported by %v for %v->%v", typeCode, e.Router, e.Original.SrcIP, e.Original.DstIP)
+}
+
+func (e *UnreachableError) Unwrap() error {
+	switch e.Code {
+	case layers.ICMPv4CodeProtocol, layers.ICMPv4CodePort:
+		return syscall.ECONNREFUSED
+	case layers.ICMPv4CodeNet, layers.ICMPv4CodeNetUnknown, layers.ICMPv4CodeNetAdminProhibited, layers.ICMPv4CodeNetTOS:
+		return syscall.ENETUNREACH
+	case layers.ICMPv4CodeFragmentationNeeded:
+		return syscall.EMSGSIZE
+	default:
+		return syscall.EHOSTUNREACH
+	}
+}
+
+// reportUnreachable hands an ICMP Destination Unreachable message to the dialed conn that sent the quoted packet.
+// It tells if such a conn was found
+func (ps *pcapSession) reportUnreachable(packet *gopacket.Packet, ipv4 *layers.IPv4) bool {
+	icmpLayer := (*packet).Layer(layers.LayerTypeICMPv4)
+	if icmpLayer == nil {
+		return false
+	}
+	icmp := icmpLayer.(*layers.ICMPv4)
+	if icmp.TypeCode.Type() != layers.ICMPv4TypeDestinationUnreachable {
+		return false
+	}
+
+	// the message quotes the IPv4 header and the first 8 bytes of the offending packet
+	original := &layers.IPv4{}
+	if err := original.DecodeFromBytes(icmp.Payload, gopacket.NilDecodeFeedback); err != nil {
+		return false
+	}
+	conn := ps.conns.lookupConnected(original.Protocol, toAddr(original.SrcIP), toAddr(original.DstIP))
+	if conn == nil {
+		return false
+	}
+
+	conn.reportError(&UnreachableError{
+		Code:     icmp.TypeCode.Code(),
+		Router:   ipv4.SrcIP,
+		Original: original,
+	})
+	return true
+}
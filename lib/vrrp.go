@@ -0,0 +1,345 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// VRRPGroup is the multicast group VRRP advertisements are sent to
+var VRRPGroup = net.IPv4(224, 0, 0, 18).To4()
+
+const (
+	vrrpTTL         = 255 // advertisements with another TTL may have been forwarded and are discarded (RFC 5798 7.1)
+	vrrpTypeAdvert  = 1
+	vrrpHeaderLen   = 8
+	vrrpV2AuthLen   = 8 // authentication data trailing VRRPv2 advertisements, always zero here
+	vrrpMaxInterval = 0xfff
+)
+
+// VRRPAdvertisement is a VRRP advertisement, version 2 (RFC 3768) or 3 (RFC 5798), for IPv4
+type VRRPAdvertisement struct {
+	Version   uint8 // 2 or 3
+	VRID      uint8
+	Priority  uint8
+	Interval  time.Duration // advertisement interval: whole seconds for version 2, centiseconds for version 3
+	Addresses []net.IP      // virtual IPv4 addresses
+	SrcIP     net.IP        // sender of a received advertisement
+}
+
+// VRRPVirtualMAC returns the virtual router MAC address 00:00:5e:00:01:{vrid} of an IPv4 virtual router
+func VRRPVirtualMAC(vrid uint8) net.HardwareAddr {
+	return net.HardwareAddr{0x00, 0x00, 0x5e, 0x00, 0x01, vrid}
+}
+
+// Marshal encodes the advertisement as sent by srcIP, checksum included
+func (adv *VRRPAdvertisement) Marshal(srcIP net.IP) ([]byte, error) {
+	if len(adv.Addresses) > 255 {
+		return nil, fmt.Errorf("vrrp: %d addresses, at most 255 fit into an advertisement", len(adv.Addresses))
+	}
+
+	var interval int
+	switch adv.Version {
+	case 2:
+		interval = int(adv.Interval / time.Second)
+		if interval < 1 || interval > 255 {
+			return nil, fmt.Errorf("vrrp: version 2 interval %v not within 1s..255s", adv.Interval)
+		}
+	case 3:
+		interval = int(adv.Interval / (10 * time.Millisecond))
+		if interval < 1 || interval > vrrpMaxInterval {
+			return nil, fmt.Errorf("vrrp: version 3 interval %v not within 10ms..40.95s", adv.Interval)
+		}
+	default:
+		return nil, fmt.Errorf("vrrp: unsupported version %d", adv.Version)
+	}
+
+	size := vrrpHeaderLen + 4*len(adv.Addresses)
+	if adv.Version == 2 {
+		size += vrrpV2AuthLen
+	}
+	b := make([]byte, size)
+	b[0] = adv.Version<<4 | vrrpTypeAdvert
+	b[1] = adv.VRID
+	b[2] = adv.Priority
+	b[3] = uint8(len(adv.Addresses))
+	if adv.Version == 2 {
+		b[4] = 0 // no authentication
+		b[5] = uint8(interval)
+	} else {
+		binary.BigEndian.PutUint16(b[4:6], uint16(interval)) // the 4 reserved bits stay zero
+	}
+	for i, addr := range adv.Addresses {
+		ip4 := addr.To4()
+		if ip4 == nil {
+			return nil, fmt.Errorf("vrrp: %v is not an IPv4 address", addr)
+		}
+		copy(b[vrrpHeaderLen+4*i:], ip4)
+	}
+
+	binary.BigEndian.PutUint16(b[6:8], vrrpChecksum(adv.Version, srcIP, b))
+	return b, nil
+}
+
+// ParseVRRPAdvertisement decodes the VRRP payload of an IPv4 packet sent by srcIP and checks its checksum
+func ParseVRRPAdvertisement(payload []byte, srcIP net.IP) (*VRRPAdvertisement, error) {
+	if len(payload) < vrrpHeaderLen {
+		return nil, fmt.Errorf("vrrp: %d bytes are too short for an advertisement", len(payload))
+	}
+	adv := &VRRPAdvertisement{
+		Version:  payload[0] >> 4,
+		VRID:     payload[1],
+		Priority: payload[2],
+		SrcIP:    srcIP,
+	}
+	if payload[0]&0x0f != vrrpTypeAdvert {
+		return nil, fmt.Errorf("vrrp: unknown packet type %d", payload[0]&0x0f)
+	}
+	if adv.Version != 2 && adv.Version != 3 {
+		return nil, fmt.Errorf("vrrp: unsupported version %d", adv.Version)
+	}
+
+	count := int(payload[3])
+	size := vrrpHeaderLen + 4*count
+	if adv.Version == 2 {
+		size += vrrpV2AuthLen
+	}
+	if len(payload) < size {
+		return nil, fmt.Errorf("vrrp: %d bytes are too short for %d addresses", len(payload), count)
+	}
+	payload = payload[:size]
+	if vrrpChecksum(adv.Version, srcIP, payload) != 0 {
+		return nil, errors.New("vrrp: bad checksum")
+	}
+
+	if adv.Version == 2 {
+		adv.Interval = time.Duration(payload[5]) * time.Second
+	} else {
+		adv.Interval = time.Duration(binary.BigEndian.Uint16(payload[4:6])&vrrpMaxInterval) * 10 * time.Millisecond
+	}
+	for i := 0; i < count; i++ {
+		adv.Addresses = append(adv.Addresses, net.IP(append([]byte(nil), payload[vrrpHeaderLen+4*i:vrrpHeaderLen+4*i+4]...)))
+	}
+	return adv, nil
+}
+
+// vrrpChecksum returns the internet checksum of msg, over an IPv4 pseudo-header for version 3.
+// It is 0 for a message carrying a valid checksum
+func vrrpChecksum(version uint8, srcIP net.IP, msg []byte) uint16 {
+	var sum uint32
+	if version == 3 {
+		sum = PseudoHeaderChecksumIPv4(srcIP, VRRPGroup, layers.IPProtocolVRRP, len(msg))
+	}
+	return FinishChecksum(sum, msg)
+}
+
+// VRRP sends and receives the advertisements of one virtual router on the interface of a local address.
+// It sends periodic advertisements while it is master; the election itself is left to the caller,
+// who tells it about mastership changes with SetMaster.
+type VRRP struct {
+	srcIP  net.IP
+	send   *RawIPConn // to VRRPGroup with TTL 255
+	recv   *RawIPConn // listening on VRRPGroup
+	mu     sync.Mutex
+	adv    VRRPAdvertisement
+	master bool
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewVRRP opens a VRRP speaker sending from srcIP the advertisements described by adv, whose SrcIP is ignored
+func (core *RawSocketCore) NewVRRP(srcIP net.IP, adv VRRPAdvertisement) (*VRRP, error) {
+	srcIP, err := checkLocal(srcIP, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := adv.Marshal(srcIP); err != nil {
+		return nil, err
+	}
+
+	send, err := core.DialIP(layers.IPProtocolVRRP, srcIP, VRRPGroup, WithTTL(vrrpTTL))
+	if err != nil {
+		return nil, fmt.Errorf("vrrp: %w", err)
+	}
+	return core.newVRRP(send, srcIP, adv)
+}
+
+// newVRRP is NewVRRP sending through send, which it takes over, and listening on its interface
+func (core *RawSocketCore) newVRRP(send *RawIPConn, srcIP net.IP, adv VRRPAdvertisement) (*VRRP, error) {
+	recv, err := core.listenGroup(send.params.Load().pcapIface, VRRPGroup, layers.IPProtocolVRRP)
+	if err != nil {
+		send.Close()
+		return nil, fmt.Errorf("vrrp: %w", err)
+	}
+
+	v := &VRRP{
+		srcIP: srcIP,
+		send:  send,
+		recv:  recv,
+		adv:   adv,
+		stop:  make(chan struct{}),
+	}
+	v.wg.Add(1)
+	go v.advertiseLoop()
+	return v, nil
+}
+
+// SetMaster tells the speaker whether it is the master of the virtual router. On becoming master, it sends
+// gratuitous ARP for every virtual address and starts advertising from the virtual router MAC address.
+func (v *VRRP) SetMaster(master bool) error {
+	v.mu.Lock()
+	becameMaster := master && !v.master
+	v.master = master
+	v.mu.Unlock()
+
+	if !becameMaster {
+		return nil
+	}
+	if err := v.sendGratuitousARP(); err != nil {
+		return err
+	}
+	return v.Advertise()
+}
+
+// SetPriority changes the priority carried by the next advertisements
+func (v *VRRP) SetPriority(priority uint8) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.adv.Priority = priority
+}
+
+// Advertise sends one advertisement now. As master, it is sent from the virtual router MAC address
+func (v *VRRP) Advertise() error {
+	v.mu.Lock()
+	adv, master := v.adv, v.master
+	v.mu.Unlock()
+
+	payload, err := adv.Marshal(v.srcIP)
+	if err != nil {
+		return err
+	}
+
+	v.send.mu.Lock()
+	defer v.send.mu.Unlock()
+	out, _, err := v.send.buildPacket(VRRPGroup, payload)
+	if err != nil {
+		return err
+	}
+	out.dstMAC = groupMAC(v.send.params.Load().pcapIface, VRRPGroup)
+	if master {
+		out.srcMAC = VRRPVirtualMAC(adv.VRID)
+	}
+	return v.send.send(out)
+}
+
+// Receive waits for the next advertisement of another router. Advertisements whose TTL is not 255 or whose
+// checksum is wrong are skipped, as are the ones sent by this speaker.
+func (v *VRRP) Receive() (*VRRPAdvertisement, error) {
+	buffer := make([]byte, 1500)
+	for {
+		n, meta, err := v.recv.ReadWithMeta(buffer)
+		if err != nil {
+			if errors.Is(err, ErrClosed) || errors.Is(err, ErrTimeout) {
+				return nil, err
+			}
+			continue
+		}
+		if meta.TTL != vrrpTTL || meta.SrcIP.Equal(v.srcIP) {
+			continue
+		}
+		adv, err := ParseVRRPAdvertisement(buffer[:min(n, len(buffer))], meta.SrcIP)
+		if err != nil {
+			continue
+		}
+		return adv, nil
+	}
+}
+
+// SetReadDeadline sets the deadline of Receive
+func (v *VRRP) SetReadDeadline(t time.Time) error {
+	return v.recv.SetReadDeadline(t)
+}
+
+// Close stops the advertisements and closes the conns of the speaker
+func (v *VRRP) Close() error {
+	close(v.stop)
+	v.wg.Wait()
+
+	v.recv.Close()
+	return v.send.Close()
+}
+
+// advertiseLoop sends an advertisement every interval while the speaker is master
+func (v *VRRP) advertiseLoop() {
+	defer v.wg.Done()
+
+	v.mu.Lock()
+	interval := v.adv.Interval
+	v.mu.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-v.stop:
+			return
+		case <-ticker.C:
+			v.mu.Lock()
+			master := v.master
+			v.mu.Unlock()
+			if !master {
+				continue
+			}
+			if err := v.Advertise(); err != nil && errors.Is(err, ErrClosed) {
+				return
+			}
+		}
+	}
+}
+
+// sendGratuitousARP announces every virtual address with the virtual router MAC address
+func (v *VRRP) sendGratuitousARP() error {
+	v.mu.Lock()
+	adv := v.adv
+	v.mu.Unlock()
+
+	mac := VRRPVirtualMAC(adv.VRID)
+	for _, addr := range adv.Addresses {
+		eth := layers.Ethernet{
+			SrcMAC:       mac,
+			DstMAC:       layers.EthernetBroadcast,
+			EthernetType: layers.EthernetTypeARP,
+		}
+		arp := layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   []byte(mac),
+			SourceProtAddress: []byte(addr.To4()),
+			DstHwAddress:      []byte{0, 0, 0, 0, 0, 0},
+			DstProtAddress:    []byte(addr.To4()),
+		}
+
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, &eth, &arp); err != nil {
+			return err
+		}
+		if err := v.send.send(&outboundPacket{frame: buf.Bytes()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// vrrpCapture holds Ethernet frames of advertisements as keepalived sends them: a VRRPv2 one of VRID 51, a VRRPv3
+// one of VRID 52, the same VRRPv3 one with its checksum damaged, then the VRRPv2 one received with TTL 64
+const vrrpCapture = "testdata/vrrp-keepalived.pcap"
+
+const (
+	vrrpCaptureV2 = iota
+	vrrpCaptureV3
+	vrrpCaptureBadChecksum
+	vrrpCaptureTTL64
+)
+
+// readVRRPCapture returns the frames of vrrpCapture
+func readVRRPCapture(tb testing.TB) [][]byte {
+	tb.Helper()
+
+	f, err := os.Open(vrrpCapture)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var frames [][]byte
+	for {
+		data, _, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		frames = append(frames, data)
+	}
+	if len(frames) != 4 {
+		tb.Fatalf("%s holds %d frames, want 4", vrrpCapture, len(frames))
+	}
+	return frames
+}
+
+func TestParseVRRPCapture(t *testing.T) {
+	frames := readVRRPCapture(t)
+	tests := []struct {
+		name  string
+		frame int
+		want  *VRRPAdvertisement
+		err   string
+	}{
+		{"version 2", vrrpCaptureV2, &VRRPAdvertisement{
+			Version:   2,
+			VRID:      51,
+			Priority:  100,
+			Interval:  time.Second,
+			Addresses: []net.IP{net.IPv4(192, 168, 122, 100).To4()},
+			SrcIP:     net.IPv4(192, 168, 122, 2).To4(),
+		}, ""},
+		{"version 3", vrrpCaptureV3, &VRRPAdvertisement{
+			Version:   3,
+			VRID:      52,
+			Priority:  150,
+			Interval:  time.Second,
+			Addresses: []net.IP{net.IPv4(192, 168, 122, 100).To4(), net.IPv4(192, 168, 122, 101).To4()},
+			SrcIP:     net.IPv4(192, 168, 122, 3).To4(),
+		}, ""},
+		{"bad checksum", vrrpCaptureBadChecksum, nil, "vrrp: bad checksum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := gopacket.NewPacket(frames[tt.frame], layers.LayerTypeEthernet, gopacket.Default)
+			ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			if ip == nil {
+				t.Fatal("no IPv4 layer")
+			}
+			adv, err := ParseVRRPAdvertisement(ip.Payload, ip.SrcIP)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("parsed with error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(adv, tt.want) {
+				t.Errorf("parsed %+v, want %+v", adv, tt.want)
+			}
+			// what keepalived sends is what Marshal sends
+			b, err := adv.Marshal(ip.SrcIP)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, ip.Payload) {
+				t.Errorf("marshalled % x, keepalived sent % x", b, ip.Payload)
+			}
+		})
+	}
+}
+
+// TestVRRPReceiveSkips injects the frames of vrrpCapture, the bad ones first, and checks that Receive returns the
+// advertisements of the good ones only
+func TestVRRPReceiveSkips(t *testing.T) {
+	frames := readVRRPCapture(t)
+	p := newMemPair(t)
+
+	config := p.server.newConnConfig(layers.IPProtocolVRRP, []ConnOption{WithTTL(vrrpTTL)})
+	config.localIP, config.remoteIP, config.nextHopIP = testServerIP, VRRPGroup, VRRPGroup
+	send, err := p.ss.dialIP(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := p.server.newVRRP(send, testServerIP, VRRPAdvertisement{Version: 3, VRID: 52, Priority: 100, Interval: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	for _, i := range []int{vrrpCaptureBadChecksum, vrrpCaptureTTL64, vrrpCaptureV2, vrrpCaptureV3} {
+		if err := p.cs.writeFrame(frames[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v.SetReadDeadline(time.Now().Add(time.Second))
+	for _, want := range []uint8{51, 52} {
+		adv, err := v.Receive()
+		if err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+		if adv.VRID != want {
+			t.Errorf("received the advertisement of VRID %d, want %d", adv.VRID, want)
+		}
+	}
+	v.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if adv, err := v.Receive(); !errors.Is(err, ErrTimeout) {
+		t.Errorf("received %+v, %v after the good advertisements, want ErrTimeout", adv, err)
+	}
+}
@@ -0,0 +1,100 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWriteBufferPackets = 64
+	defaultWriteBufferBytes   = 64 * 1024
+)
+
+// writeBufferConfig are the bounds given to WithWriteBuffer
+type writeBufferConfig struct {
+	maxPackets int
+	maxBytes   int
+	linger     time.Duration
+}
+
+// writeBuffer holds the packets written by a conn created WithWriteBuffer until they are flushed
+type writeBuffer struct {
+	writeBufferConfig
+
+	mu      sync.Mutex
+	packets []*outboundPacket
+	bytes   int
+	timer   *time.Timer // flushes the batch once linger has passed since its first packet. nil while the batch is empty
+
+	flushMu sync.Mutex // keeps concurrent flushes from interleaving their batches
+}
+
+// bufferPacket adds out to the batch of the conn, and flushes the batch if it reached its bounds
+func (conn *RawIPConn) bufferPacket(out *outboundPacket) error {
+	wb := conn.wbuf
+	wb.mu.Lock()
+	if conn.isClosed.Load() {
+		wb.mu.Unlock()
+		return ErrClosed
+	}
+	wb.packets = append(wb.packets, out)
+	wb.bytes += len((*out.packet).Data())
+	full := len(wb.packets) >= wb.maxPackets || wb.bytes >= wb.maxBytes
+	if !full && wb.timer == nil && wb.linger > 0 {
+		wb.timer = time.AfterFunc(wb.linger, func() {
+			if err := conn.Flush(); err != nil {
+				log.Printf("Raw IPConn %s: lingering writes not sent: %v", conn.getKey(), err)
+			}
+		})
+	}
+	wb.mu.Unlock()
+
+	if full {
+		return conn.Flush()
+	}
+	return nil
+}
+
+// Flush hands the packets buffered by a conn created WithWriteBuffer to the pcapSession, in the order they were written.
+// If some of them cannot be sent, e.g. because the write deadline passed while the send queue was full, the error says
+// how many were lost. Flush does nothing for a conn without write buffer.
+func (conn *RawIPConn) Flush() error {
+	wb := conn.wbuf
+	if wb == nil {
+		return nil
+	}
+
+	wb.flushMu.Lock()
+	defer wb.flushMu.Unlock()
+
+	wb.mu.Lock()
+	packets := wb.packets
+	wb.packets, wb.bytes = nil, 0
+	if wb.timer != nil {
+		wb.timer.Stop()
+		wb.timer = nil
+	}
+	wb.mu.Unlock()
+
+	var (
+		firstErr error
+		lost     int
+	)
+	for _, out := range packets {
+		if err := conn.transmit(out); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			lost++
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("%d of %d buffered packets not sent: %w", lost, len(packets), firstErr)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// WriteLayers serializes a layer stack built by the caller, e.g. IPv4, GRE, inner IPv4 and UDP, with lengths and
+// checksums fixed up, and sends it like Write: the conn only adds the link layer header for its next hop.
+// The first layer must be an IPv4 one: IPv6 conns fail with ErrIPv6Unsupported. Its addresses default to the ones of the conn, and must match them unless the
+// conn was created WithLayerAddresses. Its TTL, TOS and ID, when left 0, are the ones the conn would write.
+// WriteLayers returns the number of bytes following the outer IPv4 header.
+func (conn *RawIPConn) WriteLayers(ls ...gopacket.SerializableLayer) (int, error) {
+	if conn.config.Load().replay {
+		return 0, fmt.Errorf("cannot write to a conn replaying a capture file")
+	}
+	if len(ls) == 0 {
+		return 0, fmt.Errorf("WriteLayers: no layer to write")
+	}
+	if conn.isIPv6() {
+		return 0, fmt.Errorf("WriteLayers: %w", ErrIPv6Unsupported)
+	}
+	ipLayer, ok := ls[0].(*layers.IPv4)
+	if !ok {
+		return 0, fmt.Errorf("WriteLayers: first layer is %v, not IPv4", ls[0].LayerType())
+	}
+
+	if ipLayer.SrcIP == nil {
+		ipLayer.SrcIP = conn.config.Load().localIP
+	}
+	if ipLayer.DstIP == nil {
+		ipLayer.DstIP = conn.config.Load().remoteIP
+	}
+	if ipLayer.DstIP == nil {
+		return 0, fmt.Errorf("WriteLayers: no destination: %w", ErrUnspecifiedAddress)
+	}
+	if !conn.config.Load().layerAddrs && (!ipLayer.SrcIP.Equal(conn.config.Load().localIP) ||
+		(conn.config.Load().remoteIP != nil && !ipLayer.DstIP.Equal(conn.config.Load().remoteIP))) {
+		return 0, fmt.Errorf("WriteLayers: %v->%v: %w", ipLayer.SrcIP, ipLayer.DstIP, ErrLayerAddressMismatch)
+	}
+	if ipLayer.Version == 0 {
+		ipLayer.Version = 4
+	}
+	if ipLayer.TTL == 0 {
+		ipLayer.TTL = conn.ttl()
+	}
+	if ipLayer.TOS == 0 {
+		ipLayer.TOS = conn.tos(nil)
+	}
+	if ipLayer.Id == 0 {
+		ipLayer.Id = conn.ipID()
+	}
+
+	buffer := serializeBufferPool.Get().(gopacket.SerializeBuffer)
+	defer serializeBufferPool.Put(buffer)
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, ls...); err != nil {
+		return 0, fmt.Errorf("WriteLayers: %w", err)
+	}
+	// the header may carry options, which leave less room for the payload
+	headerLen := int(ipLayer.IHL) * 4
+	size := len(buffer.Bytes()) - headerLen
+	if limit := conn.payloadLimit(headerLen); limit > 0 && size > limit {
+		return 0, &MessageTooLongError{Size: size, Limit: limit}
+	}
+
+	packet := gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	out := &outboundPacket{packet: &packet, vlanID: conn.config.Load().vlanID}
+	if mac := conn.sourceMAC.Load(); mac != nil {
+		out.srcMAC = *mac
+	}
+	dstIP := normalizeIP(ipLayer.DstIP)
+	conn.markLocal(out, dstIP)
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.isClosed.Load() {
+		return 0, conn.closedError()
+	}
+	if err := conn.strictErr.Swap(nil); err != nil {
+		return 0, err
+	}
+	return conn.sendPacket(out, dstIP, size)
+}
@@ -0,0 +1,86 @@
+//go:build darwin || freebsd || windows
+// +build darwin freebsd windows
+
+package lib
+
+import (
+	"fmt"
+)
+
+// WriteOption overrides a header field of the conn for the packet written by WriteWithOptions
+type WriteOption func(*writeOptions)
+
+// writeOptions are the header fields a write overrides. The zero value overrides none
+type writeOptions struct {
+	trafficClass    uint8
+	setTrafficClass bool
+	flowLabel       uint32
+	setFlowLabel    bool
+	extensions      []IPv6ExtensionHeader
+	err             error // the first invalid option
+}
+
+// WithPacketTrafficClass sets the traffic class of the packet, or its TOS byte for IPv4 conns
+func WithPacketTrafficClass(tc uint8) WriteOption {
+	return func(wo *writeOptions) {
+		wo.trafficClass, wo.setTrafficClass = tc, true
+	}
+}
+
+// WithPacketFlowLabel sets the flow label of the packet, 0 included. Labels beyond 20 bits make the write fail,
+// and so does the option on IPv4 conns, whose packets have none
+func WithPacketFlowLabel(label uint32) WriteOption {
+	return func(wo *writeOptions) {
+		if label > maxFlowLabel && wo.err == nil {
+			wo.err = fmt.Errorf("flow label %#x does not fit in 20 bits", label)
+		}
+		wo.flowLabel, wo.setFlowLabel = label, true
+	}
+}
+
+// WithPacketExtensions places headers, in order, between the IPv6 header of the packet and its payload, e.g. a
+// Hop-by-Hop header carrying a Router Alert option or a Fragment header. They count against MaxPayload. A chain
+// BuildIPv6Header refuses, e.g. a Hop-by-Hop header after another one, makes the write fail, and so does the option
+// on IPv4 conns
+func WithPacketExtensions(headers ...IPv6ExtensionHeader) WriteOption {
+	return func(wo *writeOptions) {
+		wo.extensions = append(wo.extensions, headers...)
+	}
+}
+
+// extensionHeaders returns the extension headers of wo, none for a nil wo
+func (wo *writeOptions) extensionHeaders() []IPv6ExtensionHeader {
+	if wo == nil {
+		return nil
+	}
+	return wo.extensions
+}
+
+// check tells why wo cannot apply to a packet, an IPv6 one if ipv6 is set
+func (wo *writeOptions) check(ipv6 bool) error {
+	switch {
+	case wo == nil:
+		return nil
+	case wo.err != nil:
+		return wo.err
+	case !ipv6 && wo.setFlowLabel:
+		return fmt.Errorf("flow label of an IPv4 packet: %w", ErrAddressFamilyMismatch)
+	case !ipv6 && len(wo.extensions) > 0:
+		return fmt.Errorf("IPv6 extension headers in an IPv4 packet: %w", ErrAddressFamilyMismatch)
+	}
+	return nil
+}
+
+// WriteWithOptions is Write with the header fields of the conn overridden by opts for this packet only, e.g. to send
+// the same payload with different flow labels
+func (conn *RawIPConn) WriteWithOptions(data []byte, opts ...WriteOption) (int, error) {
+	var wo writeOptions
+	for _, opt := range opts {
+		opt(&wo)
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	return conn.writePacketWith(conn.config.Load().remoteIP, &wo, data)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	rawsocket "github.com/Clouded-Sabre/rawsocket/lib"
+	"github.com/google/gopacket/layers"
+)
+
+// capture_soak compares pcap drop counts of a listener with 1 and with 4 capture workers.
+// Point a high-rate UDP generator (iperf, pktgen, ...) at the listening IP while it runs.
+
+var (
+	listenIP, ifaceName string
+	duration            time.Duration
+)
+
+func init() {
+	flag.StringVar(&listenIP, "ip", "", "local IP address to listen on")
+	flag.StringVar(&ifaceName, "iface", "", "name of the interface owning the listening IP")
+	flag.DurationVar(&duration, "duration", 30*time.Second, "duration of each soak phase")
+	flag.Parse()
+}
+
+func main() {
+	ip := net.ParseIP(listenIP)
+	if ip == nil || ifaceName == "" {
+		log.Fatalln("Please provide the listening IP and its interface using the -ip and -iface flags")
+	}
+
+	for _, workers := range []int{1, 4} {
+		stats := soak(ip, workers)
+		fmt.Printf("capture workers requested=%d running=%d: received=%d dropped=%d ifdropped=%d\n",
+			workers, stats.CaptureWorkers, stats.PcapReceived, stats.PcapDropped, stats.PcapIfDropped)
+	}
+}
+
+func soak(ip net.IP, workers int) rawsocket.SessionStats {
+	core := rawsocket.NewRawSocketCore(30, 5, rawsocket.WithCaptureWorkers(workers))
+	defer core.Close()
+
+	conn, err := core.ListenIP(ip, layers.IPProtocolUDP)
+	if err != nil {
+		log.Fatalf("ListenIP failed: %v", err)
+	}
+
+	// drain the listener so that the receive queue never holds the capture back
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			if _, err := conn.Read(buffer); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(duration)
+
+	stats, err := core.SessionStats(ifaceName)
+	if err != nil {
+		log.Fatalf("SessionStats failed: %v", err)
+	}
+	return stats
+}
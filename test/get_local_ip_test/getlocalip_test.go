@@ -26,17 +26,17 @@ func main() {
 	// Replace with your target destination IP
 	targetIP := net.ParseIP(destIP)
 
-	localIP, iface, gatewayIP, err := rawsocket.GetLocalIP(targetIP)
+	r, err := rawsocket.LookupRoute(targetIP)
 	if err != nil {
 		fmt.Printf("Error finding local IP: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("Local IP for routing to %s: %s\n", targetIP, localIP)
-	if iface != nil {
-		fmt.Println("The associated local interface for sending/receiving packet is", iface.Name)
+	fmt.Printf("Local IP for routing to %s: %s\n", targetIP, r.SrcIP)
+	if r.Interface != nil {
+		fmt.Println("The associated local interface for sending/receiving packet is", r.Interface.Name, "route metric", r.Metric)
 	}
-	if gatewayIP != nil {
-		fmt.Printf("Since target IP is not in the same subnet as any of local IP, we will send packet to our default gateway IP %s first\n", gatewayIP.String())
+	if r.Gateway != nil {
+		fmt.Printf("Since target IP is not in the same subnet as any of local IP, we will send packet to our default gateway IP %s first\n", r.Gateway.String())
 	}
 }